@@ -72,6 +72,17 @@ func TestTopTable(t *testing.T) {
 		// Check sorting by cumulative count.
 		chromedp.Click(`#cumhdr1`, chromedp.ByID),
 		matchInOrder(t, "#toptable", "F1", "F2", "F3"),
+		matchAttribute(t, "#cumhdr1", "aria-sort", `^descending$`),
+
+		// Check that a selected row stays selected when the table is
+		// sorted again, and that only the sorted column shows its order.
+		chromedp.Click(`#node0`, chromedp.ByID),
+		matchAttribute(t, "#node0", "class", `\bhilite\b`),
+		chromedp.Click(`#namehdr`, chromedp.ByID),
+		matchInOrder(t, "#toptable", "F1", "F2", "F3"),
+		matchAttribute(t, "#node0", "class", `\bhilite\b`),
+		matchAttribute(t, "#namehdr", "aria-sort", `^ascending$`),
+		matchAttribute(t, "#cumhdr1", "aria-sort", `^$`),
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -145,6 +156,29 @@ func matchRegexp(t *testing.T, query, re string) chromedp.ActionFunc {
 	}
 }
 
+// matchAttribute is a chromedp.Action that fetches the value of the
+// attribute name of the first node that matched query and checks that it
+// matches regexp re. A missing attribute has an empty value.
+func matchAttribute(t *testing.T, query, name, re string) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		var value string
+		var ok bool
+		err := chromedp.AttributeValue(query, name, &value, &ok, chromedp.ByQuery).Do(ctx)
+		if err != nil {
+			return fmt.Errorf("attribute %s of %s: %v", name, query, err)
+		}
+		t.Logf("attribute %s of %s: %q", name, query, value)
+		m, err := regexp.MatchString(re, value)
+		if err != nil {
+			return err
+		}
+		if !m {
+			return fmt.Errorf("%s: attribute %s is %q, want a match of %q", query, name, value, re)
+		}
+		return nil
+	}
+}
+
 // matchInOrder is a chromedp.Action that fetches the text of the first
 // node that matched query and checks that the supplied sequence of
 // strings occur in order in the text.
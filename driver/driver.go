@@ -16,6 +16,7 @@
 package driver
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"regexp"
@@ -48,6 +49,12 @@ func (o *Options) internalOptions() *plugin.Options {
 			return o.HTTPServer(((*HTTPServerArgs)(args)))
 		}
 	}
+	var nodeKey func(f plugin.Frame, s *profile.Sample) string
+	if o.NodeKey != nil {
+		nodeKey = func(f plugin.Frame, s *profile.Sample) string {
+			return o.NodeKey(Frame(f), s)
+		}
+	}
 	return &plugin.Options{
 		Writer:        o.Writer,
 		Flagset:       o.Flagset,
@@ -57,6 +64,7 @@ func (o *Options) internalOptions() *plugin.Options {
 		UI:            o.UI,
 		HTTPServer:    httpServer,
 		HTTPTransport: o.HTTPTransport,
+		NodeKey:       nodeKey,
 	}
 }
 
@@ -74,6 +82,12 @@ type Options struct {
 	UI            UI
 	HTTPServer    func(*HTTPServerArgs) error
 	HTTPTransport http.RoundTripper
+
+	// NodeKey, if not nil, overrides the identity of the nodes of graph
+	// based reports: each frame of a sample goes to the node named by the
+	// key NodeKey returns for it, instead of the node of its function,
+	// file or address.
+	NodeKey func(f Frame, s *profile.Sample) string
 }
 
 // Writer provides a mechanism to write data under a certain name,
@@ -126,6 +140,16 @@ type Symbolizer interface {
 	Symbolize(mode string, srcs MappingSources, prof *profile.Profile) error
 }
 
+// A ContextSymbolizer is a Symbolizer that can be stopped by a context,
+// such as the one of the -deadline flag.
+type ContextSymbolizer interface {
+	Symbolizer
+
+	// SymbolizeContext is like Symbolize, but stops and returns the
+	// error of ctx once ctx is done.
+	SymbolizeContext(ctx context.Context, mode string, srcs MappingSources, prof *profile.Profile) error
+}
+
 // MappingSources map each profile.Mapping to the source of the profile.
 // The key is either Mapping.File or Mapping.BuildId.
 type MappingSources map[string][]struct {
@@ -292,9 +316,19 @@ type internalSymbolizer struct {
 }
 
 func (s *internalSymbolizer) Symbolize(mode string, srcs plugin.MappingSources, prof *profile.Profile) error {
+	return s.SymbolizeContext(context.Background(), mode, srcs, prof)
+}
+
+func (s *internalSymbolizer) SymbolizeContext(ctx context.Context, mode string, srcs plugin.MappingSources, prof *profile.Profile) error {
 	isrcs := MappingSources{}
 	for m, s := range srcs {
 		isrcs[m] = s
 	}
-	return s.Symbolizer.Symbolize(mode, isrcs, prof)
+	if cs, ok := s.Symbolizer.(ContextSymbolizer); ok {
+		return cs.SymbolizeContext(ctx, mode, isrcs, prof)
+	}
+	if err := s.Symbolizer.Symbolize(mode, isrcs, prof); err != nil {
+		return err
+	}
+	return ctx.Err()
 }
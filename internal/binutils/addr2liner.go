@@ -18,10 +18,12 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/pprof/internal/plugin"
 )
@@ -83,17 +85,82 @@ func (a *addr2LinerJob) close() {
 	a.cmd.Wait()
 }
 
+// kill stops the addr2line process without waiting for it to answer.
+func (a *addr2LinerJob) kill() {
+	a.cmd.Process.Kill()
+}
+
+// timeoutReaderWriter wraps a lineReaderWriter to bound the time each of its
+// operations may take. When an operation times out, the underlying process
+// is killed if it supports it, and all later operations fail.
+type timeoutReaderWriter struct {
+	rw       lineReaderWriter
+	timeout  time.Duration
+	timedOut bool
+}
+
+// withTimeout returns rw with its operations bounded by timeout, or rw
+// itself if timeout is not positive.
+func withTimeout(rw lineReaderWriter, timeout time.Duration) lineReaderWriter {
+	if timeout <= 0 {
+		return rw
+	}
+	return &timeoutReaderWriter{rw: rw, timeout: timeout}
+}
+
+func (t *timeoutReaderWriter) write(s string) error {
+	_, err := t.run(func() (string, error) { return "", t.rw.write(s) })
+	return err
+}
+
+func (t *timeoutReaderWriter) readLine() (string, error) {
+	return t.run(t.rw.readLine)
+}
+
+func (t *timeoutReaderWriter) close() {
+	t.rw.close()
+}
+
+// run calls op, giving up on it after the timeout.
+func (t *timeoutReaderWriter) run(op func() (string, error)) (string, error) {
+	if t.timedOut {
+		return "", fmt.Errorf("symbolizer stopped after a timeout: %w", os.ErrDeadlineExceeded)
+	}
+	type result struct {
+		s   string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := op()
+		done <- result{s, err}
+	}()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.s, r.err
+	case <-timer.C:
+		t.timedOut = true
+		if k, ok := t.rw.(interface{ kill() }); ok {
+			k.kill()
+		}
+		return "", fmt.Errorf("symbolizer timed out after %v: %w", t.timeout, os.ErrDeadlineExceeded)
+	}
+}
+
 // newAddr2Liner starts the given addr2liner command reporting
 // information about the given executable file. If file is a shared
 // library, base should be the address at which it was mapped in the
-// program under consideration.
-func newAddr2Liner(cmd, file string, base uint64) (*addr2Liner, error) {
+// program under consideration. Any extra args are appended to the
+// command line.
+func newAddr2Liner(cmd, file string, base uint64, args ...string) (*addr2Liner, error) {
 	if cmd == "" {
 		cmd = defaultAddr2line
 	}
 
 	j := &addr2LinerJob{
-		cmd: exec.Command(cmd, "-aif", "-e", file),
+		cmd: exec.Command(cmd, append([]string{"-aif", "-e", file}, args...)...),
 	}
 
 	var err error
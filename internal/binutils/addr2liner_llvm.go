@@ -68,17 +68,23 @@ func (a *llvmSymbolizerJob) close() {
 	a.cmd.Wait()
 }
 
+// kill stops the llvm-symbolizer process without waiting for it to answer.
+func (a *llvmSymbolizerJob) kill() {
+	a.cmd.Process.Kill()
+}
+
 // newLLVMSymbolizer starts the given llvmSymbolizer command reporting
 // information about the given executable file. If file is a shared
 // library, base should be the address at which it was mapped in the
-// program under consideration.
-func newLLVMSymbolizer(cmd, file string, base uint64, isData bool) (*llvmSymbolizer, error) {
+// program under consideration. Any extra args are appended to the
+// command line.
+func newLLVMSymbolizer(cmd, file string, base uint64, isData bool, args ...string) (*llvmSymbolizer, error) {
 	if cmd == "" {
 		cmd = defaultLLVMSymbolizer
 	}
 
 	j := &llvmSymbolizerJob{
-		cmd:     exec.Command(cmd, "--inlining", "-demangle=false", "--output-style=JSON"),
+		cmd:     exec.Command(cmd, append([]string{"--inlining", "-demangle=false", "--output-style=JSON"}, args...)...),
 		symType: "CODE",
 	}
 	if isData {
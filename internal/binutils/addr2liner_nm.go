@@ -58,13 +58,15 @@ func (s *symbolInfo) isData() bool {
 
 // newAddr2LinerNM starts the given nm command reporting information about the
 // given executable file. If file is a shared library, base should be the
-// address at which it was mapped in the program under consideration.
-func newAddr2LinerNM(cmd, file string, base uint64) (*addr2LinerNM, error) {
+// address at which it was mapped in the program under consideration. Any
+// extra args are passed to nm ahead of the file name.
+func newAddr2LinerNM(cmd, file string, base uint64, args ...string) (*addr2LinerNM, error) {
 	if cmd == "" {
 		cmd = defaultNM
 	}
 	var b bytes.Buffer
-	c := exec.Command(cmd, "--numeric-sort", "--print-size", "--format=posix", file)
+	args = append([]string{"--numeric-sort", "--print-size", "--format=posix"}, args...)
+	c := exec.Command(cmd, append(args, file)...)
 	c.Stdout = &b
 	if err := c.Run(); err != nil {
 		return nil, err
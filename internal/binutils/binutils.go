@@ -31,6 +31,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/pprof/internal/elfexec"
 	"github.com/google/pprof/internal/plugin"
@@ -63,9 +65,20 @@ type binrep struct {
 	objdumpFound        bool
 	isLLVMObjdump       bool
 
+	// Extra arguments to pass to each tool, keyed by tool name.
+	toolArgs map[string][]string
+
 	// if fast, perform symbolization using nm (symbol names only),
 	// instead of file-line detail from the slower addr2line.
 	fast bool
+
+	// if goSymbols, symbolize Go binaries using their function table
+	// instead of external tools.
+	goSymbols bool
+
+	// symbolizeTimeout bounds each query to addr2line or llvm-symbolizer,
+	// if positive.
+	symbolizeTimeout time.Duration
 }
 
 // get returns the current representation for bu, initializing it if necessary.
@@ -111,8 +124,8 @@ func (bu *Binutils) String() string {
 	if r.objdumpFound {
 		objdump = r.objdump
 	}
-	return fmt.Sprintf("llvm-symbolizer=%q addr2line=%q nm=%q objdump=%q fast=%t",
-		llvmSymbolizer, addr2line, nm, objdump, r.fast)
+	return fmt.Sprintf("llvm-symbolizer=%q addr2line=%q nm=%q objdump=%q fast=%t gosym=%t",
+		llvmSymbolizer, addr2line, nm, objdump, r.fast, r.goSymbols)
 }
 
 // SetFastSymbolization sets a toggle that makes binutils use fast
@@ -122,6 +135,22 @@ func (bu *Binutils) SetFastSymbolization(fast bool) {
 	bu.update(func(r *binrep) { r.fast = fast })
 }
 
+// SetGoSymbolization sets a toggle that makes binutils symbolize Go
+// binaries using the function table embedded in them, which provides
+// function, file/line and inlining information without debug information
+// or external tools. Other binaries are not affected.
+func (bu *Binutils) SetGoSymbolization(enabled bool) {
+	bu.update(func(r *binrep) { r.goSymbols = enabled })
+}
+
+// SetSymbolizeTimeout bounds the time addr2line and llvm-symbolizer may take
+// to answer each query. A process that times out is killed, and the
+// addresses it was asked about are left unsymbolized. A non-positive
+// timeout disables the limit.
+func (bu *Binutils) SetSymbolizeTimeout(timeout time.Duration) {
+	bu.update(func(r *binrep) { r.symbolizeTimeout = timeout })
+}
+
 // SetTools processes the contents of the tools option. It
 // expects a set of entries separated by commas; each entry is a pair
 // of the form t:path, where cmd will be used to look only for the
@@ -131,6 +160,21 @@ func (bu *Binutils) SetTools(config string) {
 	bu.update(func(r *binrep) { initTools(r, config) })
 }
 
+// SetToolArgs processes the contents of the tool_args option. It
+// expects a set of entries separated by commas; each entry is a pair of
+// the form t:arg, where t is one of addr2line, llvm-symbolizer, nm or
+// objdump. Each arg is appended, in order, to the arguments pprof passes
+// to the tool named t. Arguments may not themselves contain commas.
+func (bu *Binutils) SetToolArgs(config string) {
+	toolArgs := make(map[string][]string)
+	for _, t := range strings.Split(config, ",") {
+		if name, arg, ok := strings.Cut(t, ":"); ok && arg != "" {
+			toolArgs[name] = append(toolArgs[name], arg)
+		}
+	}
+	bu.update(func(r *binrep) { r.toolArgs = toolArgs })
+}
+
 func initTools(b *binrep, config string) {
 	// paths collect paths per tool; Key "" contains the default.
 	paths := make(map[string][]string)
@@ -273,6 +317,7 @@ func (bu *Binutils) Disasm(file string, start, end uint64, intelSyntax bool) ([]
 		}
 	}
 
+	args = append(args, b.toolArgs["objdump"]...)
 	args = append(args, file)
 	cmd := exec.Command(b.objdump, args...)
 	out, err := cmd.Output()
@@ -441,7 +486,7 @@ func (b *binrep) openELF(name string, start, limit, offset uint64, relocationSym
 		kernelOffset *uint64
 		pageAligned  = func(addr uint64) bool { return addr%4096 == 0 }
 	)
-	if strings.Contains(name, "vmlinux") || !pageAligned(start) || !pageAligned(limit) || !pageAligned(offset) {
+	if relocationSymbol != "" || strings.Contains(name, "vmlinux") || !pageAligned(start) || !pageAligned(limit) || !pageAligned(offset) {
 		// Reading all Symbols is expensive, and we only rarely need it so
 		// we don't want to do it every time. But if _stext happens to be
 		// page-aligned but isn't the same as Vaddr, we would symbolize
@@ -449,6 +494,8 @@ func (b *binrep) openELF(name string, start, limit, offset uint64, relocationSym
 		// the name is "vmlinux" we read _stext. We can be wrong if: (1)
 		// someone passes a kernel path that doesn't contain "vmlinux" AND
 		// (2) _stext is page-aligned AND (3) _stext is not at Vaddr
+		// A relocation symbol given for the mapping, eg for a firmware
+		// image, is always looked up.
 		symbols, err := ef.Symbols()
 		if err != nil && err != elf.ErrNoSymbols {
 			return nil, err
@@ -479,19 +526,33 @@ func (b *binrep) openELF(name string, start, limit, offset uint64, relocationSym
 		return nil, fmt.Errorf("could not identify base for %s: %v", name, err)
 	}
 
+	// Symbol information may live in a separate debug file.
+	debugFile := findDebugFile(name, ef, buildID)
+
+	if b.goSymbols && isGoELF(ef) {
+		return &fileGo{file: file{
+			b:         b,
+			name:      name,
+			buildID:   buildID,
+			debugFile: debugFile,
+			m:         &elfMapping{start: start, limit: limit, offset: offset, kernelOffset: kernelOffset},
+		}}, nil
+	}
 	if b.fast || (!b.addr2lineFound && !b.llvmSymbolizerFound) {
 		return &fileNM{file: file{
-			b:       b,
-			name:    name,
-			buildID: buildID,
-			m:       &elfMapping{start: start, limit: limit, offset: offset, kernelOffset: kernelOffset},
+			b:         b,
+			name:      name,
+			buildID:   buildID,
+			debugFile: debugFile,
+			m:         &elfMapping{start: start, limit: limit, offset: offset, kernelOffset: kernelOffset},
 		}}, nil
 	}
 	return &fileAddr2Line{file: file{
-		b:       b,
-		name:    name,
-		buildID: buildID,
-		m:       &elfMapping{start: start, limit: limit, offset: offset, kernelOffset: kernelOffset},
+		b:         b,
+		name:      name,
+		buildID:   buildID,
+		debugFile: debugFile,
+		m:         &elfMapping{start: start, limit: limit, offset: offset, kernelOffset: kernelOffset},
 	}}, nil
 }
 
@@ -577,6 +638,8 @@ type file struct {
 	b       *binrep
 	name    string
 	buildID string
+	// Separate file holding the debug info of an ELF binary, if any.
+	debugFile string
 
 	baseOnce sync.Once // Ensures the base, baseErr and isData are computed once.
 	base     uint64
@@ -584,6 +647,8 @@ type file struct {
 	isData   bool
 	// Mapping information. Relevant only for ELF files, nil otherwise.
 	m *elfMapping
+
+	closed atomic.Bool // Set by Close; the file can no longer be used.
 }
 
 // computeBase computes the relocation base for the given binary file only if
@@ -620,6 +685,14 @@ func (f *file) Name() string {
 	return f.name
 }
 
+// symbolFile returns the name of the file to read symbol information from.
+func (f *file) symbolFile() string {
+	if f.debugFile != "" {
+		return f.debugFile
+	}
+	return f.name
+}
+
 func (f *file) ObjAddr(addr uint64) (uint64, error) {
 	f.baseOnce.Do(func() { f.baseErr = f.computeBase(addr) })
 	if f.baseErr != nil {
@@ -640,13 +713,33 @@ func (f *file) SourceLine(addr uint64) ([]plugin.Frame, error) {
 	return nil, nil
 }
 
+// Close marks the file as closed. It is safe to call more than once.
 func (f *file) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+// isClosed reports whether Close has been called on the file.
+func (f *file) isClosed() bool {
+	return f.closed.Load()
+}
+
+// errIfClosed returns an error if the file has been closed, to prevent
+// starting new tools for a file after its resources have been released.
+func (f *file) errIfClosed() error {
+	if f.isClosed() {
+		return fmt.Errorf("%s: file is closed", f.name)
+	}
 	return nil
 }
 
 func (f *file) Symbols(r *regexp.Regexp, addr uint64) ([]*plugin.Sym, error) {
+	if err := f.errIfClosed(); err != nil {
+		return nil, err
+	}
 	// Get from nm a list of symbols sorted by address.
-	cmd := exec.Command(f.b.nm, "-n", f.name)
+	args := append([]string{"-n"}, f.b.toolArgs["nm"]...)
+	cmd := exec.Command(f.b.nm, append(args, f.symbolFile())...)
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
@@ -664,12 +757,15 @@ type fileNM struct {
 }
 
 func (f *fileNM) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	if err := f.errIfClosed(); err != nil {
+		return nil, err
+	}
 	f.baseOnce.Do(func() { f.baseErr = f.computeBase(addr) })
 	if f.baseErr != nil {
 		return nil, f.baseErr
 	}
 	if f.addr2linernm == nil {
-		addr2liner, err := newAddr2LinerNM(f.b.nm, f.name, f.base)
+		addr2liner, err := newAddr2LinerNM(f.b.nm, f.symbolFile(), f.base, f.b.toolArgs["nm"]...)
 		if err != nil {
 			return nil, err
 		}
@@ -691,6 +787,9 @@ type fileAddr2Line struct {
 }
 
 func (f *fileAddr2Line) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	if err := f.errIfClosed(); err != nil {
+		return nil, err
+	}
 	f.baseOnce.Do(func() { f.baseErr = f.computeBase(addr) })
 	if f.baseErr != nil {
 		return nil, f.baseErr
@@ -706,24 +805,31 @@ func (f *fileAddr2Line) SourceLine(addr uint64) ([]plugin.Frame, error) {
 }
 
 func (f *fileAddr2Line) init() {
-	if llvmSymbolizer, err := newLLVMSymbolizer(f.b.llvmSymbolizer, f.name, f.base, f.isData); err == nil {
+	if llvmSymbolizer, err := newLLVMSymbolizer(f.b.llvmSymbolizer, f.symbolFile(), f.base, f.isData, f.b.toolArgs["llvm-symbolizer"]...); err == nil {
+		llvmSymbolizer.rw = withTimeout(llvmSymbolizer.rw, f.b.symbolizeTimeout)
 		f.llvmSymbolizer = llvmSymbolizer
 		return
 	}
 
-	if addr2liner, err := newAddr2Liner(f.b.addr2line, f.name, f.base); err == nil {
+	if addr2liner, err := newAddr2Liner(f.b.addr2line, f.symbolFile(), f.base, f.b.toolArgs["addr2line"]...); err == nil {
+		addr2liner.rw = withTimeout(addr2liner.rw, f.b.symbolizeTimeout)
 		f.addr2liner = addr2liner
 
 		// When addr2line encounters some gcc compiled binaries, it
 		// drops interesting parts of names in anonymous namespaces.
 		// Fallback to NM for better function names.
-		if nm, err := newAddr2LinerNM(f.b.nm, f.name, f.base); err == nil {
+		if nm, err := newAddr2LinerNM(f.b.nm, f.symbolFile(), f.base, f.b.toolArgs["nm"]...); err == nil {
 			f.addr2liner.nm = nm
 		}
 	}
 }
 
+// Close stops the symbolization tools started for the file, if any. It is
+// safe to call more than once.
 func (f *fileAddr2Line) Close() error {
+	if f.closed.Swap(true) {
+		return nil
+	}
 	if f.llvmSymbolizer != nil {
 		f.llvmSymbolizer.rw.close()
 		f.llvmSymbolizer = nil
@@ -21,12 +21,14 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/pprof/internal/plugin"
 )
@@ -121,6 +123,62 @@ func (a *mockAddr2liner) readLine() (string, error) {
 func (a *mockAddr2liner) close() {
 }
 
+func TestAddr2LinerTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a shell script as the symbolizer")
+	}
+	// A symbolizer that reads its input but never answers.
+	slow := filepath.Join(t.TempDir(), "slow-addr2line")
+	if err := os.WriteFile(slow, []byte("#!/bin/sh\ncat >/dev/null\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAddr2Liner(slow, "binary", 0)
+	if err != nil {
+		t.Fatalf("newAddr2Liner: %v", err)
+	}
+	const timeout = 100 * time.Millisecond
+	a.rw = withTimeout(a.rw, timeout)
+
+	start := time.Now()
+	if _, err := a.addrInfo(0x1000); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("addrInfo: got error %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 10*timeout {
+		t.Errorf("addrInfo took %v, want about %v", d, timeout)
+	}
+	// The symbolizer is not used anymore after a timeout.
+	start = time.Now()
+	if _, err := a.addrInfo(0x2000); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("addrInfo after timeout: got error %v, want a timeout", err)
+	}
+	if d := time.Since(start); d >= timeout {
+		t.Errorf("addrInfo after timeout took %v, want it to fail immediately", d)
+	}
+
+	// Closing does not hang, as the process has been killed.
+	done := make(chan struct{})
+	go func() {
+		a.rw.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("close did not return after the symbolizer was killed")
+	}
+}
+
+func TestAddr2LinerNoTimeout(t *testing.T) {
+	a := addr2Liner{rw: withTimeout(&mockAddr2liner{}, time.Minute)}
+	s, err := a.addrInfo(0x1000)
+	if err != nil {
+		t.Fatalf("addrInfo: %v", err)
+	}
+	if len(s) != 1 || s[0].Func != functionName(1000) {
+		t.Errorf("addrInfo: got %+v, want a single %s frame", s, functionName(1000))
+	}
+}
+
 func TestAddr2LinerLookup(t *testing.T) {
 	for _, tc := range []struct {
 		desc             string
@@ -244,6 +302,47 @@ func TestSetTools(t *testing.T) {
 	bu.SetTools("")
 }
 
+func TestSetToolArgs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fake tools are shell scripts that have only been tested on linux")
+	}
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	// The fake tools record their arguments and produce no output.
+	for name, script := range map[string]string{
+		"objdump": `if [ "$1" = --version ]; then echo "GNU objdump (fake)"; exit 0; fi` + "\n",
+		"nm":      "",
+	} {
+		script = "#!/bin/sh\n" + script + `echo "$@" >> ` + argsFile + "\n"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatalf("write fake %s: %v", name, err)
+		}
+	}
+
+	bu := &Binutils{}
+	bu.SetTools(dir)
+	bu.SetToolArgs("objdump:--target=elf64-x86-64,nm:--demangle,objdump:-w")
+	if _, err := bu.Disasm("foo", 0x1000, 0x2000, false); err != nil {
+		t.Fatalf("Disasm: unexpected error %v", err)
+	}
+	if _, err := newAddr2LinerNM(bu.get().nm, "foo", 0, bu.get().toolArgs["nm"]...); err != nil {
+		t.Fatalf("newAddr2LinerNM: unexpected error %v", err)
+	}
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read recorded args: %v", err)
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{
+		"--disassemble --demangle --no-show-raw-insn --line-numbers --start-address=0x1000 --stop-address=0x2000 --target=elf64-x86-64 -w foo",
+		"--numeric-sort --print-size --format=posix --demangle foo",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tool command lines:\ngot  %q\nwant %q", got, want)
+	}
+}
+
 func TestSetFastSymbolization(t *testing.T) {
 	// Test that multiple calls work.
 	bu := &Binutils{}
@@ -382,6 +481,177 @@ func TestObjFile(t *testing.T) {
 	}
 }
 
+func TestObjFileCloseTwice(t *testing.T) {
+	skipUnlessLinuxAmd64(t)
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast=%v", fast), func(t *testing.T) {
+			bu := &Binutils{}
+			bu.SetFastSymbolization(fast)
+			f, err := bu.Open(filepath.Join("testdata", "exe_linux_64"), 0x400000, 0x4006fc, 0, "")
+			if err != nil {
+				t.Fatalf("Open: unexpected error %v", err)
+			}
+			// Start the symbolization tools, if any, so Close has work to do.
+			if _, err := f.SourceLine(0x40052d); err != nil {
+				t.Fatalf("SourceLine: unexpected error %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := f.Close(); err != nil {
+					t.Errorf("Close #%d: unexpected error %v", i+1, err)
+				}
+			}
+			if _, err := f.SourceLine(0x40052d); err == nil {
+				t.Error("SourceLine after Close: got no error, want an error")
+			}
+		})
+	}
+}
+
+// closeTracker reports, through a finalizer, whether the object files it
+// tracks were closed before being garbage collected.
+type closeTracker struct {
+	closed chan bool
+}
+
+func newCloseTracker() *closeTracker {
+	return &closeTracker{closed: make(chan bool, 16)}
+}
+
+func (ct *closeTracker) track(f plugin.ObjFile) {
+	runtime.SetFinalizer(f, func(f interface{ isClosed() bool }) {
+		ct.closed <- f.isClosed()
+	})
+}
+
+// wait collects the state of n tracked files, forcing garbage collections
+// until their finalizers have run.
+func (ct *closeTracker) wait(t *testing.T, n int) (leaked int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for n > 0 {
+		runtime.GC()
+		select {
+		case closed := <-ct.closed:
+			n--
+			if !closed {
+				leaked++
+			}
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d object files to be collected", n)
+			}
+		}
+	}
+	return leaked
+}
+
+func TestObjFileLeakCheck(t *testing.T) {
+	skipUnlessLinuxAmd64(t)
+	ct := newCloseTracker()
+	open := func() {
+		bu := &Binutils{}
+		f, err := bu.Open(filepath.Join("testdata", "exe_linux_64"), 0x400000, 0x4006fc, 0, "")
+		if err != nil {
+			t.Fatalf("Open: unexpected error %v", err)
+		}
+		ct.track(f)
+	}
+	openAndClose := func() {
+		bu := &Binutils{}
+		f, err := bu.Open(filepath.Join("testdata", "exe_linux_64"), 0x400000, 0x4006fc, 0, "")
+		if err != nil {
+			t.Fatalf("Open: unexpected error %v", err)
+		}
+		ct.track(f)
+		f.Close()
+	}
+
+	openAndClose()
+	if leaked := ct.wait(t, 1); leaked != 0 {
+		t.Errorf("got %d leaked object files after Close, want 0", leaked)
+	}
+	open()
+	if leaked := ct.wait(t, 1); leaked != 1 {
+		t.Errorf("got %d leaked object files without Close, want 1", leaked)
+	}
+}
+
+func TestObjFileSplitDebugInfo(t *testing.T) {
+	// testdata/exe_linux_64_stripped is testdata/exe_linux_64 without
+	// symbols, with a .gnu_debuglink to testdata/exe_linux_64.debug.
+	skipUnlessLinuxAmd64(t)
+	const buildID = "910b52eaddce54ae8bbeb49f93c04ded113fcf4d"
+
+	copyFile := func(t *testing.T, src, dst string) {
+		t.Helper()
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// buildIDLayout places a copy of the stripped binary alone in a
+	// directory, and its debug info in a build-id directory layout under
+	// PPROF_BINARY_PATH.
+	buildIDLayout := func(t *testing.T) string {
+		binDir, debugDir := t.TempDir(), t.TempDir()
+		bin := filepath.Join(binDir, "exe_linux_64_stripped")
+		copyFile(t, filepath.Join("testdata", "exe_linux_64_stripped"), bin)
+		copyFile(t, filepath.Join("testdata", "exe_linux_64.debug"), filepath.Join(debugDir, ".build-id", buildID[:2], buildID[2:]+".debug"))
+		t.Setenv("PPROF_BINARY_PATH", debugDir)
+		return bin
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		binary func(t *testing.T) string
+	}{
+		{
+			desc:   "gnu_debuglink",
+			binary: func(t *testing.T) string { return filepath.Join("testdata", "exe_linux_64_stripped") },
+		},
+		{
+			desc:   "build-id directory",
+			binary: buildIDLayout,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			bu := &Binutils{}
+			f, err := bu.Open(tc.binary(t), 0x400000, 0x4006fc, 0, "")
+			if err != nil {
+				t.Fatalf("Open: unexpected error %v", err)
+			}
+			defer f.Close()
+			if got := f.BuildID(); got != buildID {
+				t.Errorf("BuildID: got %s, want %s", got, buildID)
+			}
+			syms, err := f.Symbols(regexp.MustCompile("main"), 0)
+			if err != nil {
+				t.Fatalf("Symbols: unexpected error %v", err)
+			}
+			if findSymbol(syms, "main") == nil {
+				t.Errorf("Symbols: did not find main")
+			}
+			gotFrames, err := f.SourceLine(0x40052d)
+			if err != nil {
+				t.Fatalf("SourceLine: unexpected error %v", err)
+			}
+			wantFrames := []plugin.Frame{
+				{Func: "main", File: "/tmp/hello.c", Line: 3, StartLine: 3},
+			}
+			if !reflect.DeepEqual(gotFrames, wantFrames) {
+				t.Errorf("SourceLine for main: got %v; want %v", gotFrames, wantFrames)
+			}
+		})
+	}
+}
+
 func TestMachoFiles(t *testing.T) {
 	// If this test fails, check the address for main function in testdata/exe_mac_64
 	// and testdata/lib_mac_64 using addr2line or gaddr2line. Update the
@@ -854,7 +1124,8 @@ func (b *buf) write(s string) uint32 {
 
 // fakeELFFile generates a minimal valid ELF file, with fake .head.text and
 // .text sections, and their corresponding _text and _stext start symbols,
-// mimicking a kernel vmlinux image.
+// mimicking a kernel vmlinux image. It also has a custom _fw_start symbol,
+// as used by some firmware images.
 func fakeELFFile(t *testing.T) *elf.File {
 	var (
 		sizeHeader64  = binary.Size(elf.Header64{})
@@ -863,8 +1134,9 @@ func fakeELFFile(t *testing.T) *elf.File {
 	)
 
 	const (
-		textAddr  = 0xffff000010080000
-		stextAddr = 0xffff000010081000
+		textAddr    = 0xffff000010080000
+		stextAddr   = 0xffff000010081000
+		fwStartAddr = 0xffff000010082000
 	)
 
 	// Generate magic to identify as an ELF file.
@@ -887,6 +1159,7 @@ func fakeELFFile(t *testing.T) *elf.File {
 		{}, // first symbol empty by convention
 		{Name: symNames.write("_text"), Info: 0, Other: 0, Shndx: 0, Value: textAddr, Size: 0},
 		{Name: symNames.write("_stext"), Info: 0, Other: 0, Shndx: 0, Value: stextAddr, Size: 0},
+		{Name: symNames.write("_fw_start"), Info: 0, Other: 0, Shndx: 0, Value: fwStartAddr, Size: 0},
 	}
 
 	const numSections = 5
@@ -976,3 +1249,42 @@ func TestELFKernelOffset(t *testing.T) {
 
 	}
 }
+
+func TestELFCustomRelocationSymbol(t *testing.T) {
+	realELFOpen := elfOpen
+	defer func() {
+		elfOpen = realELFOpen
+	}()
+	elfOpen = func(_ string) (*elf.File, error) {
+		return fakeELFFile(t), nil
+	}
+
+	// The image is not named vmlinux and its mapping is page-aligned, so
+	// symbols are only read because a relocation symbol is given.
+	const start, limit = 0xffff000020082000, 0xffff000030000000
+	for _, tc := range []struct {
+		name             string
+		relocationSymbol string
+		wantAddr         uint64
+	}{
+		{"custom", "_fw_start", 0xffff000010083000},
+		// Without it, the mapping offset is taken as a file offset into
+		// the program segment.
+		{"none", "", 0xffff000010081000},
+	} {
+		b := binrep{}
+		o, err := b.openELF("firmware.elf", start, limit, start, tc.relocationSymbol)
+		if err != nil {
+			t.Errorf("%v: openELF got error %v, want nil", tc.name, err)
+			continue
+		}
+		addr, err := o.ObjAddr(0xffff000020083000)
+		if err != nil {
+			t.Errorf("%v: ObjAddr got err %v, want nil", tc.name, err)
+			continue
+		}
+		if addr != tc.wantAddr {
+			t.Errorf("%v: ObjAddr got %x, want %x", tc.name, addr, tc.wantAddr)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binutils
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/pprof/internal/elfexec"
+)
+
+// defaultDebugRoot is the system-wide directory holding separate debug
+// info files, as used by GDB.
+const defaultDebugRoot = "/usr/lib/debug"
+
+// findDebugFile locates a separate debug info file for the ELF binary
+// name, for binaries whose debug info has been split out, and returns ""
+// if the binary has its own debug info or no debug file is found.
+//
+// The debug roots are the entries of $PPROF_BINARY_PATH, followed by
+// /usr/lib/debug. Candidates are examined in this order, similar to GDB:
+//
+//  1. $root/.build-id/xx/yyyy.debug for each debug root, where xxyyyy is
+//     the build ID of the binary. The candidate must have the same build ID.
+//  2. The file named by the .gnu_debuglink section, searched for in the
+//     directory of the binary, in its .debug subdirectory and then in
+//     $root/$dir for each debug root. The candidate must match the CRC
+//     recorded in the section.
+func findDebugFile(name string, ef *elf.File, buildID string) string {
+	if ef.Section(".debug_info") != nil || ef.Section(".zdebug_info") != nil {
+		return ""
+	}
+	roots := append(filepath.SplitList(os.Getenv("PPROF_BINARY_PATH")), defaultDebugRoot)
+
+	if len(buildID) > 2 {
+		for _, root := range roots {
+			candidate := filepath.Join(root, ".build-id", buildID[:2], buildID[2:]+".debug")
+			if !sameFile(name, candidate) && debugBuildID(candidate) == buildID {
+				return candidate
+			}
+		}
+	}
+
+	link, crc, ok := debugLink(ef)
+	if !ok {
+		return ""
+	}
+	dir, _ := filepath.Abs(filepath.Dir(name))
+	candidates := []string{
+		filepath.Join(dir, link),
+		filepath.Join(dir, ".debug", link),
+	}
+	for _, root := range roots {
+		candidates = append(candidates, filepath.Join(root, dir, link))
+	}
+	for _, candidate := range candidates {
+		if !sameFile(name, candidate) && debugCRC(candidate) == crc {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// debugLink returns the file name and CRC recorded in the .gnu_debuglink
+// section of ef.
+func debugLink(ef *elf.File) (string, uint32, bool) {
+	s := ef.Section(".gnu_debuglink")
+	if s == nil {
+		return "", 0, false
+	}
+	data, err := s.Data()
+	if err != nil {
+		return "", 0, false
+	}
+	// The section holds a NUL-terminated file name, padded to a 4-byte
+	// boundary, followed by a 4-byte CRC32 of the debug file.
+	end := bytes.IndexByte(data, 0)
+	if end <= 0 {
+		return "", 0, false
+	}
+	crcOff := (end + 4) &^ 3
+	if crcOff+4 > len(data) {
+		return "", 0, false
+	}
+	return string(data[:end]), ef.ByteOrder.Uint32(data[crcOff:]), true
+}
+
+// debugBuildID returns the build ID of the ELF file name, or "" if it
+// cannot be read.
+func debugBuildID(name string) string {
+	ef, err := elfOpen(name)
+	if err != nil {
+		return ""
+	}
+	defer ef.Close()
+	id, err := elfexec.GetBuildID(ef)
+	if err != nil || id == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", id)
+}
+
+// debugCRC returns the CRC32 checksum of the contents of the file name,
+// as used by .gnu_debuglink, or 0 if it cannot be read.
+func debugCRC(name string) uint32 {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0
+	}
+	return h.Sum32()
+}
+
+// sameFile reports whether a and b refer to the same existing file.
+func sameFile(a, b string) bool {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(sa, sb)
+}
@@ -0,0 +1,314 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binutils
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/gosym"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/google/pprof/internal/plugin"
+)
+
+// isGoELF reports whether ef is a Go binary with a function table that
+// goTable can read.
+func isGoELF(ef *elf.File) bool {
+	if ef.Section(".gopclntab") == nil {
+		return false
+	}
+	return ef.Section(".go.buildinfo") != nil || ef.Section(".note.go.buildid") != nil
+}
+
+// fileGo implements the binutils.ObjFile interface for Go binaries, using
+// the function table (pclntab) the Go runtime uses for its own stack
+// traces to map addresses to symbols. It works on binaries without debug
+// information and does not need any external tool.
+type fileGo struct {
+	file
+	once    sync.Once
+	table   *goTable
+	loadErr error
+}
+
+func (f *fileGo) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	if err := f.errIfClosed(); err != nil {
+		return nil, err
+	}
+	f.baseOnce.Do(func() { f.baseErr = f.computeBase(addr) })
+	if f.baseErr != nil {
+		return nil, f.baseErr
+	}
+	f.once.Do(func() { f.table, f.loadErr = newGoTable(f.name) })
+	if f.loadErr != nil {
+		return nil, f.loadErr
+	}
+	return f.table.frames(addr - f.base), nil
+}
+
+// goTable maps the addresses of a Go binary to functions and source lines.
+// Besides the line table decoded by debug/gosym, it reads the inline trees
+// of the functions, which debug/gosym ignores, to expand the calls inlined
+// at an address. Inline trees are only read from binaries built by Go 1.20
+// or later, whose table layout is known; older binaries get the outermost
+// function only.
+type goTable struct {
+	table *gosym.Table
+
+	// Fields used to read inline trees; pcln is nil if they are unavailable.
+	pcln       []byte
+	order      binary.ByteOrder
+	quantum    uint64 // Minimum instruction size, the unit of pc deltas.
+	funcnames  []byte // Function name table.
+	pctab      []byte // Table of pc-value tables.
+	functab    []byte // Function table, indexed by function entry.
+	textStart  uint64
+	gofunc     uint64 // Address of the go:func.* symbol.
+	rodata     []byte // Section holding go:func.*, at address rodataAddr.
+	rodataAddr uint64
+}
+
+// Constants of the Go 1.20+ runtime used to find inline trees.
+const (
+	goPclntabMagic120 = 0xfffffff1
+	goFuncFixedSize   = 44 // Size of the fixed part of runtime._func.
+	goPCDataInlTree   = 2  // PCDATA_InlTreeIndex
+	goFuncDataInlTree = 3  // FUNCDATA_InlTree
+	goInlinedCallSize = 16 // Size of runtime.inlinedCall.
+	goMaxInlineDepth  = 1024
+)
+
+// newGoTable reads the function table of the Go binary name.
+func newGoTable(name string) (*goTable, error) {
+	ef, err := elfOpen(name)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	defer ef.Close()
+
+	pclntab, text := ef.Section(".gopclntab"), ef.Section(".text")
+	if pclntab == nil || text == nil {
+		return nil, fmt.Errorf("%s has no Go function table", name)
+	}
+	pcln, err := pclntab.Data()
+	if err != nil {
+		return nil, fmt.Errorf("reading Go function table of %s: %v", name, err)
+	}
+	var symtab []byte
+	if s := ef.Section(".gosymtab"); s != nil {
+		if symtab, err = s.Data(); err != nil {
+			return nil, fmt.Errorf("reading Go symbol table of %s: %v", name, err)
+		}
+	}
+	table, err := gosym.NewTable(symtab, gosym.NewLineTable(pcln, text.Addr))
+	if err != nil {
+		return nil, fmt.Errorf("parsing Go function table of %s: %v", name, err)
+	}
+	t := &goTable{table: table, textStart: text.Addr}
+	t.initInline(ef, pcln)
+	return t, nil
+}
+
+// initInline prepares reading inline trees, if the layout of the table is
+// known and the go:func.* symbol, which inline tree offsets are relative
+// to, was not stripped.
+func (t *goTable) initInline(ef *elf.File, pcln []byte) {
+	if len(pcln) < 8 {
+		return
+	}
+	order := ef.ByteOrder
+	ptrSize := int(pcln[7])
+	if order.Uint32(pcln) != goPclntabMagic120 || (ptrSize != 4 && ptrSize != 8) || len(pcln) < 8+8*ptrSize {
+		return
+	}
+	word := func(i int) uint64 {
+		off := 8 + i*ptrSize
+		if ptrSize == 4 {
+			return uint64(order.Uint32(pcln[off:]))
+		}
+		return order.Uint64(pcln[off:])
+	}
+	nfunc, funcnameOff, pctabOff, pclnOff := word(0), word(3), word(6), word(7)
+	if funcnameOff > pctabOff || pctabOff > pclnOff || pclnOff+(nfunc+1)*8 > uint64(len(pcln)) {
+		return
+	}
+
+	syms, err := ef.Symbols()
+	if err != nil {
+		return
+	}
+	var gofunc uint64
+	found := false
+	for _, s := range syms {
+		if s.Name == "go:func.*" {
+			gofunc, found = s.Value, true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	for _, s := range ef.Sections {
+		if s.Type == elf.SHT_PROGBITS && s.Addr <= gofunc && gofunc < s.Addr+s.Size {
+			if t.rodata, err = s.Data(); err != nil {
+				return
+			}
+			t.rodataAddr = s.Addr
+			break
+		}
+	}
+	if t.rodata == nil {
+		return
+	}
+
+	t.order = order
+	t.quantum = uint64(pcln[6])
+	t.funcnames = pcln[funcnameOff:]
+	t.pctab = pcln[pctabOff:]
+	t.functab = pcln[pclnOff : pclnOff+(nfunc+1)*8]
+	t.gofunc = gofunc
+	t.pcln = pcln[pclnOff:]
+}
+
+// frames returns the frames at the address addr of the binary, starting with
+// the innermost inlined call.
+func (t *goTable) frames(addr uint64) []plugin.Frame {
+	file, line, fn := t.table.PCToLine(addr)
+	if fn == nil {
+		return nil
+	}
+	var frames []plugin.Frame
+	for _, call := range t.inlinedCalls(fn, addr) {
+		frames = append(frames, plugin.Frame{Func: call.name, File: file, Line: line, StartLine: call.startLine})
+		file, line, _ = t.table.PCToLine(fn.Entry + call.parentPC)
+	}
+	startLine := 0
+	if f := t.funcData(fn.Entry); f != nil {
+		startLine = int(int32(t.order.Uint32(f[36:])))
+	}
+	return append(frames, plugin.Frame{Func: fn.Name, File: file, Line: line, StartLine: startLine})
+}
+
+// goInlinedCall is a call inlined in a function.
+type goInlinedCall struct {
+	name      string
+	startLine int
+	parentPC  uint64 // Offset from the function entry of the call.
+}
+
+// inlinedCalls returns the calls inlined at address pc of fn, from the
+// innermost one out. It returns nil if the inline tree of fn can't be read.
+func (t *goTable) inlinedCalls(fn *gosym.Func, pc uint64) []goInlinedCall {
+	f := t.funcData(fn.Entry)
+	if f == nil {
+		return nil
+	}
+	npcdata, nfuncdata := t.order.Uint32(f[28:]), uint32(f[43])
+	if npcdata <= goPCDataInlTree || nfuncdata <= goFuncDataInlTree || uint64(len(f)) < goFuncFixedSize+4*uint64(npcdata+nfuncdata) {
+		return nil
+	}
+	pcdata := t.order.Uint32(f[goFuncFixedSize+4*goPCDataInlTree:])
+	funcdata := t.order.Uint32(f[goFuncFixedSize+4*npcdata+4*goFuncDataInlTree:])
+	if pcdata == 0 || funcdata == ^uint32(0) {
+		return nil
+	}
+	tree := t.gofunc + uint64(funcdata) - t.rodataAddr
+
+	var calls []goInlinedCall
+	for i := t.pcValue(pcdata, fn.Entry, pc); i >= 0 && len(calls) < goMaxInlineDepth; {
+		off := tree + uint64(i)*goInlinedCallSize
+		if off+goInlinedCallSize > uint64(len(t.rodata)) {
+			return nil
+		}
+		c := t.rodata[off:]
+		call := goInlinedCall{
+			name:      t.funcName(t.order.Uint32(c[4:])),
+			parentPC:  uint64(t.order.Uint32(c[8:])),
+			startLine: int(int32(t.order.Uint32(c[12:]))),
+		}
+		calls = append(calls, call)
+		i = t.pcValue(pcdata, fn.Entry, fn.Entry+call.parentPC)
+	}
+	return calls
+}
+
+// funcData returns the runtime._func of the function at entry, or nil if
+// inline trees can't be read.
+func (t *goTable) funcData(entry uint64) []byte {
+	if t.pcln == nil || entry < t.textStart {
+		return nil
+	}
+	entryOff := uint32(entry - t.textStart)
+	n := len(t.functab)/8 - 1
+	lo, hi := 0, n
+	for lo < hi {
+		m := (lo + hi) / 2
+		if t.order.Uint32(t.functab[8*m:]) < entryOff {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	if lo == n || t.order.Uint32(t.functab[8*lo:]) != entryOff {
+		return nil
+	}
+	off := uint64(t.order.Uint32(t.functab[8*lo+4:]))
+	if off+goFuncFixedSize > uint64(len(t.pcln)) {
+		return nil
+	}
+	return t.pcln[off:]
+}
+
+// funcName returns the function name at offset off of the name table.
+func (t *goTable) funcName(off uint32) string {
+	if uint64(off) >= uint64(len(t.funcnames)) {
+		return ""
+	}
+	name := t.funcnames[off:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return string(name)
+}
+
+// pcValue returns the value at address pc of the pc-value table at offset
+// off of the pc tables, for the function at entry, or -1 if not found.
+func (t *goTable) pcValue(off uint32, entry, pc uint64) int32 {
+	if uint64(off) >= uint64(len(t.pctab)) {
+		return -1
+	}
+	p := t.pctab[off:]
+	val, cur := int32(-1), entry
+	for first := true; len(p) > 0; first = false {
+		uvdelta, n := binary.Uvarint(p)
+		if n <= 0 || (uvdelta == 0 && !first) {
+			break
+		}
+		p = p[n:]
+		val += int32(-(uint32(uvdelta) & 1) ^ (uint32(uvdelta) >> 1))
+		pcdelta, n := binary.Uvarint(p)
+		if n <= 0 {
+			break
+		}
+		p = p[n:]
+		cur += pcdelta * t.quantum
+		if pc < cur {
+			return val
+		}
+	}
+	return -1
+}
@@ -0,0 +1,127 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binutils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/google/pprof/internal/plugin"
+)
+
+func TestGoSymbolization(t *testing.T) {
+	skipUnlessLinuxAmd64(t)
+	// sample.bin is a Go binary; main.busyLoop is at 0x4b4310.
+	name := filepath.Join("..", "report", "testdata", "sample.bin")
+	bu := &Binutils{}
+	bu.SetGoSymbolization(true)
+	f, err := bu.Open(name, 0x400000, 0x600000, 0, "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if _, ok := f.(*fileGo); !ok {
+		t.Fatalf("Open: got %T, want *fileGo", f)
+	}
+	frames, err := f.SourceLine(0x4b4310)
+	if err != nil {
+		t.Fatalf("SourceLine: %v", err)
+	}
+	// The function table of this old binary has no start lines.
+	want := []plugin.Frame{{Func: "main.busyLoop", File: "/usr/local/google/home/sanjay/go/src/github.com/google/pprof/internal/report/testdata/sample/sample.go", Line: 29}}
+	if !reflect.DeepEqual(frames, want) {
+		t.Errorf("SourceLine: got %v, want %v", frames, want)
+	}
+
+	// Non-Go binaries are symbolized as usual.
+	f, err = bu.Open(filepath.Join("testdata", "exe_linux_64"), 0x400000, 0x4006fc, 0, "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if _, ok := f.(*fileGo); ok {
+		t.Errorf("Open of a C binary: got %T", f)
+	}
+}
+
+const inlineProgram = `package main
+
+var sink int
+
+func add(a, b int) int {
+	return a*b + a
+}
+
+//go:noinline
+func run(n int) {
+	for i := 0; i < n; i++ {
+		sink += add(i, n)
+	}
+}
+
+func main() {
+	run(10)
+}
+`
+
+func TestGoSymbolizationInlined(t *testing.T) {
+	skipUnlessLinuxAmd64(t)
+	goTool, err := exec.LookPath(filepath.Join(runtime.GOROOT(), "bin", "go"))
+	if err != nil {
+		t.Skip("go tool not available")
+	}
+	dir := t.TempDir()
+	src, exe := filepath.Join(dir, "main.go"), filepath.Join(dir, "main")
+	if err := os.WriteFile(src, []byte(inlineProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(goTool, "build", "-o", exe, src)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH=amd64", "CGO_ENABLED=0", "GOFLAGS=", "GO111MODULE=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("building test program: %v\n%s", err, out)
+	}
+
+	table, err := newGoTable(exe)
+	if err != nil {
+		t.Fatalf("newGoTable: %v", err)
+	}
+	if table.pcln == nil {
+		t.Fatal("newGoTable: inline trees not available")
+	}
+	run := table.table.LookupFunc("main.run")
+	if run == nil {
+		t.Fatal("main.run not found")
+	}
+	for pc := run.Entry; pc < run.End; pc++ {
+		frames := table.frames(pc)
+		if len(frames) != 2 {
+			continue
+		}
+		want := []plugin.Frame{
+			{Func: "main.add", File: src, Line: 6, StartLine: 5},
+			{Func: "main.run", File: src, Line: 12, StartLine: 10},
+		}
+		if !reflect.DeepEqual(frames, want) {
+			t.Errorf("frames(%#x): got %v, want %v", pc, frames, want)
+		}
+		return
+	}
+	t.Error("no address of main.run has inlined frames")
+}
@@ -47,6 +47,20 @@ func main() {
 			log.Fatal(err)
 		}
 
+		// Split the debug info into a separate file, for testing symbolization
+		// of stripped binaries.
+		out, err = exec.Command("objcopy", "--only-keep-debug", "exe_linux_64", "exe_linux_64.debug").CombinedOutput()
+		log.Println(string(out))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		out, err = exec.Command("objcopy", "--strip-all", "--add-gnu-debuglink=exe_linux_64.debug", "exe_linux_64", "exe_linux_64_stripped").CombinedOutput()
+		log.Println(string(out))
+		if err != nil {
+			log.Fatal(err)
+		}
+
 	case "darwin":
 		if err := removeGlob("exe_mac_64*", "lib_mac_64"); err != nil {
 			log.Fatal(err)
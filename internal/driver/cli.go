@@ -18,9 +18,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/google/pprof/internal/binutils"
 	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/internal/report"
 )
 
 type source struct {
@@ -29,14 +32,49 @@ type source struct {
 	BuildID   string
 	Base      []string
 	DiffBase  bool
+	RatioBase bool
+	BaseMean  bool
 	Normalize bool
 
+	// SourceStats marks the samples of each source profile with its index,
+	// for reports to show the statistics of node values across sources.
+	SourceStats bool
+
+	// UnsampleHeap estimates the unsampled values of the fetched heap
+	// profiles from their sampling period.
+	UnsampleHeap bool
+
 	Seconds            int
 	Timeout            int
+	FetchParallelism   int
 	Symbolize          string
 	HTTPHostport       string
 	HTTPDisableBrowser bool
-	Comment            string
+	Comments           []string
+
+	// CompareSymbols holds the two binaries whose symbolization of the
+	// profile addresses is compared, instead of generating a report.
+	CompareSymbols []string
+
+	// RelocationSymbols maps the file names of mappings, or their base
+	// names, to the symbol at their start address.
+	RelocationSymbols map[string]string
+
+	// Image is the container image in which the binaries of mappings are
+	// looked up, if any.
+	Image *containerImage
+
+	// StripDeleted looks up the binaries of mappings of deleted files, with
+	// a " (deleted)" suffix, by the name without the suffix.
+	StripDeleted bool
+
+	// PrintConfig is set to print the configuration as command line flags
+	// instead of fetching the profile.
+	PrintConfig bool
+
+	// Deadline, if positive, bounds the time to symbolize the profile and
+	// generate the report.
+	Deadline time.Duration
 }
 
 // parseFlags parses the command lines through the specified flags package
@@ -46,12 +84,22 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 	flag := o.Flagset
 	// Comparisons.
 	flagDiffBase := flag.StringList("diff_base", "", "Source of base profile for comparison")
+	flagRatioBase := flag.StringList("ratio_base", "", "Source of base profile for ratios of node values")
 	flagBase := flag.StringList("base", "", "Source of base profile for profile subtraction")
+	flagBaseMean := flag.Bool("base_mean", false, "Average the base profiles instead of summing them")
+	flagSourceStats := flag.Bool("source_stats", false, "Show the mean and standard error of nodes across source profiles")
 	// Source options.
 	flagSymbolize := flag.String("symbolize", "", "Options for profile symbolization")
+	flagCompareSymbols := flag.String("compare_symbols", "", "Compare the symbolization of two binaries, as binary1,binary2")
+	flagForceSymbolize := flag.Bool("force_symbolize", false, "Discard existing symbols and re-symbolize with local binaries")
 	flagBuildID := flag.String("buildid", "", "Override build id for first mapping")
 	flagTimeout := flag.Int("timeout", -1, "Timeout in seconds for fetching a profile")
-	flagAddComment := flag.String("add_comment", "", "Annotation string to record in the profile")
+	flagFetchParallelism := flag.Int("fetch_parallelism", 0, "Maximum number of profiles to fetch concurrently")
+	flagAddComment := flag.StringList("add_comment", "", "Annotation string to record in the profile")
+	flagAddLabel := flag.StringList("add_label", "", "Label to add to report headers")
+	flagRelocationSymbol := flag.StringList("relocation_symbol", "", "Relocation symbol for a mapping, as file=symbol")
+	flagImage := flag.String("image", "", "Container image tarball holding the binaries of the profile")
+	flagStripDeleted := flag.Bool("strip_deleted", false, "Look up the binaries of deleted mappings without the (deleted) suffix")
 	// CPU profile options
 	flagSeconds := flag.Int("seconds", -1, "Length of time for dynamic profiles")
 	// Heap profile options
@@ -59,14 +107,21 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 	flagInUseObjects := flag.Bool("inuse_objects", false, "Display in-use object counts")
 	flagAllocSpace := flag.Bool("alloc_space", false, "Display allocated memory size")
 	flagAllocObjects := flag.Bool("alloc_objects", false, "Display allocated object counts")
+	flagUnsampleHeap := flag.Bool("unsample_heap", false, "Estimate unsampled values of sampled heap profiles")
 	// Contention profile options
 	flagTotalDelay := flag.Bool("total_delay", false, "Display total delay at each region")
 	flagContentions := flag.Bool("contentions", false, "Display number of delays at each region")
 	flagMeanDelay := flag.Bool("mean_delay", false, "Display mean delay at each region")
+	flagFull := flag.Bool("full", false, "Show all nodes and edges, without trimming")
 	flagTools := flag.String("tools", os.Getenv("PPROF_TOOLS"), "Path for object tool pathnames")
+	flagToolArgs := flag.String("tool_args", os.Getenv("PPROF_TOOL_ARGS"), "Extra arguments for object tools")
+	flagSymbolizeTimeout := flag.Int("symbolize_timeout", 0, "Timeout in seconds for each symbolizer query")
 
 	flagHTTP := flag.String("http", "", "Present interactive web UI at the specified http host:port")
 	flagNoBrowser := flag.Bool("no_browser", false, "Skip opening a browser for the interactive web UI")
+	flagJSONErrors := flag.Bool("json_errors", false, "Print diagnostics as JSON lines to stderr")
+	flagPrintConfig := flag.Bool("print_config", false, "Print the configuration as command line flags and exit")
+	flagDeadline := flag.String("deadline", "", "Abort if symbolizing the profile and generating the report take longer than this duration")
 
 	// Flags that set configuration properties.
 	cfg := currentConfig()
@@ -89,8 +144,19 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 			flag.ExtraUsage() +
 			usageMsgVars)
 	})
-	if len(args) == 0 {
-		return nil, nil, errors.New("no profile source specified")
+	if *flagJSONErrors {
+		useJSONUI(o, os.Stderr)
+	}
+	if len(args) == 0 && !*flagPrintConfig {
+		if *flagBuildID == "" {
+			return nil, nil, errors.New("no profile source specified")
+		}
+		// Look for a profile of the binary in the local profile cache.
+		path, err := locateProfileByBuildID(*flagBuildID)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = []string{path}
 	}
 
 	var execName string
@@ -108,6 +174,7 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 	if err := configFlagSetter(); err != nil {
 		return nil, nil, err
 	}
+	cfg.ExtraLabels = dropEmpty(*flagAddLabel)
 
 	cmd, err := outputFormat(flagCommands, flagParamCommands)
 	if err != nil {
@@ -117,10 +184,39 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 		return nil, nil, errors.New("-http is not compatible with an output format on the command line")
 	}
 
+	var compareSymbols []string
+	if *flagCompareSymbols != "" {
+		compareSymbols = strings.Split(*flagCompareSymbols, ",")
+		if len(compareSymbols) != 2 || compareSymbols[0] == "" || compareSymbols[1] == "" {
+			return nil, nil, errors.New("-compare_symbols takes two binaries separated by a comma")
+		}
+		if cmd != nil || *flagHTTP != "" {
+			return nil, nil, errors.New("-compare_symbols is not compatible with an output format or -http")
+		}
+	}
+
+	if *flagSourceStats && cmd != nil && pprofCommands[cmd[0]].format != report.Text {
+		return nil, nil, errors.New("-source_stats only applies to text reports, such as top")
+	}
+
 	if *flagNoBrowser && *flagHTTP == "" {
 		return nil, nil, errors.New("-no_browser only makes sense with -http")
 	}
 
+	var deadline time.Duration
+	if *flagDeadline != "" {
+		if cmd == nil {
+			return nil, nil, errors.New("-deadline only makes sense with an output format on the command line")
+		}
+		if deadline, err = time.ParseDuration(*flagDeadline); err != nil || deadline <= 0 {
+			return nil, nil, fmt.Errorf("-deadline %q is not a positive duration", *flagDeadline)
+		}
+	}
+
+	if *flagFetchParallelism < 0 {
+		return nil, nil, errors.New("-fetch_parallelism must not be negative")
+	}
+
 	si := cfg.SampleIndex
 	si = sampleIndex(flagTotalDelay, si, "delay", "-total_delay", o.UI)
 	si = sampleIndex(flagMeanDelay, si, "delay", "-mean_delay", o.UI)
@@ -135,22 +231,60 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 		cfg.Mean = true
 	}
 
+	if *flagFull {
+		cfg.Trim = false
+		cfg.NodeCount = -1
+		cfg.NodeFraction = 0
+		cfg.EdgeFraction = 0
+	}
+
 	source := &source{
 		Sources:            args,
 		ExecName:           execName,
 		BuildID:            *flagBuildID,
 		Seconds:            *flagSeconds,
 		Timeout:            *flagTimeout,
+		FetchParallelism:   *flagFetchParallelism,
 		Symbolize:          *flagSymbolize,
 		HTTPHostport:       *flagHTTP,
 		HTTPDisableBrowser: *flagNoBrowser,
-		Comment:            *flagAddComment,
+		Comments:           dropEmpty(*flagAddComment),
+		CompareSymbols:     compareSymbols,
+		PrintConfig:        *flagPrintConfig,
+		UnsampleHeap:       *flagUnsampleHeap,
+		SourceStats:        *flagSourceStats,
+		StripDeleted:       *flagStripDeleted,
+		Deadline:           deadline,
+	}
+
+	if source.RelocationSymbols, err = relocationSymbols(dropEmpty(*flagRelocationSymbol)); err != nil {
+		return nil, nil, err
+	}
+
+	if *flagImage != "" {
+		if source.Image, err = openImage(*flagImage); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if *flagForceSymbolize {
+		for _, mode := range strings.Split(strings.ToLower(source.Symbolize), ":") {
+			if mode == "none" || mode == "no" {
+				return nil, nil, errors.New("-force_symbolize is not compatible with -symbolize=none")
+			}
+		}
+		source.Symbolize = strings.TrimPrefix(source.Symbolize+":clear", ":")
 	}
 
-	if err := source.addBaseProfiles(*flagBase, *flagDiffBase); err != nil {
+	if err := source.addBaseProfiles(*flagBase, *flagDiffBase, *flagRatioBase); err != nil {
 		return nil, nil, err
 	}
 
+	if *flagBaseMean && len(source.Base) == 0 {
+		return nil, nil, errors.New("must have base profile to average")
+	}
+	source.BaseMean = *flagBaseMean
+
 	normalize := cfg.Normalize
 	if normalize && len(source.Base) == 0 {
 		return nil, nil, errors.New("must have base profile to normalize by")
@@ -159,25 +293,49 @@ func parseFlags(o *plugin.Options) (*source, []string, error) {
 
 	if bu, ok := o.Obj.(*binutils.Binutils); ok {
 		bu.SetTools(*flagTools)
+		bu.SetToolArgs(*flagToolArgs)
+		bu.SetSymbolizeTimeout(time.Duration(*flagSymbolizeTimeout) * time.Second)
 	}
 
 	setCurrentConfig(cfg)
 	return source, cmd, nil
 }
 
-// addBaseProfiles adds the list of base profiles or diff base profiles to
-// the source. This function will return an error if both base and diff base
-// profiles are specified.
-func (source *source) addBaseProfiles(flagBase, flagDiffBase []*string) error {
-	base, diffBase := dropEmpty(flagBase), dropEmpty(flagDiffBase)
+// relocationSymbols parses the file=symbol values of -relocation_symbol.
+func relocationSymbols(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	syms := make(map[string]string, len(values))
+	for _, v := range values {
+		file, sym, ok := strings.Cut(v, "=")
+		if !ok || file == "" || sym == "" {
+			return nil, fmt.Errorf("-relocation_symbol %q is not of the form file=symbol", v)
+		}
+		syms[file] = sym
+	}
+	return syms, nil
+}
+
+// addBaseProfiles adds the list of base profiles, diff base profiles or
+// ratio base profiles to the source. This function will return an error if
+// more than one kind of base profiles are specified.
+func (source *source) addBaseProfiles(flagBase, flagDiffBase, flagRatioBase []*string) error {
+	base, diffBase, ratioBase := dropEmpty(flagBase), dropEmpty(flagDiffBase), dropEmpty(flagRatioBase)
 	if len(base) > 0 && len(diffBase) > 0 {
 		return errors.New("-base and -diff_base flags cannot both be specified")
 	}
+	if len(ratioBase) > 0 && len(base)+len(diffBase) > 0 {
+		return errors.New("-ratio_base cannot be specified with -base or -diff_base")
+	}
 
 	source.Base = base
 	if len(diffBase) > 0 {
 		source.Base, source.DiffBase = diffBase, true
 	}
+	if len(ratioBase) > 0 {
+		source.Base, source.RatioBase = ratioBase, true
+	}
 	return nil
 }
 
@@ -315,20 +473,56 @@ var usageMsgSrc = "\n\n" +
 	"  Source options:\n" +
 	"    -seconds              Duration for time-based profile collection\n" +
 	"    -timeout              Timeout in seconds for profile collection\n" +
+	"    -fetch_parallelism    Max number of profiles fetched concurrently\n" +
+	"                          Unlimited if zero, the default\n" +
 	"    -buildid              Override build id for main binary\n" +
+	"                          Without a profile source, the most recent profile\n" +
+	"                          with this build id in PPROF_PROFILE_PATH is used\n" +
 	"    -add_comment          Free-form annotation to add to the profile\n" +
-	"                          Displayed on some reports or with pprof -comments\n" +
+	"                          Displayed on some reports or with pprof -comments;\n" +
+	"                          can be repeated\n" +
+	"    -add_label            Label to add to report headers; can be repeated\n" +
 	"    -diff_base source     Source of base profile for comparison\n" +
+	"    -ratio_base source    Source of base profile to divide node values by\n" +
+	"                          Text reports show the ratio of the cum value of\n" +
+	"                          each node to its value in the base, or new\n" +
 	"    -base source          Source of base profile for profile subtraction\n" +
+	"    -base_mean            Average multiple base profiles instead of summing them\n" +
+	"    -source_stats         Text reports show the mean and standard error of\n" +
+	"                          the value of each node across the source profiles\n" +
+	"    -unsample_heap        Estimate the actual allocations of heap profiles\n" +
+	"                          holding sampled allocations, such as older ones,\n" +
+	"                          from their sampling period\n" +
 	"    profile.pb.gz         Profile in compressed protobuf format\n" +
+	"    file@offset:length    Profile embedded in a larger file at offset\n" +
+	"    profiles.tar          Tar archive of profiles to merge\n" +
 	"    legacy_profile        Profile in legacy pprof format\n" +
 	"    http://host/profile   URL for profile handler to retrieve\n" +
+	"    user@host:/path       Profile copied over SSH with the system scp\n" +
 	"    -symbolize=           Controls source of symbol information\n" +
 	"      none                  Do not attempt symbolization\n" +
 	"      local                 Examine only local binaries\n" +
 	"      fastlocal             Only get function names from local binaries\n" +
+	"      gosym                 Examine only local binaries, using the function\n" +
+	"                            table of Go binaries instead of binutils\n" +
 	"      remote                Do not examine local binaries\n" +
 	"      force                 Force re-symbolization\n" +
+	"      clear                 Force re-symbolization, discarding the symbols\n" +
+	"                            of mappings with a local binary\n" +
+	"    -force_symbolize      Same as adding :clear to -symbolize\n" +
+	"    -compare_symbols      Print the addresses of the main binary that resolve\n" +
+	"                          to different functions in two binaries, given as\n" +
+	"                          binary1,binary2, instead of a report\n" +
+	"    -relocation_symbol    Symbol at the start address of a mapping, as\n" +
+	"                          file=symbol, where file is the mapping file or its\n" +
+	"                          base name; can be repeated. Kernel mappings use\n" +
+	"                          _stext or _text by default\n" +
+	"    -image                Docker or OCI image tarball, such as written by\n" +
+	"                          docker save, in which the file names of mappings\n" +
+	"                          are looked up as paths from the root of the image\n" +
+	"    -strip_deleted        Look up the binaries of mappings of files deleted\n" +
+	"                          after they were mapped, whose names end with\n" +
+	"                          \" (deleted)\", by their names without the suffix\n" +
 	"    Binary                  Local path or build id of binary for symbolization\n"
 
 var usageMsgVars = "\n\n" +
@@ -337,7 +531,18 @@ var usageMsgVars = "\n\n" +
 	"                      Host is optional and 'localhost' by default.\n" +
 	"                      Port is optional and a randomly available port by default.\n" +
 	"   -no_browser        Skip opening a browser for the interactive web UI.\n" +
+	"   -json_errors       Print diagnostics to stderr as JSON lines with\n" +
+	"                      \"severity\" and \"message\" fields.\n" +
+	"   -print_config      Print the options in effect, including the default\n" +
+	"                      ones, as flags to reproduce the same view, and exit.\n" +
+	"   -deadline          Abort if symbolizing the profile and generating the\n" +
+	"                      report take longer than this duration, e.g. 30s.\n" +
+	"                      Requires an output format on the command line.\n" +
 	"   -tools             Search path for object tools\n" +
+	"   -tool_args         Extra arguments for object tools, as tool:arg,...\n" +
+	"                      e.g. objdump:--target=elf64-x86-64\n" +
+	"   -symbolize_timeout Timeout in seconds for each addr2line or\n" +
+	"                      llvm-symbolizer query; unlimited if zero\n" +
 	"\n" +
 	"  Legacy convenience options:\n" +
 	"   -inuse_space           Same as -sample_index=inuse_space\n" +
@@ -347,14 +552,23 @@ var usageMsgVars = "\n\n" +
 	"   -total_delay           Same as -sample_index=delay\n" +
 	"   -contentions           Same as -sample_index=contentions\n" +
 	"   -mean_delay            Same as -mean -sample_index=delay\n" +
+	"   -full                  Same as -trim=false -nodecount=-1 -nodefraction=0\n" +
+	"                          -edgefraction=0, to show everything\n" +
 	"\n" +
 	"  Environment Variables:\n" +
 	"   PPROF_TMPDIR       Location for saved profiles (default $HOME/pprof)\n" +
 	"   PPROF_TOOLS        Search path for object-level tools\n" +
+	"   PPROF_TOOL_ARGS    Extra arguments for object-level tools\n" +
 	"   PPROF_BINARY_PATH  Search path for local binary files\n" +
 	"                      default: $HOME/pprof/binaries\n" +
 	"                      searches $buildid/$name, $buildid/*, $path/$buildid,\n" +
 	"                      ${buildid:0:2}/${buildid:2}.debug, $name, $path,\n" +
 	"                      ${name}.debug, $dir/.debug/${name}.debug,\n" +
 	"                      usr/lib/debug/$dir/${name}.debug\n" +
+	"                      Also used to find split debug info of stripped binaries:\n" +
+	"                      .build-id/${buildid:0:2}/${buildid:2}.debug, and\n" +
+	"                      $dir/$debuglink for the .gnu_debuglink file name\n" +
+	"   PPROF_PROFILE_PATH Search path for profiles selected by -buildid\n" +
+	"                      default: $HOME/pprof/profiles\n" +
+	"                      searches $path/$buildid/*\n" +
 	"   * On Windows, %USERPROFILE% is used instead of $HOME"
@@ -82,23 +82,36 @@ var interactiveMode = false
 // pprofCommands are the report generation commands recognized by pprof.
 var pprofCommands = commands{
 	// Commands that require no post-processing.
-	"comments": {report.Comments, nil, nil, false, "Output all profile comments", ""},
-	"disasm":   {report.Dis, nil, nil, true, "Output assembly listings annotated with samples", listHelp("disasm", true)},
-	"dot":      {report.Dot, nil, nil, false, "Outputs a graph in DOT format", reportHelp("dot", false, true)},
-	"list":     {report.List, nil, nil, true, "Output annotated source for functions matching regexp", listHelp("list", false)},
-	"peek":     {report.Tree, nil, nil, true, "Output callers/callees of functions matching regexp", "peek func_regex\nDisplay callers and callees of functions matching func_regex."},
-	"raw":      {report.Raw, nil, nil, false, "Outputs a text representation of the raw profile", ""},
-	"tags":     {report.Tags, nil, nil, false, "Outputs all tags in the profile", "tags [tag_regex]* [-ignore_regex]* [>file]\nList tags with key:value matching tag_regex and exclude ignore_regex."},
-	"text":     {report.Text, nil, nil, false, "Outputs top entries in text form", reportHelp("text", true, true)},
-	"top":      {report.Text, nil, nil, false, "Outputs top entries in text form", reportHelp("top", true, true)},
-	"traces":   {report.Traces, nil, nil, false, "Outputs all profile samples in text form", ""},
-	"tree":     {report.Tree, nil, nil, false, "Outputs a text rendering of call graph", reportHelp("tree", true, true)},
+	"comments":   {report.Comments, nil, nil, false, "Output all profile comments", ""},
+	"coverage":   {report.Coverage, nil, nil, true, "Output the source lines with and without samples for functions matching regexp", listHelp("coverage", false)},
+	"d3json":     {report.D3JSON, nil, nil, false, "Outputs the call tree as hierarchical JSON for D3", "d3json\nPrint the call tree as nested nodes with a name, a flat value and children,\nsuitable for D3 sunburst and treemap layouts."},
+	"disasm":     {report.Dis, nil, nil, true, "Output assembly listings annotated with samples", listHelp("disasm", true)},
+	"dot":        {report.Dot, nil, nil, false, "Outputs a graph in DOT format", reportHelp("dot", false, true)},
+	"edges":      {report.Edges, nil, nil, false, "Outputs the heaviest caller->callee edges", "edges [n] [-focus_regex]* [-ignore_regex]* [>file]\nList the n heaviest caller->callee pairs of the whole graph, by weight,\nfor the hottest calls beyond the callers and callees of peek."},
+	"list":       {report.List, nil, nil, true, "Output annotated source for functions matching regexp", listHelp("list", false)},
+	"ndjson":     {report.NDJSON, nil, nil, false, "Outputs the samples as newline-delimited JSON", "ndjson [-focus_regex]* [-ignore_regex]* [>file]\nPrint a JSON object per line for each sample, with its values, labels and\nframes, for streaming into log and analytics pipelines."},
+	"oneline":    {report.OneLine, nil, nil, false, "Outputs a single-line summary of the profile", "oneline\nPrint the total, the top entry by flat value and the sample count on one line."},
+	"peek":       {report.Tree, nil, nil, true, "Output callers/callees of functions matching regexp", "peek func_regex\nDisplay callers and callees of functions matching func_regex."},
+	"prometheus": {report.Prometheus, nil, nil, false, "Outputs the flat and cum values of functions as Prometheus metrics", "prometheus [-focus_regex]* [-ignore_regex]* [>file]\nPrint the pprof_function_flat and pprof_function_cum gauges of each function,\nin the Prometheus text format, for pushing profile summaries into monitoring."},
+	"raw":        {report.Raw, nil, nil, false, "Outputs a text representation of the raw profile", ""},
+	"sample":     {report.Sample, nil, nil, true, "Output the values, labels and full stack of a sample", "sample index\nPrint the sample at the given index of the profile, counting from 0 after\nfiltering, with all its values and labels and its stack including addresses\nand inlined frames."},
+	"sizes":      {report.Sizes, nil, nil, false, "Outputs the serialized size of each profile table", ""},
+	"tags":       {report.Tags, nil, nil, false, "Outputs all tags in the profile", "tags [tag_regex]* [-ignore_regex]* [>file]\nList tags with key:value matching tag_regex and exclude ignore_regex."},
+	"text":       {report.Text, nil, nil, false, "Outputs top entries in text form", reportHelp("text", true, true)},
+	"top":        {report.Text, nil, nil, false, "Outputs top entries in text form", reportHelp("top", true, true)},
+	"traces":     {report.Traces, nil, nil, false, "Outputs all profile samples in text form", ""},
+	"tree":       {report.Tree, nil, nil, false, "Outputs a text rendering of call graph", reportHelp("tree", true, true)},
 
 	// Save binary formats to a file
 	"callgrind": {report.Callgrind, nil, awayFromTTY("callgraph.out"), false, "Outputs a graph in callgrind format", reportHelp("callgrind", false, true)},
+	"graphml":   {report.GraphML, nil, awayFromTTY("graphml"), false, "Outputs a graph in GraphML format", reportHelp("graphml", false, true)},
 	"proto":     {report.Proto, nil, awayFromTTY("pb.gz"), false, "Outputs the profile in compressed protobuf format", ""},
+	"sqlite":    {report.SQLite, nil, awayFromTTY("db"), false, "Outputs the graph nodes and edges as a SQLite database", "sqlite [-focus_regex]* [-ignore_regex]* [>file]\nWrite the nodes and edges of the graph to the info, nodes and edges tables\nof a SQLite database, for SQL queries over the profile."},
 	"topproto":  {report.TopProto, nil, awayFromTTY("pb.gz"), false, "Outputs top entries in compressed protobuf format", ""},
 
+	// Save a self-contained HTML flame graph to a file
+	"flamegraph_html": {report.FlameGraph, nil, awayFromTTY("html"), false, "Outputs a standalone HTML flame graph", "flamegraph_html [-focus_regex]* [-ignore_regex]* [>file]\nWrite a self-contained HTML flame graph, with the folded stacks and the viewer\nembedded in the file."},
+
 	// Generate report in DOT format and postprocess with dot
 	"gif": {report.Dot, invokeDot("gif"), awayFromTTY("gif"), false, "Outputs a graph image in GIF format", reportHelp("gif", false, true)},
 	"pdf": {report.Dot, invokeDot("pdf"), awayFromTTY("pdf"), false, "Outputs a graph in PDF format", reportHelp("pdf", false, true)},
@@ -130,6 +143,16 @@ var configHelp = map[string]string{
 	"drop_negative": helpText(
 		"Ignore negative differences",
 		"Do not show any locations with values <0."),
+	"clamp": helpText(
+		"Set negative sample values to zero",
+		"Keeps only the growth in comparisons of profiles. Unlike",
+		"drop_negative, applies to samples before they are aggregated.",
+		"With -diff_base, the base is subtracted from the samples first."),
+	"drop_address_only": helpText(
+		"Drop locations that have only an address",
+		"Unsymbolized frames are removed from the call stacks, so their",
+		"weight is attributed to their callers. Samples made up only of",
+		"such frames are counted in the total but not shown on any node."),
 
 	// Graph handling options.
 	"call_tree": helpText(
@@ -141,6 +164,11 @@ var configHelp = map[string]string{
 		"Show percentages relative to focused subgraph",
 		"If unset, percentages are relative to full graph before focusing",
 		"to facilitate comparison with original graph."),
+	"percent_base": helpText(
+		"Show percentages relative to the cum of matching functions",
+		"The flat and cum percentages of nodes are relative to the value of",
+		"samples going through a function matching this regexp, to drill",
+		"into a subsystem. The total and the trimming are unchanged."),
 	"unit": helpText(
 		"Measurement units to display",
 		"Scale the sample values to this unit.",
@@ -150,20 +178,129 @@ var configHelp = map[string]string{
 	"compact_labels": "Show minimal headers",
 	"source_path":    "Search path for source files",
 	"trim_path":      "Path to trim from source paths before search",
+	"source_url": helpText(
+		"URL template linking weblist source lines to a code host",
+		"The {file} and {line} placeholders are replaced by the source file",
+		"and line, e.g. https://github.com/org/repo/blob/<commit>/{file}#L{line}.",
+		"Only relative file names are linked; see trim_path."),
 	"intel_syntax": helpText(
 		"Show assembly in Intel syntax",
 		"Only applicable to commands `disasm` and `weblist`"),
+	"source_asm": helpText(
+		"Show the assembly of each source line",
+		"Interleaves the instructions generated for each line with the",
+		"source, as in the weblist view.",
+		"Only applicable to command `list`"),
+	"trace_timestamps": helpText(
+		"Show the time at which each sample was taken",
+		"Uses the 'timestamp' numeric label of samples, in nanoseconds since",
+		"the Unix epoch unless the label has another time unit.",
+		"Only applicable to command `traces`"),
+	"thread": helpText(
+		"Show only the traces of this thread or goroutine id",
+		"Matches the string or numeric label named by thread_label, or",
+		"the first of 'thread', 'tid' and 'goroutine' a sample has.",
+		"Only applicable to command `traces`"),
+	"thread_label": helpText(
+		"Label key holding the thread id used by the thread option"),
+	"trace_max_depth": helpText(
+		"Maximum number of frames shown for each sample",
+		"Deeper stacks are truncated, ending with a line counting the",
+		"frames not shown. All frames are shown if zero, the default.",
+		"Only applicable to command `traces`"),
+	"labels": helpText(
+		"Comma-separated list of label keys to show",
+		"Restricts the labels shown by the `traces` and `tags` commands.",
+		"All labels are shown by default."),
+	"tags_cum": helpText(
+		"Add a cum column to the tags report",
+		"The cum value of a tag is the sum of its cum values on all nodes",
+		"of the call graph, so samples with deeper stacks weigh more."),
+	"title": helpText(
+		"Title of the report",
+		"Shown in the report headers and used as the name of graphs.",
+		"Defaults to the name of the main binary."),
+	"comments_first": helpText(
+		"Show profile comments at the top of report headers",
+		"Comments are shown even with compact_labels. Use the comments",
+		"command to print only the comments."),
+	"hot_path": helpText(
+		"Highlight the heaviest path in graphs",
+		"The nodes and edges of the path carrying the most weight from a root",
+		"to a leaf are drawn in bold red."),
+	"stable_dot_ids": helpText(
+		"Derive DOT node IDs from node contents",
+		"Unchanged nodes keep the same ID across runs, which simplifies",
+		"diffing the output of the `dot` command."),
 
 	// Filtering options
 	"nodecount": helpText(
 		"Max number of nodes to show",
 		"Uses heuristics to limit the number of locations to be displayed.",
 		"On graphs, dotted edges represent paths through nodes that have been removed."),
+	"text_nodecount": helpText(
+		"Max number of nodes to show in text reports",
+		"Overrides nodecount for text, top and topproto. Zero uses nodecount."),
+	"graph_nodecount": helpText(
+		"Max number of nodes to show in graphs",
+		"Overrides nodecount for dot, svg, web and other graph outputs.",
+		"Zero uses nodecount."),
 	"nodefraction": "Hide nodes below <f>*total",
 	"edgefraction": "Hide edges below <f>*total",
+	"other_node": helpText(
+		"Aggregate nodes hidden by trimming into an (other) node",
+		"The (other) node holds the flat value of all nodes dropped by",
+		"nodecount and nodefraction, so that the node values add up to the total."),
+	"rankdir": helpText(
+		"Direction of the layout of graphs",
+		"One of TB (top to bottom, the default), LR (left to right),",
+		"BT (bottom to top) or RL (right to left)."),
+	"node_size": helpText(
+		"Node value scaling the label size of graph nodes",
+		"Either flat or cum. Nodes are sized by their flat value by default."),
+	"node_color": helpText(
+		"Node value setting the color of graph nodes",
+		"Either flat or cum. Nodes are colored by their cum value by default."),
+	"concentration": helpText(
+		"Summarize how concentrated the values are in report headers",
+		"If set to N > 0, the headers show the share of the total held by",
+		"the N nodes with the largest flat values, along with the Gini",
+		"coefficient of the flat values of all the nodes shown."),
+	"flat_only": helpText(
+		"Omit the cum columns from text reports",
+		"Entries are sorted by their flat value, even with -cum."),
+	"no_inline_labels": helpText(
+		"Omit the (inline) suffixes of names in text reports",
+		"Names are printed without the (inline) and (partial-inline)",
+		"suffixes marking inlined calls in text, traces and tree reports."),
+	"estimated_total": helpText(
+		"Add the estimated totals to text reports",
+		"Adds a column with the value of each entry times the period of",
+		"the profile, such as the CPU time estimated from sample counts.",
+		"The column is omitted if the profile has no period or the values",
+		"are not sample counts."),
+	"sample_count_diff": helpText(
+		"Add the sample count differences to text reports",
+		"With -diff_base, adds a column with the number of samples of each",
+		"entry minus its number of samples in the base profiles, whatever",
+		"their values, to compare how often the entries are sampled.",
+		"Requires samples/count values in the profiles."),
+	"sample_indices": helpText(
+		"List the samples of each node in d3json output",
+		"Each node gets the indices in the profile of the samples that",
+		"contributed to its cum value, to correlate nodes with raw samples."),
+	"label_metrics": helpText(
+		"Numeric labels shown as metrics of each node",
+		"Comma-separated numeric label keys, such as hardware counters,",
+		"whose values are summed over the samples of each node. Text",
+		"reports get a column per key and graph nodes a line per key."),
 	"trim": helpText(
 		"Honor nodefraction/edgefraction/nodecount defaults",
 		"Set to false to get the full profile, without any trimming."),
+	"paths_to": helpText(
+		"Only show the paths of the graph to nodes matching regexp",
+		"Drops the nodes from which no matching node can be reached,",
+		"before the graph is trimmed. Matching uses the node names."),
 	"focus": helpText(
 		"Restricts to samples going through a node matching regexp",
 		"Discard samples that do not include a node matching this regexp.",
@@ -172,10 +309,24 @@ var configHelp = map[string]string{
 		"Skips paths going through any nodes matching regexp",
 		"If set, discard samples that include a node matching this regexp.",
 		"Matching includes the function name, filename or object name."),
+	"focus_leaf": helpText(
+		"Restricts to samples whose leaf matches regexp",
+		"Discard samples whose leaf location, the top of the stack, does not",
+		"match this regexp. Functions inlined at the leaf location also match.",
+		"Matching includes the function name, filename or object name."),
+	"focus_buildid": helpText(
+		"Restricts to samples going through a binary with this build ID",
+		"Discard samples that do not include a location in a mapping whose",
+		"build ID starts with this hex string, ignoring case."),
 	"prune_from": helpText(
 		"Drops any functions below the matched frame.",
 		"If set, any frames matching the specified regexp and any frames",
 		"below it will be dropped from each sample."),
+	"redact": helpText(
+		"Removes sensitive data matching regexp from the profile",
+		"Samples with a label key=value matching this regexp are dropped,",
+		"and matching function names are replaced with \"[redacted]\"",
+		"along with their system names and file names."),
 	"hide": helpText(
 		"Skips nodes matching regexp",
 		"Discard nodes that match this location.",
@@ -189,6 +340,10 @@ var configHelp = map[string]string{
 		"Drops functions above the highest matched frame.",
 		"If set, all frames above the highest match are dropped from every sample.",
 		"Matching includes the function name, filename or object name."),
+	"match_system_name": helpText(
+		"Match focus, ignore, hide and show against system names too",
+		"System names are the names of functions as found in the binary,",
+		"such as mangled C++ names."),
 	"tagroot": helpText(
 		"Adds pseudo stack frames for labels key/value pairs at the callstack root.",
 		"A comma-separated list of label keys.",
@@ -213,10 +368,45 @@ var configHelp = map[string]string{
 	"taghide": helpText(
 		"Skip tags matching this regexp",
 		"Discard tags that match this regexp"),
+	"nodetagshow": helpText(
+		"Only show graph node tags matching this regexp",
+		"Matches the key:value name of label tags, and the formatted",
+		"value or the unit of numeric tags, eg 1kB. Samples are kept."),
+	"nodetaghide": helpText(
+		"Skip graph node tags matching this regexp",
+		"Matches the key:value name of label tags, and the formatted",
+		"value or the unit of numeric tags, eg 1kB. Samples are kept."),
+	"min_depth": helpText(
+		"Restricts to samples with at least this many frames",
+		"A value of 0 disables the lower bound.",
+		"See depth_inlines for how inlined frames are counted."),
+	"max_depth": helpText(
+		"Restricts to samples with at most this many frames",
+		"A value of 0 disables the upper bound.",
+		"See depth_inlines for how inlined frames are counted."),
+	"depth_inlines": helpText(
+		"Count inlined frames towards the stack depth",
+		"By default min_depth and max_depth count locations, so a location",
+		"with inlined calls counts as a single frame."),
+	"truncation_depth": helpText(
+		"Warn about samples with exactly this many locations",
+		"Such samples likely had their stacks truncated by the profiler,",
+		"making cum values too low. A value of 0 warns when the deepest",
+		"samples have a round depth such as 64 or 100; a negative value",
+		"disables the warning. The warning is shown once, when the profile",
+		"is loaded."),
 	// Heap profile options
 	"divide_by": helpText(
 		"Ratio to divide all samples before visualization",
 		"Divide all samples values by a constant, eg the number of processors or jobs."),
+	"compression": helpText(
+		"Gzip compression level of the proto and topproto outputs",
+		"From 0 (no compression) to 9 (best compression); -1 selects the",
+		"default level and -2 Huffman-only compression."),
+	"per_label": helpText(
+		"Divide all samples by the number of distinct values of a label",
+		"Normalizes values per value of the label with this key, eg per",
+		"request for profiles labeled with a request id."),
 	"mean": helpText(
 		"Average sample value over first value (count)",
 		"For memory profiles, report average memory per allocation.",
@@ -231,6 +421,9 @@ var configHelp = map[string]string{
 	// Data sorting criteria
 	"flat": helpText("Sort entries based on own weight"),
 	"cum":  helpText("Sort entries based on cumulative weight"),
+	"name": helpText(
+		"Sort entries alphabetically by name",
+		"Entries are still selected by weight; only their order changes."),
 
 	// Output granularity
 	"functions": helpText(
@@ -240,6 +433,9 @@ var configHelp = map[string]string{
 		"Aggregate at the function level.",
 		"Takes into account the filename where the function was defined."),
 	"files": "Aggregate at the file level.",
+	"dirs": helpText(
+		"Aggregate at the directory level.",
+		"Groups files by the directory containing them."),
 	"lines": "Aggregate at the source code line level.",
 	"addresses": helpText(
 		"Aggregate at the address level.",
@@ -247,8 +443,23 @@ var configHelp = map[string]string{
 	"noinlines": helpText(
 		"Ignore inlines.",
 		"Attributes inlined functions to their first out-of-line caller."),
+	"noinlines_leaf": helpText(
+		"Ignore inlines, but name frames after the innermost inlined function.",
+		"Attributes inlined functions to their first out-of-line caller, and",
+		"names the resulting frame \"leaf (inlined into caller)\"."),
 	"showcolumns": helpText(
 		"Show column numbers at the source code line level."),
+	"merge_functions": helpText(
+		"Merge the functions with the same name",
+		"Functions with the same name from different files or binaries are",
+		"reported as a single node, whatever the granularity, which only",
+		"applies to locations without a function name. Ignored by reports",
+		"on the binaries, such as list and disasm."),
+	"collapse_lambdas": helpText(
+		"Attribute anonymous functions to their enclosing function",
+		"Renames Go function literals such as pkg.Outer.func1, C++ and Java",
+		"lambdas and Rust closures after the named function they are",
+		"defined in, before aggregation, to keep graphs from fragmenting."),
 }
 
 func helpText(s ...string) string {
@@ -330,6 +541,10 @@ func listHelp(c string, redirect bool) string {
 		"Include functions matching func_regex, or including the address specified.",
 		"Include samples matching focus_regex, and exclude ignore_regex.",
 	}
+	if c == "disasm" {
+		h[0] = c + "<func_regex|address|start-end> [-focus_regex]* [-ignore_regex]*"
+		h = append(h, "An address range start-end, such as 0x1000-0x2000, restricts the listing to the instructions within it.")
+	}
 	if redirect {
 		h[0] += " >f"
 		h = append(h, "Optionally save the report on the file f")
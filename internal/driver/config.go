@@ -1,9 +1,12 @@
 package driver
 
 import (
+	"compress/gzip"
 	"fmt"
 	"net/url"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,28 +22,47 @@ type config struct {
 	// Display options.
 	CallTree            bool    `json:"call_tree,omitempty"`
 	RelativePercentages bool    `json:"relative_percentages,omitempty"`
+	PercentBase         string  `json:"percent_base,omitempty"`
 	Unit                string  `json:"unit,omitempty"`
 	CompactLabels       bool    `json:"compact_labels,omitempty"`
+	CommentsFirst       bool    `json:"comments_first,omitempty"`
 	SourcePath          string  `json:"-"`
 	TrimPath            string  `json:"-"`
+	SourceURL           string  `json:"source_url,omitempty"`
 	IntelSyntax         bool    `json:"intel_syntax,omitempty"`
+	SourceAsm           bool    `json:"source_asm,omitempty"`
+	TraceTimestamps     bool    `json:"trace_timestamps,omitempty"`
+	TraceMaxDepth       int     `json:"trace_max_depth,omitempty"`
+	Labels              string  `json:"labels,omitempty"`
+	TagsCum             bool    `json:"tags_cum,omitempty"`
+	Title               string  `json:"title,omitempty"`
 	Mean                bool    `json:"mean,omitempty"`
 	SampleIndex         string  `json:"-"`
 	DivideBy            float64 `json:"-"`
+	Compression         int     `json:"-"`
+	PerLabel            string  `json:"per_label,omitempty"`
 	Normalize           bool    `json:"normalize,omitempty"`
 	Sort                string  `json:"sort,omitempty"`
 
+	// Restrict the traces report to the samples of one thread.
+	Thread      string `json:"thread,omitempty"`
+	ThreadLabel string `json:"thread_label,omitempty"`
+
 	// Label pseudo stack frame generation options
 	TagRoot string `json:"tagroot,omitempty"`
 	TagLeaf string `json:"tagleaf,omitempty"`
 
 	// Filtering options
 	DropNegative bool    `json:"drop_negative,omitempty"`
+	Clamp        bool    `json:"clamp,omitempty"`
 	NodeCount    int     `json:"nodecount,omitempty"`
 	NodeFraction float64 `json:"nodefraction,omitempty"`
 	EdgeFraction float64 `json:"edgefraction,omitempty"`
 	Trim         bool    `json:"trim,omitempty"`
+	PathsTo      string  `json:"paths_to,omitempty"`
 	Focus        string  `json:"focus,omitempty"`
+	FocusLeaf    string  `json:"focus_leaf,omitempty"`
+	FocusBuildID string  `json:"focus_buildid,omitempty"`
 	Ignore       string  `json:"ignore,omitempty"`
 	PruneFrom    string  `json:"prune_from,omitempty"`
 	Hide         string  `json:"hide,omitempty"`
@@ -50,11 +72,72 @@ type config struct {
 	TagIgnore    string  `json:"tagignore,omitempty"`
 	TagShow      string  `json:"tagshow,omitempty"`
 	TagHide      string  `json:"taghide,omitempty"`
+	NodeTagShow  string  `json:"nodetagshow,omitempty"`
+	NodeTagHide  string  `json:"nodetaghide,omitempty"`
 	NoInlines    bool    `json:"noinlines,omitempty"`
 	ShowColumns  bool    `json:"showcolumns,omitempty"`
 
+	// Also match focus, ignore, hide and show against system names.
+	MatchSystemName bool `json:"match_system_name,omitempty"`
+
+	// Per-format overrides of NodeCount; zero means use NodeCount.
+	TextNodeCount  int `json:"text_nodecount,omitempty"`
+	GraphNodeCount int `json:"graph_nodecount,omitempty"`
+
+	DropAddressOnly bool `json:"drop_address_only,omitempty"`
+	StableDotIDs    bool `json:"stable_dot_ids,omitempty"`
+	HotPath         bool `json:"hot_path,omitempty"`
+	OtherNode       bool `json:"other_node,omitempty"`
+
+	// Direction of the layout of graphs.
+	RankDir string `json:"rankdir,omitempty"`
+
+	// Node values shown by the size and color of graph nodes.
+	NodeSize  string `json:"node_size,omitempty"`
+	NodeColor string `json:"node_color,omitempty"`
+
+	Concentration int `json:"concentration,omitempty"`
+
+	FlatOnly bool `json:"flat_only,omitempty"`
+
+	NoInlineLabels bool `json:"no_inline_labels,omitempty"`
+
+	// Add the values times the profile period to text reports.
+	EstimatedTotal bool `json:"estimated_total,omitempty"`
+
+	// Add the sample count differences with -diff_base to text reports.
+	SampleCountDiff bool `json:"sample_count_diff,omitempty"`
+
+	// List the samples of each node in the d3json output.
+	SampleIndices bool `json:"sample_indices,omitempty"`
+
+	// Numeric labels summed per node in text and graph reports.
+	LabelMetrics string `json:"label_metrics,omitempty"`
+
+	// Redaction of sensitive labels and function names.
+	Redact string `json:"redact,omitempty"`
+
+	// Stack depth filtering options
+	MinDepth     int  `json:"min_depth,omitempty"`
+	MaxDepth     int  `json:"max_depth,omitempty"`
+	DepthInlines bool `json:"depth_inlines,omitempty"`
+
+	// Stack depth at which samples are reported as likely truncated.
+	TruncationDepth int `json:"truncation_depth,omitempty"`
+
 	// Output granularity
-	Granularity string `json:"granularity,omitempty"`
+	Granularity   string `json:"granularity,omitempty"`
+	NoInlinesLeaf bool   `json:"noinlines_leaf,omitempty"`
+
+	// Merge the functions with the same name, whatever the granularity.
+	MergeFunctions bool `json:"merge_functions,omitempty"`
+
+	// Attribute anonymous functions to their enclosing named function.
+	CollapseLambdas bool `json:"collapse_lambdas,omitempty"`
+
+	// Labels added to report headers with -add_label. They are set from
+	// the command line only.
+	ExtraLabels []string `json:"-"`
 }
 
 // defaultConfig returns the default configuration values; it is unaffected by
@@ -67,6 +150,7 @@ func defaultConfig() config {
 		EdgeFraction: 0.001,
 		Trim:         true,
 		DivideBy:     1.0,
+		Compression:  gzip.DefaultCompression,
 		Sort:         "flat",
 		Granularity:  "", // Default depends on the display format
 	}
@@ -115,17 +199,18 @@ func init() {
 		"SampleIndex": "sample_index",
 
 		// Following fields are also not placed in URLs.
-		"Output":     "output",
-		"SourcePath": "source_path",
-		"TrimPath":   "trim_path",
-		"DivideBy":   "divide_by",
+		"Output":      "output",
+		"SourcePath":  "source_path",
+		"TrimPath":    "trim_path",
+		"DivideBy":    "divide_by",
+		"Compression": "compression",
 	}
 
 	// choices holds the list of allowed values for config fields that can
 	// take on one of a bounded set of values.
 	choices := map[string][]string{
-		"sort":        {"cum", "flat"},
-		"granularity": {"functions", "filefunctions", "files", "lines", "addresses"},
+		"sort":        {"cum", "flat", "name"},
+		"granularity": {"functions", "filefunctions", "files", "dirs", "lines", "addresses"},
 	}
 
 	// urlparam holds the mapping from a config field name to the URL
@@ -133,31 +218,72 @@ func init() {
 	// a name, the corresponding field is not saved in URLs.
 	urlparam := map[string]string{
 		"drop_negative":        "dropneg",
+		"clamp":                "clamp",
+		"drop_address_only":    "dropaddr",
 		"call_tree":            "calltree",
 		"relative_percentages": "rel",
+		"percent_base":         "pctbase",
 		"unit":                 "unit",
 		"compact_labels":       "compact",
+		"comments_first":       "comments",
 		"intel_syntax":         "intel",
+		"source_asm":           "sourceasm",
+		"trace_timestamps":     "tracets",
+		"trace_max_depth":      "tracemaxdepth",
+		"stable_dot_ids":       "stableids",
+		"hot_path":             "hotpath",
+		"other_node":           "other",
+		"rankdir":              "rankdir",
+		"node_size":            "nodesize",
+		"node_color":           "nodecolor",
+		"concentration":        "conc",
+		"flat_only":            "flatonly",
+		"no_inline_labels":     "noinlinelabels",
+		"estimated_total":      "esttotal",
+		"sample_count_diff":    "countdiff",
+		"sample_indices":       "sampleidx",
+		"label_metrics":        "labelmetrics",
+		"labels":               "labels",
+		"tags_cum":             "tagscum",
+		"title":                "title",
+		"source_url":           "srcurl",
 		"nodecount":            "n",
 		"nodefraction":         "nf",
 		"edgefraction":         "ef",
 		"trim":                 "trim",
+		"paths_to":             "pathsto",
 		"focus":                "f",
+		"focus_leaf":           "fleaf",
+		"focus_buildid":        "fbuildid",
 		"ignore":               "i",
 		"prune_from":           "prunefrom",
+		"redact":               "redact",
 		"hide":                 "h",
 		"show":                 "s",
 		"show_from":            "sf",
+		"match_system_name":    "sysname",
 		"tagfocus":             "tf",
 		"tagignore":            "ti",
 		"tagshow":              "ts",
 		"taghide":              "th",
+		"nodetagshow":          "nts",
+		"nodetaghide":          "nth",
+		"min_depth":            "mindepth",
+		"max_depth":            "maxdepth",
+		"depth_inlines":        "depthinlines",
+		"truncation_depth":     "truncdepth",
 		"mean":                 "mean",
 		"sample_index":         "si",
+		"per_label":            "perlabel",
+		"thread":               "thread",
+		"thread_label":         "threadlabel",
 		"normalize":            "norm",
 		"sort":                 "sort",
 		"granularity":          "g",
 		"noinlines":            "noinlines",
+		"noinlines_leaf":       "noinlinesleaf",
+		"merge_functions":      "mergefuncs",
+		"collapse_lambdas":     "collapselambdas",
 		"showcolumns":          "showcolumns",
 	}
 
@@ -320,6 +446,7 @@ func (cfg *config) resetTransient() {
 	cfg.SourcePath = current.SourcePath
 	cfg.TrimPath = current.TrimPath
 	cfg.DivideBy = current.DivideBy
+	cfg.Compression = current.Compression
 	cfg.SampleIndex = current.SampleIndex
 }
 
@@ -371,3 +498,33 @@ func (cfg *config) makeURL(initialURL url.URL) (url.URL, bool) {
 	}
 	return initialURL, changed
 }
+
+// flags returns the command line flags that reproduce cfg, sorted by name.
+// A field with a set of choices, such as granularity, is given by the flag
+// of its value, and omitted when it has none. Values are quoted for a
+// POSIX shell when needed.
+func (cfg *config) flags() []string {
+	var flags []string
+	for _, f := range configFields {
+		v := cfg.get(f)
+		if len(f.choices) > 0 {
+			if v != "" {
+				flags = append(flags, "-"+v)
+			}
+			continue
+		}
+		flags = append(flags, "-"+f.name+"="+shellQuote(v))
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+var shellSafeRx = regexp.MustCompile(`^[-\w./:=,+@%]+$`)
+
+// shellQuote quotes s as a single word for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if shellSafeRx.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -19,15 +19,23 @@ package driver
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/pprof/internal/graph"
 	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/report"
+	"github.com/google/pprof/internal/symbolizer"
 	"github.com/google/pprof/profile"
 )
 
@@ -45,13 +53,30 @@ func PProf(eo *plugin.Options) error {
 		return err
 	}
 
-	p, err := fetchProfiles(src, o)
+	if src.PrintConfig {
+		return printConfig(os.Stdout, currentConfig())
+	}
+
+	ctx := context.Background()
+	if src.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, src.Deadline)
+		defer cancel()
+	}
+
+	p, err := fetchProfiles(ctx, src, o)
 	if err != nil {
-		return err
+		return deadlineError(err, src.Deadline)
+	}
+	// Warn once, not with each report of the interactive modes.
+	warnTruncatedStacks(p, currentConfig().TruncationDepth, o.UI)
+
+	if src.CompareSymbols != nil {
+		return compareSymbols(os.Stdout, p, src.CompareSymbols, o.Obj)
 	}
 
 	if cmd != nil {
-		return generateReport(p, cmd, currentConfig(), o)
+		return deadlineError(generateReport(ctx, p, cmd, currentConfig(), o), src.Deadline)
 	}
 
 	if src.HTTPHostport != "" {
@@ -60,6 +85,22 @@ func PProf(eo *plugin.Options) error {
 	return interactive(p, o)
 }
 
+// printConfig writes cfg to w as command line flags, one per line, so
+// that the output can be redirected to a script.
+func printConfig(w io.Writer, cfg config) error {
+	_, err := fmt.Fprintln(w, strings.Join(cfg.flags(), " \\\n"))
+	return err
+}
+
+// deadlineError returns err, explaining it if it is caused by exceeding
+// the deadline d.
+func deadlineError(err error, d time.Duration) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("aborted after exceeding the deadline of %v", d)
+	}
+	return err
+}
+
 // generateRawReport is allowed to modify p.
 func generateRawReport(p *profile.Profile, cmd []string, cfg config, o *plugin.Options) (*command, *report.Report, error) {
 	// Identify units of numeric tags in profile.
@@ -73,6 +114,19 @@ func generateRawReport(p *profile.Profile, cmd []string, cfg config, o *plugin.O
 
 	cfg = applyCommandOverrides(cmd[0], c.format, cfg)
 
+	// Redact before anything else so that no later stage, including the
+	// label pseudo nodes, can expose the sensitive data.
+	if err := redact(p, cfg.Redact); err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Clamp {
+		// The negated base of a comparison must be subtracted from the
+		// current samples before they are clamped, or it would be dropped.
+		mergeDiffBase(p)
+		p.ClampNonNegative()
+	}
+
 	// Create label pseudo nodes before filtering, in case the filters use
 	// the generated nodes.
 	generateTagRootsLeaves(p, cfg, o.UI)
@@ -89,7 +143,24 @@ func generateRawReport(p *profile.Profile, cmd []string, cfg config, o *plugin.O
 		return nil, nil, err
 	}
 	ropt.OutputFormat = c.format
-	if len(cmd) == 2 {
+	if o.NodeKey != nil {
+		ropt.KeyFunc = func(info graph.NodeInfo, s *profile.Sample) string {
+			return o.NodeKey(plugin.Frame{
+				Func:      info.Name,
+				File:      info.File,
+				Line:      info.Lineno,
+				Column:    info.Columnno,
+				StartLine: info.StartLine,
+			}, s)
+		}
+	}
+	if len(cmd) == 2 && c.format == report.Sample {
+		n, err := strconv.Atoi(cmd[1])
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("parsing argument sample index %s: want a non-negative integer", cmd[1])
+		}
+		ropt.SampleNumber = n
+	} else if len(cmd) == 2 {
 		s, err := regexp.Compile(cmd[1])
 		if err != nil {
 			return nil, nil, fmt.Errorf("parsing argument regexp %s: %v", cmd[1], err)
@@ -110,8 +181,27 @@ func generateRawReport(p *profile.Profile, cmd []string, cfg config, o *plugin.O
 	return c, rpt, nil
 }
 
-// generateReport is allowed to modify p.
-func generateReport(p *profile.Profile, cmd []string, cfg config, o *plugin.Options) error {
+// mergeDiffBase merges the samples of the base profile of a comparison
+// into the matching samples of p, leaving their differences.
+func mergeDiffBase(p *profile.Profile) {
+	hasBase := false
+	for _, s := range p.Sample {
+		hasBase = hasBase || s.DiffBaseSample()
+	}
+	if !hasBase {
+		return
+	}
+	p.RemoveLabel("pprof::base")
+	c := p.Compact()
+	if c == nil {
+		return
+	}
+	p.Sample, p.Location, p.Function, p.Mapping = c.Sample, c.Location, c.Function, c.Mapping
+}
+
+// generateReport is allowed to modify p. It stops building the report
+// once ctx is done.
+func generateReport(ctx context.Context, p *profile.Profile, cmd []string, cfg config, o *plugin.Options) error {
 	c, rpt, err := generateRawReport(p, cmd, cfg, o)
 	if err != nil {
 		return err
@@ -123,12 +213,23 @@ func generateReport(p *profile.Profile, cmd []string, cfg config, o *plugin.Opti
 	case report.WebList:
 		// We need template expansion, so generate here instead of in report.
 		err = printWebList(dst, rpt, o.Obj)
+	case report.FlameGraph:
+		err = printFlameGraphHTML(dst, rpt)
+	case report.SQLite:
+		err = printSQLite(ctx, dst, rpt)
 	default:
-		err = report.Generate(dst, rpt, o.Obj)
+		err = report.Generate(ctx, dst, rpt, o.Obj)
 	}
 	if err != nil {
 		return err
 	}
+	// The report is incomplete if it was aborted by the context.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, w := range rpt.Warnings() {
+		o.UI.PrintErr(w)
+	}
 	src := dst
 
 	// If necessary, perform any data post-processing.
@@ -175,6 +276,48 @@ func printWebList(dst io.Writer, rpt *report.Report, obj plugin.ObjTool) error {
 	})
 }
 
+// compareSymbols symbolizes the addresses of the main binary of p with
+// the two binaries and prints the addresses that resolve to different
+// functions.
+func compareSymbols(w io.Writer, p *profile.Profile, binaries []string, obj plugin.ObjTool) error {
+	if len(p.Mapping) == 0 {
+		return fmt.Errorf("profile has no mappings to compare symbols for")
+	}
+	m := p.Mapping[0]
+	var addrs []uint64
+	seen := make(map[uint64]bool)
+	for _, l := range p.Location {
+		if l.Mapping == m && !seen[l.Address] {
+			seen[l.Address] = true
+			addrs = append(addrs, l.Address)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var names [2][][]string
+	for i, name := range binaries {
+		f, err := obj.Open(name, m.Start, m.Limit, m.Offset, m.KernelRelocationSymbol)
+		if err != nil {
+			return fmt.Errorf("opening %s: %v", name, err)
+		}
+		names[i] = symbolizer.FunctionNames(f, addrs)
+		f.Close()
+	}
+	diffs := report.DiffSymbols(addrs, names[0], names[1])
+	report.PrintSymbolDiff(w, diffs, len(addrs), binaries[0], binaries[1])
+	return nil
+}
+
+// printFlameGraphHTML writes a self-contained HTML flame graph of the
+// stacks of rpt.
+func printFlameGraphHTML(dst io.Writer, rpt *report.Report) error {
+	stacks := rpt.Stacks()
+	return renderHTML(dst, "flamegraph_html", rpt, nil, stacks.Legend(), webArgs{
+		Standalone: true,
+		Folded:     stacks.Folded(),
+	})
+}
+
 func applyCommandOverrides(cmd string, outputFormat int, cfg config) config {
 	// Some report types override the trim flag to false below. This is to make
 	// sure the default heuristics of excluding insignificant nodes and edges
@@ -196,29 +339,66 @@ func applyCommandOverrides(cmd string, outputFormat int, cfg config) config {
 		// This is because the merge is done by address and in case of an inlined
 		// stack each of the inlined entries is a separate callgraph node.
 		cfg.NoInlines = true
+		cfg.NoInlinesLeaf = false
 	case "weblist":
 		trim = false
 		cfg.Granularity = "addresses"
 		cfg.NoInlines = false // Need inline info to support call expansion
+		cfg.NoInlinesLeaf = false
 	case "peek":
 		trim = false
+	case "sample", "ndjson":
+		// Keep every frame of the stacks, with their addresses.
+		trim = false
+		cfg.Granularity = "addresses"
+		cfg.NoInlines = false
+		cfg.NoInlinesLeaf = false
+	case "flamegraph_html":
+		// Same settings as the flame graph of the web interface.
+		trim = false
+		if cfg.Granularity == "" {
+			cfg.Granularity = "filefunctions"
+		}
+	case "coverage":
+		// Keep the addresses of the samples to find the end of their
+		// functions in the binaries.
+		trim = false
+		cfg.Granularity = "addresses"
 	case "list":
 		trim = false
 		cfg.Granularity = "lines"
 		// Do not force 'noinlines' to be false so that specifying
 		// "-list foo -noinlines" is supported and works as expected.
+		if cfg.SourceAsm {
+			// Same settings as weblist, which shows the same annotations.
+			cfg.Granularity = "addresses"
+			cfg.NoInlines = false
+			cfg.NoInlinesLeaf = false
+		}
+	case "prometheus":
+		// A series per function, for all the functions by default.
+		cfg.Granularity = "functions"
+		if cfg.NodeCount == -1 {
+			cfg.NodeCount = 0
+		}
 	case "text", "top", "topproto":
+		if cfg.TextNodeCount > 0 {
+			cfg.NodeCount = cfg.TextNodeCount
+		}
 		if cfg.NodeCount == -1 {
 			cfg.NodeCount = 0
 		}
 	default:
+		if outputFormat == report.Dot && cfg.GraphNodeCount > 0 {
+			cfg.NodeCount = cfg.GraphNodeCount
+		}
 		if cfg.NodeCount == -1 {
 			cfg.NodeCount = 80
 		}
 	}
 
 	switch outputFormat {
-	case report.Proto, report.Raw, report.Callgrind:
+	case report.Proto, report.Raw, report.Sizes, report.Callgrind:
 		trim = false
 		cfg.Granularity = "addresses"
 	}
@@ -250,9 +430,111 @@ func dropEmptyStrings(in []string) (out []string) {
 	return
 }
 
+// redactedName replaces the names of functions removed by redact.
+const redactedName = "[redacted]"
+
+// redact drops the samples having a string label whose key=value form
+// matches the regexp expr, and replaces the name, system name and file
+// name of every function whose name matches it. The stack structure of
+// the remaining samples is preserved.
+func redact(p *profile.Profile, expr string) error {
+	rx, err := compileRegexOption("redact", expr, nil)
+	if err != nil || rx == nil {
+		return err
+	}
+	var samples []*profile.Sample
+	for _, s := range p.Sample {
+		if !labelsMatch(s, rx) {
+			samples = append(samples, s)
+		}
+	}
+	p.Sample = samples
+	for _, f := range p.Function {
+		if rx.MatchString(f.Name) || rx.MatchString(f.SystemName) {
+			f.Name, f.SystemName, f.Filename = redactedName, redactedName, ""
+		}
+	}
+	return nil
+}
+
+// warnTruncatedStacks warns about the samples of p whose stacks have
+// exactly limit locations, as profilers that cap the stack depth leave
+// such samples with their outermost frames missing. If limit is 0, the
+// depth of the deepest samples is used when it is a round number. A
+// negative limit disables the check.
+func warnTruncatedStacks(p *profile.Profile, limit int, ui plugin.UI) {
+	if limit < 0 || len(p.Sample) == 0 {
+		return
+	}
+	if limit == 0 {
+		for _, s := range p.Sample {
+			limit = max(limit, len(s.Location))
+		}
+		if !isRoundDepth(limit) {
+			return
+		}
+	}
+	var count int
+	for _, s := range p.Sample {
+		if len(s.Location) == limit {
+			count++
+		}
+	}
+	if count > 0 {
+		ui.PrintErr(fmt.Sprintf("%d of %d samples have a stack of exactly %d locations and may be truncated; cum values may be underestimated", count, len(p.Sample), limit))
+	}
+}
+
+// isRoundDepth reports whether a stack depth is a typical limit of a
+// profiler: a power of two or a multiple of 100, of at least 32.
+func isRoundDepth(depth int) bool {
+	return depth >= 32 && (depth&(depth-1) == 0 || depth%100 == 0)
+}
+
+// labelsMatch reports whether a string label of s matches rx in its
+// key=value form.
+func labelsMatch(s *profile.Sample, rx *regexp.Regexp) bool {
+	for key, vals := range s.Label {
+		for _, val := range vals {
+			if rx.MatchString(key + "=" + val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasWindowsMappings reports whether the profile was collected on
+// Windows, judging from the file names of its mappings, which are then
+// case insensitive regardless of the system pprof runs on.
+func hasWindowsMappings(p *profile.Profile) bool {
+	for _, m := range p.Mapping {
+		f := strings.ToLower(m.File)
+		switch {
+		case len(f) >= 3 && 'a' <= f[0] && f[0] <= 'z' && f[1] == ':' && (f[2] == '\\' || f[2] == '/'):
+			// A drive letter.
+			return true
+		case strings.HasPrefix(f, `\\`):
+			// A UNC path.
+			return true
+		case strings.HasSuffix(f, ".exe") || strings.HasSuffix(f, ".dll"):
+			return true
+		}
+	}
+	return false
+}
+
 func aggregate(prof *profile.Profile, cfg config) error {
 	var function, filename, linenumber, address bool
-	inlines := !cfg.NoInlines
+	if cfg.CollapseLambdas {
+		prof.CollapseAnonymousFunctions()
+	}
+	inlines := !cfg.NoInlines && !cfg.NoInlinesLeaf
+	if cfg.NoInlinesLeaf {
+		if err := prof.NameInlinesByLeaf(); err != nil {
+			return err
+		}
+	}
 	switch cfg.Granularity {
 	case "":
 		function = true // Default granularity is "functions"
@@ -270,6 +552,9 @@ func aggregate(prof *profile.Profile, cfg config) error {
 		linenumber = true
 	case "files":
 		filename = true
+	case "dirs":
+		filename = true
+		filenamesToDirs(prof)
 	case "functions":
 		function = true
 	case "filefunctions":
@@ -281,6 +566,22 @@ func aggregate(prof *profile.Profile, cfg config) error {
 	return prof.Aggregate(inlines, function, filename, linenumber, cfg.ShowColumns, address)
 }
 
+// unknownDir names the directory of functions without a file name when
+// aggregating by directory.
+const unknownDir = "(unknown)"
+
+// filenamesToDirs replaces the file name of every function by its
+// directory, so that aggregating by file name groups them by directory.
+func filenamesToDirs(prof *profile.Profile) {
+	for _, f := range prof.Function {
+		if f.Filename == "" {
+			f.Filename = unknownDir
+			continue
+		}
+		f.Filename = filepath.Dir(f.Filename)
+	}
+}
+
 func reportOptions(p *profile.Profile, numLabelUnits map[string]string, cfg config) (*report.Options, error) {
 	si, mean := cfg.SampleIndex, cfg.Mean
 	value, meanDiv, sample, err := sampleFormat(p, si, mean)
@@ -293,9 +594,29 @@ func reportOptions(p *profile.Profile, numLabelUnits map[string]string, cfg conf
 		stype = "mean_" + stype
 	}
 
+	// For contention profiles showing delay, also show the mean delay per
+	// contention if the profile records the number of contentions.
+	var contentionCount sampleValueFunc
+	if !mean && sample.Type == "delay" {
+		if ix, err := p.SampleIndexByName("contentions"); err == nil {
+			contentionCount = valueExtractor(ix)
+		}
+	}
+
 	if cfg.DivideBy == 0 {
 		return nil, fmt.Errorf("zero divisor specified")
 	}
+	if cfg.Compression < gzip.HuffmanOnly || cfg.Compression > gzip.BestCompression {
+		return nil, fmt.Errorf("compression level %d is not between %d and %d", cfg.Compression, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	ratio := 1 / cfg.DivideBy
+	var perLabelCount int
+	if cfg.PerLabel != "" {
+		if perLabelCount = distinctLabelValues(p, cfg.PerLabel); perLabelCount == 0 {
+			return nil, fmt.Errorf("per_label: no samples have a %q label", cfg.PerLabel)
+		}
+		ratio /= float64(perLabelCount)
+	}
 
 	var filters []string
 	addFilter := func(k string, v string) {
@@ -304,6 +625,7 @@ func reportOptions(p *profile.Profile, numLabelUnits map[string]string, cfg conf
 		}
 	}
 	addFilter("focus", cfg.Focus)
+	addFilter("focus_leaf", cfg.FocusLeaf)
 	addFilter("ignore", cfg.Ignore)
 	addFilter("hide", cfg.Hide)
 	addFilter("show", cfg.Show)
@@ -312,14 +634,43 @@ func reportOptions(p *profile.Profile, numLabelUnits map[string]string, cfg conf
 	addFilter("tagignore", cfg.TagIgnore)
 	addFilter("tagshow", cfg.TagShow)
 	addFilter("taghide", cfg.TagHide)
+	addFilter("nodetagshow", cfg.NodeTagShow)
+	addFilter("nodetaghide", cfg.NodeTagHide)
 
 	ropt := &report.Options{
 		CumSort:      cfg.Sort == "cum",
+		NameSort:     cfg.Sort == "name",
 		CallTree:     cfg.CallTree,
 		DropNegative: cfg.DropNegative,
 
+		MergeFunctionNames: cfg.MergeFunctions,
+
+		DropAddressOnly: cfg.DropAddressOnly,
+		FoldMappingCase: hasWindowsMappings(p),
+		TraceTimestamps: cfg.TraceTimestamps,
+		TraceMaxDepth:   cfg.TraceMaxDepth,
+		StableDotIDs:    cfg.StableDotIDs,
+		HotPath:         cfg.HotPath,
+		OtherNode:       cfg.OtherNode,
+		Concentration:   cfg.Concentration,
+		SampleIndices:   cfg.SampleIndices,
+
+		LabelKeys:    dropEmptyStrings(strings.Split(cfg.Labels, ",")),
+		LabelMetrics: dropEmptyStrings(strings.Split(cfg.LabelMetrics, ",")),
+		TagsCum:      cfg.TagsCum,
+
+		Thread:      cfg.Thread,
+		ThreadLabel: cfg.ThreadLabel,
+
 		CompactLabels: cfg.CompactLabels,
-		Ratio:         1 / cfg.DivideBy,
+		CommentsFirst: cfg.CommentsFirst,
+		FlatOnly:      cfg.FlatOnly,
+		Ratio:         ratio,
+
+		NoInlineLabels: cfg.NoInlineLabels,
+		EstimatedTotal: cfg.EstimatedTotal,
+
+		SampleCountDiff: cfg.SampleCountDiff,
 
 		NodeCount:    cfg.NodeCount,
 		NodeFraction: cfg.NodeFraction,
@@ -330,24 +681,101 @@ func reportOptions(p *profile.Profile, numLabelUnits map[string]string, cfg conf
 
 		SampleValue:       value,
 		SampleMeanDivisor: meanDiv,
+		ContentionCount:   contentionCount,
 		SampleType:        stype,
 		SampleUnit:        sample.Unit,
 
 		OutputUnit: cfg.Unit,
 
-		SourcePath: cfg.SourcePath,
-		TrimPath:   cfg.TrimPath,
+		SourcePath:        cfg.SourcePath,
+		TrimPath:          cfg.TrimPath,
+		SourceURLTemplate: cfg.SourceURL,
 
 		IntelSyntax: cfg.IntelSyntax,
+		SourceAsm:   cfg.SourceAsm,
+	}
+
+	if cfg.Compression != gzip.DefaultCompression {
+		level := cfg.Compression
+		ropt.Compression = &level
+	}
+
+	if cfg.PercentBase != "" {
+		rx, err := regexp.Compile(cfg.PercentBase)
+		if err != nil {
+			return nil, fmt.Errorf("parsing percent_base regexp %s: %v", cfg.PercentBase, err)
+		}
+		ropt.PercentBase = rx
+	}
+
+	ropt.NodeTagShow, err = compileRegexOption("nodetagshow", cfg.NodeTagShow, nil)
+	ropt.NodeTagHide, err = compileRegexOption("nodetaghide", cfg.NodeTagHide, err)
+	ropt.PathsTo, err = compileRegexOption("paths_to", cfg.PathsTo, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if ropt.RankDir, err = rankDir(cfg.RankDir); err != nil {
+		return nil, err
+	}
+	if ropt.NodeSize, err = nodeMetric("node_size", cfg.NodeSize); err != nil {
+		return nil, err
+	}
+	if ropt.NodeColor, err = nodeMetric("node_color", cfg.NodeColor); err != nil {
+		return nil, err
 	}
 
 	if len(p.Mapping) > 0 && p.Mapping[0].File != "" {
 		ropt.Title = filepath.Base(p.Mapping[0].File)
 	}
+	if cfg.Title != "" {
+		// Unlike the default title, a title set by the user is also shown
+		// in the report headers.
+		ropt.Title = cfg.Title
+		ropt.ExtraLabels = append(ropt.ExtraLabels, "Title: "+cfg.Title)
+	}
+	if perLabelCount > 0 {
+		ropt.ExtraLabels = append(ropt.ExtraLabels, fmt.Sprintf("Per %s: values divided by %d distinct values", cfg.PerLabel, perLabelCount))
+	}
+	ropt.ExtraLabels = append(ropt.ExtraLabels, cfg.ExtraLabels...)
 
 	return ropt, nil
 }
 
+// distinctLabelValues returns the number of distinct values of the
+// string label key in the samples of p.
+func distinctLabelValues(p *profile.Profile, key string) int {
+	values := make(map[string]bool)
+	for _, s := range p.Sample {
+		for _, v := range s.Label[key] {
+			values[v] = true
+		}
+	}
+	return len(values)
+}
+
+// nodeMetric parses the value of the graph node metric option name.
+func nodeMetric(name, value string) (graph.NodeMetric, error) {
+	switch value {
+	case "":
+		return graph.DefaultMetric, nil
+	case "flat":
+		return graph.FlatMetric, nil
+	case "cum":
+		return graph.CumMetric, nil
+	}
+	return 0, fmt.Errorf("invalid %s %q: want flat or cum", name, value)
+}
+
+// rankDir parses the value of the rankdir option, ignoring case.
+func rankDir(value string) (string, error) {
+	switch dir := strings.ToUpper(value); dir {
+	case "", "TB", "LR", "BT", "RL":
+		return dir, nil
+	}
+	return "", fmt.Errorf("invalid rankdir %q: want TB, LR, BT or RL", value)
+}
+
 // identifyNumLabelUnits returns a map of numeric label keys to the units
 // associated with those keys.
 func identifyNumLabelUnits(p *profile.Profile, ui plugin.UI) map[string]string {
@@ -30,6 +30,7 @@ var tagFilterRangeRx = regexp.MustCompile("([+-]?[[:digit:]]+)([[:alpha:]]+)?")
 // applyFocus filters samples based on the focus/ignore options
 func applyFocus(prof *profile.Profile, numLabelUnits map[string]string, cfg config, ui plugin.UI) error {
 	focus, err := compileRegexOption("focus", cfg.Focus, nil)
+	focusleaf, err := compileRegexOption("focus_leaf", cfg.FocusLeaf, err)
 	ignore, err := compileRegexOption("ignore", cfg.Ignore, err)
 	hide, err := compileRegexOption("hide", cfg.Hide, err)
 	show, err := compileRegexOption("show", cfg.Show, err)
@@ -41,19 +42,39 @@ func applyFocus(prof *profile.Profile, numLabelUnits map[string]string, cfg conf
 		return err
 	}
 
-	fm, im, hm, hnm := prof.FilterSamplesByName(focus, ignore, hide, show)
+	filterByName := prof.FilterSamplesByName
+	if cfg.MatchSystemName {
+		filterByName = prof.FilterSamplesByAnyName
+	}
+	fm, im, hm, hnm := filterByName(focus, ignore, hide, show)
 	warnNoMatches(focus == nil || fm, "Focus", ui)
 	warnNoMatches(ignore == nil || im, "Ignore", ui)
 	warnNoMatches(hide == nil || hm, "Hide", ui)
 	warnNoMatches(show == nil || hnm, "Show", ui)
 
+	flm := prof.FilterSamplesByLeaf(focusleaf, cfg.MatchSystemName)
+	warnNoMatches(focusleaf == nil || flm, "FocusLeaf", ui)
+
 	sfm := prof.ShowFrom(showfrom)
 	warnNoMatches(showfrom == nil || sfm, "ShowFrom", ui)
 
+	if cfg.FocusBuildID != "" {
+		bm := prof.FilterSamplesByBuildID(cfg.FocusBuildID)
+		warnNoMatches(bm, "FocusBuildID", ui)
+	}
+
 	tfm, tim := prof.FilterSamplesByTag(tagfocus, tagignore)
 	warnNoMatches(tagfocus == nil || tfm, "TagFocus", ui)
 	warnNoMatches(tagignore == nil || tim, "TagIgnore", ui)
 
+	if cfg.MinDepth > 0 || cfg.MaxDepth > 0 {
+		if cfg.MaxDepth > 0 && cfg.MinDepth > cfg.MaxDepth {
+			return fmt.Errorf("min_depth %d is greater than max_depth %d", cfg.MinDepth, cfg.MaxDepth)
+		}
+		dm := filterSamplesByDepth(prof, cfg.MinDepth, cfg.MaxDepth, cfg.DepthInlines)
+		warnNoMatches(dm, "Depth", ui)
+	}
+
 	tagshow, err := compileRegexOption("tagshow", cfg.TagShow, err)
 	taghide, err := compileRegexOption("taghide", cfg.TagHide, err)
 	tns, tnh := prof.FilterTagsByName(tagshow, taghide)
@@ -66,6 +87,29 @@ func applyFocus(prof *profile.Profile, numLabelUnits map[string]string, cfg conf
 	return err
 }
 
+// filterSamplesByDepth keeps only the samples whose stack depth is within
+// [minDepth, maxDepth], where a zero bound is ignored. The depth counts
+// locations, or individual inlined frames if inlines is set. It reports
+// whether any sample was kept.
+func filterSamplesByDepth(prof *profile.Profile, minDepth, maxDepth int, inlines bool) bool {
+	var samples []*profile.Sample
+	for _, s := range prof.Sample {
+		depth := len(s.Location)
+		if inlines {
+			depth = 0
+			for _, l := range s.Location {
+				depth += max(len(l.Line), 1)
+			}
+		}
+		if (minDepth > 0 && depth < minDepth) || (maxDepth > 0 && depth > maxDepth) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	prof.Sample = samples
+	return len(samples) > 0
+}
+
 func compileRegexOption(name, value string, err error) (*regexp.Regexp, error) {
 	if value == "" || err != nil {
 		return nil, err
@@ -16,14 +16,21 @@ package driver
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -31,6 +38,8 @@ import (
 
 	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/internal/report"
+	"github.com/google/pprof/internal/symbolizer"
 	"github.com/google/pprof/internal/symbolz"
 	"github.com/google/pprof/profile"
 )
@@ -57,6 +66,7 @@ func TestParse(t *testing.T) {
 		{"text,addresses,noinlines,flat", "cpu"},
 		{"tree,addresses,flat,nodecount=4", "cpusmall"},
 		{"text,functions,flat,nodecount=5,call_tree", "unknown"},
+		{"text,functions,cum,flat_only", "cpu"},
 		{"text,alloc_objects,flat", "heap_alloc"},
 		{"text,files,flat", "heap"},
 		{"text,files,flat,focus=[12]00,taghide=[X3]00", "heap"},
@@ -108,7 +118,7 @@ func TestParse(t *testing.T) {
 			// Reset config before processing
 			setCurrentConfig(baseConfig)
 
-			testUI := &proftest.TestUI{T: t, AllowRx: "Generating report in|Ignoring local file|expression matched no samples|Interpreted .* as range, not regexp"}
+			testUI := &proftest.TestUI{T: t, AllowRx: "Generating report in|Ignoring local file|expression matched no samples|Interpreted .* as range, not regexp|values were truncated"}
 
 			f := baseFlags()
 			f.args = []string{tc.source}
@@ -268,6 +278,7 @@ func solutionFilename(source string, f *testFlags) string {
 	name = addString(name, f, []string{"relative_percentages"})
 	name = addString(name, f, []string{"seconds"})
 	name = addString(name, f, []string{"call_tree"})
+	name = addString(name, f, []string{"flat_only"})
 	name = addString(name, f, []string{"text", "tree", "callgrind", "dot", "svg", "tags", "dot", "traces", "disasm", "peek", "weblist", "topproto", "comments"})
 	if f.strings["focus"] != "" || f.strings["tagfocus"] != "" {
 		name = append(name, "focus")
@@ -345,6 +356,9 @@ func (f testFlags) StringList(s, d, c string) *[]*string {
 		}
 		return &tp
 	}
+	if t, ok := f.strings[s]; ok {
+		return &[]*string{&t}
+	}
 	return &[]*string{}
 }
 
@@ -1153,6 +1167,78 @@ func TestTagFilter(t *testing.T) {
 	}
 }
 
+func TestFilterSamplesByDepth(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "f"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	inl := &profile.Location{ID: 2, Line: []profile.Line{{Function: fn}, {Function: fn}, {Function: fn}}}
+	newProfile := func() *profile.Profile {
+		return &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+			Sample: []*profile.Sample{
+				{Value: []int64{1}, Location: []*profile.Location{loc}},
+				{Value: []int64{2}, Location: []*profile.Location{loc, loc}},
+				{Value: []int64{3}, Location: []*profile.Location{inl, loc}},
+				{Value: []int64{4}, Location: []*profile.Location{loc, loc, loc, loc}},
+			},
+			Location: []*profile.Location{loc, inl},
+			Function: []*profile.Function{fn},
+		}
+	}
+	for _, tc := range []struct {
+		desc               string
+		minDepth, maxDepth int
+		inlines            bool
+		want               []int64
+	}{
+		{"no bounds", 0, 0, false, []int64{1, 2, 3, 4}},
+		{"min only", 2, 0, false, []int64{2, 3, 4}},
+		{"max only", 0, 2, false, []int64{1, 2, 3}},
+		{"exact depth", 2, 2, false, []int64{2, 3}},
+		{"exact depth with inlines", 2, 2, true, []int64{2}},
+		{"min with inlines", 4, 0, true, []int64{3, 4}},
+		{"no match", 5, 0, false, nil},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := newProfile()
+			matched := filterSamplesByDepth(p, tc.minDepth, tc.maxDepth, tc.inlines)
+			var got []int64
+			for _, s := range p.Sample {
+				got = append(got, s.Value[0])
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("kept samples %v, want %v", got, tc.want)
+			}
+			if want := len(tc.want) > 0; matched != want {
+				t.Errorf("matched = %v, want %v", matched, want)
+			}
+		})
+	}
+}
+
+func TestFocusBuildID(t *testing.T) {
+	m1 := &profile.Mapping{ID: 1, File: "lib.so", BuildID: "abcd"}
+	m2 := &profile.Mapping{ID: 2, File: "lib.so", BuildID: "ef01"}
+	loc1 := &profile.Location{ID: 1, Mapping: m1}
+	loc2 := &profile.Location{ID: 2, Mapping: m2}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Value: []int64{1}, Location: []*profile.Location{loc1}},
+			{Value: []int64{2}, Location: []*profile.Location{loc2}},
+		},
+		Location: []*profile.Location{loc1, loc2},
+		Mapping:  []*profile.Mapping{m1, m2},
+	}
+	cfg := currentConfig()
+	cfg.FocusBuildID = "EF"
+	if err := applyFocus(p, nil, cfg, &proftest.TestUI{T: t}); err != nil {
+		t.Fatalf("applyFocus: %v", err)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].Value[0] != 2 {
+		t.Errorf("applyFocus with focus_buildid=%s: got samples %v, want the sample of build ID ef01", cfg.FocusBuildID, p.Sample)
+	}
+}
+
 func TestIdentifyNumLabelUnits(t *testing.T) {
 	var tagFilterTests = []struct {
 		desc               string
@@ -1568,7 +1654,7 @@ func TestSymbolzAfterMerge(t *testing.T) {
 
 	o.Fetch = testSymbolzMergeFetcher{}
 	o.Sym = testSymbolzSymbolizer{}
-	p, err := fetchProfiles(src, o)
+	p, err := fetchProfiles(context.Background(), src, o)
 	if err != nil {
 		t.Fatalf("fetchProfiles: %v", err)
 	}
@@ -1753,3 +1839,1194 @@ func (m *mockFile) Symbols(r *regexp.Regexp, addr uint64) ([]*plugin.Sym, error)
 func (*mockFile) Close() error {
 	return nil
 }
+
+func TestContentionMean(t *testing.T) {
+	f, err := os.Open("testdata/cppbench.contention")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	textItems := func(p *profile.Profile, cfg config) ([]report.TextItem, *report.Options) {
+		t.Helper()
+		ropt, err := reportOptions(p, nil, cfg)
+		if err != nil {
+			t.Fatalf("reportOptions: %v", err)
+		}
+		ropt.OutputFormat = report.Text
+		items, _ := report.TextItems(context.Background(), report.New(p.Copy(), ropt))
+		return items, ropt
+	}
+
+	cfg := currentConfig()
+	cfg.Unit = "ns"
+	items, ropt := textItems(prof, cfg)
+	if ropt.ContentionCount == nil {
+		t.Fatal("got no contention count for a contention profile showing delay")
+	}
+	cfg.SampleIndex = "contentions"
+	countItems, _ := textItems(prof, cfg)
+	counts := make(map[string]int64)
+	for _, item := range countItems {
+		counts[item.Name] = item.Cum
+	}
+	var checked int
+	for _, item := range items {
+		c, ok := counts[item.Name]
+		if !ok || c == 0 {
+			continue
+		}
+		if want := fmt.Sprintf("%dns", item.Cum/c); item.MeanFormat != want {
+			t.Errorf("%s: got mean %q, want %q", item.Name, item.MeanFormat, want)
+		}
+		checked++
+	}
+	if checked == 0 {
+		t.Error("no nodes with a mean delay")
+	}
+
+	// No mean column when showing contentions, with -mean, or when the
+	// profile has no contention counts.
+	if _, ropt := textItems(prof, cfg); ropt.ContentionCount != nil {
+		t.Error("got contention count when showing contentions")
+	}
+	cfg.SampleIndex, cfg.Mean = "", true
+	if _, ropt := textItems(prof, cfg); ropt.ContentionCount != nil {
+		t.Error("got contention count with -mean")
+	}
+	delayOnly := prof.Copy()
+	delayOnly.SampleType = delayOnly.SampleType[1:]
+	for _, s := range delayOnly.Sample {
+		s.Value = s.Value[1:]
+	}
+	cfg.Mean = false
+	if _, ropt := textItems(delayOnly, cfg); ropt.ContentionCount != nil {
+		t.Error("got contention count for a profile without contentions")
+	}
+}
+
+func TestTitleAndLabels(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	f := baseFlags()
+	f.strings["title"] = "my service"
+	f.stringLists = map[string][]string{"add_label": {"env: staging", "", "run: 42"}}
+	f.args = []string{"cpu"}
+	o := setDefaults(&plugin.Options{Flagset: f})
+	if _, _, err := parseFlags(o); err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	cfg := currentConfig()
+	if want := []string{"env: staging", "run: 42"}; !reflect.DeepEqual(cfg.ExtraLabels, want) {
+		t.Fatalf("got extra labels %q, want %q", cfg.ExtraLabels, want)
+	}
+
+	for _, tc := range []struct {
+		cmd           string
+		compactLabels bool
+		want          []string
+	}{
+		{"top", false, nil},
+		{"top", true, nil},
+		{"dot", true, []string{`digraph "my service"`}},
+		{"traces", true, nil},
+	} {
+		t.Run(fmt.Sprintf("%s,compact=%v", tc.cmd, tc.compactLabels), func(t *testing.T) {
+			cfg := cfg
+			cfg.CompactLabels = tc.compactLabels
+			_, rpt, err := generateRawReport(cpuProfile(), []string{tc.cmd}, cfg, o)
+			if err != nil {
+				t.Fatalf("generateRawReport: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := report.Generate(context.Background(), &buf, rpt, o.Obj); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			for _, want := range append([]string{"Title: my service", "env: staging", "run: 42"}, tc.want...) {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("output does not contain %q:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPerFormatNodeCount(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		nodeCount, text, graph int
+		wantByCmd              map[string]int
+	}{
+		{
+			name:      "defaults",
+			nodeCount: -1,
+			wantByCmd: map[string]int{"top": 0, "text": 0, "dot": 80, "svg": 80, "web": 80},
+		},
+		{
+			name:      "nodecount only",
+			nodeCount: 30,
+			wantByCmd: map[string]int{"top": 30, "text": 30, "dot": 30, "svg": 30, "web": 30},
+		},
+		{
+			name:      "per-format overrides",
+			nodeCount: -1, text: 50, graph: 20,
+			wantByCmd: map[string]int{"top": 50, "text": 50, "topproto": 50, "dot": 20, "svg": 20, "web": 20, "traces": 80},
+		},
+		{
+			name:      "overrides fall back to nodecount",
+			nodeCount: 30, graph: 20,
+			wantByCmd: map[string]int{"top": 30, "dot": 20},
+		},
+		{
+			name:      "untrimmed reports ignore overrides",
+			nodeCount: 30, text: 50, graph: 20,
+			wantByCmd: map[string]int{"list": 0, "weblist": 0, "proto": 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for cmd, want := range tc.wantByCmd {
+				cfg := defaultConfig()
+				cfg.NodeCount, cfg.TextNodeCount, cfg.GraphNodeCount = tc.nodeCount, tc.text, tc.graph
+				c := pprofCommands[cmd]
+				if c == nil {
+					t.Fatalf("unknown command %q", cmd)
+				}
+				if got := applyCommandOverrides(cmd, c.format, cfg).NodeCount; got != want {
+					t.Errorf("%s: got nodecount %d, want %d", cmd, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	p := cpuProfile()
+	p.Sample[0].Label = map[string][]string{"user": {"alice"}}
+	p.Sample[1].Label = map[string][]string{"user": {"bob"}}
+	wantSamples := len(p.Sample) - 1
+
+	cfg := defaultConfig()
+	cfg.Redact = "user=alice|mangled2"
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	_, rpt, err := generateRawReport(p, []string{"proto"}, cfg, o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := report.Generate(context.Background(), &buf, rpt, o.Obj); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	got, err := profile.Parse(&buf)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(got.Sample) != wantSamples {
+		t.Errorf("got %d samples, want %d", len(got.Sample), wantSamples)
+	}
+	for _, s := range got.Sample {
+		if reflect.DeepEqual(s.Label["user"], []string{"alice"}) {
+			t.Errorf("sample with a redacted label was kept: %v", s)
+		}
+	}
+	var redacted int
+	for _, f := range got.Function {
+		if strings.Contains(f.Name, "mangled2") || strings.Contains(f.SystemName, "mangled2") {
+			t.Errorf("function %v was not redacted", f)
+		}
+		if f.Name == redactedName {
+			if f.SystemName != redactedName || f.Filename != "" {
+				t.Errorf("function %v was partially redacted", f)
+			}
+			redacted++
+		}
+	}
+	if redacted == 0 {
+		t.Error("no function was redacted")
+	}
+
+	cfg.Redact = "["
+	if _, _, err := generateRawReport(cpuProfile(), []string{"proto"}, cfg, o); err == nil {
+		t.Error("want error for an invalid redact regexp")
+	}
+}
+
+func TestDirsGranularity(t *testing.T) {
+	p := cpuProfile()
+	for _, f := range p.Function {
+		switch f.ID {
+		case 1:
+			f.Filename = ""
+		case 4:
+			f.Filename = "other/dir/file3000.src"
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.Granularity = "dirs"
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	_, rpt, err := generateRawReport(p, []string{"top"}, cfg, o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	items, _ := report.TextItems(context.Background(), rpt)
+	var got []string
+	for _, item := range items {
+		got = append(got, item.Name)
+	}
+	sort.Strings(got)
+	if want := []string{"(unknown)", "other/dir", "testdata"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	f := baseFlags()
+	f.bools["json_errors"] = true
+	f.args = []string{"cpu"}
+	o := setDefaults(&plugin.Options{Flagset: f, UI: &proftest.TestUI{T: t}})
+	if _, _, err := parseFlags(o); err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	ui, ok := o.UI.(*jsonUI)
+	if !ok {
+		t.Fatalf("got UI %T, want *jsonUI", o.UI)
+	}
+	if sym := o.Sym.(*symbolizer.Symbolizer); sym.UI != o.UI {
+		t.Error("symbolizer does not use the JSON UI")
+	}
+
+	var buf bytes.Buffer
+	ui.w = &buf
+	ui.Print("Fetching profile")
+	ui.PrintErr("Local symbolization failed for ", "main", ": no such file\n")
+	ui.PrintErr(`quoted "name"`)
+
+	want := []jsonMessage{
+		{"info", "Fetching profile"},
+		{"error", "Local symbolization failed for main: no such file"},
+		{"error", `quoted "name"`},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var got jsonMessage
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %q is not JSON: %v", line, err)
+		}
+		if got != want[i] {
+			t.Errorf("got message %+v, want %+v", got, want[i])
+		}
+	}
+}
+
+func TestForceSymbolize(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	for _, tc := range []struct {
+		symbolize, want string
+		wantErr         bool
+	}{
+		{symbolize: "", want: "clear"},
+		{symbolize: "local", want: "local:clear"},
+		{symbolize: "remote:demangle=full", want: "remote:demangle=full:clear"},
+		{symbolize: "none", wantErr: true},
+	} {
+		f := baseFlags()
+		f.bools["force_symbolize"] = true
+		f.strings["symbolize"] = tc.symbolize
+		f.args = []string{"cpu"}
+		src, _, err := parseFlags(setDefaults(&plugin.Options{Flagset: f}))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("-symbolize=%s: got no error, want one", tc.symbolize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("-symbolize=%s: parseFlags: %v", tc.symbolize, err)
+		}
+		if src.Symbolize != tc.want {
+			t.Errorf("-symbolize=%s: got symbolization mode %q, want %q", tc.symbolize, src.Symbolize, tc.want)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	for _, tc := range []struct {
+		deadline string
+		proto    bool
+		want     time.Duration
+		wantErr  bool
+	}{
+		{deadline: "", proto: true},
+		{deadline: "1m30s", proto: true, want: 90 * time.Second},
+		{deadline: "30", proto: true, wantErr: true},
+		{deadline: "-1s", proto: true, wantErr: true},
+		// A deadline needs an output format.
+		{deadline: "1m", wantErr: true},
+	} {
+		f := baseFlags()
+		f.strings["deadline"] = tc.deadline
+		f.bools["proto"] = tc.proto
+		f.args = []string{"cpu"}
+		src, _, err := parseFlags(setDefaults(&plugin.Options{Flagset: f}))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("-deadline=%s: got no error, want one", tc.deadline)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("-deadline=%s: parseFlags: %v", tc.deadline, err)
+		}
+		if src.Deadline != tc.want {
+			t.Errorf("-deadline=%s: got deadline %v, want %v", tc.deadline, src.Deadline, tc.want)
+		}
+	}
+
+	// The deadline is exceeded while the graph of the report is built: the
+	// key of the first frame is only returned once it is.
+	const d = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	var keys int
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	o.NodeKey = func(f plugin.Frame, s *profile.Sample) string {
+		keys++
+		<-ctx.Done()
+		return f.Func
+	}
+	cfg := defaultConfig()
+	cfg.Output = filepath.Join(t.TempDir(), "top.txt")
+	err := deadlineError(generateReport(ctx, cpuProfile(), []string{"top"}, cfg, o), d)
+	if err == nil || !strings.Contains(err.Error(), "aborted after exceeding the deadline of 10ms") {
+		t.Errorf("generateReport: got error %v, want the deadline to be exceeded", err)
+	}
+	if _, err := os.Stat(cfg.Output); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got report written despite the deadline, stat error %v", err)
+	}
+	// Only the frames of the first sample were read, once per graph.
+	if want := 3 * 2; keys > want {
+		t.Errorf("got %d node keys computed, want at most %d", keys, want)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	f := testFlags{
+		bools:   map[string]bool{"print_config": true, "lines": true},
+		strings: map[string]string{"focus": "main|it's"},
+	}
+	src, _, err := parseFlags(setDefaults(&plugin.Options{Flagset: f}))
+	if err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	if !src.PrintConfig {
+		t.Fatal("parseFlags: PrintConfig not set")
+	}
+	cfg := currentConfig()
+	flags := cfg.flags()
+	for _, want := range []string{
+		"-nodecount=-1",
+		"-nodefraction=0.005",
+		"-edgefraction=0.001",
+		"-unit=minimum",
+		"-trim=true",
+		"-flat",
+		"-lines",
+		"-call_tree=false",
+		"-tagfocus=''",
+		`-focus='main|it'\''s'`,
+	} {
+		if !slices.Contains(flags, want) {
+			t.Errorf("flags: %s missing from %v", want, flags)
+		}
+	}
+	if !slices.IsSorted(flags) {
+		t.Errorf("flags: got %v, want sorted", flags)
+	}
+
+	var buf bytes.Buffer
+	if err := printConfig(&buf, cfg); err != nil {
+		t.Fatalf("printConfig: %v", err)
+	}
+	if got, want := buf.String(), strings.Join(flags, " \\\n")+"\n"; got != want {
+		t.Errorf("printConfig: got %q, want %q", got, want)
+	}
+}
+
+func TestWarnTruncatedStacks(t *testing.T) {
+	stack := func(depth int) *profile.Sample {
+		s := &profile.Sample{Value: []int64{1}}
+		for i := 0; i < depth; i++ {
+			s.Location = append(s.Location, &profile.Location{ID: uint64(i + 1)})
+		}
+		return s
+	}
+	for _, tc := range []struct {
+		desc    string
+		depths  []int
+		limit   int
+		wantMsg string
+	}{
+		{
+			desc:    "deepest samples at round depth",
+			depths:  []int{3, 64, 10, 64},
+			wantMsg: "2 of 4 samples have a stack of exactly 64 locations",
+		},
+		{
+			desc:   "deepest samples at other depth",
+			depths: []int{3, 65, 10},
+		},
+		{
+			desc:    "explicit limit",
+			depths:  []int{3, 65, 10, 65, 65},
+			limit:   65,
+			wantMsg: "3 of 5 samples have a stack of exactly 65 locations",
+		},
+		{
+			desc:   "explicit limit not reached",
+			depths: []int{3, 64},
+			limit:  65,
+		},
+		{
+			desc:   "disabled",
+			depths: []int{3, 64},
+			limit:  -1,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := &profile.Profile{}
+			for _, d := range tc.depths {
+				p.Sample = append(p.Sample, stack(d))
+			}
+			ui := &proftest.TestUI{T: t, AllowRx: "may be truncated"}
+			warnTruncatedStacks(p, tc.limit, ui)
+			wantCount := 0
+			if tc.wantMsg != "" {
+				wantCount = 1
+			}
+			if ui.NumAllowRxMatches != wantCount {
+				t.Fatalf("got %d warnings, want %d", ui.NumAllowRxMatches, wantCount)
+			}
+			if tc.wantMsg != "" {
+				ui := &proftest.TestUI{T: t, AllowRx: regexp.QuoteMeta(tc.wantMsg)}
+				warnTruncatedStacks(p, tc.limit, ui)
+				if ui.NumAllowRxMatches != 1 {
+					t.Errorf("warning does not contain %q", tc.wantMsg)
+				}
+			}
+		})
+	}
+}
+
+func TestWarnTruncatedStacksOnce(t *testing.T) {
+	defer setCurrentConfig(currentConfig())
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+	}
+	s := &profile.Sample{Value: []int64{1}}
+	for i := 0; i < 64; i++ {
+		fn := &profile.Function{ID: uint64(i + 1), Name: fmt.Sprintf("fn%d", i)}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		s.Location = append(s.Location, loc)
+	}
+	p.Sample = []*profile.Sample{s}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "deep.pb.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each report of the interactive mode would repeat the warning.
+	ui := &proftest.TestUI{T: t, Input: []string{"top", "traces"}, AllowRx: "may be truncated"}
+	f := testFlags{
+		strings: map[string]string{"symbolize": "none"},
+		args:    []string{path},
+	}
+	o := setDefaults(&plugin.Options{UI: ui, Flagset: f})
+	if err := PProf(o); err != nil {
+		t.Fatalf("PProf: %v", err)
+	}
+	if ui.NumAllowRxMatches != 1 {
+		t.Errorf("got %d truncation warnings, want 1", ui.NumAllowRxMatches)
+	}
+}
+
+func TestPerLabel(t *testing.T) {
+	p := cpuProfile()
+	requests := []string{"r1", "r2", "r3", "r4"}
+	for i, s := range p.Sample {
+		s.Label = map[string][]string{"request": {requests[i%len(requests)]}}
+	}
+
+	cfg := defaultConfig()
+	cfg.PerLabel = "request"
+	cfg.DivideBy = 2
+	ropt, err := reportOptions(p, nil, cfg)
+	if err != nil {
+		t.Fatalf("reportOptions: %v", err)
+	}
+	if want := 1.0 / 8; ropt.Ratio != want {
+		t.Errorf("got ratio %v, want %v", ropt.Ratio, want)
+	}
+	if want := "Per request: values divided by 4 distinct values"; !slices.Contains(ropt.ExtraLabels, want) {
+		t.Errorf("got labels %q, want them to contain %q", ropt.ExtraLabels, want)
+	}
+
+	// The report shows the same values as when dividing by the number of
+	// requests.
+	topFlat := func(cfg config) string {
+		t.Helper()
+		o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+		_, rpt, err := generateRawReport(p.Copy(), []string{"top"}, cfg, o)
+		if err != nil {
+			t.Fatalf("generateRawReport: %v", err)
+		}
+		items, _ := report.TextItems(context.Background(), rpt)
+		if len(items) == 0 {
+			t.Fatal("got no report entries")
+		}
+		return items[0].FlatFormat
+	}
+	cfg.DivideBy = 1
+	perLabel := topFlat(cfg)
+	cfg.PerLabel, cfg.DivideBy = "", 4
+	if divided := topFlat(cfg); perLabel != divided {
+		t.Errorf("got flat %s, want %s", perLabel, divided)
+	}
+
+	cfg.PerLabel, cfg.DivideBy = "user", 1
+	if _, err := reportOptions(p, nil, cfg); err == nil {
+		t.Error("reportOptions with a missing per_label key got nil error")
+	}
+}
+
+func TestClamp(t *testing.T) {
+	// A diff where the first function regressed and the others improved.
+	p := cpuProfile()
+	for i, s := range p.Sample {
+		if i > 0 {
+			for j := range s.Value {
+				s.Value[j] = -s.Value[j]
+			}
+		}
+	}
+
+	for _, clamp := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.Clamp = clamp
+		o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+		_, rpt, err := generateRawReport(p.Copy(), []string{"top"}, cfg, o)
+		if err != nil {
+			t.Fatalf("generateRawReport: %v", err)
+		}
+		items, _ := report.TextItems(context.Background(), rpt)
+		var negative bool
+		for _, item := range items {
+			negative = negative || strings.HasPrefix(item.FlatFormat, "-")
+		}
+		if negative == clamp {
+			t.Errorf("clamp=%v: got negative values %v, want %v", clamp, negative, !clamp)
+		}
+	}
+}
+
+func TestClampDiffBase(t *testing.T) {
+	// The first sample improved, the others regressed.
+	p := cpuProfile()
+	base := p.Copy()
+	for i, s := range base.Sample {
+		for j := range s.Value {
+			if i == 0 {
+				s.Value[j] *= 2
+			} else {
+				s.Value[j] /= 2
+			}
+		}
+	}
+	base.Scale(-1)
+	base.SetLabel("pprof::base", []string{"true"})
+	diff, err := profile.Merge([]*profile.Profile{p, base})
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	// Only the growth of the regressed samples is left.
+	growth := p.Copy()
+	growth.Sample = growth.Sample[1:]
+	growth.Scale(0.5)
+
+	flat := func(p *profile.Profile, clamp bool) int64 {
+		t.Helper()
+		cfg := defaultConfig()
+		cfg.Clamp = clamp
+		o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+		_, rpt, err := generateRawReport(p, []string{"top"}, cfg, o)
+		if err != nil {
+			t.Fatalf("generateRawReport: %v", err)
+		}
+		items, _ := report.TextItems(context.Background(), rpt)
+		var total int64
+		for _, item := range items {
+			total += item.Flat
+		}
+		return total
+	}
+	if got, want := flat(diff, true), flat(growth, false); got != want || got == 0 {
+		t.Errorf("got total flat %d, want %d", got, want)
+	}
+}
+
+func TestFull(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	// A heavy function and many light ones, trimmed by default.
+	p := &profile.Profile{SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}}}
+	for i := 0; i <= 100; i++ {
+		fn := &profile.Function{ID: uint64(i + 1), Name: fmt.Sprintf("fn%d", i)}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn}}}
+		value := int64(1)
+		if i == 0 {
+			value = 10000
+		}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{Location: []*profile.Location{loc}, Value: []int64{value}})
+	}
+
+	for _, full := range []bool{false, true} {
+		f := baseFlags()
+		f.bools["full"] = full
+		f.args = []string{"cpu"}
+		o := setDefaults(&plugin.Options{Flagset: f})
+		if _, _, err := parseFlags(o); err != nil {
+			t.Fatalf("-full=%v: parseFlags: %v", full, err)
+		}
+		_, rpt, err := generateRawReport(p.Copy(), []string{"top"}, currentConfig(), o)
+		if err != nil {
+			t.Fatalf("-full=%v: generateRawReport: %v", full, err)
+		}
+		items, _ := report.TextItems(context.Background(), rpt)
+		if got, trimmed := len(items), len(items) < len(p.Function); trimmed == full {
+			t.Errorf("-full=%v: got %d of %d functions", full, got, len(p.Function))
+		}
+	}
+}
+
+func TestMergeFunctions(t *testing.T) {
+	// The same template instance defined in two files.
+	p := &profile.Profile{SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}}}
+	for i, file := range []string{"a.h", "b.h"} {
+		fn := &profile.Function{ID: uint64(i + 1), Name: "Vector<int>::size", Filename: file}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn, Line: int64(i + 10)}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{Location: []*profile.Location{loc}, Value: []int64{int64(i + 1)}})
+	}
+
+	for _, tc := range []struct {
+		granularity string
+		merge       bool
+		want        []string
+	}{
+		{"lines", false, []string{"Vector<int>::size b.h:11", "Vector<int>::size a.h:10"}},
+		{"filefunctions", false, []string{"Vector<int>::size b.h", "Vector<int>::size a.h"}},
+		// Merging takes precedence over the granularity.
+		{"lines", true, []string{"Vector<int>::size"}},
+		{"filefunctions", true, []string{"Vector<int>::size"}},
+	} {
+		cfg := defaultConfig()
+		cfg.Granularity = tc.granularity
+		cfg.MergeFunctions = tc.merge
+		o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+		_, rpt, err := generateRawReport(p.Copy(), []string{"top"}, cfg, o)
+		if err != nil {
+			t.Fatalf("generateRawReport: %v", err)
+		}
+		items, _ := report.TextItems(context.Background(), rpt)
+		var got []string
+		for _, item := range items {
+			got = append(got, item.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("granularity=%s merge_functions=%v: got %q, want %q", tc.granularity, tc.merge, got, tc.want)
+		}
+	}
+}
+
+func TestCollapseLambdas(t *testing.T) {
+	p := &profile.Profile{SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}}}
+	for i, name := range []string{"main.run", "main.run.func1", "main.run.func1.2"} {
+		fn := &profile.Function{ID: uint64(i + 1), Name: name, Filename: "main.go"}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn, Line: int64(i + 10)}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{Location: []*profile.Location{loc}, Value: []int64{int64(i + 1)}})
+	}
+
+	for _, tc := range []struct {
+		collapse bool
+		want     []string
+	}{
+		{false, []string{"main.run.func1.2", "main.run.func1", "main.run"}},
+		{true, []string{"main.run"}},
+	} {
+		cfg := defaultConfig()
+		cfg.CollapseLambdas = tc.collapse
+		o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+		_, rpt, err := generateRawReport(p.Copy(), []string{"top"}, cfg, o)
+		if err != nil {
+			t.Fatalf("generateRawReport: %v", err)
+		}
+		items, _ := report.TextItems(context.Background(), rpt)
+		var got []string
+		for _, item := range items {
+			got = append(got, item.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("collapse_lambdas=%v: got %q, want %q", tc.collapse, got, tc.want)
+		}
+	}
+}
+
+func TestNodeTagFilters(t *testing.T) {
+	p := cpuProfile()
+	for i, s := range p.Sample {
+		s.Label = map[string][]string{"thread": {string(rune('a' + i%2))}}
+		s.NumLabel = map[string][]int64{"bytes": {int64(1024 * (i + 1))}}
+	}
+
+	for _, tc := range []struct {
+		desc       string
+		show, hide string
+		want       []string
+		notWant    []string
+	}{
+		{
+			desc:    "show label value",
+			show:    "^thread:a$",
+			want:    []string{"thread:a"},
+			notWant: []string{"thread:b", "kB"},
+		},
+		{
+			desc:    "hide numeric value",
+			hide:    "^1kB$",
+			want:    []string{"thread:a", "thread:b", "2kB"},
+			notWant: []string{`"1kB"`},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.NodeTagShow, cfg.NodeTagHide = tc.show, tc.hide
+			// The test UI fails on any warning, such as the ones about
+			// tag filters that match no tag key.
+			o := setDefaults(&plugin.Options{Flagset: baseFlags(), UI: &proftest.TestUI{T: t}})
+			_, rpt, err := generateRawReport(p.Copy(), []string{"dot"}, cfg, o)
+			if err != nil {
+				t.Fatalf("generateRawReport: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := report.Generate(context.Background(), &buf, rpt, nil); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			got := buf.String()
+			for _, w := range tc.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("output does not contain %q:\n%s", w, got)
+				}
+			}
+			for _, w := range tc.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("output unexpectedly contains %q:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeKey(t *testing.T) {
+	p := cpuProfile()
+	for i, s := range p.Sample {
+		s.Label = map[string][]string{"thread": {fmt.Sprint(i % 2)}}
+	}
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	// Each frame is keyed by its function and the thread of its sample.
+	o.NodeKey = func(f plugin.Frame, s *profile.Sample) string {
+		return f.Func + "@" + s.Label["thread"][0]
+	}
+	_, rpt, err := generateRawReport(p.Copy(), []string{"top"}, defaultConfig(), o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	items, _ := report.TextItems(context.Background(), rpt)
+	var got []string
+	for _, item := range items {
+		got = append(got, item.Name)
+	}
+	slices.Sort(got)
+	want := []string{"mangled1000@0", "mangled1000@1", "mangled2000@0", "mangled2001@0", "mangled3000@0", "mangled3000@1", "mangled3001@0", "mangled3001@1", "mangled3002@0", "mangled3002@1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got nodes %q, want %q", got, want)
+	}
+}
+
+func TestPathsTo(t *testing.T) {
+	p := &profile.Profile{SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}}}
+	locs := make(map[string]*profile.Location)
+	for i, name := range []string{"main", "a", "b", "target"} {
+		fn := &profile.Function{ID: uint64(i + 1), Name: name}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		locs[name] = loc
+	}
+	// main calls a, which calls target, and b.
+	for _, stack := range [][]string{{"target", "a", "main"}, {"b", "main"}, {"a", "main"}} {
+		s := &profile.Sample{Value: []int64{1}}
+		for _, name := range stack {
+			s.Location = append(s.Location, locs[name])
+		}
+		p.Sample = append(p.Sample, s)
+	}
+
+	for _, tc := range []struct {
+		pathsTo string
+		want    []string
+	}{
+		{"", []string{"a", "b", "main", "target"}},
+		{"^target$", []string{"a", "main", "target"}},
+		{"nomatch", []string{"a", "b", "main", "target"}},
+	} {
+		for _, cmd := range []string{"top", "dot"} {
+			cfg := defaultConfig()
+			cfg.PathsTo = tc.pathsTo
+			o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+			_, rpt, err := generateRawReport(p.Copy(), []string{cmd}, cfg, o)
+			if err != nil {
+				t.Fatalf("generateRawReport: %v", err)
+			}
+			var got []string
+			if cmd == "top" {
+				items, _ := report.TextItems(context.Background(), rpt)
+				for _, item := range items {
+					got = append(got, item.Name)
+				}
+			} else {
+				var buf bytes.Buffer
+				if err := report.Generate(context.Background(), &buf, rpt, nil); err != nil {
+					t.Fatalf("Generate: %v", err)
+				}
+				for _, name := range []string{"a", "b", "main", "target"} {
+					if strings.Contains(buf.String(), fmt.Sprintf("label=\"%s\\n", name)) {
+						got = append(got, name)
+					}
+				}
+			}
+			slices.Sort(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%s with paths_to=%q: got nodes %q, want %q", cmd, tc.pathsTo, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestFlameGraphHTML(t *testing.T) {
+	p := cpuProfile()
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	_, rpt, err := generateRawReport(p.Copy(), []string{"flamegraph_html"}, defaultConfig(), o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := printFlameGraphHTML(&buf, rpt); err != nil {
+		t.Fatalf("printFlameGraphHTML: %v", err)
+	}
+	html := buf.String()
+
+	stacks := rpt.Stacks()
+	folded := stacks.Folded()
+	if len(folded) == 0 {
+		t.Fatal("got no folded stacks")
+	}
+	data, err := json.Marshal(folded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<!DOCTYPE html>",
+		`<div id="flamegraph"></div>`,
+		"const folded = " + string(data) + ";",
+		"function buildTree(lines)",
+		"show(tree);",
+		"Type: cpu",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("flame graph HTML does not contain %q", want)
+		}
+	}
+	// The file must not depend on the web server.
+	for _, bad := range []string{`src="http`, `href="./`} {
+		if strings.Contains(html, bad) {
+			t.Errorf("flame graph HTML contains %q", bad)
+		}
+	}
+}
+
+// symbolObjTool opens fake binaries resolving addresses to the frames of
+// the binary with the same name.
+type symbolObjTool map[string]map[uint64][]plugin.Frame
+
+func (t symbolObjTool) Open(file string, start, limit, offset uint64, relocationSymbol string) (plugin.ObjFile, error) {
+	frames, ok := t[file]
+	if !ok {
+		return nil, fmt.Errorf("unknown binary %s", file)
+	}
+	return symbolObjFile{file, frames}, nil
+}
+
+func (symbolObjTool) Disasm(file string, start, end uint64, intelSyntax bool) ([]plugin.Inst, error) {
+	return nil, fmt.Errorf("disassembly not supported")
+}
+
+type symbolObjFile struct {
+	name   string
+	frames map[uint64][]plugin.Frame
+}
+
+func (f symbolObjFile) Name() string                        { return f.name }
+func (f symbolObjFile) ObjAddr(addr uint64) (uint64, error) { return addr, nil }
+func (f symbolObjFile) BuildID() string                     { return "" }
+func (f symbolObjFile) Close() error                        { return nil }
+func (f symbolObjFile) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	if frames, ok := f.frames[addr]; ok {
+		return frames, nil
+	}
+	return nil, fmt.Errorf("no symbol for %#x", addr)
+}
+func (f symbolObjFile) Symbols(r *regexp.Regexp, addr uint64) ([]*plugin.Sym, error) {
+	return nil, nil
+}
+
+func TestCompareSymbols(t *testing.T) {
+	m := &profile.Mapping{ID: 1, Start: 0x1000, Limit: 0x5000, File: "prog"}
+	other := &profile.Mapping{ID: 2, Start: 0x10000, Limit: 0x20000, File: "libc.so"}
+	p := &profile.Profile{Mapping: []*profile.Mapping{m, other}}
+	for i, addr := range []uint64{0x1300, 0x1100, 0x1200, 0x1400} {
+		p.Location = append(p.Location, &profile.Location{ID: uint64(i + 1), Mapping: m, Address: addr})
+	}
+	p.Location = append(p.Location, &profile.Location{ID: 5, Mapping: other, Address: 0x10100})
+
+	obj := symbolObjTool{
+		"old": {
+			0x1100: {{Func: "main"}},
+			0x1200: {{Func: "parse"}, {Func: "main"}},
+			0x1300: {{Func: "flush"}},
+			0x1400: {{Func: "write"}},
+		},
+		"new": {
+			0x1100: {{Func: "main"}},
+			0x1200: {{Func: "parseFast"}, {Func: "main"}},
+			0x1300: {{Func: "flush"}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := compareSymbols(&buf, p, []string{"old", "new"}, obj); err != nil {
+		t.Fatalf("compareSymbols: %v", err)
+	}
+	want := strings.Join([]string{
+		"Symbols differing between old and new: 2 of 4 addresses",
+		"0x1200",
+		"  old: parse <- main",
+		"  new: parseFast <- main",
+		"0x1400",
+		"  old: write",
+		"  new: ??",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := compareSymbols(&buf, p, []string{"old", "missing"}, obj); err == nil {
+		t.Error("compareSymbols with a missing binary got nil error")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	sizes := map[int]int{}
+	for _, level := range []int{gzip.NoCompression, gzip.BestCompression} {
+		cfg := defaultConfig()
+		cfg.Compression = level
+		_, rpt, err := generateRawReport(cpuProfile(), []string{"proto"}, cfg, o)
+		if err != nil {
+			t.Fatalf("generateRawReport: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := report.Generate(context.Background(), &buf, rpt, o.Obj); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		sizes[level] = buf.Len()
+		if _, err := profile.Parse(&buf); err != nil {
+			t.Errorf("Parse of proto output at level %d: %v", level, err)
+		}
+	}
+	if sizes[gzip.NoCompression] <= sizes[gzip.BestCompression] {
+		t.Errorf("got sizes %v, want the output without compression to be larger", sizes)
+	}
+
+	cfg := defaultConfig()
+	cfg.Compression = 10
+	if _, _, err := generateRawReport(cpuProfile(), []string{"proto"}, cfg, o); err == nil {
+		t.Error("generateRawReport with compression level 10 got nil error")
+	}
+}
+
+func TestRankDir(t *testing.T) {
+	for _, tc := range []struct {
+		rankdir, want string
+		wantErr       bool
+	}{
+		{"", "", false},
+		{"LR", "rankdir=LR\n", false},
+		{"rl", "rankdir=RL\n", false},
+		{"left", "", true},
+	} {
+		cfg := defaultConfig()
+		cfg.RankDir = tc.rankdir
+		o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+		_, rpt, err := generateRawReport(cpuProfile(), []string{"dot"}, cfg, o)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("rankdir=%s: got no error", tc.rankdir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("rankdir=%s: generateRawReport: %v", tc.rankdir, err)
+		}
+		var buf bytes.Buffer
+		if err := report.Generate(context.Background(), &buf, rpt, o.Obj); err != nil {
+			t.Fatalf("rankdir=%s: Generate: %v", tc.rankdir, err)
+		}
+		if got := regexp.MustCompile(`(?m)^rankdir=.*\n`).FindString(buf.String()); got != tc.want {
+			t.Errorf("rankdir=%s: got %q in DOT output, want %q", tc.rankdir, got, tc.want)
+		}
+	}
+}
+
+func TestSampleCommand(t *testing.T) {
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	_, rpt, err := generateRawReport(cpuProfile(), []string{"sample", "1"}, defaultConfig(), o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := report.Generate(context.Background(), &buf, rpt, o.Obj); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Sample 1 of ") || !strings.Contains(buf.String(), "     stack:\n") {
+		t.Errorf("sample report does not show sample 1 and its stack:\n%s", buf.String())
+	}
+
+	for _, arg := range []string{"x", "-1"} {
+		if _, _, err := generateRawReport(cpuProfile(), []string{"sample", arg}, defaultConfig(), o); err == nil {
+			t.Errorf("sample %s: got no error", arg)
+		}
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	_, rpt, err := generateRawReport(cpuProfile(), []string{"prometheus"}, defaultConfig(), o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := report.Generate(context.Background(), &buf, rpt, o.Obj); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := `# HELP pprof_function_flat Value of the samples in the function itself.
+# TYPE pprof_function_flat gauge
+pprof_function_flat{func="mangled1000",unit="milliseconds"} 1100
+pprof_function_flat{func="mangled2001",unit="milliseconds"} 10
+pprof_function_flat{func="mangled3002",unit="milliseconds"} 10
+pprof_function_flat{func="mangled2000",unit="milliseconds"} 0
+pprof_function_flat{func="mangled3000",unit="milliseconds"} 0
+pprof_function_flat{func="mangled3001",unit="milliseconds"} 0
+# HELP pprof_function_cum Value of the samples in the function and its callees.
+# TYPE pprof_function_cum gauge
+pprof_function_cum{func="mangled1000",unit="milliseconds"} 1100
+pprof_function_cum{func="mangled2001",unit="milliseconds"} 1010
+pprof_function_cum{func="mangled3002",unit="milliseconds"} 1020
+pprof_function_cum{func="mangled2000",unit="milliseconds"} 1010
+pprof_function_cum{func="mangled3000",unit="milliseconds"} 1120
+pprof_function_cum{func="mangled3001",unit="milliseconds"} 1110
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEdgesCommand(t *testing.T) {
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	cfg := defaultConfig()
+	cfg.NodeCount = 3
+	_, rpt, err := generateRawReport(cpuProfile(), []string{"edges"}, cfg, o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := report.Generate(context.Background(), &buf, rpt, o.Obj); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	_, edges, _ := strings.Cut(buf.String(), "caller -> callee\n")
+	if got := strings.Count(edges, " -> "); got != 3 {
+		t.Errorf("edges report with 3 nodes shows %d edges, want 3:\n%s", got, buf.String())
+	}
+}
+
+func TestHasWindowsMappings(t *testing.T) {
+	for _, tc := range []struct {
+		files []string
+		want  bool
+	}{
+		{[]string{"/usr/lib/libc.so.6", "/bin/server"}, false},
+		{[]string{"/bin/server", `C:\Windows\System32\KERNEL32.DLL`}, true},
+		{[]string{"d:/build/server"}, true},
+		{[]string{`\\host\share\server`}, true},
+		{[]string{"server.EXE"}, true},
+		{[]string{"[vdso]", ""}, false},
+	} {
+		p := &profile.Profile{}
+		for i, f := range tc.files {
+			p.Mapping = append(p.Mapping, &profile.Mapping{ID: uint64(i + 1), File: f})
+		}
+		if got := hasWindowsMappings(p); got != tc.want {
+			t.Errorf("hasWindowsMappings(%q) = %v, want %v", tc.files, got, tc.want)
+		}
+	}
+}
@@ -15,9 +15,13 @@
 package driver
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -37,14 +41,18 @@ import (
 // fetchProfiles fetches and symbolizes the profiles specified by s.
 // It will merge all the profiles it is able to retrieve, even if
 // there are some failures. It will return an error if it is unable to
-// fetch any profiles.
-func fetchProfiles(s *source, o *plugin.Options) (*profile.Profile, error) {
+// fetch any profiles. The symbolization stops once ctx is done.
+func fetchProfiles(ctx context.Context, s *source, o *plugin.Options) (*profile.Profile, error) {
 	sources := make([]profileSource, 0, len(s.Sources))
-	for _, src := range s.Sources {
-		sources = append(sources, profileSource{
+	for i, src := range s.Sources {
+		ps := profileSource{
 			addr:   src,
 			source: s,
-		})
+		}
+		if s.SourceStats {
+			ps.label = strconv.Itoa(i)
+		}
+		sources = append(sources, ps)
 	}
 
 	bases := make([]profileSource, 0, len(s.Base))
@@ -55,22 +63,35 @@ func fetchProfiles(s *source, o *plugin.Options) (*profile.Profile, error) {
 		})
 	}
 
-	p, pbase, m, mbase, save, err := grabSourcesAndBases(sources, bases, o.Fetch, o.Obj, o.UI, o.HTTPTransport)
+	p, pbase, m, mbase, nbase, save, err := grabSourcesAndBases(sources, bases, o.Fetch, o.Obj, o.UI, o.HTTPTransport)
 	if err != nil {
 		return nil, err
 	}
 
+	if s.SourceStats && len(s.Sources) < 2 {
+		o.UI.PrintErr("-source_stats: needs more than one source profile")
+	}
+
 	if pbase != nil {
 		if s.DiffBase {
 			pbase.SetLabel("pprof::base", []string{"true"})
 		}
+		if s.BaseMean {
+			// The fetched base profiles were merged by summing them.
+			pbase.Scale(1 / float64(nbase))
+		}
 		if s.Normalize {
 			err := p.Normalize(pbase)
 			if err != nil {
 				return nil, err
 			}
 		}
-		pbase.Scale(-1)
+		if s.RatioBase {
+			// Base samples are kept apart by the report to compute ratios.
+			pbase.SetLabel("pprof::ratio_base", []string{"true"})
+		} else {
+			pbase.Scale(-1)
+		}
 		p, m, err = combineProfiles([]*profile.Profile{p, pbase}, []plugin.MappingSources{m, mbase})
 		if err != nil {
 			return nil, err
@@ -78,15 +99,14 @@ func fetchProfiles(s *source, o *plugin.Options) (*profile.Profile, error) {
 	}
 
 	// Symbolize the merged profile.
-	if err := o.Sym.Symbolize(s.Symbolize, m, p); err != nil {
+	if err := symbolize(ctx, o.Sym, s.Symbolize, m, p); err != nil {
+		metrics.symbolizeFailed()
 		return nil, err
 	}
 	p.RemoveUninteresting()
 	unsourceMappings(p)
 
-	if s.Comment != "" {
-		p.Comments = append(p.Comments, s.Comment)
-	}
+	p.Comments = append(p.Comments, s.Comments...)
 
 	// Save a copy of the merged profile if there is at least one remote source.
 	if save {
@@ -103,9 +123,18 @@ func fetchProfiles(s *source, o *plugin.Options) (*profile.Profile, error) {
 			prefix += s.Type + "."
 		}
 
+		saved := p
+		if s.SourceStats {
+			// The sources of the samples are of no use outside of this run.
+			saved = p.Copy()
+			saved.RemoveLabel("pprof::source")
+			if merged, err := profile.Merge([]*profile.Profile{saved}); err == nil {
+				saved = merged
+			}
+		}
 		tempFile, err := newTempFile(dir, prefix, ".pb.gz")
 		if err == nil {
-			if err = p.Write(tempFile); err == nil {
+			if err = saved.Write(tempFile); err == nil {
 				o.UI.PrintErr("Saved profile in ", tempFile.Name())
 			}
 		}
@@ -121,7 +150,20 @@ func fetchProfiles(s *source, o *plugin.Options) (*profile.Profile, error) {
 	return p, nil
 }
 
-func grabSourcesAndBases(sources, bases []profileSource, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI, tr http.RoundTripper) (*profile.Profile, *profile.Profile, plugin.MappingSources, plugin.MappingSources, bool, error) {
+// symbolize symbolizes p with sym, which is stopped once ctx is done if
+// it is a plugin.ContextSymbolizer. Otherwise, the error of ctx is only
+// checked once sym is done.
+func symbolize(ctx context.Context, sym plugin.Symbolizer, mode string, sources plugin.MappingSources, p *profile.Profile) error {
+	if cs, ok := sym.(plugin.ContextSymbolizer); ok {
+		return cs.SymbolizeContext(ctx, mode, sources, p)
+	}
+	if err := sym.Symbolize(mode, sources, p); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func grabSourcesAndBases(sources, bases []profileSource, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI, tr http.RoundTripper) (*profile.Profile, *profile.Profile, plugin.MappingSources, plugin.MappingSources, int, bool, error) {
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	var psrc, pbase *profile.Profile
@@ -141,16 +183,16 @@ func grabSourcesAndBases(sources, bases []profileSource, fetch plugin.Fetcher, o
 	save := savesrc || savebase
 
 	if errsrc != nil {
-		return nil, nil, nil, nil, false, fmt.Errorf("problem fetching source profiles: %v", errsrc)
+		return nil, nil, nil, nil, 0, false, fmt.Errorf("problem fetching source profiles: %v", errsrc)
 	}
 	if errbase != nil {
-		return nil, nil, nil, nil, false, fmt.Errorf("problem fetching base profiles: %v,", errbase)
+		return nil, nil, nil, nil, 0, false, fmt.Errorf("problem fetching base profiles: %v,", errbase)
 	}
 	if countsrc == 0 {
-		return nil, nil, nil, nil, false, fmt.Errorf("failed to fetch any source profiles")
+		return nil, nil, nil, nil, 0, false, fmt.Errorf("failed to fetch any source profiles")
 	}
 	if countbase == 0 && len(bases) > 0 {
-		return nil, nil, nil, nil, false, fmt.Errorf("failed to fetch any base profiles")
+		return nil, nil, nil, nil, 0, false, fmt.Errorf("failed to fetch any base profiles")
 	}
 	if want, got := len(sources), countsrc; want != got {
 		ui.PrintErr(fmt.Sprintf("Fetched %d source profiles out of %d", got, want))
@@ -159,7 +201,7 @@ func grabSourcesAndBases(sources, bases []profileSource, fetch plugin.Fetcher, o
 		ui.PrintErr(fmt.Sprintf("Fetched %d base profiles out of %d", got, want))
 	}
 
-	return psrc, pbase, msrc, mbase, save, nil
+	return psrc, pbase, msrc, mbase, countbase, save, nil
 }
 
 // chunkedGrab fetches the profiles described in source and merges them into
@@ -201,13 +243,26 @@ func chunkedGrab(sources []profileSource, fetch plugin.Fetcher, obj plugin.ObjTo
 	return p, msrc, save, count, nil
 }
 
-// concurrentGrab fetches multiple profiles concurrently
+// concurrentGrab fetches multiple profiles concurrently, running at most
+// source.FetchParallelism fetches at a time if that is positive. The
+// profiles are merged in the order of sources, regardless of the order in
+// which the fetches complete, and fetch errors are reported in that order.
 func concurrentGrab(sources []profileSource, fetch plugin.Fetcher, obj plugin.ObjTool, ui plugin.UI, tr http.RoundTripper) (*profile.Profile, plugin.MappingSources, bool, int, error) {
+	limit := len(sources)
+	if len(sources) > 0 && sources[0].source != nil {
+		if n := sources[0].source.FetchParallelism; n > 0 && n < limit {
+			limit = n
+		}
+	}
+	sem := make(chan struct{}, limit)
+
 	wg := sync.WaitGroup{}
 	wg.Add(len(sources))
 	for i := range sources {
 		go func(s *profileSource) {
 			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
 			s.p, s.msrc, s.remote, s.err = grabProfile(s.source, s.addr, fetch, obj, ui, tr)
 		}(&sources[i])
 	}
@@ -223,6 +278,15 @@ func concurrentGrab(sources []profileSource, fetch plugin.Fetcher, obj plugin.Ob
 			continue
 		}
 		save = save || s.remote
+		if s.source != nil && s.source.UnsampleHeap && !s.p.UnsampleHeap() {
+			// Unsampling depends on the average size of the objects of
+			// each sample, so it is done before profiles are merged.
+			ui.PrintErr(s.addr + ": -unsample_heap: not a heap profile with a sampling period, values left unchanged")
+		}
+		if s.label != "" {
+			// Keep track of the source of the samples through the merge.
+			s.p.SetLabel("pprof::source", []string{s.label})
+		}
 		profiles = append(profiles, s.p)
 		msrcs = append(msrcs, s.msrc)
 		*s = profileSource{}
@@ -275,6 +339,7 @@ func combineProfiles(profiles []*profile.Profile, msrcs []plugin.MappingSources)
 type profileSource struct {
 	addr   string
 	source *source
+	label  string // Value of the pprof::source label of the samples, if any.
 
 	p      *profile.Profile
 	msrc   plugin.MappingSources
@@ -340,6 +405,7 @@ func grabProfile(s *source, source string, fetcher plugin.Fetcher, obj plugin.Ob
 	if err = p.CheckValid(); err != nil {
 		return
 	}
+	metrics.profileParsed()
 
 	// Update the binary locations from command line and paths.
 	locateBinaries(p, s, obj, ui)
@@ -397,6 +463,47 @@ func unsourceMappings(p *profile.Profile) {
 	}
 }
 
+// locateProfileByBuildID returns the path of a profile for the binary with
+// the given build ID from the local profile cache. The cache is searched in
+// PPROF_PROFILE_PATH, which defaults to $HOME/pprof/profiles, and stores the
+// profiles of a binary in $path/$buildid/. If several profiles match, the most
+// recently modified one is returned.
+func locateProfileByBuildID(buildID string) (string, error) {
+	if buildID == "" || filepath.Base(buildID) != buildID || buildID == "." || buildID == ".." {
+		return "", fmt.Errorf("invalid build id %q", buildID)
+	}
+	searchPath := os.Getenv("PPROF_PROFILE_PATH")
+	if searchPath == "" {
+		searchPath = filepath.Join(os.Getenv(homeEnv()), "pprof", "profiles")
+	}
+	var found string
+	var foundTime time.Time
+	for _, path := range filepath.SplitList(searchPath) {
+		entries, err := os.ReadDir(filepath.Join(path, buildID))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			// Earlier entries of the search path win ties.
+			if found == "" || info.ModTime().After(foundTime) {
+				found, foundTime = filepath.Join(path, buildID, e.Name()), info.ModTime()
+			}
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no profile found for build id %s in %s", buildID, searchPath)
+	}
+	return found, nil
+}
+
+// deletedSuffix is appended by the kernel to the names of mapped files
+// that have been deleted since they were mapped.
+const deletedSuffix = " (deleted)"
+
 // locateBinaries searches for binary files listed in the profile and, if found,
 // updates the profile accordingly.
 func locateBinaries(p *profile.Profile, s *source, obj plugin.ObjTool, ui plugin.UI) {
@@ -408,12 +515,55 @@ func locateBinaries(p *profile.Profile, s *source, obj plugin.ObjTool, ui plugin
 	}
 mapping:
 	for _, m := range p.Mapping {
+		if sym, ok := s.RelocationSymbols[m.File]; ok {
+			m.KernelRelocationSymbol = sym
+		} else if sym, ok := s.RelocationSymbols[filepath.Base(m.File)]; ok && m.File != "" {
+			m.KernelRelocationSymbol = sym
+		}
+
+		// useFile makes name the file of m if it is a binary with the
+		// build id of m.
+		useFile := func(name string) bool {
+			f, err := obj.Open(name, m.Start, m.Limit, m.Offset, m.KernelRelocationSymbol)
+			if err != nil {
+				return false
+			}
+			defer f.Close()
+			fileBuildID := f.BuildID()
+			if m.BuildID != "" && m.BuildID != fileBuildID {
+				ui.PrintErr("Ignoring local file " + name + ": build-id mismatch (" + m.BuildID + " != " + fileBuildID + ")")
+				return false
+			}
+			// Explicitly do not update KernelRelocationSymbol --
+			// the new local file name is most likely missing it.
+			m.File = name
+			return true
+		}
+
+		// file is the name under which the binary of m is looked up.
+		file := m.File
+		deleted := false
+		if s.StripDeleted {
+			file, deleted = strings.CutSuffix(file, deletedSuffix)
+		}
+
+		if s.Image != nil && file != "" {
+			// The image is where the profiled process found its binaries.
+			name, err := s.Image.extract(file)
+			if err == nil && useFile(name) {
+				continue mapping
+			}
+			if err != nil && !errors.Is(err, errNotInImage) {
+				ui.PrintErr("Reading ", file, " from image: ", err)
+			}
+		}
+
 		var noVolumeFile string
 		var baseName string
 		var dirName string
-		if m.File != "" {
-			noVolumeFile = strings.TrimPrefix(m.File, filepath.VolumeName(m.File))
-			baseName = filepath.Base(m.File)
+		if file != "" {
+			noVolumeFile = strings.TrimPrefix(file, filepath.VolumeName(file))
+			baseName = filepath.Base(file)
 			dirName = filepath.Dir(noVolumeFile)
 		}
 
@@ -430,7 +580,7 @@ mapping:
 				// e.g. `/ab/cdef0123456.debug`
 				fileNames = append(fileNames, filepath.Join(path, m.BuildID[:2], m.BuildID[2:]+".debug"))
 			}
-			if m.File != "" {
+			if file != "" {
 				// Try both the basename and the full path, to support the same directory
 				// structure as the perf symfs option.
 				fileNames = append(fileNames, filepath.Join(path, baseName))
@@ -442,20 +592,18 @@ mapping:
 				fileNames = append(fileNames, filepath.Join(path, "usr", "lib", "debug", dirName, baseName+".debug"))
 			}
 			for _, name := range fileNames {
-				if f, err := obj.Open(name, m.Start, m.Limit, m.Offset, m.KernelRelocationSymbol); err == nil {
-					defer f.Close()
-					fileBuildID := f.BuildID()
-					if m.BuildID != "" && m.BuildID != fileBuildID {
-						ui.PrintErr("Ignoring local file " + name + ": build-id mismatch (" + m.BuildID + " != " + fileBuildID + ")")
-					} else {
-						// Explicitly do not update KernelRelocationSymbol --
-						// the new local file name is most likely missing it.
-						m.File = name
-						continue mapping
-					}
+				if useFile(name) {
+					continue mapping
 				}
 			}
 		}
+		if deleted {
+			// Like for other mappings, the file at the path of the mapping is
+			// the last resort. It is a new version if the build ids match.
+			if !useFile(file) {
+				ui.PrintErr("No binary found for deleted mapping ", m.File)
+			}
+		}
 	}
 	if len(p.Mapping) == 0 {
 		// If there are no mappings, add a fake mapping to attempt symbolization.
@@ -488,9 +636,12 @@ mapping:
 
 // fetch fetches a profile from source, within the timeout specified,
 // producing messages through the ui. It returns the profile and the
-// url of the actual source of the profile for remote profiles.
+// url of the actual source of the profile for remote profiles. A tar
+// archive of profiles, as identified by isProfileTar, is fetched as the
+// merge of the profiles it holds.
 func fetch(source string, duration, timeout time.Duration, ui plugin.UI, tr http.RoundTripper) (p *profile.Profile, src string, err error) {
 	var f io.ReadCloser
+	name, contentType := source, ""
 
 	// First determine whether the source is a file, if not, it will be treated as a URL.
 	if _, err = os.Stat(source); err == nil {
@@ -499,6 +650,11 @@ func fetch(source string, duration, timeout time.Duration, ui plugin.UI, tr http
 		} else {
 			f, err = os.Open(source)
 		}
+	} else if slice, offset, length, ok := parseFileSlice(source); ok {
+		f, err = openFileSlice(slice, offset, length)
+	} else if parseSSHSource(source) {
+		ui.Print("Fetching profile over SSH from " + source)
+		f, err = fetchSSH(source, timeout)
 	} else {
 		sourceURL, timeout := adjustURL(source, duration, timeout)
 		if sourceURL != "" {
@@ -506,33 +662,192 @@ func fetch(source string, duration, timeout time.Duration, ui plugin.UI, tr http
 			if duration > 0 {
 				ui.Print(fmt.Sprintf("Please wait... (%v)", duration))
 			}
-			f, err = fetchURL(sourceURL, timeout, tr)
+			f, contentType, err = fetchURL(sourceURL, timeout, tr)
 			src = sourceURL
+			if u, uerr := url.Parse(sourceURL); uerr == nil {
+				name = u.Path
+			}
 		}
 	}
 	if err == nil {
 		defer f.Close()
-		p, err = profile.Parse(f)
+		if isProfileTar(name, contentType) {
+			p, err = parseProfileTar(f)
+		} else {
+			p, err = profile.Parse(f)
+		}
 	}
 	return
 }
 
-// fetchURL fetches a profile from a URL using HTTP.
-func fetchURL(source string, timeout time.Duration, tr http.RoundTripper) (io.ReadCloser, error) {
+// isProfileTar reports whether a source with the given file name or URL
+// path, and the given HTTP response content type if fetched over HTTP,
+// is a tar archive of profiles: its content type is application/x-tar
+// or application/tar, or its name ends in .tar.
+func isProfileTar(name, contentType string) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case "application/x-tar", "application/tar":
+			return true
+		}
+	}
+	return strings.HasSuffix(name, ".tar")
+}
+
+// parseProfileTar parses the profiles held by the regular files of a tar
+// archive, such as one profile per CPU core, and merges them.
+func parseProfileTar(r io.Reader) (*profile.Profile, error) {
+	tr := tar.NewReader(r)
+	var profiles []*profile.Profile
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar archive: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		p, err := profile.Parse(tr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s in tar archive: %v", h.Name, err)
+		}
+		profiles = append(profiles, p)
+	}
+	if len(profiles) == 0 {
+		return nil, errors.New("tar archive holds no profiles")
+	}
+	p, _, err := combineProfiles(profiles, nil)
+	return p, err
+}
+
+// parseFileSlice recognizes sources of the form file@offset:length, which
+// refer to a profile embedded in a larger file such as a core dump. The
+// offset and length may be given in decimal or with a 0x prefix. ok is
+// false if the source does not have this form or the file does not exist.
+func parseFileSlice(source string) (name string, offset, length int64, ok bool) {
+	at := strings.LastIndex(source, "@")
+	if at == -1 {
+		return "", 0, 0, false
+	}
+	name = source[:at]
+	off, size, found := strings.Cut(source[at+1:], ":")
+	if !found {
+		return "", 0, 0, false
+	}
+	var err error
+	if offset, err = strconv.ParseInt(off, 0, 64); err != nil {
+		return "", 0, 0, false
+	}
+	if length, err = strconv.ParseInt(size, 0, 64); err != nil {
+		return "", 0, 0, false
+	}
+	if _, err := os.Stat(name); err != nil {
+		return "", 0, 0, false
+	}
+	return name, offset, length, true
+}
+
+// openFileSlice opens the length bytes of the named file starting at
+// offset, after checking that they lie within the file.
+func openFileSlice(name string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("%s: invalid profile slice at offset %d with length %d", name, offset, length)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if size := fi.Size(); offset > size || length > size-offset {
+		f.Close()
+		return nil, fmt.Errorf("%s: profile slice at offset %d with length %d is truncated, file size is %d", name, offset, length, size)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+// scpCommand is the command used to copy profiles from scp-style sources.
+// It is a variable so that tests can replace it.
+var scpCommand = "scp"
+
+// parseSSHSource reports whether source has the scp form user@host:path,
+// where path is absolute or relative to the remote home directory ("~/").
+// The user and host must be non-empty and free of slashes and spaces, and
+// so cannot be confused with a local file or a URL, nor start with '-'
+// and be taken as an option by scp.
+func parseSSHSource(source string) bool {
+	userHost, path, found := strings.Cut(source, ":")
+	if !found || !(strings.HasPrefix(path, "/") || strings.HasPrefix(path, "~/")) {
+		return false
+	}
+	user, host, found := strings.Cut(userHost, "@")
+	if !found || user == "" || host == "" || strings.HasPrefix(user, "-") {
+		return false
+	}
+	return !strings.ContainsAny(userHost, "/ \t\n") && !strings.Contains(host, "@")
+}
+
+// fetchSSH copies the profile at an scp-style source into a temporary file
+// using scp, and opens it. The source is passed to scp as a single argument
+// following "--", without going through a local shell, so it cannot inject
+// options or commands. Authentication and host key verification are left
+// to scp and the user's ssh configuration. A positive timeout bounds the
+// whole transfer.
+func fetchSSH(source string, timeout time.Duration) (io.ReadCloser, error) {
+	tmp, err := newTempFile(os.TempDir(), "pprof_", ".pb.gz")
+	if err != nil {
+		return nil, err
+	}
+	deferDeleteTempFile(tmp.Name())
+	tmp.Close()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, scpCommand, "-q", "--", source, tmp.Name())
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("scp fetch of %s: %v: %s", source, err, msg)
+		}
+		return nil, fmt.Errorf("scp fetch of %s: %v", source, err)
+	}
+	return os.Open(tmp.Name())
+}
+
+// fetchURL fetches a profile from a URL using HTTP. It returns the body
+// and the content type of the response.
+func fetchURL(source string, timeout time.Duration, tr http.RoundTripper) (io.ReadCloser, string, error) {
 	client := &http.Client{
 		Transport: tr,
 		Timeout:   timeout + 5*time.Second,
 	}
 	resp, err := client.Get(source)
 	if err != nil {
-		return nil, fmt.Errorf("http fetch: %v", err)
+		return nil, "", fmt.Errorf("http fetch: %v", err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
-		return nil, statusCodeError(resp)
+		return nil, "", statusCodeError(resp)
 	}
 
-	return resp.Body, nil
+	return resp.Body, resp.Header.Get("Content-Type"), nil
 }
 
 func statusCodeError(resp *http.Response) error {
@@ -15,28 +15,35 @@
 package driver
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/pprof/internal/binutils"
 	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/internal/report"
 	"github.com/google/pprof/internal/symbolizer"
 	"github.com/google/pprof/internal/transport"
 	"github.com/google/pprof/profile"
@@ -97,6 +104,67 @@ func TestSymbolizationPath(t *testing.T) {
 	os.Setenv("PPROF_BINARY_PATH", savePath)
 }
 
+func TestStripDeleted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test assumes Unix paths")
+	}
+	home := t.TempDir()
+	t.Setenv(homeEnv(), home)
+	for _, tc := range []struct {
+		env, file, buildID string
+		strip              bool
+		want               string
+		msgCount           int
+	}{
+		{"", "/usr/bin/binary (deleted)", "", false, "/usr/bin/binary (deleted)", 0},
+		{"", "/usr/bin/binary (deleted)", "", true, "/usr/bin/binary", 0},
+		{"", "/usr/bin/binary (deleted)", "fedcb10000", true, "/usr/bin/binary", 0},
+		{"/alternate/architecture", "/usr/bin/binary (deleted)", "", true, "/alternate/architecture/binary", 0},
+		// A different build: the ignored file and the missing binary are reported.
+		{"", "/usr/bin/binary (deleted)", "abcde10002", true, "/usr/bin/binary (deleted)", 2},
+		{"", "/usr/bin/missing (deleted)", "", true, "/usr/bin/missing (deleted)", 1},
+	} {
+		t.Setenv("PPROF_BINARY_PATH", tc.env)
+		p := &profile.Profile{
+			Mapping: []*profile.Mapping{{File: tc.file, BuildID: tc.buildID}},
+		}
+		s := &source{StripDeleted: tc.strip}
+		ui := &proftest.TestUI{T: t, AllowRx: "Ignoring local file|No binary found"}
+		locateBinaries(p, s, testObj{home}, ui)
+		if file := p.Mapping[0].File; file != tc.want {
+			t.Errorf("%s:%s:%s strip=%v, want %s, got %s", tc.env, tc.file, tc.buildID, tc.strip, tc.want, file)
+		}
+		if ui.NumAllowRxMatches != tc.msgCount {
+			t.Errorf("%s:%s:%s strip=%v, got %d messages, want %d", tc.env, tc.file, tc.buildID, tc.strip, ui.NumAllowRxMatches, tc.msgCount)
+		}
+	}
+}
+
+func TestRelocationSymbols(t *testing.T) {
+	if _, err := relocationSymbols([]string{"firmware.elf"}); err == nil {
+		t.Error("relocationSymbols() of a value without a symbol got nil error")
+	}
+	syms, err := relocationSymbols([]string{"firmware.elf=_fw_start", "/boot/loader=_reset"})
+	if err != nil {
+		t.Fatalf("relocationSymbols() got error %v", err)
+	}
+
+	p := &profile.Profile{
+		Mapping: []*profile.Mapping{
+			{ID: 1, File: "/lib/firmware/firmware.elf"},
+			{ID: 2, File: "/boot/loader"},
+			{ID: 3, File: "[kernel.kallsyms]_text", KernelRelocationSymbol: "_text"},
+			{ID: 4},
+		},
+	}
+	locateBinaries(p, &source{RelocationSymbols: syms}, testObj{t.TempDir()}, &proftest.TestUI{T: t})
+	for i, want := range []string{"_fw_start", "_reset", "_text", ""} {
+		if got := p.Mapping[i].KernelRelocationSymbol; got != want {
+			t.Errorf("mapping %d: got relocation symbol %q, want %q", p.Mapping[i].ID, got, want)
+		}
+	}
+}
+
 func TestCollectMappingSources(t *testing.T) {
 	const startAddress uint64 = 0x40000
 	const url = "http://example.com"
@@ -242,6 +310,386 @@ func TestFetch(t *testing.T) {
 	}
 }
 
+func TestFetchFileSlice(t *testing.T) {
+	data, err := os.ReadFile("testdata/go.crc32.cpu")
+	if err != nil {
+		t.Fatalf("read profile: %v", err)
+	}
+	prefix := bytes.Repeat([]byte{0xde, 0xad}, 100)
+	suffix := bytes.Repeat([]byte{0xbe, 0xef}, 50)
+	name := filepath.Join(t.TempDir(), "core")
+	if err := os.WriteFile(name, append(append(prefix, data...), suffix...), 0644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	total := len(prefix) + len(data) + len(suffix)
+
+	for _, tc := range []struct {
+		desc, source string
+		wantErr      string
+	}{
+		{
+			desc:   "decimal",
+			source: fmt.Sprintf("%s@%d:%d", name, len(prefix), len(data)),
+		},
+		{
+			desc:   "hex",
+			source: fmt.Sprintf("%s@%#x:%#x", name, len(prefix), len(data)),
+		},
+		{
+			desc:    "truncated",
+			source:  fmt.Sprintf("%s@%d:%d", name, len(prefix), total),
+			wantErr: "truncated",
+		},
+		{
+			desc:    "offset past end",
+			source:  fmt.Sprintf("%s@%d:%d", name, total+1, 1),
+			wantErr: "truncated",
+		},
+		{
+			desc:    "zero length",
+			source:  fmt.Sprintf("%s@%d:0", name, len(prefix)),
+			wantErr: "invalid profile slice",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, _, err := fetch(tc.source, 0, 0, &proftest.TestUI{T: t}, &httpTransport{})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("fetch(%s) got error %v, want error containing %q", tc.source, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetch(%s) got error %v, want no error", tc.source, err)
+			}
+			if len(p.Sample) == 0 {
+				t.Error("got zero samples, want non-zero")
+			}
+		})
+	}
+}
+
+// profileTar returns a tar archive holding a file for each of the data.
+func profileTar(t *testing.T, data ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for i, d := range data {
+		if err := w.WriteHeader(&tar.Header{Name: fmt.Sprintf("cpu%d.pb.gz", i), Mode: 0644, Size: int64(len(d))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchTar(t *testing.T) {
+	var profiles [][]byte
+	for i, name := range []string{"core0", "core1"} {
+		fn := &profile.Function{ID: 1, Name: name}
+		loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+		p := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+			Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{int64(10 * (i + 1))}}},
+			Location:   []*profile.Location{loc},
+			Function:   []*profile.Function{fn},
+		}
+		var buf bytes.Buffer
+		if err := p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		profiles = append(profiles, buf.Bytes())
+	}
+	archive := profileTar(t, profiles...)
+	file := filepath.Join(t.TempDir(), "profiles.tar")
+	if err := os.WriteFile(file, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/profiles":
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.Write(archive)
+		case "/profiles.tar":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(archive)
+		case "/empty":
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.Write(profileTar(t))
+		case "/bad":
+			w.Header().Set("Content-Type", "application/x-tar; charset=binary")
+			w.Write(profileTar(t, profiles[0], []byte("not a profile")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		desc, source string
+		wantErr      string
+	}{
+		{desc: "content type", source: server.URL + "/profiles"},
+		{desc: "URL extension", source: server.URL + "/profiles.tar"},
+		{desc: "file extension", source: file},
+		{desc: "empty", source: server.URL + "/empty", wantErr: "no profiles"},
+		{desc: "not a profile", source: server.URL + "/bad", wantErr: "cpu1.pb.gz"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, _, err := fetch(tc.source, 0, 0, &proftest.TestUI{T: t}, nil)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("fetch(%s) got error %v, want error containing %q", tc.source, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetch(%s) got error %v, want no error", tc.source, err)
+			}
+			got := make(map[string]int64)
+			for _, s := range p.Sample {
+				got[s.Location[0].Line[0].Function.Name] += s.Value[0]
+			}
+			if want := map[string]int64{"core0": 10, "core1": 20}; !reflect.DeepEqual(got, want) {
+				t.Errorf("fetch(%s) got values %v, want %v", tc.source, got, want)
+			}
+		})
+	}
+}
+
+func TestParseSSHSource(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		want   bool
+	}{
+		{"user@host:/tmp/cpu.pb.gz", true},
+		{"user@host.example.com:~/profiles/heap", true},
+		{"user@host:relative/path", false},
+		{"user@host:8080/debug/pprof/profile", false},
+		{"host:/tmp/cpu.pb.gz", false},
+		{"@host:/tmp/cpu.pb.gz", false},
+		{"user@:/tmp/cpu.pb.gz", false},
+		{"-oProxyCommand=x@host:/tmp/cpu.pb.gz", false},
+		{"user@host@other:/tmp/cpu.pb.gz", false},
+		{"dir/user@host:/tmp/cpu.pb.gz", false},
+		{"http://user@host:/tmp/cpu.pb.gz", false},
+		{"testdata/core@0x10:0x20", false},
+	} {
+		if got := parseSSHSource(tc.source); got != tc.want {
+			t.Errorf("parseSSHSource(%q) = %v, want %v", tc.source, got, tc.want)
+		}
+	}
+}
+
+func TestFetchSSH(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a shell script as scp")
+	}
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	profilePath, err := filepath.Abs("testdata/go.crc32.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake scp records its arguments, and copies the test profile to
+	// its destination unless asked for a missing file.
+	fakeSCP := filepath.Join(dir, "scp")
+	script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$@" > %q
+case "$3" in
+*missing*) echo "scp: $3: No such file or directory" >&2; exit 1;;
+esac
+cp %q "$4"
+`, argsFile, profilePath)
+	if err := os.WriteFile(fakeSCP, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(cmd string) { scpCommand = cmd }(scpCommand)
+	scpCommand = fakeSCP
+	defer cleanupTempFiles()
+
+	const source = "user@host:/tmp/cpu.pb.gz"
+	p, src, err := fetch(source, 0, 0, &proftest.TestUI{T: t}, &httpTransport{})
+	if err != nil {
+		t.Fatalf("fetch(%s): %v", source, err)
+	}
+	if len(p.Sample) == 0 {
+		t.Error("got zero samples, want non-zero")
+	}
+	if src != "" {
+		t.Errorf("got remote source %q, want none", src)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotArgs := strings.Split(strings.TrimSpace(string(args)), "\n")
+	if len(gotArgs) != 4 || !reflect.DeepEqual(gotArgs[:3], []string{"-q", "--", source}) {
+		t.Errorf("got scp arguments %q, want [-q -- %s <tmpfile>]", gotArgs, source)
+	}
+
+	_, _, err = fetch("user@host:/tmp/missing", 0, 0, &proftest.TestUI{T: t}, &httpTransport{})
+	if err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+		t.Errorf("got error %v, want scp error message", err)
+	}
+}
+
+// slowFetcher returns a single-sample profile for sources named "p<N>",
+// taking longer for smaller N so that fetches complete in reverse order.
+// It records the maximum number of fetches in progress at once.
+type slowFetcher struct {
+	n int
+
+	mu              sync.Mutex
+	active, maxSeen int
+}
+
+func (f *slowFetcher) Fetch(src string, _, _ time.Duration) (*profile.Profile, string, error) {
+	f.mu.Lock()
+	f.active++
+	f.maxSeen = max(f.maxSeen, f.active)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.active--
+		f.mu.Unlock()
+	}()
+
+	var i int
+	if _, err := fmt.Sscanf(src, "p%d", &i); err != nil {
+		return nil, "", fmt.Errorf("fetch failed")
+	}
+	time.Sleep(time.Duration(f.n-i) * 10 * time.Millisecond)
+
+	fn := &profile.Function{ID: 1, Name: src}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	return &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "samples", Unit: "count"},
+		Period:     1,
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{int64(i + 1)}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+	}, "", nil
+}
+
+func TestFetchParallelism(t *testing.T) {
+	const n = 6
+	for _, parallelism := range []int{0, 1, 2, 4} {
+		t.Run(fmt.Sprintf("parallelism=%d", parallelism), func(t *testing.T) {
+			s := &source{FetchParallelism: parallelism}
+			var sources []profileSource
+			for i := 0; i < n; i++ {
+				sources = append(sources, profileSource{addr: fmt.Sprintf("p%d", i), source: s})
+				if i == n/2 {
+					sources = append(sources, profileSource{addr: "bad", source: s})
+				}
+			}
+			f := &slowFetcher{n: n}
+			ui := &proftest.TestUI{T: t, AllowRx: "bad: fetch failed"}
+
+			p, _, _, count, err := chunkedGrab(sources, f, testObj{}, ui, &httpTransport{})
+			if err != nil {
+				t.Fatalf("chunkedGrab() got error %v, want no error", err)
+			}
+			if count != n {
+				t.Errorf("got %d profiles, want %d", count, n)
+			}
+			if ui.NumAllowRxMatches != 1 {
+				t.Errorf("got %d fetch errors reported, want 1", ui.NumAllowRxMatches)
+			}
+			if parallelism > 0 && f.maxSeen > parallelism {
+				t.Errorf("got %d concurrent fetches, want at most %d", f.maxSeen, parallelism)
+			}
+
+			// Samples must be merged in source order.
+			var got []string
+			for _, s := range p.Sample {
+				got = append(got, fmt.Sprintf("%s=%d", s.Location[0].Line[0].Function.Name, s.Value[0]))
+			}
+			var want []string
+			for i := 0; i < n; i++ {
+				want = append(want, fmt.Sprintf("p%d=%d", i, i+1))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got samples %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestProfileByBuildID(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	t.Setenv("PPROF_PROFILE_PATH", dir1+string(filepath.ListSeparator)+dir2)
+
+	writeProfile := func(path, fn string, age time.Duration) {
+		t.Helper()
+		p := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+			Mapping:    []*profile.Mapping{{ID: 1, File: "/bin/main", BuildID: "abcd"}},
+			Function:   []*profile.Function{{ID: 1, Name: fn}},
+		}
+		p.Location = []*profile.Location{{ID: 1, Mapping: p.Mapping[0], Line: []profile.Line{{Function: p.Function[0]}}}}
+		p.Sample = []*profile.Sample{{Location: p.Location, Value: []int64{1}}}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeProfile(filepath.Join(dir1, "abcd", "old.pb.gz"), "old", 2*time.Hour)
+	writeProfile(filepath.Join(dir2, "abcd", "new.pb.gz"), "new", time.Hour)
+	writeProfile(filepath.Join(dir1, "other", "other.pb.gz"), "other", 0)
+
+	parse := func(buildID string) (*source, error) {
+		f := baseFlags()
+		f.strings["buildid"] = buildID
+		o := setDefaults(&plugin.Options{Flagset: f})
+		src, _, err := parseFlags(o)
+		return src, err
+	}
+
+	src, err := parse("abcd")
+	if err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	if want := filepath.Join(dir2, "abcd", "new.pb.gz"); !reflect.DeepEqual(src.Sources, []string{want}) {
+		t.Fatalf("got sources %v, want [%s]", src.Sources, want)
+	}
+	src.Symbolize = "none"
+	p, err := fetchProfiles(context.Background(), src, setDefaults(&plugin.Options{Flagset: baseFlags(), UI: &proftest.TestUI{T: t}}))
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	if got := p.Function[0].Name; got != "new" {
+		t.Errorf("fetched profile with function %q, want %q", got, "new")
+	}
+
+	for _, buildID := range []string{"missing", "../abcd"} {
+		if _, err := parse(buildID); err == nil {
+			t.Errorf("parseFlags with build id %q: got no error", buildID)
+		}
+	}
+}
+
 func TestFetchWithBase(t *testing.T) {
 	baseConfig := currentConfig()
 	defer setCurrentConfig(baseConfig)
@@ -536,7 +984,7 @@ func TestFetchWithBase(t *testing.T) {
 				t.Fatalf("got error %q, want no error", err)
 			}
 
-			p, err := fetchProfiles(src, o)
+			p, err := fetchProfiles(context.Background(), src, o)
 
 			if tc.wantFetchErrorMsg != "" {
 				if err == nil {
@@ -569,6 +1017,233 @@ func TestFetchWithBase(t *testing.T) {
 	}
 }
 
+func TestFetchWithBaseMean(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	const path = "testdata/"
+	for _, tc := range []struct {
+		desc       string
+		bases      []string
+		baseMean   bool
+		wantValues [][]int64
+		wantErrMsg string
+	}{
+		{
+			desc:     "mean of identical bases equal to source",
+			bases:    []string{path + "cppbench.contention", path + "cppbench.contention"},
+			baseMean: true,
+		},
+		{
+			desc:     "mean of identical bases different from source",
+			bases:    []string{path + "cppbench.small.contention", path + "cppbench.small.contention", path + "cppbench.small.contention"},
+			baseMean: true,
+			wantValues: [][]int64{
+				{1700, 608878600},
+				{100, 23992},
+				{200, 179943},
+				{100, 17778444},
+				{100, 75976},
+				{300, 63568134},
+			},
+		},
+		{
+			desc:  "sum of identical bases",
+			bases: []string{path + "cppbench.contention", path + "cppbench.contention"},
+			wantValues: [][]int64{
+				{-2700, -608881724},
+				{-100, -23992},
+				{-200, -179943},
+				{-100, -17778444},
+				{-100, -75976},
+				{-300, -63568134},
+			},
+		},
+		{
+			desc:       "mean without base",
+			baseMean:   true,
+			wantErrMsg: "must have base profile to average",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			setCurrentConfig(baseConfig)
+			f := testFlags{
+				stringLists: map[string][]string{"base": tc.bases},
+				bools:       map[string]bool{"base_mean": tc.baseMean},
+				args:        []string{path + "cppbench.contention"},
+			}
+			o := setDefaults(&plugin.Options{
+				UI:            &proftest.TestUI{T: t, AllowRx: "Local symbolization failed|Some binary filenames not available"},
+				Flagset:       f,
+				HTTPTransport: transport.New(nil),
+			})
+			src, _, err := parseFlags(o)
+			if tc.wantErrMsg != "" {
+				if err == nil || err.Error() != tc.wantErrMsg {
+					t.Fatalf("got error %v, want error %q", err, tc.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFlags: %v", err)
+			}
+			p, err := fetchProfiles(context.Background(), src, o)
+			if err != nil {
+				t.Fatalf("fetchProfiles: %v", err)
+			}
+			var got [][]int64
+			for _, s := range p.Sample {
+				got = append(got, s.Value)
+			}
+			if !reflect.DeepEqual(got, tc.wantValues) {
+				t.Errorf("got sample values %v, want %v", got, tc.wantValues)
+			}
+		})
+	}
+}
+
+func TestFetchUnsampleHeap(t *testing.T) {
+	defer setCurrentConfig(currentConfig())
+
+	heapProfile := func(values []int64) *profile.Profile {
+		fn := &profile.Function{ID: 1, Name: "alloc"}
+		loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+		return &profile.Profile{
+			SampleType: []*profile.ValueType{
+				{Type: "inuse_objects", Unit: "count"},
+				{Type: "inuse_space", Unit: "bytes"},
+			},
+			PeriodType: &profile.ValueType{Type: "space", Unit: "bytes"},
+			Period:     524288,
+			Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: values}},
+			Location:   []*profile.Location{loc},
+			Function:   []*profile.Function{fn},
+		}
+	}
+	writeProfile := func(p *profile.Profile) string {
+		var buf bytes.Buffer
+		if err := p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "heap.pb.gz")
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	small := writeProfile(heapProfile([]int64{10, 1000}))
+	large := writeProfile(heapProfile([]int64{10, 100000}))
+
+	// Profiles are unsampled before they are merged, as the estimate
+	// depends on the average object size of their samples.
+	var wantMerged []int64
+	for _, values := range [][]int64{{10, 1000}, {10, 100000}} {
+		p := heapProfile(values)
+		p.UnsampleHeap()
+		if wantMerged == nil {
+			wantMerged = p.Sample[0].Value
+			continue
+		}
+		for i, v := range p.Sample[0].Value {
+			wantMerged[i] += v
+		}
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		unsample bool
+		sources  []string
+		want     []int64
+	}{
+		{"sampled", false, []string{small}, []int64{10, 1000}},
+		{"unsampled", true, []string{small}, []int64{52433, 5243380}},
+		{"unsampled sources", true, []string{small, large}, wantMerged},
+	} {
+		f := testFlags{
+			bools:   map[string]bool{"unsample_heap": tc.unsample},
+			strings: map[string]string{"symbolize": "none"},
+			args:    tc.sources,
+		}
+		o := setDefaults(&plugin.Options{UI: &proftest.TestUI{T: t}, Flagset: f})
+		src, _, err := parseFlags(o)
+		if err != nil {
+			t.Fatalf("%s: parseFlags: %v", tc.desc, err)
+		}
+		p, err := fetchProfiles(context.Background(), src, o)
+		if err != nil {
+			t.Fatalf("%s: fetchProfiles: %v", tc.desc, err)
+		}
+		if got := p.Sample[0].Value; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got values %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestFetchWithRatioBase(t *testing.T) {
+	baseConfig := currentConfig()
+	defer setCurrentConfig(baseConfig)
+
+	const path = "testdata/"
+	for _, tc := range []struct {
+		desc       string
+		lists      map[string][]string
+		wantErrMsg string
+	}{
+		{
+			desc:  "ratio to itself",
+			lists: map[string][]string{"ratio_base": {path + "cppbench.contention"}},
+		},
+		{
+			desc: "ratio_base and base both specified",
+			lists: map[string][]string{
+				"ratio_base": {path + "cppbench.contention"},
+				"base":       {path + "cppbench.contention"},
+			},
+			wantErrMsg: "-ratio_base cannot be specified with -base or -diff_base",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			setCurrentConfig(baseConfig)
+			f := testFlags{
+				stringLists: tc.lists,
+				args:        []string{path + "cppbench.contention"},
+			}
+			o := setDefaults(&plugin.Options{
+				UI:            &proftest.TestUI{T: t, AllowRx: "Local symbolization failed|Some binary filenames not available"},
+				Flagset:       f,
+				HTTPTransport: transport.New(nil),
+			})
+			src, _, err := parseFlags(o)
+			if tc.wantErrMsg != "" {
+				if err == nil || err.Error() != tc.wantErrMsg {
+					t.Fatalf("got error %v, want error %q", err, tc.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFlags: %v", err)
+			}
+			p, err := fetchProfiles(context.Background(), src, o)
+			if err != nil {
+				t.Fatalf("fetchProfiles: %v", err)
+			}
+			_, rpt, err := generateRawReport(p, []string{"top"}, currentConfig(), o)
+			if err != nil {
+				t.Fatalf("generateRawReport: %v", err)
+			}
+			items, _ := report.TextItems(context.Background(), rpt)
+			if len(items) == 0 {
+				t.Fatal("got no report entries")
+			}
+			for _, item := range items {
+				if item.RatioFormat != "1.00x" {
+					t.Errorf("%s: got ratio %q, want 1.00x", item.Name, item.RatioFormat)
+				}
+			}
+		})
+	}
+}
+
 // mappingSources creates MappingSources map with a single item.
 func mappingSources(key, source string, start uint64) plugin.MappingSources {
 	return plugin.MappingSources{
@@ -663,7 +1338,7 @@ func TestHTTPSInsecure(t *testing.T) {
 		HTTPTransport: transport.New(nil),
 	}
 	o.Sym = &symbolizer.Symbolizer{Obj: o.Obj, UI: o.UI}
-	p, err := fetchProfiles(s, o)
+	p, err := fetchProfiles(context.Background(), s, o)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -776,7 +1451,7 @@ func TestHTTPSWithServerCertFetch(t *testing.T) {
 	}
 
 	o.Sym = &symbolizer.Symbolizer{Obj: o.Obj, UI: o.UI, Transport: o.HTTPTransport}
-	p, err := fetchProfiles(s, o)
+	p, err := fetchProfiles(context.Background(), s, o)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -834,3 +1509,191 @@ func selfSignedCert(t *testing.T, host string) (tls.Certificate, []byte, []byte)
 	}
 	return cert, bc, bk
 }
+
+func TestFetchSourceStats(t *testing.T) {
+	defer setCurrentConfig(currentConfig())
+
+	fn := &profile.Function{ID: 1, Name: "work"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	dir := t.TempDir()
+	var paths []string
+	for i, v := range []int64{10, 20, 30} {
+		prof := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+			Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{v}}},
+			Location:   []*profile.Location{loc},
+			Function:   []*profile.Function{fn},
+		}
+		var buf bytes.Buffer
+		if err := prof.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("p%d.pb.gz", i))
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	for _, stats := range []bool{false, true} {
+		f := testFlags{
+			bools:   map[string]bool{"source_stats": stats},
+			strings: map[string]string{"symbolize": "none"},
+			args:    paths,
+		}
+		o := setDefaults(&plugin.Options{UI: &proftest.TestUI{T: t}, Flagset: f})
+		src, _, err := parseFlags(o)
+		if err != nil {
+			t.Fatalf("parseFlags: %v", err)
+		}
+		p, err := fetchProfiles(context.Background(), src, o)
+		if err != nil {
+			t.Fatalf("fetchProfiles: %v", err)
+		}
+		got := make(map[string]int64)
+		for _, s := range p.Sample {
+			got[strings.Join(s.Label["pprof::source"], ",")] += s.Value[0]
+		}
+		want := map[string]int64{"": 60}
+		if stats {
+			// Samples are kept apart by source through the merge.
+			want = map[string]int64{"0": 10, "1": 20, "2": 30}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("source_stats=%v: got values by source %v, want %v", stats, got, want)
+		}
+	}
+}
+
+func TestFetchSampleCountDiff(t *testing.T) {
+	defer setCurrentConfig(currentConfig())
+
+	fn := &profile.Function{ID: 1, Name: "work"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	dir := t.TempDir()
+	var paths []string
+	// The current profile has 3 samples of the same stack, which the
+	// fetch merges, and the base profile a single heavier one.
+	for i, cpu := range [][]int64{{10, 10, 10}, {100}} {
+		prof := &profile.Profile{
+			SampleType: []*profile.ValueType{
+				{Type: "samples", Unit: "count"},
+				{Type: "cpu", Unit: "nanoseconds"},
+			},
+			Location: []*profile.Location{loc},
+			Function: []*profile.Function{fn},
+		}
+		for _, v := range cpu {
+			prof.Sample = append(prof.Sample, &profile.Sample{Location: []*profile.Location{loc}, Value: []int64{1, v}})
+		}
+		var buf bytes.Buffer
+		if err := prof.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("p%d.pb.gz", i))
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	f := testFlags{
+		bools:       map[string]bool{"top": true},
+		strings:     map[string]string{"symbolize": "none"},
+		stringLists: map[string][]string{"diff_base": {paths[1]}},
+		args:        paths[:1],
+	}
+	o := setDefaults(&plugin.Options{UI: &proftest.TestUI{T: t}, Flagset: f})
+	src, _, err := parseFlags(o)
+	if err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	p, err := fetchProfiles(context.Background(), src, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	cfg := currentConfig()
+	cfg.SampleCountDiff = true
+	_, rpt, err := generateRawReport(p, []string{"top"}, cfg, o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	items, _ := report.TextItems(context.Background(), rpt)
+	if len(items) != 1 || items[0].CountDiffFormat != "+2" {
+		t.Errorf("got items %+v, want a single one with a count diff of +2", items)
+	}
+}
+
+// ctxSymbolizer is a plugin.ContextSymbolizer returning the error of the
+// context it is given.
+type ctxSymbolizer struct{ testSymbolizer }
+
+func (ctxSymbolizer) SymbolizeContext(ctx context.Context, _ string, _ plugin.MappingSources, _ *profile.Profile) error {
+	return ctx.Err()
+}
+
+func TestSymbolizeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, sym := range []plugin.Symbolizer{testSymbolizer{}, ctxSymbolizer{}} {
+		if err := symbolize(ctx, sym, "", nil, &profile.Profile{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("symbolize with %T: got error %v, want %v", sym, err, context.Canceled)
+		}
+		if err := symbolize(context.Background(), sym, "", nil, &profile.Profile{}); err != nil {
+			t.Errorf("symbolize with %T: got error %v, want none", sym, err)
+		}
+	}
+}
+
+func TestSourceStatsFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format  string
+		wantErr bool
+	}{
+		{"top", false},
+		{"traces", true},
+		{"tags", true},
+		{"raw", true},
+		{"proto", true},
+	} {
+		f := testFlags{
+			bools: map[string]bool{"source_stats": true, tc.format: true},
+			args:  []string{"p0.pb.gz", "p1.pb.gz"},
+		}
+		o := setDefaults(&plugin.Options{UI: &proftest.TestUI{T: t}, Flagset: f})
+		_, _, err := parseFlags(o)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("-source_stats -%s: got error %v, want error %v", tc.format, err, tc.wantErr)
+		}
+	}
+}
+
+func TestFetchAddComments(t *testing.T) {
+	defer setCurrentConfig(currentConfig())
+
+	f := testFlags{
+		strings:     map[string]string{"symbolize": "none"},
+		stringLists: map[string][]string{"add_comment": {"captured on host X", "", "after the upgrade"}},
+		args:        []string{"testdata/cppbench.cpu"},
+	}
+	o := setDefaults(&plugin.Options{UI: &proftest.TestUI{T: t}, Flagset: f})
+	src, _, err := parseFlags(o)
+	if err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	p, err := fetchProfiles(context.Background(), src, o)
+	if err != nil {
+		t.Fatalf("fetchProfiles: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	p, err = profile.Parse(&buf)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if want := []string{"captured on host X", "after the upgrade"}; !reflect.DeepEqual(p.Comments, want) {
+		t.Errorf("got comments %q after round trip, want %q", p.Comments, want)
+	}
+}
@@ -407,6 +407,16 @@ function viewer(baseUrl, nodes, options) {
   let origFill = new Map();
   let searchAlarm = null;
   let buttonsEnabled = true;
+  const linkUpdaters = new Map();
+
+  // Keyboard shortcuts of Refine menu entries.
+  const shortcuts = {
+    'f': 'focus',
+    'i': 'ignore',
+    'h': 'hide',
+    's': 'show',
+    'r': 'reset',
+  };
 
   // Return current selection.
   function getSelection() {
@@ -438,6 +448,28 @@ function viewer(baseUrl, nodes, options) {
     e.preventDefault();
   }
 
+  function handleShortcut(e) {
+    // Leave keys typed in text fields, such as the search box, and
+    // browser shortcuts alone.
+    const t = e.target;
+    if (t.nodeName == 'INPUT' || t.nodeName == 'TEXTAREA' ||
+        t.nodeName == 'SELECT' || t.isContentEditable) {
+      return;
+    }
+    if (e.ctrlKey || e.metaKey || e.altKey) return;
+    const id = shortcuts[e.key];
+    if (!id) return;
+    const link = document.getElementById(id);
+    if (link == null) return;
+    // Refinements need a selection, but reset does not.
+    if (id != 'reset') {
+      if (!buttonsEnabled) return;
+      linkUpdaters.get(id)();
+    }
+    e.preventDefault();
+    window.location.href = link.href;
+  }
+
   function handleSearch() {
     // Delay expensive processing so a flurry of key strokes is handled once.
     if (searchAlarm != null) {
@@ -584,6 +616,7 @@ function viewer(baseUrl, nodes, options) {
     // We update on mouseenter so middle-click/right-click work properly.
     elem.addEventListener('mouseenter', updater);
     elem.addEventListener('touchstart', updater);
+    linkUpdaters.set(id, updater);
 
     function updater() {
       // The selection can be in one of two modes: regexp-based or
@@ -700,6 +733,7 @@ function viewer(baseUrl, nodes, options) {
 
   search.addEventListener('input', handleSearch);
   search.addEventListener('keydown', handleKey);
+  document.addEventListener('keydown', handleShortcut);
 
   // Give initial focus to main container so it can be scrolled using keys.
   const main = document.getElementById('bodycontainer');
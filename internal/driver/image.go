@@ -0,0 +1,339 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// containerImage is a container image tarball, as written by "docker save"
+// or holding an OCI image layout, in which the file names of mappings are
+// looked up to find the binaries of a profile of a containerized process.
+// A file name such as /usr/bin/server is the path of the file in the root
+// file system of the image, made of its layers.
+// The members of the image tarball and the entries of its layers are
+// indexed when the image is opened, so that looking up a file only reads
+// the layer holding it.
+type containerImage struct {
+	path    string
+	members map[string]imageMember // Members of the image tarball, by name.
+	layers  []*imageLayer          // Layers of the image, from the bottom up.
+}
+
+// imageMember locates the contents of a member of the image tarball.
+type imageMember struct {
+	offset, size int64
+}
+
+// imageLayer is a layer of an image, with the headers of its entries by
+// absolute file name.
+type imageLayer struct {
+	member  string
+	entries map[string]*tar.Header
+}
+
+// errNotInImage is returned when a file is not in the image.
+var errNotInImage = errors.New("file not found in image")
+
+// maxImageSymlinks is the number of symbolic links followed to resolve
+// a file name in an image.
+const maxImageSymlinks = 16
+
+// openImage reads the manifest of the image tarball at path and indexes
+// the entries of its layers.
+func openImage(path string) (*containerImage, error) {
+	img := &containerImage{path: path}
+	if err := img.indexMembers(); err != nil {
+		return nil, err
+	}
+	layers, err := img.dockerLayers()
+	if err != nil {
+		if layers, err = img.ociLayers(); err != nil {
+			return nil, fmt.Errorf("%s is not a Docker or OCI image tarball: %v", path, err)
+		}
+	}
+	for _, member := range layers {
+		l, err := img.indexLayer(member)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", member, err)
+		}
+		img.layers = append(img.layers, l)
+	}
+	return img, nil
+}
+
+// indexMembers records the location of the members of the image tarball.
+func (img *containerImage) indexMembers() error {
+	f, err := os.Open(img.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img.members = make(map[string]imageMember)
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The tar reader does not buffer, so the file is at the start of
+		// the member contents.
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		img.members[path.Clean(h.Name)] = imageMember{offset, h.Size}
+	}
+}
+
+// indexLayer reads the headers of the entries of the layer tarball member.
+func (img *containerImage) indexLayer(member string) (*imageLayer, error) {
+	l := &imageLayer{member: member, entries: make(map[string]*tar.Header)}
+	err := img.walk(member, func(r io.Reader) error {
+		tr, err := layerReader(r)
+		if err != nil {
+			return err
+		}
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			l.entries[path.Clean("/"+h.Name)] = h
+		}
+	})
+	return l, err
+}
+
+// dockerLayers returns the layers listed by the manifest.json file of
+// "docker save" tarballs. Only the first image of the tarball is used.
+func (img *containerImage) dockerLayers() ([]string, error) {
+	var manifest []struct {
+		Layers []string
+	}
+	if err := img.readJSON("manifest.json", &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest) == 0 {
+		return nil, errors.New("empty manifest.json")
+	}
+	return manifest[0].Layers, nil
+}
+
+// ociLayers returns the layers of the image referenced by the index.json
+// file of an OCI image layout, going through nested indexes. Only the
+// first manifest of each index is used.
+func (img *containerImage) ociLayers() ([]string, error) {
+	type descriptor struct {
+		Digest string
+	}
+	var index struct {
+		Manifests []descriptor
+		Layers    []descriptor
+	}
+	if err := img.readJSON("index.json", &index); err != nil {
+		return nil, err
+	}
+	for depth := 0; len(index.Layers) == 0; depth++ {
+		if len(index.Manifests) == 0 || depth > 4 {
+			return nil, errors.New("no image manifest in index.json")
+		}
+		digest := index.Manifests[0].Digest
+		index.Manifests = nil
+		if err := img.readJSON(blobPath(digest), &index); err != nil {
+			return nil, err
+		}
+	}
+	var layers []string
+	for _, l := range index.Layers {
+		layers = append(layers, blobPath(l.Digest))
+	}
+	return layers, nil
+}
+
+// blobPath returns the path of the blob with the given digest in an OCI
+// image layout.
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// readJSON decodes the JSON file name of the image tarball into v.
+func (img *containerImage) readJSON(name string, v interface{}) error {
+	return img.walk(name, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(v)
+	})
+}
+
+// walk calls read with the contents of the member name of the image
+// tarball.
+func (img *containerImage) walk(name string, read func(io.Reader) error) error {
+	m, ok := img.members[name]
+	if !ok {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	f, err := os.Open(img.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return read(io.NewSectionReader(f, m.offset, m.size))
+}
+
+// extract copies the file name of the image to a temporary file, deleted
+// when pprof exits, and returns the path of the temporary file.
+func (img *containerImage) extract(name string) (string, error) {
+	var out *os.File
+	err := img.lookup(name, func(r io.Reader) error {
+		var err error
+		if out, err = newTempFile(os.TempDir(), "pprof-image-", "-"+path.Base(name)); err != nil {
+			return err
+		}
+		deferDeleteTempFile(out.Name())
+		_, err = io.Copy(out, r)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// lookup calls read with the contents of the file name in the root file
+// system of the image, resolving symbolic links.
+func (img *containerImage) lookup(name string, read func(io.Reader) error) error {
+	name = path.Clean("/" + name)
+	for links := 0; links <= maxImageSymlinks; links++ {
+		target, err := img.find(name, read)
+		if err != nil || target == "" {
+			return err
+		}
+		name = target
+	}
+	return fmt.Errorf("%s: too many levels of symbolic links", name)
+}
+
+// find looks for the file name in the layers of the image, from the top
+// layer down, taking the files deleted by upper layers into account. It
+// calls read with the contents of the file if it is a regular file, and
+// returns the absolute target of the file if it is a link.
+func (img *containerImage) find(name string, read func(io.Reader) error) (string, error) {
+	for i := len(img.layers) - 1; i >= 0; i-- {
+		l := img.layers[i]
+		// Whiteout: the file or one of its directories was deleted.
+		for p := name; p != "/"; p = path.Dir(p) {
+			if _, ok := l.entries[path.Join(path.Dir(p), ".wh."+path.Base(p))]; ok {
+				return "", errNotInImage
+			}
+		}
+		if h, ok := l.entries[name]; ok {
+			switch h.Typeflag {
+			case tar.TypeReg:
+				return "", img.readFile(l, name, read)
+			case tar.TypeSymlink:
+				target := h.Linkname
+				if !path.IsAbs(target) {
+					target = path.Join(path.Dir(name), target)
+				}
+				return target, nil
+			case tar.TypeLink:
+				return path.Clean("/" + h.Linkname), nil
+			}
+			return "", fmt.Errorf("%s is not a regular file in image", name)
+		}
+		for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+			if h, ok := l.entries[dir]; ok && h.Typeflag == tar.TypeSymlink {
+				// A directory of the file is a link.
+				target := h.Linkname
+				if !path.IsAbs(target) {
+					target = path.Join(path.Dir(dir), target)
+				}
+				return path.Join(target, strings.TrimPrefix(name, dir)), nil
+			}
+		}
+		for dir := path.Dir(name); ; dir = path.Dir(dir) {
+			if _, ok := l.entries[path.Join(dir, ".wh..wh..opq")]; ok {
+				// Opaque directory: lower layers do not contribute to it.
+				return "", errNotInImage
+			}
+			if dir == "/" {
+				break
+			}
+		}
+	}
+	return "", errNotInImage
+}
+
+// readFile calls read with the contents of the regular file name of
+// layer l.
+func (img *containerImage) readFile(l *imageLayer, name string, read func(io.Reader) error) error {
+	return img.walk(l.member, func(r io.Reader) error {
+		tr, err := layerReader(r)
+		if err != nil {
+			return err
+		}
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+			}
+			if err != nil {
+				return err
+			}
+			if h.Typeflag == tar.TypeReg && path.Clean("/"+h.Name) == name {
+				return read(tr)
+			}
+		}
+	})
+}
+
+// layerReader returns a tar reader for a layer, decompressing it if it is
+// compressed with gzip.
+func layerReader(r io.Reader) (*tar.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(zr), nil
+	}
+	return tar.NewReader(br), nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/google/pprof/internal/binutils"
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/profile"
+)
+
+// tarEntry is a file of a test tarball. Files with a link are symbolic
+// links.
+type tarEntry struct {
+	name, link string
+	data       []byte
+}
+
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0755, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			h.Typeflag, h.Linkname = tar.TypeSymlink, e.link
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testImageLayers are the layers of the test images, from the bottom up.
+func testImageLayers(t *testing.T, server []byte) [][]byte {
+	return [][]byte{
+		makeTar(t, []tarEntry{
+			{name: "usr/bin/server", data: []byte("old server")},
+			{name: "usr/bin/tool", data: []byte("tool")},
+			{name: "usr/lib/old/lib.so", data: []byte("lib")},
+			{name: "etc/hidden", data: []byte("hidden")},
+		}),
+		makeTar(t, []tarEntry{
+			{name: "bin", link: "usr/bin"},
+			{name: "usr/bin/server", data: server},
+			{name: "usr/bin/current", link: "server"},
+			{name: "usr/bin/.wh.tool"},
+			{name: "usr/lib/.wh.old"},
+			{name: "etc/.wh..wh..opq"},
+			{name: "etc/config", data: []byte("config")},
+		}),
+	}
+}
+
+// writeDockerImage writes an image tarball in the format of docker save.
+func writeDockerImage(t *testing.T, server []byte) string {
+	layers := testImageLayers(t, server)
+	path := filepath.Join(t.TempDir(), "image.tar")
+	entries := []tarEntry{
+		{name: "manifest.json", data: []byte(`[{"Config":"config.json","Layers":["l1/layer.tar","l2/layer.tar"]}]`)},
+		{name: "l1/layer.tar", data: layers[0]},
+		{name: "l2/layer.tar", data: layers[1]},
+	}
+	if err := os.WriteFile(path, makeTar(t, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeOCIImage writes an image tarball holding an OCI image layout with
+// compressed layers.
+func writeOCIImage(t *testing.T, server []byte) string {
+	layers := testImageLayers(t, server)
+	path := filepath.Join(t.TempDir(), "image.tar")
+	entries := []tarEntry{
+		{name: "oci-layout", data: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{name: "index.json", data: []byte(`{"manifests":[{"digest":"sha256:index"}]}`)},
+		{name: "blobs/sha256/index", data: []byte(`{"manifests":[{"digest":"sha256:manifest"}]}`)},
+		{name: "blobs/sha256/manifest", data: []byte(`{"layers":[{"digest":"sha256:l1"},{"digest":"sha256:l2"}]}`)},
+		{name: "blobs/sha256/l1", data: gzipData(t, layers[0])},
+		{name: "blobs/sha256/l2", data: gzipData(t, layers[1])},
+	}
+	if err := os.WriteFile(path, makeTar(t, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestContainerImage(t *testing.T) {
+	defer cleanupTempFiles()
+	for _, tc := range []struct {
+		desc  string
+		write func(*testing.T, []byte) string
+	}{
+		{"docker", writeDockerImage},
+		{"oci", writeOCIImage},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			img, err := openImage(tc.write(t, []byte("new server")))
+			if err != nil {
+				t.Fatalf("openImage: %v", err)
+			}
+			for _, c := range []struct {
+				name, want string
+			}{
+				{"/usr/bin/server", "new server"},
+				{"usr/bin/server", "new server"},
+				{"/bin/server", "new server"},
+				{"/usr/bin/current", "new server"},
+				{"/etc/config", "config"},
+				{"/usr/bin/tool", ""},
+				{"/usr/lib/old/lib.so", ""},
+				{"/etc/hidden", ""},
+				{"/missing", ""},
+			} {
+				path, err := img.extract(c.name)
+				if c.want == "" {
+					if !errors.Is(err, errNotInImage) {
+						t.Errorf("extract(%s): got error %v, want %v", c.name, err, errNotInImage)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("extract(%s): %v", c.name, err)
+					continue
+				}
+				if got, err := os.ReadFile(path); err != nil || string(got) != c.want {
+					t.Errorf("extract(%s): got %q, %v, want %q", c.name, got, err, c.want)
+				}
+			}
+		})
+	}
+
+	if _, err := openImage(writeTestFile(t, makeTar(t, []tarEntry{{name: "other", data: []byte("x")}}))); err == nil {
+		t.Error("openImage of a tarball without manifest got nil error")
+	}
+}
+
+func TestContainerImageIndex(t *testing.T) {
+	defer cleanupTempFiles()
+	path := writeOCIImage(t, []byte("new server"))
+	img, err := openImage(path)
+	if err != nil {
+		t.Fatalf("openImage: %v", err)
+	}
+	// Files are looked up in the index built by openImage, and only the
+	// contents of regular files are read from the tarball.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/usr/bin/tool", "/etc/hidden", "/missing", "/bin/missing"} {
+		if _, err := img.extract(name); !errors.Is(err, errNotInImage) {
+			t.Errorf("extract(%s): got error %v, want %v", name, err, errNotInImage)
+		}
+	}
+	if _, err := img.extract("/bin/server"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("extract(/bin/server) of removed tarball: got error %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocateBinariesInImage(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("This test only works on x86-64 Linux")
+	}
+	defer cleanupTempFiles()
+	exe, err := os.ReadFile(filepath.Join("..", "binutils", "testdata", "exe_linux_64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := openImage(writeDockerImage(t, exe))
+	if err != nil {
+		t.Fatalf("openImage: %v", err)
+	}
+
+	m := &profile.Mapping{ID: 1, Start: 0x400000, Limit: 0x4006fc, File: "/usr/bin/server"}
+	p := &profile.Profile{Mapping: []*profile.Mapping{m}}
+	bu := &binutils.Binutils{}
+	locateBinaries(p, &source{Image: img}, bu, &proftest.TestUI{T: t})
+	if m.File == "/usr/bin/server" {
+		t.Fatalf("binary of mapping not found in image")
+	}
+
+	f, err := bu.Open(m.File, m.Start, m.Limit, m.Offset, "")
+	if err != nil {
+		t.Fatalf("Open(%s): %v", m.File, err)
+	}
+	defer f.Close()
+	frames, err := f.SourceLine(0x40052d)
+	if err != nil {
+		t.Fatalf("SourceLine: %v", err)
+	}
+	want := []plugin.Frame{{Func: "main", File: "/tmp/hello.c", Line: 3, StartLine: 3}}
+	if !reflect.DeepEqual(frames, want) {
+		t.Errorf("SourceLine: got %v, want %v", frames, want)
+	}
+}
@@ -15,6 +15,7 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"regexp"
@@ -111,7 +112,7 @@ func interactive(p *profile.Profile, o *plugin.Options) error {
 
 			args, cfg, err := parseCommandLine(tokens)
 			if err == nil {
-				err = generateReportWrapper(copier.newCopy(), args, cfg, o)
+				err = generateReportWrapper(context.Background(), copier.newCopy(), args, cfg, o)
 			}
 
 			if err != nil {
@@ -260,6 +261,9 @@ func parseCommandLine(input []string) ([]string, config, error) {
 		t := args[i]
 		if n, err := strconv.ParseInt(t, 10, 32); err == nil {
 			vcopy.NodeCount = int(n)
+			// An explicit count on the command line wins over the
+			// per-format defaults.
+			vcopy.TextNodeCount, vcopy.GraphNodeCount = 0, 0
 			continue
 		}
 		switch t[0] {
@@ -15,6 +15,7 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"strings"
@@ -131,7 +132,7 @@ func makeShortcuts(input []string, seed int64) (shortcuts, []string) {
 	return s, output
 }
 
-func checkValue(p *profile.Profile, cmd []string, cfg config, o *plugin.Options) error {
+func checkValue(_ context.Context, p *profile.Profile, cmd []string, cfg config, o *plugin.Options) error {
 	if len(cmd) != 2 {
 		return fmt.Errorf("expected len(cmd)==2, got %v", cmd)
 	}
@@ -0,0 +1,109 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// serverMetrics counts the events of a pprof process exposed by the
+// /metrics endpoint of the web interface.
+type serverMetrics struct {
+	mu                sync.Mutex
+	profilesParsed    int64
+	symbolizeFailures int64
+	renders           map[string]*renderStats // Keyed by handler path.
+}
+
+// renderStats accumulates the renders of a web interface handler.
+type renderStats struct {
+	count int64
+	total time.Duration
+}
+
+// metrics holds the metrics of the running pprof process.
+var metrics = &serverMetrics{renders: make(map[string]*renderStats)}
+
+func (m *serverMetrics) profileParsed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.profilesParsed++
+}
+
+func (m *serverMetrics) symbolizeFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.symbolizeFailures++
+}
+
+func (m *serverMetrics) rendered(path string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.renders[path]
+	if s == nil {
+		s = &renderStats{}
+		m.renders[path] = s
+	}
+	s.count++
+	s.total += d
+}
+
+// writeTo writes the metrics in a simple text format, one metric per
+// line, as a name, optionally followed by labels in braces, and a value:
+//
+//	pprof_profiles_parsed_total 1
+//	pprof_symbolization_failures_total 0
+//	pprof_render_count{handler="/top"} 2
+//	pprof_render_seconds_total{handler="/top"} 0.004
+//
+// Render metrics are sorted by handler.
+func (m *serverMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "pprof_profiles_parsed_total %d\n", m.profilesParsed)
+	fmt.Fprintf(w, "pprof_symbolization_failures_total %d\n", m.symbolizeFailures)
+	paths := make([]string, 0, len(m.renders))
+	for path := range m.renders {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(w, "pprof_render_count{handler=%q} %d\n", path, m.renders[path].count)
+	}
+	for _, path := range paths {
+		fmt.Fprintf(w, "pprof_render_seconds_total{handler=%q} %g\n", path, m.renders[path].total.Seconds())
+	}
+}
+
+// timeRender records the time taken by h to serve each request as a
+// render of the handler registered at path.
+func timeRender(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		h(w, req)
+		metrics.rendered(path, time.Since(start))
+	}
+}
+
+// serveMetrics serves the metrics of the pprof process.
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	metrics.writeTo(w)
+}
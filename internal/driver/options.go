@@ -16,10 +16,12 @@ package driver
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/google/pprof/internal/binutils"
 	"github.com/google/pprof/internal/plugin"
@@ -91,6 +93,47 @@ func (ui *stdUI) fprint(f *os.File, args []interface{}) {
 	f.WriteString(text)
 }
 
+// jsonUI wraps a UI to write the messages it prints to w as JSON lines,
+// one object per message with its severity and text, for tools parsing
+// the diagnostics of pprof. Messages from Print have severity "info" and
+// those from PrintErr have severity "error".
+type jsonUI struct {
+	plugin.UI
+
+	mu sync.Mutex // Serializes writes to w.
+	w  io.Writer
+}
+
+// jsonMessage is a message printed by jsonUI.
+type jsonMessage struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// useJSONUI makes the options print messages as JSON lines to w, also
+// for the default symbolizer.
+func useJSONUI(o *plugin.Options, w io.Writer) {
+	o.UI = &jsonUI{UI: o.UI, w: w}
+	if sym, ok := o.Sym.(*symbolizer.Symbolizer); ok {
+		sym.UI = o.UI
+	}
+}
+
+func (ui *jsonUI) Print(args ...interface{}) {
+	ui.print("info", args)
+}
+
+func (ui *jsonUI) PrintErr(args ...interface{}) {
+	ui.print("error", args)
+}
+
+func (ui *jsonUI) print(severity string, args []interface{}) {
+	msg := jsonMessage{severity, strings.TrimSuffix(fmt.Sprint(args...), "\n")}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	json.NewEncoder(ui.w).Encode(msg)
+}
+
 // oswriter implements the Writer interface using a regular file.
 type oswriter struct{}
 
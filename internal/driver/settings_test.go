@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"compress/gzip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -81,6 +82,7 @@ func TestParseConfig(t *testing.T) {
 		TagShow:             "tagshow",
 		TagHide:             "taghide",
 		DivideBy:            1,
+		Compression:         gzip.DefaultCompression,
 		Mean:                true,
 		Normalize:           true,
 		Sort:                "cum",
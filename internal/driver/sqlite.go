@@ -0,0 +1,359 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/pprof/internal/graph"
+	"github.com/google/pprof/internal/report"
+)
+
+// The schema of the SQLite databases written by the sqlite command. Node
+// and edge values are in the unit of the samples, given by the info table.
+const (
+	sqliteInfoSchema = `CREATE TABLE info (key TEXT, value TEXT)`
+
+	sqliteNodesSchema = `CREATE TABLE nodes (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  file TEXT,
+  line INTEGER,
+  objfile TEXT,
+  address INTEGER,
+  flat INTEGER,
+  cum INTEGER
+)`
+
+	sqliteEdgesSchema = `CREATE TABLE edges (
+  src INTEGER REFERENCES nodes(id),
+  dest INTEGER REFERENCES nodes(id),
+  weight INTEGER,
+  residual INTEGER,
+  inline INTEGER
+)`
+)
+
+// sqliteTable is a table of a SQLite database.
+type sqliteTable struct {
+	name, schema string
+	rows         []sqliteRow
+}
+
+// sqliteRow is a row of a table. Its values are nil, int64 or string.
+type sqliteRow struct {
+	rowid  int64
+	values []interface{}
+}
+
+// printSQLite writes the nodes and edges of the graph of a report as a
+// SQLite database.
+func printSQLite(ctx context.Context, w io.Writer, rpt *report.Report) error {
+	g, _ := report.GetDOT(ctx, rpt)
+	typ, unit := rpt.SampleType()
+	return writeSQLite(w, sqliteTables(g, typ, unit, rpt.Total()))
+}
+
+// sqliteTables returns the tables holding the graph g, whose values are
+// samples of the given type and unit.
+func sqliteTables(g *graph.Graph, typ, unit string, total int64) []sqliteTable {
+	info := sqliteTable{name: "info", schema: sqliteInfoSchema}
+	for i, kv := range [][2]string{
+		{"sample_type", typ},
+		{"unit", unit},
+		{"total", fmt.Sprint(total)},
+	} {
+		info.rows = append(info.rows, sqliteRow{int64(i + 1), []interface{}{kv[0], kv[1]}})
+	}
+
+	nodes := sqliteTable{name: "nodes", schema: sqliteNodesSchema}
+	ids := make(map[*graph.Node]int64, len(g.Nodes))
+	for i, n := range g.Nodes {
+		id := int64(i + 1)
+		ids[n] = id
+		// The id is the rowid, which is stored as NULL.
+		nodes.rows = append(nodes.rows, sqliteRow{id, []interface{}{
+			nil, n.Info.PrintableName(), n.Info.File, int64(n.Info.Lineno),
+			n.Info.Objfile, int64(n.Info.Address), n.FlatValue(), n.CumValue(),
+		}})
+	}
+
+	edges := sqliteTable{name: "edges", schema: sqliteEdgesSchema}
+	for _, n := range g.Nodes {
+		for _, e := range n.Out.Sort() {
+			edges.rows = append(edges.rows, sqliteRow{int64(len(edges.rows) + 1), []interface{}{
+				ids[e.Src], ids[e.Dest], e.WeightValue(), sqliteBool(e.Residual), sqliteBool(e.Inline),
+			}})
+		}
+	}
+	return []sqliteTable{info, nodes, edges}
+}
+
+func sqliteBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// SQLite file format constants, from https://www.sqlite.org/fileformat.html.
+const (
+	sqlitePageSize = 4096
+	// Page types.
+	sqliteInteriorTable = 0x05
+	sqliteLeafTable     = 0x0d
+	// Largest payload of a table leaf cell stored in the page, and the
+	// smallest stored in it when the payload spills to overflow pages.
+	sqliteMaxLocal = sqlitePageSize - 35
+	sqliteMinLocal = (sqlitePageSize-12)*32/255 - 23
+	// Number of children of an interior page whose cells, a page number
+	// and a rowid of at most 9 bytes, fit in the page with their pointers.
+	sqliteMaxChildren = (sqlitePageSize-12)/(2+4+9) + 1
+)
+
+// sqliteWriter lays out the pages of a SQLite database.
+type sqliteWriter struct {
+	pages [][]byte // Pages of the database; page number i+1 is pages[i].
+}
+
+// writeSQLite writes a SQLite database holding the tables.
+func writeSQLite(w io.Writer, tables []sqliteTable) error {
+	sw := &sqliteWriter{}
+	// Page 1 holds the file header and the schema table.
+	sw.newPage()
+	schema := make([]sqliteRow, len(tables))
+	for i, t := range tables {
+		root := sw.writeTable(t.rows)
+		schema[i] = sqliteRow{int64(i + 1), []interface{}{"table", t.name, t.name, int64(root), t.schema}}
+	}
+	leaves := sw.writeLeaves(schema, 1)
+	if len(leaves) != 1 {
+		return fmt.Errorf("sqlite schema does not fit in a page")
+	}
+
+	h := sw.pages[0]
+	copy(h, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(h[16:], sqlitePageSize)
+	h[18], h[19] = 1, 1                   // Legacy journal mode.
+	h[21], h[22], h[23] = 64, 32, 32      // Payload fractions.
+	binary.BigEndian.PutUint32(h[24:], 1) // File change counter.
+	binary.BigEndian.PutUint32(h[28:], uint32(len(sw.pages)))
+	binary.BigEndian.PutUint32(h[40:], 1) // Schema cookie.
+	binary.BigEndian.PutUint32(h[44:], 4) // Schema format.
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8 text.
+	binary.BigEndian.PutUint32(h[92:], 1) // Version valid for the change counter.
+	binary.BigEndian.PutUint32(h[96:], 3040000)
+
+	for _, p := range sw.pages {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newPage adds a page to the database and returns its number.
+func (sw *sqliteWriter) newPage() int {
+	sw.pages = append(sw.pages, make([]byte, sqlitePageSize))
+	return len(sw.pages)
+}
+
+// writeTable writes the b-tree of a table with the rows, which are in
+// increasing rowid order, and returns the number of its root page.
+func (sw *sqliteWriter) writeTable(rows []sqliteRow) int {
+	children := sw.writeLeaves(rows, sw.newPage())
+	for len(children) > 1 {
+		children = sw.writeInteriorPages(children)
+	}
+	return children[0].page
+}
+
+// sqliteChild is a page of a b-tree, with the largest rowid in it.
+type sqliteChild struct {
+	page     int
+	maxRowid int64
+}
+
+// writeLeaves writes the rows to leaf pages, starting with the page first,
+// which is already allocated, and returns the pages.
+func (sw *sqliteWriter) writeLeaves(rows []sqliteRow, first int) []sqliteChild {
+	var cells [][]byte
+	var size int
+	leaves := []sqliteChild{{page: first}}
+	for _, r := range rows {
+		cell := sw.leafCell(r)
+		if len(cells) > 0 && sw.headerOffset(leaves[len(leaves)-1].page)+8+2*(len(cells)+1)+size+len(cell) > sqlitePageSize {
+			sw.fillPage(leaves[len(leaves)-1].page, sqliteLeafTable, cells, 0)
+			leaves = append(leaves, sqliteChild{page: sw.newPage()})
+			cells, size = nil, 0
+		}
+		cells = append(cells, cell)
+		size += len(cell)
+		leaves[len(leaves)-1].maxRowid = r.rowid
+	}
+	sw.fillPage(leaves[len(leaves)-1].page, sqliteLeafTable, cells, 0)
+	return leaves
+}
+
+// writeInteriorPages writes interior pages pointing to the children and
+// returns them.
+func (sw *sqliteWriter) writeInteriorPages(children []sqliteChild) []sqliteChild {
+	// Spread the children evenly over pages holding at most
+	// sqliteMaxChildren of them, so that each page has at least a cell
+	// besides its right-most pointer.
+	n := (len(children) + sqliteMaxChildren - 1) / sqliteMaxChildren
+	var parents []sqliteChild
+	for i := 0; i < n; i++ {
+		group := children[i*len(children)/n : (i+1)*len(children)/n]
+		var cells [][]byte
+		for _, c := range group[:len(group)-1] {
+			cell := binary.BigEndian.AppendUint32(nil, uint32(c.page))
+			cells = append(cells, appendSQLiteVarint(cell, uint64(c.maxRowid)))
+		}
+		last := group[len(group)-1]
+		page := sw.newPage()
+		sw.fillPage(page, sqliteInteriorTable, cells, last.page)
+		parents = append(parents, sqliteChild{page, last.maxRowid})
+	}
+	return parents
+}
+
+// headerOffset returns the offset of the b-tree page header in a page.
+func (sw *sqliteWriter) headerOffset(page int) int {
+	if page == 1 {
+		return 100
+	}
+	return 0
+}
+
+// fillPage writes a b-tree page of the given type with the cells. The
+// right-most pointer is only written for interior pages.
+func (sw *sqliteWriter) fillPage(page int, typ byte, cells [][]byte, rightMost int) {
+	p := sw.pages[page-1]
+	h := p[sw.headerOffset(page):]
+	h[0] = typ
+	binary.BigEndian.PutUint16(h[3:], uint16(len(cells)))
+	ptrs := h[8:]
+	if typ == sqliteInteriorTable {
+		binary.BigEndian.PutUint32(h[8:], uint32(rightMost))
+		ptrs = h[12:]
+	}
+	// Cells are stored from the end of the page.
+	end := sqlitePageSize
+	for i, c := range cells {
+		end -= len(c)
+		copy(p[end:], c)
+		binary.BigEndian.PutUint16(ptrs[2*i:], uint16(end))
+	}
+	binary.BigEndian.PutUint16(h[5:], uint16(end))
+}
+
+// leafCell returns the table leaf cell of a row, writing the part of its
+// payload that does not fit in the page to overflow pages.
+func (sw *sqliteWriter) leafCell(r sqliteRow) []byte {
+	payload := sqliteRecord(r.values)
+	cell := appendSQLiteVarint(nil, uint64(len(payload)))
+	cell = appendSQLiteVarint(cell, uint64(r.rowid))
+	if len(payload) <= sqliteMaxLocal {
+		return append(cell, payload...)
+	}
+	local := sqliteMinLocal + (len(payload)-sqliteMinLocal)%(sqlitePageSize-4)
+	if local > sqliteMaxLocal {
+		local = sqliteMinLocal
+	}
+	cell = append(cell, payload[:local]...)
+	cell = binary.BigEndian.AppendUint32(cell, uint32(len(sw.pages)+1))
+	for rest := payload[local:]; len(rest) > 0; {
+		page := sw.pages[sw.newPage()-1]
+		n := copy(page[4:], rest)
+		if rest = rest[n:]; len(rest) > 0 {
+			binary.BigEndian.PutUint32(page, uint32(len(sw.pages)+1))
+		}
+	}
+	return cell
+}
+
+// sqliteRecord encodes values in the SQLite record format.
+func sqliteRecord(values []interface{}) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendSQLiteVarint(types, 0)
+		case int64:
+			switch {
+			case v == 0:
+				types = appendSQLiteVarint(types, 8)
+			case v == 1:
+				types = appendSQLiteVarint(types, 9)
+			default:
+				// Integers are stored in 1, 2, 3, 4, 6 or 8 bytes, with
+				// serial types 1 to 6.
+				for i, size := range []int{1, 2, 3, 4, 6, 8} {
+					if size == 8 || (v >= -1<<(8*size-1) && v < 1<<(8*size-1)) {
+						types = appendSQLiteVarint(types, uint64(i+1))
+						for b := size - 1; b >= 0; b-- {
+							body = append(body, byte(v>>(8*b)))
+						}
+						break
+					}
+				}
+			}
+		case string:
+			types = appendSQLiteVarint(types, uint64(13+2*len(v)))
+			body = append(body, v...)
+		default:
+			panic(fmt.Sprintf("unexpected SQLite value %T", v))
+		}
+	}
+	// The header size includes its own varint.
+	size := len(types) + 1
+	if len(appendSQLiteVarint(nil, uint64(size))) > 1 {
+		size = len(types) + len(appendSQLiteVarint(nil, uint64(len(types)+2)))
+	}
+	record := appendSQLiteVarint(nil, uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// appendSQLiteVarint appends v as a SQLite variable-length integer, which
+// is big-endian, unlike the varints of encoding/binary.
+func appendSQLiteVarint(b []byte, v uint64) []byte {
+	if v>>56 != 0 {
+		// The ninth byte holds 8 bits.
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := len(buf)
+	for {
+		n--
+		buf[n] = byte(v&0x7f) | 0x80
+		if v >>= 7; v == 0 {
+			break
+		}
+	}
+	buf[len(buf)-1] &= 0x7f
+	return append(b, buf[n:]...)
+}
@@ -0,0 +1,205 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/profile"
+)
+
+func TestSQLite(t *testing.T) {
+	var funcs []*profile.Function
+	var locs []*profile.Location
+	for i, name := range []string{"main", "foo", "bar"} {
+		funcs = append(funcs, &profile.Function{ID: uint64(i + 1), Name: name, Filename: name + ".go"})
+		locs = append(locs, &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: funcs[i], Line: int64(i + 1)}}})
+	}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{locs[0]}, Value: []int64{5}},
+			{Location: []*profile.Location{locs[1], locs[0]}, Value: []int64{10}},
+			{Location: []*profile.Location{locs[2], locs[0]}, Value: []int64{20}},
+		},
+		Location: locs,
+		Function: funcs,
+	}
+
+	o := setDefaults(&plugin.Options{Flagset: baseFlags()})
+	_, rpt, err := generateRawReport(p, []string{"sqlite"}, defaultConfig(), o)
+	if err != nil {
+		t.Fatalf("generateRawReport: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := printSQLite(context.Background(), &buf, rpt); err != nil {
+		t.Fatalf("printSQLite: %v", err)
+	}
+
+	got := readSQLite(t, buf.Bytes())
+	want := map[string][]sqliteRow{
+		"info": {
+			{1, []interface{}{"sample_type", "cpu"}},
+			{2, []interface{}{"unit", "nanoseconds"}},
+			{3, []interface{}{"total", "35"}},
+		},
+		"nodes": {
+			{1, []interface{}{nil, "bar", "", int64(0), "", int64(0), int64(20), int64(20)}},
+			{2, []interface{}{nil, "foo", "", int64(0), "", int64(0), int64(10), int64(10)}},
+			{3, []interface{}{nil, "main", "", int64(0), "", int64(0), int64(5), int64(35)}},
+		},
+		"edges": {
+			{1, []interface{}{int64(3), int64(1), int64(20), int64(0), int64(0)}},
+			{2, []interface{}{int64(3), int64(2), int64(10), int64(0), int64(0)}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tables %v, want %v", got, want)
+	}
+}
+
+func TestWriteSQLiteLarge(t *testing.T) {
+	// Enough rows for several levels of pages, and values spilling to
+	// overflow pages.
+	var rows []sqliteRow
+	for i := int64(1); i <= 100000; i++ {
+		name := "n"
+		if i%10000 == 0 {
+			name = strings.Repeat("x", 10000)
+		}
+		rows = append(rows, sqliteRow{i, []interface{}{name, -i, i << 40, nil}})
+	}
+	var buf bytes.Buffer
+	if err := writeSQLite(&buf, []sqliteTable{{name: "t", schema: "CREATE TABLE t (a, b, c, d)", rows: rows}}); err != nil {
+		t.Fatalf("writeSQLite: %v", err)
+	}
+	if got := readSQLite(t, buf.Bytes())["t"]; !reflect.DeepEqual(got, rows) {
+		t.Errorf("read back %d rows, want %d equal rows", len(got), len(rows))
+	}
+}
+
+// readSQLite returns the rows of the tables of a SQLite database written by
+// writeSQLite, by table name.
+func readSQLite(t *testing.T, db []byte) map[string][]sqliteRow {
+	t.Helper()
+	if !bytes.HasPrefix(db, []byte("SQLite format 3\x00")) || len(db)%sqlitePageSize != 0 {
+		t.Fatalf("not a SQLite database of %d byte pages", sqlitePageSize)
+	}
+	if n := binary.BigEndian.Uint32(db[28:]); int(n) != len(db)/sqlitePageSize {
+		t.Fatalf("header has %d pages, file has %d", n, len(db)/sqlitePageSize)
+	}
+	tables := make(map[string][]sqliteRow)
+	for _, r := range readSQLiteRows(t, db, 1) {
+		tables[r.values[1].(string)] = readSQLiteRows(t, db, int(r.values[3].(int64)))
+	}
+	return tables
+}
+
+// readSQLiteRows returns the rows of the table b-tree rooted at page.
+func readSQLiteRows(t *testing.T, db []byte, page int) []sqliteRow {
+	t.Helper()
+	p := db[(page-1)*sqlitePageSize : page*sqlitePageSize]
+	h := p
+	if page == 1 {
+		h = p[100:]
+	}
+	n := int(binary.BigEndian.Uint16(h[3:]))
+	var rows []sqliteRow
+	switch h[0] {
+	case sqliteInteriorTable:
+		for i := 0; i < n; i++ {
+			c := p[binary.BigEndian.Uint16(h[12+2*i:]):]
+			rows = append(rows, readSQLiteRows(t, db, int(binary.BigEndian.Uint32(c)))...)
+		}
+		return append(rows, readSQLiteRows(t, db, int(binary.BigEndian.Uint32(h[8:])))...)
+	case sqliteLeafTable:
+		for i := 0; i < n; i++ {
+			c := p[binary.BigEndian.Uint16(h[8+2*i:]):]
+			size, k := readSQLiteVarint(c)
+			rowid, l := readSQLiteVarint(c[k:])
+			c = c[k+l:]
+			local := int(size)
+			if local > sqliteMaxLocal {
+				local = sqliteMinLocal + (local-sqliteMinLocal)%(sqlitePageSize-4)
+				if local > sqliteMaxLocal {
+					local = sqliteMinLocal
+				}
+			}
+			payload := append([]byte(nil), c[:local]...)
+			for next := 0; len(payload) < int(size); {
+				if next == 0 {
+					next = int(binary.BigEndian.Uint32(c[local:]))
+				}
+				o := db[(next-1)*sqlitePageSize : next*sqlitePageSize]
+				payload = append(payload, o[4:min(len(o), 4+int(size)-len(payload))]...)
+				next = int(binary.BigEndian.Uint32(o))
+			}
+			rows = append(rows, sqliteRow{int64(rowid), readSQLiteRecord(payload)})
+		}
+		return rows
+	}
+	t.Fatalf("page %d: unexpected page type %#x", page, h[0])
+	return nil
+}
+
+func readSQLiteRecord(r []byte) []interface{} {
+	size, _ := readSQLiteVarint(r)
+	header, body := r[:size], r[size:]
+	_, k := readSQLiteVarint(header)
+	var values []interface{}
+	for header = header[k:]; len(header) > 0; header = header[k:] {
+		var typ uint64
+		typ, k = readSQLiteVarint(header)
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ == 8, typ == 9:
+			values = append(values, int64(typ-8))
+		case typ <= 6:
+			n := []int{1, 2, 3, 4, 6, 8}[typ-1]
+			// Sign-extend the big-endian integer.
+			v := int64(int8(body[0]))
+			for _, b := range body[1:n] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+			body = body[n:]
+		case typ >= 13 && typ%2 == 1:
+			n := int(typ-13) / 2
+			values = append(values, string(body[:n]))
+			body = body[n:]
+		default:
+			panic("unexpected serial type")
+		}
+	}
+	return values
+}
+
+func readSQLiteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
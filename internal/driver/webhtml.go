@@ -82,4 +82,5 @@ func addTemplates(templates *template.Template) {
 	def("stacks", loadFile("html/stacks.html"))
 	def("stacks_css", loadCSS("html/stacks.css"))
 	def("stacks_js", loadJS("html/stacks.js"))
+	def("flamegraph_html", loadFile("html/flamegraph.html"))
 }
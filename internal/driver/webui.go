@@ -89,6 +89,7 @@ type webArgs struct {
 	Listing     report.WebListData
 	FlameGraph  template.JS
 	Stacks      template.JS
+	Folded      []string // Folded stacks for the standalone flame graph.
 	Configs     []configMenuEntry
 	UnitDefs    []measurement.UnitType
 }
@@ -125,16 +126,17 @@ func serveWebInterface(hostport string, p *profile.Profile, o *plugin.Options, d
 		Host:     host,
 		Port:     port,
 		Handlers: map[string]http.Handler{
-			"/":              http.HandlerFunc(ui.dot),
-			"/top":           http.HandlerFunc(ui.top),
-			"/disasm":        http.HandlerFunc(ui.disasm),
-			"/source":        http.HandlerFunc(ui.source),
-			"/peek":          http.HandlerFunc(ui.peek),
-			"/flamegraph":    http.HandlerFunc(ui.stackView),
+			"/":              timeRender("/", ui.dot),
+			"/top":           timeRender("/top", ui.top),
+			"/disasm":        timeRender("/disasm", ui.disasm),
+			"/source":        timeRender("/source", ui.source),
+			"/peek":          timeRender("/peek", ui.peek),
+			"/flamegraph":    timeRender("/flamegraph", ui.stackView),
 			"/flamegraph2":   redirectWithQuery("flamegraph", http.StatusMovedPermanently), // Keep legacy URL working.
 			"/flamegraphold": redirectWithQuery("flamegraph", http.StatusMovedPermanently), // Keep legacy URL working.
 			"/saveconfig":    http.HandlerFunc(ui.saveConfig),
 			"/deleteconfig":  http.HandlerFunc(ui.deleteConfig),
+			"/metrics":       http.HandlerFunc(serveMetrics),
 			"/download": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 				w.Header().Set("Content-Type", "application/vnd.google.protobuf+gzip")
 				w.Header().Set("Content-Disposition", "attachment;filename=profile.pb.gz")
@@ -289,6 +291,9 @@ func renderHTML(dst io.Writer, tmpl string, rpt *report.Report, errList, legend
 	file := getFromLegend(legend, "File: ", "unknown")
 	profile := getFromLegend(legend, "Type: ", "unknown")
 	data.Title = file + " " + profile
+	if title := getFromLegend(legend, "Title: ", ""); title != "" {
+		data.Title = title
+	}
 	data.Errors = errList
 	data.Total = rpt.Total()
 	data.DocURL = rpt.DocURL()
@@ -320,7 +325,7 @@ func (ui *webInterface) dot(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Generate dot graph.
-	g, config := report.GetDOT(rpt)
+	g, config := report.GetDOT(req.Context(), rpt)
 	legend := config.Labels
 	config.Labels = nil
 	dot := &bytes.Buffer{}
@@ -372,7 +377,7 @@ func (ui *webInterface) top(w http.ResponseWriter, req *http.Request) {
 	if rpt == nil {
 		return // error already reported
 	}
-	top, legend := report.TextItems(rpt)
+	top, legend := report.TextItems(req.Context(), rpt)
 	var nodes []string
 	for _, item := range top {
 		nodes = append(nodes, item.Name)
@@ -393,7 +398,7 @@ func (ui *webInterface) disasm(w http.ResponseWriter, req *http.Request) {
 	}
 
 	out := &bytes.Buffer{}
-	if err := report.PrintAssembly(out, rpt, ui.options.Obj, maxEntries); err != nil {
+	if err := report.PrintAssembly(req.Context(), out, rpt, ui.options.Obj, maxEntries); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		ui.options.UI.PrintErr(err)
 		return
@@ -440,7 +445,7 @@ func (ui *webInterface) peek(w http.ResponseWriter, req *http.Request) {
 	}
 
 	out := &bytes.Buffer{}
-	if err := report.Generate(out, rpt, ui.options.Obj); err != nil {
+	if err := report.Generate(req.Context(), out, rpt, ui.options.Obj); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		ui.options.UI.PrintErr(err)
 		return
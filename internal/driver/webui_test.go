@@ -15,6 +15,7 @@
 package driver
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -24,11 +25,13 @@ import (
 	"os/exec"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 
 	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/proftest"
+	"github.com/google/pprof/internal/report"
 	"github.com/google/pprof/profile"
 )
 
@@ -80,7 +83,20 @@ func TestWebInterface(t *testing.T) {
 	}
 	testcases := []testCase{
 		{"/", []string{"F1", "F2", "F3", "testbin", "cpu"}, true},
-		{"/top", []string{`"Name":"F2","InlineLabel":"","Flat":200,"Cum":300,"FlatFormat":"200ms","CumFormat":"300ms"}`}, false},
+		{"/top", []string{
+			`"Name":"F2","InlineLabel":"","Flat":200,"Cum":300,"FlatFormat":"200ms","CumFormat":"300ms"}`,
+			// Check that the sorted column shows the sort direction.
+			`#toptable th\[aria-sort="descending"\]::after`,
+			`hdr\.setAttribute\('aria-sort', descending \? 'descending' : 'ascending'\)`,
+			// Check that the selected rows are kept when sorting.
+			`if \(hilited\.has\(row\.Id\)\) tr\.classList\.add\('hilite'\)`,
+			// Check that the Refine menu keyboard shortcuts are wired.
+			`'f': 'focus'`,
+			`'h': 'hide'`,
+			`'r': 'reset'`,
+			`id="reset"`,
+			`document\.addEventListener\('keydown', handleShortcut\)`,
+		}, false},
 		{"/source?f=" + url.QueryEscape("F[12]"), []string{
 			"F1",
 			"F2",
@@ -153,6 +169,36 @@ func TestWebInterface(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWebInterfaceMetrics(t *testing.T) {
+	server := makeTestServer(t, makeFakeProfile())
+	get := func(path string) string {
+		t.Helper()
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal("could not fetch", path, err)
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal("could not read response", path, err)
+		}
+		return string(data)
+	}
+
+	get("/top")
+	result := get("/metrics")
+	for _, want := range []string{
+		`(?m)^pprof_profiles_parsed_total \d+$`,
+		`(?m)^pprof_symbolization_failures_total \d+$`,
+		`(?m)^pprof_render_count\{handler="/top"\} [1-9]\d*$`,
+		`(?m)^pprof_render_seconds_total\{handler="/top"\} \S+$`,
+	} {
+		if match, _ := regexp.MatchString(want, result); !match {
+			t.Errorf("/metrics does not match %q; actual result:\n%s", want, result)
+		}
+	}
+}
+
 // Implement fake object file support.
 
 const addrBase = 0x1000
@@ -254,6 +300,37 @@ func makeFakeProfile() *profile.Profile {
 	}
 }
 
+func TestSourceListingLinks(t *testing.T) {
+	prof := makeFakeProfile()
+	rpt := report.New(prof, &report.Options{
+		SampleValue: func(v []int64) int64 { return v[0] },
+		SampleUnit:  "milliseconds",
+	})
+	listing := report.WebListData{
+		Total: "300ms",
+		Files: []report.WebListFile{{Funcs: []report.WebListFunc{{
+			Name: "F1",
+			File: fakeSource,
+			Lines: []report.WebListLine{
+				{Line: 11, SrcLine: "linked", URL: "https://example.com/repo/" + fakeSource + "#L11"},
+				{Line: 12, SrcLine: "not linked"},
+			},
+		}}}},
+	}
+	var buf bytes.Buffer
+	if err := renderHTML(&buf, "sourcelisting", rpt, nil, nil, webArgs{Standalone: true, Listing: listing}); err != nil {
+		t.Fatalf("renderHTML: %v", err)
+	}
+	for _, want := range []string{
+		`<span class=line><a href="https://example.com/repo/testdata/file1000.src#L11">     11</a></span>`,
+		`<span class=line>     12</span>`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("source listing does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
 func TestGetHostAndPort(t *testing.T) {
 	if runtime.GOOS == "nacl" || runtime.GOOS == "js" {
 		t.Skip("test assumes tcp available")
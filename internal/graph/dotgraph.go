@@ -16,9 +16,11 @@ package graph
 
 import (
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/google/pprof/internal/measurement"
@@ -48,8 +50,64 @@ type DotConfig struct {
 
 	FormatValue func(int64) string // A formatting function for values
 	Total       int64              // The total weight of the graph, used to compute percentages
+
+	// PercentTotal, if not zero, replaces Total as the value the node
+	// percentages are relative to.
+	PercentTotal int64
+
+	// StableIDs derives node IDs from the node contents instead of their
+	// position in the graph, so that a node keeps its ID across renders
+	// of different graphs.
+	StableIDs bool
+
+	// HotPath highlights the nodes and edges of the heaviest path through
+	// the graph, as computed by Graph.HotPath.
+	HotPath bool
+
+	// Diff colors the nodes and edges of a profile comparison by the sign
+	// of their values even when they are small, so that improvements
+	// (negative values) never render as grey like regressions.
+	Diff bool
+
+	// RankDir is the direction of the layout, one of the DOT rankdir
+	// values TB, LR, BT or RL. Graphs are laid out top to bottom by default.
+	RankDir string
+
+	SizeBy  NodeMetric // The node value scaling the font size; flat by default
+	ColorBy NodeMetric // The node value setting the colors; cum by default
+
+	// LabelMetrics are the keys of the label metrics of the nodes whose
+	// cum value is added to the node labels, formatted by
+	// FormatLabelMetric.
+	LabelMetrics      []string
+	FormatLabelMetric func(key string, value int64) string
+}
+
+// NodeMetric selects the node value a DOT node attribute is derived from.
+type NodeMetric int
+
+const (
+	// DefaultMetric uses the metric the attribute is usually derived from.
+	DefaultMetric NodeMetric = iota
+	FlatMetric
+	CumMetric
+)
+
+// value returns the value of n selected by m, using def in place of
+// DefaultMetric.
+func (m NodeMetric) value(n *Node, def NodeMetric) int64 {
+	if m == DefaultMetric {
+		m = def
+	}
+	if m == CumMetric {
+		return n.CumValue()
+	}
+	return n.FlatValue()
 }
 
+// hotPathColor is the color of the nodes and edges on the hot path.
+const hotPathColor = "#ff0000"
+
 const maxNodelets = 4 // Number of nodelets for labels (both numeric and non)
 
 // ComposeDot creates and writes a in the DOT format to the writer, using
@@ -66,23 +124,33 @@ func ComposeDot(w io.Writer, g *Graph, a *DotAttributes, c *DotConfig) {
 		return
 	}
 
-	// Preprocess graph to get id map and find max flat.
-	nodeIDMap := make(map[*Node]int)
+	// Preprocess graph to get id map and find the max value sizing nodes.
+	nodeIDMap := make(map[*Node]string)
 	hasNodelets := make(map[*Node]bool)
 
-	maxFlat := float64(abs64(g.Nodes[0].FlatValue()))
+	maxSize := float64(abs64(c.SizeBy.value(g.Nodes[0], FlatMetric)))
 	for i, n := range g.Nodes {
-		nodeIDMap[n] = i + 1
-		if float64(abs64(n.FlatValue())) > maxFlat {
-			maxFlat = float64(abs64(n.FlatValue()))
+		nodeIDMap[n] = strconv.Itoa(i + 1)
+		if size := float64(abs64(c.SizeBy.value(n, FlatMetric))); size > maxSize {
+			maxSize = size
 		}
 	}
 
+	if c.StableIDs {
+		nodeIDMap = stableNodeIDs(g.Nodes)
+	}
+	hotNodes, hotEdges := make(map[*Node]bool), make(map[*Edge]bool)
+	if c.HotPath {
+		for _, e := range g.HotPath() {
+			hotEdges[e] = true
+			hotNodes[e.Src], hotNodes[e.Dest] = true, true
+		}
+	}
 	edges := EdgeMap{}
 
 	// Add nodes and nodelets to DOT builder.
 	for _, n := range g.Nodes {
-		builder.addNode(n, nodeIDMap[n], maxFlat)
+		builder.addNode(n, nodeIDMap[n], maxSize, hotNodes[n])
 		hasNodelets[n] = builder.addNodelets(n, nodeIDMap[n])
 
 		// Collect all edges. Use a fake node to support multiple incoming edges.
@@ -93,7 +161,7 @@ func ComposeDot(w io.Writer, g *Graph, a *DotAttributes, c *DotConfig) {
 
 	// Add edges to DOT builder. Sort edges by frequency as a hint to the graph layout engine.
 	for _, e := range edges.Sort() {
-		builder.addEdge(e, nodeIDMap[e.Src], nodeIDMap[e.Dest], hasNodelets[e.Src])
+		builder.addEdge(e, nodeIDMap[e.Src], nodeIDMap[e.Dest], hasNodelets[e.Src], hotEdges[e])
 	}
 }
 
@@ -111,6 +179,9 @@ func (b *builder) start() {
 		graphname = b.config.Title
 	}
 	fmt.Fprintln(b, `digraph "`+graphname+`" {`)
+	if b.config.RankDir != "" {
+		fmt.Fprintf(b, "rankdir=%s\n", b.config.RankDir)
+	}
 	fmt.Fprintln(b, `node [style=filled fillcolor="#f8f8f8"]`)
 }
 
@@ -138,7 +209,7 @@ func (b *builder) addLegend() {
 }
 
 // addNode generates a graph node in DOT format.
-func (b *builder) addNode(node *Node, nodeID int, maxFlat float64) {
+func (b *builder) addNode(node *Node, nodeID string, maxSize float64, hot bool) {
 	flat, cum := node.FlatValue(), node.CumValue()
 	attrs := b.attributes.Nodes[node]
 
@@ -150,11 +221,15 @@ func (b *builder) addNode(node *Node, nodeID int, maxFlat float64) {
 		label = multilinePrintableName(&node.Info)
 	}
 
+	percentTotal := b.config.Total
+	if b.config.PercentTotal != 0 {
+		percentTotal = b.config.PercentTotal
+	}
 	flatValue := b.config.FormatValue(flat)
 	if flat != 0 {
 		label = label + fmt.Sprintf(`%s (%s)`,
 			flatValue,
-			strings.TrimSpace(measurement.Percentage(flat, b.config.Total)))
+			strings.TrimSpace(measurement.Percentage(flat, percentTotal)))
 	} else {
 		label = label + "0"
 	}
@@ -168,15 +243,22 @@ func (b *builder) addNode(node *Node, nodeID int, maxFlat float64) {
 		cumValue = b.config.FormatValue(cum)
 		label = label + fmt.Sprintf(`of %s (%s)`,
 			cumValue,
-			strings.TrimSpace(measurement.Percentage(cum, b.config.Total)))
+			strings.TrimSpace(measurement.Percentage(cum, percentTotal)))
+	}
+	for _, key := range b.config.LabelMetrics {
+		if m := node.LabelMetrics[key]; m != nil {
+			label = label + fmt.Sprintf(`\n%s: %s`, escapeForDot(key), b.config.FormatLabelMetric(key, m.Cum))
+		}
 	}
 
-	// Scale font sizes from 8 to 24 based on percentage of flat frequency.
+	// Scale font sizes from 8 to 24 based on percentage of flat frequency,
+	// or of the metric selected by SizeBy.
 	// Use non linear growth to emphasize the size difference.
 	baseFontSize, maxFontGrowth := 8, 16.0
 	fontSize := baseFontSize
-	if maxFlat != 0 && flat != 0 && float64(abs64(flat)) <= maxFlat {
-		fontSize += int(math.Ceil(maxFontGrowth * math.Sqrt(float64(abs64(flat))/maxFlat)))
+	size := b.config.SizeBy.value(node, FlatMetric)
+	if maxSize != 0 && size != 0 && float64(abs64(size)) <= maxSize {
+		fontSize += int(math.Ceil(maxFontGrowth * math.Sqrt(float64(abs64(size))/maxSize)))
 	}
 
 	// Determine node shape.
@@ -185,16 +267,27 @@ func (b *builder) addNode(node *Node, nodeID int, maxFlat float64) {
 		shape = attrs.Shape
 	}
 
+	score := b.score(b.config.ColorBy.value(node, CumMetric))
+	color := dotColor(score, false)
+	if hot {
+		color = hotPathColor
+	}
+
 	// Create DOT attribute for node.
-	attr := fmt.Sprintf(`label="%s" id="node%d" fontsize=%d shape=%s tooltip="%s (%s)" color="%s" fillcolor="%s"`,
+	attr := fmt.Sprintf(`label="%s" id="node%s" fontsize=%d shape=%s tooltip="%s (%s)" color="%s" fillcolor="%s"`,
 		label, nodeID, fontSize, shape, escapeForDot(node.Info.PrintableName()), cumValue,
-		dotColor(float64(node.CumValue())/float64(abs64(b.config.Total)), false),
-		dotColor(float64(node.CumValue())/float64(abs64(b.config.Total)), true))
+		color,
+		dotColor(score, true))
+
+	// Nodes on the hot path are bold.
+	if hot {
+		attr += ` style="bold,filled"`
+	}
 
 	// Add on extra attributes if provided.
 	if attrs != nil {
 		// Make bold if specified.
-		if attrs.Bold {
+		if attrs.Bold && !hot {
 			attr += ` style="bold,filled"`
 		}
 
@@ -209,11 +302,11 @@ func (b *builder) addNode(node *Node, nodeID int, maxFlat float64) {
 		}
 	}
 
-	fmt.Fprintf(b, "N%d [%s]\n", nodeID, attr)
+	fmt.Fprintf(b, "N%s [%s]\n", nodeID, attr)
 }
 
 // addNodelets generates the DOT boxes for the node tags if they exist.
-func (b *builder) addNodelets(node *Node, nodeID int) bool {
+func (b *builder) addNodelets(node *Node, nodeID string) bool {
 	var nodelets string
 
 	// Populate two Tag slices, one for LabelTags and one for NumericTags.
@@ -247,15 +340,15 @@ func (b *builder) addNodelets(node *Node, nodeID int) bool {
 			continue
 		}
 		weight := b.config.FormatValue(w)
-		nodelets += fmt.Sprintf(`N%d_%d [label = "%s" id="N%d_%d" fontsize=8 shape=box3d tooltip="%s"]`+"\n", nodeID, i, t.Name, nodeID, i, weight)
-		nodelets += fmt.Sprintf(`N%d -> N%d_%d [label=" %s" weight=100 tooltip="%s" labeltooltip="%s"]`+"\n", nodeID, nodeID, i, weight, weight, weight)
+		nodelets += fmt.Sprintf(`N%s_%d [label = "%s" id="N%s_%d" fontsize=8 shape=box3d tooltip="%s"]`+"\n", nodeID, i, t.Name, nodeID, i, weight)
+		nodelets += fmt.Sprintf(`N%s -> N%s_%d [label=" %s" weight=100 tooltip="%s" labeltooltip="%s"]`+"\n", nodeID, nodeID, i, weight, weight, weight)
 		if nts := lnts[t.Name]; nts != nil {
-			nodelets += b.numericNodelets(nts, maxNodelets, flatTags, fmt.Sprintf(`N%d_%d`, nodeID, i))
+			nodelets += b.numericNodelets(nts, maxNodelets, flatTags, fmt.Sprintf(`N%s_%d`, nodeID, i))
 		}
 	}
 
 	if nts := lnts[""]; nts != nil {
-		nodelets += b.numericNodelets(nts, maxNodelets, flatTags, fmt.Sprintf(`N%d`, nodeID))
+		nodelets += b.numericNodelets(nts, maxNodelets, flatTags, fmt.Sprintf(`N%s`, nodeID))
 	}
 
 	fmt.Fprint(b, nodelets)
@@ -282,7 +375,7 @@ func (b *builder) numericNodelets(nts []*Tag, maxNumNodelets int, flatTags bool,
 }
 
 // addEdge generates a graph edge in DOT format.
-func (b *builder) addEdge(edge *Edge, from, to int, hasNodelets bool) {
+func (b *builder) addEdge(edge *Edge, from, to string, hasNodelets, hot bool) {
 	var inline string
 	if edge.Inline {
 		inline = `\n (inline)`
@@ -294,11 +387,16 @@ func (b *builder) addEdge(edge *Edge, from, to int, hasNodelets bool) {
 		if weight := 1 + int(min64(abs64(edge.WeightValue()*100/b.config.Total), 100)); weight > 1 {
 			attr = fmt.Sprintf(`%s weight=%d`, attr, weight)
 		}
-		if width := 1 + int(min64(abs64(edge.WeightValue()*5/b.config.Total), 5)); width > 1 {
+		if width := 1 + int(min64(abs64(edge.WeightValue()*5/b.config.Total), 5)); width > 1 && !hot {
 			attr = fmt.Sprintf(`%s penwidth=%d`, attr, width)
 		}
-		attr = fmt.Sprintf(`%s color="%s"`, attr,
-			dotColor(float64(edge.WeightValue())/float64(abs64(b.config.Total)), false))
+		if !hot {
+			attr = fmt.Sprintf(`%s color="%s"`, attr,
+				dotColor(b.score(edge.WeightValue()), false))
+		}
+	}
+	if hot {
+		attr = fmt.Sprintf(`%s color="%s" penwidth=6`, attr, hotPathColor)
 	}
 	arrow := "->"
 	if edge.Residual {
@@ -309,7 +407,12 @@ func (b *builder) addEdge(edge *Edge, from, to int, hasNodelets bool) {
 		escapeForDot(edge.Dest.Info.PrintableName()), w)
 	attr = fmt.Sprintf(`%s tooltip=%s labeltooltip=%s`, attr, tooltip, tooltip)
 
-	if edge.Residual {
+	switch {
+	case hot && edge.Residual:
+		attr = attr + ` style="bold,dotted"`
+	case hot:
+		attr = attr + ` style="bold"`
+	case edge.Residual:
 		attr = attr + ` style="dotted"`
 	}
 
@@ -318,9 +421,46 @@ func (b *builder) addEdge(edge *Edge, from, to int, hasNodelets bool) {
 		attr = attr + " minlen=2"
 	}
 
-	fmt.Fprintf(b, "N%d -> N%d [%s]\n", from, to, attr)
+	fmt.Fprintf(b, "N%s -> N%s [%s]\n", from, to, attr)
 }
 
+// stableNodeIDs returns an ID for each node derived from a hash of its
+// NodeInfo. Nodes with identical NodeInfo, as can happen in call trees,
+// get a numeric suffix in the order they appear in nodes.
+func stableNodeIDs(nodes Nodes) map[*Node]string {
+	ids := make(map[*Node]string, len(nodes))
+	seen := make(map[string]int, len(nodes))
+	for _, n := range nodes {
+		h := fnv.New64a()
+		i := n.Info
+		fmt.Fprintf(h, "%s\x00%s\x00%x\x00%s\x00%d\x00%d\x00%d\x00%s", i.Name, i.OrigName, i.Address, i.File, i.StartLine, i.Lineno, i.Columnno, i.Objfile)
+		id := fmt.Sprintf("%016x", h.Sum64())
+		if seen[id]++; seen[id] > 1 {
+			// Hex digits never include 'x', so this cannot collide with a hash.
+			id = fmt.Sprintf("%sx%d", id, seen[id])
+		}
+		ids[n] = id
+	}
+	return ids
+}
+
+// score returns the color score of value, its fraction of the total.
+// For diffs, the magnitude of non-zero scores is offset by minDiffScore
+// so dotColor gives even small changes the hue of their sign, while
+// larger changes keep a stronger color.
+func (b *builder) score(value int64) float64 {
+	score := float64(value) / float64(abs64(b.config.Total))
+	if b.config.Diff && score != 0 {
+		mag := math.Min(math.Abs(score), 1)
+		score = math.Copysign(minDiffScore+(1-minDiffScore)*mag, score)
+	}
+	return score
+}
+
+// minDiffScore is the smallest score magnitude of non-zero diff values,
+// the one from which dotColor uses the full saturation.
+const minDiffScore = 0.2
+
 // dotColor returns a color for the given score (between -1.0 and
 // 1.0), with -1.0 colored green, 0.0 colored grey, and 1.0 colored
 // red. If isBackground is true, then a light (low-saturation)
@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -163,6 +164,179 @@ func TestComposeWithCommentsWithNewlines(t *testing.T) {
 	compareGraphs(t, buf.Bytes(), "compose9.dot")
 }
 
+func TestComposeWithStableIDs(t *testing.T) {
+	destID := func(g *Graph) string {
+		t.Helper()
+		a, c := baseAttrsAndConfig()
+		c.StableIDs = true
+		var buf bytes.Buffer
+		ComposeDot(&buf, g, a, c)
+		m := regexp.MustCompile(`(?m)^(N\w+) \[label="dest`).FindStringSubmatch(buf.String())
+		if m == nil {
+			t.Fatalf("no node for dest in:\n%s", buf.String())
+		}
+		return m[1]
+	}
+
+	g1 := baseGraph()
+	g2 := baseGraph()
+	// Prepend an extra node so that dest's position in the graph changes.
+	extra := &Node{Info: NodeInfo{Name: "extra"}, Flat: 5, Cum: 5, In: make(EdgeMap), Out: make(EdgeMap)}
+	g2.Nodes = append(Nodes{extra}, g2.Nodes...)
+
+	if id1, id2 := destID(g1), destID(g2); id1 != id2 {
+		t.Errorf("dest has ID %s in the first graph and %s in the second, want them equal", id1, id2)
+	}
+	if id := destID(g1); id == "N2" {
+		t.Errorf("dest has sequential ID %s, want a content-derived ID", id)
+	}
+}
+
+func TestComposeWithHotPath(t *testing.T) {
+	g := baseGraph()
+	a, c := baseAttrsAndConfig()
+	c.HotPath = true
+	var buf bytes.Buffer
+	ComposeDot(&buf, g, a, c)
+	out := buf.String()
+
+	for _, re := range []string{
+		`(?m)^N1 \[label="src.* color="#ff0000" .*style="bold,filled"`,
+		`(?m)^N2 \[label="dest.* color="#ff0000" .*style="bold,filled"`,
+		`(?m)^N1 -> N2 \[.* color="#ff0000" penwidth=6 .*style="bold"`,
+	} {
+		if !regexp.MustCompile(re).MatchString(out) {
+			t.Errorf("output does not match %s:\n%s", re, out)
+		}
+	}
+
+	c.HotPath = false
+	buf.Reset()
+	ComposeDot(&buf, g, a, c)
+	if strings.Contains(buf.String(), hotPathColor) {
+		t.Errorf("output without hot path highlights it:\n%s", buf.String())
+	}
+}
+
+func TestComposeWithRankDir(t *testing.T) {
+	g := baseGraph()
+	a, c := baseAttrsAndConfig()
+	var buf bytes.Buffer
+	ComposeDot(&buf, g, a, c)
+	if strings.Contains(buf.String(), "rankdir") {
+		t.Errorf("output sets rankdir by default:\n%s", buf.String())
+	}
+
+	c.RankDir = "LR"
+	buf.Reset()
+	ComposeDot(&buf, g, a, c)
+	if want := "digraph \"testtitle\" {\nrankdir=LR\n"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("output does not start with %q:\n%s", want, buf.String())
+	}
+}
+
+func TestComposeWithNodeMetrics(t *testing.T) {
+	// a has a small flat value and a large cum value, b the opposite.
+	a := &Node{Info: NodeInfo{Name: "a"}, Flat: 10, Cum: 100}
+	b := &Node{Info: NodeInfo{Name: "b"}, Flat: 50, Cum: 50}
+	g := &Graph{Nodes: Nodes{a, b}}
+
+	type attrs struct {
+		fontSize  string
+		fillColor string
+	}
+	for _, tc := range []struct {
+		desc            string
+		sizeBy, colorBy NodeMetric
+		wantA, wantB    attrs
+	}{
+		{
+			desc:  "default",
+			wantA: attrs{"16", dotColor(1.0, true)},
+			wantB: attrs{"24", dotColor(0.5, true)},
+		},
+		{
+			desc:   "explicit defaults",
+			sizeBy: FlatMetric, colorBy: CumMetric,
+			wantA: attrs{"16", dotColor(1.0, true)},
+			wantB: attrs{"24", dotColor(0.5, true)},
+		},
+		{
+			desc:   "size by cum, color by flat",
+			sizeBy: CumMetric, colorBy: FlatMetric,
+			wantA: attrs{"24", dotColor(0.1, true)},
+			wantB: attrs{"20", dotColor(0.5, true)},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := &DotConfig{
+				FormatValue: func(v int64) string { return strconv.FormatInt(v, 10) },
+				Total:       100,
+				SizeBy:      tc.sizeBy,
+				ColorBy:     tc.colorBy,
+			}
+			var buf bytes.Buffer
+			ComposeDot(&buf, g, &DotAttributes{}, c)
+			for id, want := range map[string]attrs{"N1": tc.wantA, "N2": tc.wantB} {
+				re := regexp.MustCompile(`(?m)^` + id + ` \[.* fontsize=(\d+) .* fillcolor="([^"]*)"`)
+				m := re.FindStringSubmatch(buf.String())
+				if m == nil {
+					t.Fatalf("no attributes for %s:\n%s", id, buf.String())
+				}
+				if got := (attrs{m[1], m[2]}); got != want {
+					t.Errorf("%s: got %+v, want %+v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestComposeWithDiff(t *testing.T) {
+	// A small regression, a small improvement and a larger regression.
+	g := &Graph{Nodes: Nodes{
+		{Info: NodeInfo{Name: "regression"}, Flat: 1, Cum: 1},
+		{Info: NodeInfo{Name: "improvement"}, Flat: -1, Cum: -1},
+		{Info: NodeInfo{Name: "large regression"}, Flat: 30, Cum: 30},
+	}}
+	colors := func(diff bool) (pos, neg, large string) {
+		c := &DotConfig{
+			FormatValue: func(v int64) string { return strconv.FormatInt(v, 10) },
+			Total:       100,
+			Diff:        diff,
+		}
+		var buf bytes.Buffer
+		ComposeDot(&buf, g, &DotAttributes{}, c)
+		re := regexp.MustCompile(`(?m)^N(\d) \[.* color="([^"]*)"`)
+		got := map[string]string{}
+		for _, m := range re.FindAllStringSubmatch(buf.String(), -1) {
+			got[m[1]] = m[2]
+		}
+		return got["1"], got["2"], got["3"]
+	}
+
+	pos, neg, large := colors(true)
+	if want := dotColor(0.208, false); pos != want {
+		t.Errorf("regression color: got %s, want %s", pos, want)
+	}
+	if want := dotColor(-0.208, false); neg != want {
+		t.Errorf("improvement color: got %s, want %s", neg, want)
+	}
+	if want := dotColor(0.44, false); large != want {
+		t.Errorf("large regression color: got %s, want %s", large, want)
+	}
+	if pos == neg {
+		t.Errorf("regression and improvement have the same color %s", pos)
+	}
+	if pos == large {
+		t.Errorf("small and large regressions have the same color %s", pos)
+	}
+
+	pos, neg, _ = colors(false)
+	if pos != dotColor(0.01, false) || neg != dotColor(-0.01, false) {
+		t.Errorf("without diff: got colors %s and %s, want %s and %s", pos, neg, dotColor(0.01, false), dotColor(-0.01, false))
+	}
+}
+
 func baseGraph() *Graph {
 	src := &Node{
 		Info:        NodeInfo{Name: "src"},
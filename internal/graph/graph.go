@@ -16,6 +16,7 @@
 package graph
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"path/filepath"
@@ -58,11 +59,32 @@ type Options struct {
 	FormatTag         func(int64, string) string // Function to format a sample tag value into a string
 	ObjNames          bool                       // Always preserve obj filename
 	OrigFnNames       bool                       // Preserve original (eg mangled) function names
+	SampleIndices     bool                       // Record the samples of each node in Node.SampleIndices
 
 	CallTree     bool // Build a tree instead of a graph
 	DropNegative bool // Drop nodes with overall negative values
 
+	// MergeFunctionNames keys the nodes of named functions by their name
+	// only, merging the functions with the same name from different files
+	// or binaries, and the lines and addresses within them. It takes
+	// precedence over ObjNames and OrigFnNames.
+	MergeFunctionNames bool
+
 	KeptNodes NodeSet // If non-nil, only use nodes in this set
+
+	// LabelMetrics, if not nil, returns the values of the numeric labels
+	// of a sample that are summed per node in Node.LabelMetrics.
+	LabelMetrics func(s *profile.Sample) map[string]int64
+
+	// KeyFunc, if not nil, overrides the identity of the nodes: each frame
+	// of a sample goes to the node for the key it returns, given the info
+	// the frame would have without it, and the node is named by its key
+	// with no other info. Edges join the nodes of consecutive frames of the
+	// samples as usual: in a graph, frames of a sample with the same key
+	// share a node without an edge between them, like recursive calls,
+	// while a call tree has a child node for them. KeptNodes then holds the
+	// infos of keyed nodes.
+	KeyFunc func(info NodeInfo, s *profile.Sample) string
 }
 
 // Nodes is an ordered collection of graph nodes.
@@ -97,6 +119,44 @@ type Node struct {
 	// for NumericTags is the name of the LabelTag they are associated
 	// to, or "" for numeric tags not associated to a label tag.
 	NumericTags map[string]TagMap
+
+	// LabelMetrics holds the sums of the numeric labels selected by
+	// Options.LabelMetrics over the samples of the node, keyed by label.
+	LabelMetrics map[string]*LabelMetric
+
+	// SampleIndices holds the indices in the profile samples of the
+	// samples that contributed to Cum, in increasing order. It is only
+	// set if Options.SampleIndices is set.
+	SampleIndices []int
+}
+
+// LabelMetric holds the sums of the values of a numeric label over the
+// samples of a node. Flat only counts the samples the node is the leaf of.
+type LabelMetric struct {
+	Flat, Cum int64
+}
+
+// addLabelMetrics adds the values of the label metrics of a sample to the
+// node, to its flat values if flat is set and to its cum values otherwise.
+func (n *Node) addLabelMetrics(values map[string]int64, flat bool) {
+	if len(values) == 0 {
+		return
+	}
+	if n.LabelMetrics == nil {
+		n.LabelMetrics = make(map[string]*LabelMetric, len(values))
+	}
+	for k, v := range values {
+		m := n.LabelMetrics[k]
+		if m == nil {
+			m = &LabelMetric{}
+			n.LabelMetrics[k] = m
+		}
+		if flat {
+			m.Flat += v
+		} else {
+			m.Cum += v
+		}
+	}
 }
 
 // FlatValue returns the exclusive value for this node, computing the
@@ -313,21 +373,83 @@ func SortTags(t []*Tag, flat bool) []*Tag {
 
 // New summarizes performance data from a profile into a graph.
 func New(prof *profile.Profile, o *Options) *Graph {
+	g, _ := NewContext(context.Background(), prof, o)
+	return g
+}
+
+// NewContext is like New, but stops the construction of the graph once
+// ctx is done, returning the incomplete graph and the error of ctx.
+func NewContext(ctx context.Context, prof *profile.Profile, o *Options) (*Graph, error) {
+	var g *Graph
 	if o.CallTree {
-		return newTree(prof, o)
+		g = newTree(ctx, prof, o)
+	} else {
+		g = newGraph(ctx, prof, o)
 	}
-	g, _ := newGraph(prof, o)
-	return g
+	return g, ctx.Err()
 }
 
-// newGraph computes a graph from a profile. It returns the graph, and
-// a map from the profile location indices to the corresponding graph
-// nodes.
-func newGraph(prof *profile.Profile, o *Options) (*Graph, map[uint64]Nodes) {
-	nodes, locationMap := CreateNodes(prof, o)
+// NewNodes computes the nodes of the graph of a profile, with the same
+// flat and cum values as the nodes built by New for a graph that is not a
+// tree, but without edges or tags. It is much faster than New for reports
+// that only select nodes by their values. Like NewContext, it stops once
+// ctx is done, returning the incomplete graph and the error of ctx.
+func NewNodes(ctx context.Context, prof *profile.Profile, o *Options) (*Graph, error) {
+	frameNodes, nodes := sampleNodes(prof, o)
 	seenNode := make(map[*Node]bool)
-	seenEdge := make(map[nodePair]bool)
 	for _, sample := range prof.Sample {
+		if ctx.Err() != nil {
+			break
+		}
+		var w, dw int64
+		w = o.SampleValue(sample.Value)
+		if o.SampleMeanDivisor != nil {
+			dw = o.SampleMeanDivisor(sample.Value)
+		}
+		if dw == 0 && w == 0 {
+			continue
+		}
+		for k := range seenNode {
+			delete(seenNode, k)
+		}
+		var leaf *Node
+		// As in newGraph, the flat value goes to the leaf frame only if
+		// its node is kept.
+		residual := false
+		for i := len(sample.Location) - 1; i >= 0; i-- {
+			locNodes := frameNodes(sample.Location[i], sample)
+			for ni := len(locNodes) - 1; ni >= 0; ni-- {
+				n := locNodes[ni]
+				if n == nil {
+					residual = true
+					continue
+				}
+				if !seenNode[n] {
+					seenNode[n] = true
+					n.CumDiv += dw
+					n.Cum += w
+				}
+				leaf = n
+				residual = false
+			}
+		}
+		if leaf != nil && !residual {
+			leaf.FlatDiv += dw
+			leaf.Flat += w
+		}
+	}
+	return selectNodesForGraph(nodes(), o.DropNegative), ctx.Err()
+}
+
+// newGraph computes a graph from a profile, until ctx is done.
+func newGraph(ctx context.Context, prof *profile.Profile, o *Options) *Graph {
+	frameNodes, nodes := sampleNodes(prof, o)
+	seenNode := make(map[*Node]bool)
+	seenEdge := make(map[nodePair]bool)
+	for si, sample := range prof.Sample {
+		if ctx.Err() != nil {
+			break
+		}
 		var w, dw int64
 		w = o.SampleValue(sample.Value)
 		if o.SampleMeanDivisor != nil {
@@ -347,10 +469,13 @@ func newGraph(prof *profile.Profile, o *Options) (*Graph, map[uint64]Nodes) {
 		residual := false
 
 		labels := joinLabels(sample)
+		var metrics map[string]int64
+		if o.LabelMetrics != nil {
+			metrics = o.LabelMetrics(sample)
+		}
 		// Group the sample frames, based on a global map.
 		for i := len(sample.Location) - 1; i >= 0; i-- {
-			l := sample.Location[i]
-			locNodes := locationMap[l.ID]
+			locNodes := frameNodes(sample.Location[i], sample)
 			for ni := len(locNodes) - 1; ni >= 0; ni-- {
 				n := locNodes[ni]
 				if n == nil {
@@ -361,6 +486,10 @@ func newGraph(prof *profile.Profile, o *Options) (*Graph, map[uint64]Nodes) {
 				if _, ok := seenNode[n]; !ok {
 					seenNode[n] = true
 					n.addSample(dw, w, labels, sample.NumLabel, sample.NumUnit, o.FormatTag, false)
+					n.addLabelMetrics(metrics, false)
+					if o.SampleIndices {
+						n.SampleIndices = append(n.SampleIndices, si)
+					}
 				}
 				// Update edge weights for all edges in stack, avoiding double counting.
 				if _, ok := seenEdge[nodePair{n, parent}]; !ok && parent != nil && n != parent {
@@ -374,10 +503,38 @@ func newGraph(prof *profile.Profile, o *Options) (*Graph, map[uint64]Nodes) {
 		if parent != nil && !residual {
 			// Add flat weight to leaf node.
 			parent.addSample(dw, w, labels, sample.NumLabel, sample.NumUnit, o.FormatTag, true)
+			parent.addLabelMetrics(metrics, true)
 		}
 	}
 
-	return selectNodesForGraph(nodes, o.DropNegative), locationMap
+	return selectNodesForGraph(nodes(), o.DropNegative)
+}
+
+// sampleNodes creates the nodes for the frames of the samples of a
+// profile. It returns a function giving the nodes for the frames of a
+// location in a sample, in the order of its lines, with nil for the frames
+// whose node is not kept, and a function returning all the nodes created.
+func sampleNodes(prof *profile.Profile, o *Options) (frameNodes func(l *profile.Location, s *profile.Sample) Nodes, nodes func() Nodes) {
+	if o.KeyFunc == nil {
+		all, locationMap := CreateNodes(prof, o)
+		frameNodes = func(l *profile.Location, _ *profile.Sample) Nodes {
+			return locationMap[l.ID]
+		}
+		return frameNodes, func() Nodes { return all }
+	}
+	nm := make(NodeMap)
+	frameNodes = func(l *profile.Location, s *profile.Sample) Nodes {
+		lines := l.Line
+		if len(lines) == 0 {
+			lines = []profile.Line{{}} // Create empty line to include location info.
+		}
+		locNodes := make(Nodes, len(lines))
+		for ln := range lines {
+			locNodes[ln] = nm.findOrInsertKey(l, lines[ln], s, o)
+		}
+		return locNodes
+	}
+	return frameNodes, nm.nodes
 }
 
 func selectNodesForGraph(nodes Nodes, dropNegative bool) *Graph {
@@ -402,9 +559,12 @@ type nodePair struct {
 	src, dest *Node
 }
 
-func newTree(prof *profile.Profile, o *Options) (g *Graph) {
+func newTree(ctx context.Context, prof *profile.Profile, o *Options) (g *Graph) {
 	parentNodeMap := make(map[*Node]NodeMap, len(prof.Sample))
-	for _, sample := range prof.Sample {
+	for si, sample := range prof.Sample {
+		if ctx.Err() != nil {
+			break
+		}
 		var w, dw int64
 		w = o.SampleValue(sample.Value)
 		if o.SampleMeanDivisor != nil {
@@ -415,6 +575,10 @@ func newTree(prof *profile.Profile, o *Options) (g *Graph) {
 		}
 		var parent *Node
 		labels := joinLabels(sample)
+		var metrics map[string]int64
+		if o.LabelMetrics != nil {
+			metrics = o.LabelMetrics(sample)
+		}
 		// Group the sample frames, based on a per-node map.
 		for i := len(sample.Location) - 1; i >= 0; i-- {
 			l := sample.Location[i]
@@ -428,11 +592,20 @@ func newTree(prof *profile.Profile, o *Options) (g *Graph) {
 					nodeMap = make(NodeMap)
 					parentNodeMap[parent] = nodeMap
 				}
-				n := nodeMap.findOrInsertLine(l, lines[lidx], o)
+				var n *Node
+				if o.KeyFunc != nil {
+					n = nodeMap.findOrInsertKey(l, lines[lidx], sample, o)
+				} else {
+					n = nodeMap.findOrInsertLine(l, lines[lidx], o)
+				}
 				if n == nil {
 					continue
 				}
 				n.addSample(dw, w, labels, sample.NumLabel, sample.NumUnit, o.FormatTag, false)
+				n.addLabelMetrics(metrics, false)
+				if o.SampleIndices {
+					n.SampleIndices = append(n.SampleIndices, si)
+				}
 				if parent != nil {
 					parent.AddToEdgeDiv(n, dw, w, false, lidx != len(lines)-1)
 				}
@@ -441,6 +614,7 @@ func newTree(prof *profile.Profile, o *Options) (g *Graph) {
 		}
 		if parent != nil {
 			parent.addSample(dw, w, labels, sample.NumLabel, sample.NumUnit, o.FormatTag, true)
+			parent.addLabelMetrics(metrics, true)
 		}
 	}
 
@@ -582,21 +756,36 @@ func (nm NodeMap) nodes() Nodes {
 }
 
 func (nm NodeMap) findOrInsertLine(l *profile.Location, li profile.Line, o *Options) *Node {
-	var objfile string
-	if m := l.Mapping; m != nil && m.File != "" {
-		objfile = m.File
+	if ni := nodeInfo(l, li, locationObjfile(l), o); ni != nil {
+		return nm.FindOrInsertNode(*ni, o.KeptNodes)
 	}
+	return nil
+}
 
-	if ni := nodeInfo(l, li, objfile, o); ni != nil {
-		return nm.FindOrInsertNode(*ni, o.KeptNodes)
+// findOrInsertKey is like findOrInsertLine, but returns the node for the
+// key o.KeyFunc gives the frame in sample s.
+func (nm NodeMap) findOrInsertKey(l *profile.Location, li profile.Line, s *profile.Sample, o *Options) *Node {
+	if ni := nodeInfo(l, li, locationObjfile(l), o); ni != nil {
+		return nm.FindOrInsertNode(NodeInfo{Name: o.KeyFunc(*ni, s)}, o.KeptNodes)
 	}
 	return nil
 }
 
+// locationObjfile returns the file of the mapping of a location, if any.
+func locationObjfile(l *profile.Location) string {
+	if m := l.Mapping; m != nil {
+		return m.File
+	}
+	return ""
+}
+
 func nodeInfo(l *profile.Location, line profile.Line, objfile string, o *Options) *NodeInfo {
 	if line.Function == nil {
 		return &NodeInfo{Address: l.Address, Objfile: objfile}
 	}
+	if o.MergeFunctionNames && line.Function.Name != "" {
+		return &NodeInfo{Name: line.Function.Name}
+	}
 	ni := &NodeInfo{
 		Address:  l.Address,
 		Lineno:   int(line.Line),
@@ -798,6 +987,43 @@ func trimLowFreqTags(tags TagMap, minValue int64) TagMap {
 	return kept
 }
 
+// FilterTags removes the tags of the nodes in the graph that do not
+// match show or that match hide, leaving the node values unchanged.
+// Label tags are matched by their key:value name, and numeric tags by
+// their formatted value and their unit. Numeric tags attached to a
+// removed label tag are removed too. Returns whether show and hide
+// matched any tag.
+func (g *Graph) FilterTags(show, hide *regexp.Regexp) (sm, hm bool) {
+	remove := func(names ...string) bool {
+		matchShow, matchHide := show == nil, false
+		for _, name := range names {
+			if show != nil && show.MatchString(name) {
+				matchShow, sm = true, true
+			}
+			if hide != nil && hide.MatchString(name) {
+				matchHide, hm = true, true
+			}
+		}
+		return !matchShow || matchHide
+	}
+	for _, n := range g.Nodes {
+		for name, t := range n.LabelTags {
+			if remove(t.Name) {
+				delete(n.LabelTags, name)
+				delete(n.NumericTags, t.Name)
+			}
+		}
+		for _, nt := range n.NumericTags {
+			for name, t := range nt {
+				if remove(t.Name, t.Unit) {
+					delete(nt, name)
+				}
+			}
+		}
+	}
+	return
+}
+
 // TrimLowFrequencyEdges removes edges that have less than
 // the specified weight. Returns the number of edges removed
 func (g *Graph) TrimLowFrequencyEdges(edgeCutoff int64) int {
@@ -814,6 +1040,72 @@ func (g *Graph) TrimLowFrequencyEdges(edgeCutoff int64) int {
 	return droppedEdges
 }
 
+// KeepPathsTo prunes the graph down to the nodes and edges that lie on
+// some path to a node whose name matches target, that is the nodes from
+// which a matching node can be reached, including the nodes of cycles
+// without callers, and returns whether any node matched. Edges to nodes
+// outside the graph are dropped as well. If target is nil or matches no
+// node, it returns false and does not modify the graph.
+func (g *Graph) KeepPathsTo(target *regexp.Regexp) bool {
+	if target == nil {
+		return false
+	}
+	inGraph := make(map[*Node]bool, len(g.Nodes))
+	for _, n := range g.Nodes {
+		inGraph[n] = true
+	}
+	var targets Nodes
+	for _, n := range g.Nodes {
+		if target.MatchString(n.Info.PrintableName()) {
+			targets = append(targets, n)
+		}
+	}
+	if len(targets) == 0 {
+		return false
+	}
+	// Every node is reached from a root or from a cycle without callers,
+	// so the nodes on paths to the targets are their callers, found by
+	// following the edges to callers from the targets.
+	reachesTarget := make(map[*Node]bool, len(g.Nodes))
+	for from := targets; len(from) > 0; {
+		n := from[len(from)-1]
+		from = from[:len(from)-1]
+		if reachesTarget[n] {
+			continue
+		}
+		reachesTarget[n] = true
+		for src := range n.In {
+			if inGraph[src] && !reachesTarget[src] {
+				from = append(from, src)
+			}
+		}
+	}
+	keep := make(map[*Node]bool, len(g.Nodes))
+	kept := make(Nodes, 0, len(g.Nodes))
+	for _, n := range g.Nodes {
+		if reachesTarget[n] {
+			keep[n] = true
+			kept = append(kept, n)
+		}
+	}
+	for _, n := range g.Nodes {
+		for dest := range n.Out {
+			if !keep[n] || !keep[dest] {
+				delete(n.Out, dest)
+				delete(dest.In, n)
+			}
+		}
+		for src := range n.In {
+			if !keep[n] || !keep[src] {
+				delete(n.In, src)
+				delete(src.Out, n)
+			}
+		}
+	}
+	g.Nodes = kept
+	return true
+}
+
 // SortNodes sorts the nodes in a graph based on a specific heuristic.
 func (g *Graph) SortNodes(cum bool, visualMode bool) {
 	// Sort nodes based on requested mode
@@ -838,6 +1130,8 @@ func (g *Graph) SelectTopNodePtrs(maxNodes int, visualMode bool) NodePtrSet {
 }
 
 // SelectTopNodes returns a set of the top maxNodes nodes in a graph.
+// The nodes must be sorted, as by SortNodes, whose orders break ties by
+// name so that the selection does not depend on the order of the nodes.
 func (g *Graph) SelectTopNodes(maxNodes int, visualMode bool) NodeSet {
 	return makeNodeSet(g.selectTopNodes(maxNodes, visualMode), 0)
 }
@@ -910,6 +1204,158 @@ func (g *Graph) RemoveRedundantEdges() {
 	}
 }
 
+// TopologicalOrder returns the nodes of the graph ordered so that the
+// source of every edge comes before its destination, i.e. callers come
+// before their callees. Self-edges from direct recursion are ignored, as
+// are edges to nodes outside the graph. Ties are broken by the current
+// order of g.Nodes, so the result is deterministic. If the graph has
+// other cycles, an error is returned along with a best-effort order: the
+// nodes that could be ordered, followed by the nodes involved in or
+// reachable from a cycle, in their current order.
+func (g *Graph) TopologicalOrder() (Nodes, error) {
+	index := make(map[*Node]int, len(g.Nodes))
+	for i, n := range g.Nodes {
+		index[n] = i
+	}
+	inDegree := make([]int, len(g.Nodes))
+	for i, n := range g.Nodes {
+		for src := range n.In {
+			if _, ok := index[src]; ok && src != n {
+				inDegree[i]++
+			}
+		}
+	}
+
+	order := make(Nodes, 0, len(g.Nodes))
+	for i, n := range g.Nodes {
+		if inDegree[i] == 0 {
+			order = append(order, n)
+		}
+	}
+	for next := 0; next < len(order); next++ {
+		n := order[next]
+		var ready []int
+		for dest := range n.Out {
+			i, ok := index[dest]
+			if !ok || dest == n {
+				continue
+			}
+			if inDegree[i]--; inDegree[i] == 0 {
+				ready = append(ready, i)
+			}
+		}
+		sort.Ints(ready)
+		for _, i := range ready {
+			order = append(order, g.Nodes[i])
+		}
+	}
+	if len(order) == len(g.Nodes) {
+		return order, nil
+	}
+
+	remaining := len(g.Nodes) - len(order)
+	for i, n := range g.Nodes {
+		if inDegree[i] > 0 {
+			order = append(order, n)
+		}
+	}
+	return order, fmt.Errorf("graph has cycles: %d of %d nodes could not be ordered", remaining, len(g.Nodes))
+}
+
+// HotPath returns the edges of the heaviest path from a root of the graph
+// (a node without callers) to a leaf (a node without callees), ordered from
+// the root. The weight of a path is the smallest of the cum value of its
+// root and the weights of its edges, so the hot path is the one carrying
+// the most weight all the way to a leaf. Edges closing a cycle, as found
+// by a depth-first search starting from the roots, are ignored. It returns
+// nil if the graph has no edges.
+func (g *Graph) HotPath() []*Edge {
+	// Order the nodes in reverse postorder of a depth-first search, which
+	// is a topological order once the edges closing cycles are removed.
+	inGraph := make(map[*Node]bool, len(g.Nodes))
+	for _, n := range g.Nodes {
+		inGraph[n] = true
+	}
+	visited := make(map[*Node]bool, len(g.Nodes))
+	var postorder Nodes
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		visited[n] = true
+		for _, e := range n.Out.Sort() {
+			if inGraph[e.Dest] && !visited[e.Dest] {
+				visit(e.Dest)
+			}
+		}
+		postorder = append(postorder, n)
+	}
+	isRoot := func(n *Node) bool {
+		for src := range n.In {
+			if inGraph[src] && src != n {
+				return false
+			}
+		}
+		return true
+	}
+	for _, roots := range []bool{true, false} {
+		for _, n := range g.Nodes {
+			if !visited[n] && isRoot(n) == roots {
+				visit(n)
+			}
+		}
+	}
+	position := make(map[*Node]int, len(postorder))
+	order := make(Nodes, len(postorder))
+	for i, n := range postorder {
+		position[n] = len(postorder) - 1 - i
+		order[len(postorder)-1-i] = n
+	}
+	// forward returns the edges that follow the topological order.
+	forward := func(edges EdgeMap) []*Edge {
+		var fwd []*Edge
+		for _, e := range edges.Sort() {
+			src, srcOK := position[e.Src]
+			dest, destOK := position[e.Dest]
+			if srcOK && destOK && src < dest {
+				fwd = append(fwd, e)
+			}
+		}
+		return fwd
+	}
+
+	// best holds the weight of the heaviest path from a root to each node,
+	// and pred the last edge of that path. As the predecessors of a node
+	// come before it, its path is known by the time it is reached.
+	best := make(map[*Node]int64, len(order))
+	pred := make(map[*Node]*Edge, len(order))
+	var leaf *Node
+	for _, n := range order {
+		if pred[n] == nil {
+			best[n] = abs64(n.CumValue())
+		}
+		out := forward(n.Out)
+		for _, e := range out {
+			if w := min64(best[n], abs64(e.WeightValue())); pred[e.Dest] == nil || w > best[e.Dest] {
+				best[e.Dest], pred[e.Dest] = w, e
+			}
+		}
+		if pred[n] != nil && len(out) == 0 && (leaf == nil || best[n] > best[leaf]) {
+			leaf = n
+		}
+	}
+	if leaf == nil {
+		return nil
+	}
+
+	var path []*Edge
+	for e := pred[leaf]; e != nil; e = pred[e.Src] {
+		path = append(path, e)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
 // isRedundantEdge determines if there is a path that allows e.Src
 // to reach e.Dest after removing e.
 func isRedundantEdge(e *Edge) bool {
@@ -1133,6 +1579,19 @@ func (e EdgeMap) Sort() []*Edge {
 	return el
 }
 
+// SortedEdges returns the outgoing edges of all the nodes of the graph,
+// sorted as by EdgeMap.Sort, by decreasing weight.
+func (g *Graph) SortedEdges() []*Edge {
+	var el edgeList
+	for _, n := range g.Nodes {
+		for _, e := range n.Out {
+			el = append(el, e)
+		}
+	}
+	sort.Sort(el)
+	return el
+}
+
 // Sum returns the total weight for a set of nodes.
 func (e EdgeMap) Sum() int64 {
 	var ret int64
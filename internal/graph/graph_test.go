@@ -15,7 +15,12 @@
 package graph
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/google/pprof/profile"
@@ -545,3 +550,613 @@ func TestShortenFunctionName(t *testing.T) {
 		}
 	}
 }
+
+func TestTopologicalOrder(t *testing.T) {
+	// newNodes returns n named nodes without edges.
+	newNodes := func(names ...string) Nodes {
+		var ns Nodes
+		for _, name := range names {
+			n := createEmptyNode()
+			n.Info.Name = name
+			ns = append(ns, n)
+		}
+		return ns
+	}
+	names := func(ns Nodes) []string {
+		var s []string
+		for _, n := range ns {
+			s = append(s, n.Info.Name)
+		}
+		return s
+	}
+
+	t.Run("acyclic", func(t *testing.T) {
+		// Nodes are listed in an order that is not topological.
+		ns := newNodes("c", "main", "b", "a", "d")
+		c, main, b, a, d := ns[0], ns[1], ns[2], ns[3], ns[4]
+		createEdges(main, a, b)
+		createEdges(a, c)
+		createEdges(b, c, b) // b is directly recursive.
+		createEdges(c, d)
+		got, err := (&Graph{Nodes: ns}).TopologicalOrder()
+		if err != nil {
+			t.Fatalf("TopologicalOrder: unexpected error %v", err)
+		}
+		if want := []string{"main", "b", "a", "c", "d"}; !reflect.DeepEqual(names(got), want) {
+			t.Errorf("TopologicalOrder() = %v, want %v", names(got), want)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		ns := newNodes("main", "x", "y", "z", "other")
+		main, x, y, z := ns[0], ns[1], ns[2], ns[3]
+		createEdges(main, x)
+		createEdges(x, y)
+		createEdges(y, x, z)
+		got, err := (&Graph{Nodes: ns}).TopologicalOrder()
+		if err == nil {
+			t.Fatal("TopologicalOrder: got no error for graph with a cycle")
+		}
+		if want := []string{"main", "other", "x", "y", "z"}; !reflect.DeepEqual(names(got), want) {
+			t.Errorf("TopologicalOrder() = %v, want best-effort order %v", names(got), want)
+		}
+	})
+}
+
+func TestHotPath(t *testing.T) {
+	newNode := func(name string, cum int64) *Node {
+		n := createEmptyNode()
+		n.Info.Name, n.Cum = name, cum
+		return n
+	}
+	pathString := func(path []*Edge) string {
+		var s []string
+		for _, e := range path {
+			s = append(s, e.Src.Info.Name+"->"+e.Dest.Info.Name)
+		}
+		return strings.Join(s, " ")
+	}
+
+	main, a, b, c, d := newNode("main", 100), newNode("a", 60), newNode("b", 40), newNode("c", 50), newNode("d", 50)
+	createEdges(main, a, b)
+	createEdges(a, c, d)
+	createEdges(b, c)
+	createEdges(d, a) // Closes a cycle through a.
+	setEdgeWeight(main.Out, a, 60)
+	setEdgeWeight(main.Out, b, 40)
+	setEdgeWeight(a.Out, c, 10)
+	setEdgeWeight(a.Out, d, 50)
+	setEdgeWeight(b.Out, c, 40)
+	setEdgeWeight(d.Out, a, 5)
+
+	// main->b->c carries 40 all the way to c, but main->a->d carries 50.
+	g := &Graph{Nodes: Nodes{c, d, main, b, a}}
+	if got, want := pathString(g.HotPath()), "main->a a->d"; got != want {
+		t.Errorf("HotPath() = %q, want %q", got, want)
+	}
+
+	setEdgeWeight(a.Out, d, 30)
+	if got, want := pathString(g.HotPath()), "main->b b->c"; got != want {
+		t.Errorf("HotPath() = %q, want %q", got, want)
+	}
+
+	if got := (&Graph{Nodes: Nodes{newNode("alone", 10)}}).HotPath(); got != nil {
+		t.Errorf("HotPath() of a graph without edges = %q, want none", pathString(got))
+	}
+}
+
+func TestKeepPathsTo(t *testing.T) {
+	newNode := func(name string) *Node {
+		n := createEmptyNode()
+		n.Info.Name = name
+		return n
+	}
+	edgeStrings := func(g *Graph) []string {
+		var s []string
+		for _, n := range g.Nodes {
+			for _, e := range n.Out.Sort() {
+				s = append(s, e.Src.Info.Name+"->"+e.Dest.Info.Name)
+			}
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	// main calls a and b, which both call target. b also calls c, target
+	// calls d and the other root e calls d, none of which reach target.
+	main, a, b, c, d, e, target := newNode("main"), newNode("a"), newNode("b"), newNode("c"), newNode("d"), newNode("e"), newNode("target")
+	createEdges(main, a, b)
+	createEdges(a, target)
+	createEdges(b, c, target)
+	createEdges(target, d)
+	createEdges(e, d)
+	g := &Graph{Nodes: Nodes{main, a, b, c, d, e, target}}
+
+	if g.KeepPathsTo(regexp.MustCompile("nomatch")) {
+		t.Errorf("KeepPathsTo(nomatch) = true, want false")
+	}
+	if got := len(edgeStrings(g)); got != 7 {
+		t.Errorf("KeepPathsTo(nomatch) left %d edges, want all 7", got)
+	}
+
+	if !g.KeepPathsTo(regexp.MustCompile("^target$")) {
+		t.Errorf("KeepPathsTo(target) = false, want true")
+	}
+	if got, want := edgeStrings(g), []string{"a->target", "b->target", "main->a", "main->b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("KeepPathsTo(target) kept edges %v, want %v", got, want)
+	}
+	var names []string
+	for _, n := range g.Nodes {
+		names = append(names, n.Info.Name)
+	}
+	if got, want := strings.Join(names, " "), "main a b target"; got != want {
+		t.Errorf("KeepPathsTo(target) kept nodes %q, want %q", got, want)
+	}
+	if len(c.In) != 0 || len(d.In) != 0 || len(e.Out) != 0 {
+		t.Errorf("KeepPathsTo(target) left edges to pruned nodes")
+	}
+
+	// In a cycle without callers, every node of the cycle is on a path to
+	// target, unlike the node it calls.
+	x, y, target, z := newNode("x"), newNode("y"), newNode("target"), newNode("z")
+	createEdges(x, y)
+	createEdges(y, target)
+	createEdges(target, x, z)
+	g = &Graph{Nodes: Nodes{x, y, target, z}}
+	if !g.KeepPathsTo(regexp.MustCompile("^target$")) {
+		t.Errorf("KeepPathsTo(target) of a cycle = false, want true")
+	}
+	if got, want := edgeStrings(g), []string{"target->x", "x->y", "y->target"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("KeepPathsTo(target) of a cycle kept edges %v, want %v", got, want)
+	}
+}
+
+func TestFilterTags(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "alloc"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "space", Unit: "bytes"}},
+		Function:   []*profile.Function{fn},
+		Location:   []*profile.Location{loc},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{loc}, Value: []int64{10}, Label: map[string][]string{"thread": {"a"}}, NumLabel: map[string][]int64{"bytes": {1024}}},
+			{Location: []*profile.Location{loc}, Value: []int64{20}, Label: map[string][]string{"thread": {"b"}}, NumLabel: map[string][]int64{"bytes": {2048}}},
+			{Location: []*profile.Location{loc}, Value: []int64{30}, NumLabel: map[string][]int64{"bytes": {4096}}},
+		},
+	}
+	tagNames := func(g *Graph) []string {
+		var names []string
+		for _, t := range g.Nodes[0].LabelTags {
+			names = append(names, t.Name)
+		}
+		for l, nt := range g.Nodes[0].NumericTags {
+			for _, t := range nt {
+				names = append(names, l+"/"+t.Name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	for _, tc := range []struct {
+		desc       string
+		show, hide string
+		want       []string
+		sm, hm     bool
+	}{
+		{
+			desc: "no filters",
+			want: []string{"/4096", "thread:a", "thread:a/1024", "thread:b", "thread:b/2048"},
+		},
+		{
+			desc: "hide value",
+			hide: "^2048$",
+			want: []string{"/4096", "thread:a", "thread:a/1024", "thread:b"},
+			hm:   true,
+		},
+		{
+			desc: "hide label tag",
+			hide: "thread:a",
+			want: []string{"/4096", "thread:b", "thread:b/2048"},
+			hm:   true,
+		},
+		{
+			desc: "show unit",
+			show: "bytes",
+			want: []string{"/4096"},
+			sm:   true,
+		},
+		{
+			desc: "hide unit",
+			hide: "bytes",
+			want: []string{"thread:a", "thread:b"},
+			hm:   true,
+		},
+		{
+			desc: "no matches",
+			show: "nomatch",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			g := New(prof, &Options{SampleValue: func(v []int64) int64 { return v[0] }})
+			var show, hide *regexp.Regexp
+			if tc.show != "" {
+				show = regexp.MustCompile(tc.show)
+			}
+			if tc.hide != "" {
+				hide = regexp.MustCompile(tc.hide)
+			}
+			sm, hm := g.FilterTags(show, hide)
+			if sm != tc.sm || hm != tc.hm {
+				t.Errorf("FilterTags() = %v, %v, want %v, %v", sm, hm, tc.sm, tc.hm)
+			}
+			if got := tagNames(g); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got tags %v, want %v", got, tc.want)
+			}
+			// Tags are only hidden, the node keeps the value of all samples.
+			if n := g.Nodes[0]; n.Flat != 60 || n.Cum != 60 {
+				t.Errorf("got flat=%d cum=%d, want 60 for both", n.Flat, n.Cum)
+			}
+		})
+	}
+}
+
+func TestSelectTopNodesTies(t *testing.T) {
+	names := []string{"e", "b", "d", "a", "c"}
+	newGraph := func(perm []int) *Graph {
+		g := &Graph{Nodes: Nodes{{Info: NodeInfo{Name: "top"}, Flat: 100, Cum: 100}}}
+		for _, i := range perm {
+			g.Nodes = append(g.Nodes, &Node{Info: NodeInfo{Name: names[i]}, Flat: 10, Cum: 10})
+		}
+		g.Nodes = append(g.Nodes, &Node{Info: NodeInfo{Name: "low"}, Flat: 1, Cum: 1})
+		return g
+	}
+	want := []string{"a", "b", "c", "top"}
+	for _, visualMode := range []bool{false, true} {
+		for _, perm := range [][]int{{0, 1, 2, 3, 4}, {4, 3, 2, 1, 0}, {2, 0, 4, 1, 3}, {3, 4, 0, 2, 1}} {
+			g := newGraph(perm)
+			g.SortNodes(true, visualMode)
+			var got []string
+			for n := range g.SelectTopNodes(4, visualMode) {
+				got = append(got, n.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("SelectTopNodes(visualMode=%v) with node order %v: got %v, want %v", visualMode, perm, got, want)
+			}
+		}
+	}
+}
+
+func TestSampleIndices(t *testing.T) {
+	var funcs []*profile.Function
+	var locs []*profile.Location
+	for i, name := range []string{"a", "b", "c"} {
+		funcs = append(funcs, &profile.Function{ID: uint64(i + 1), Name: name})
+		locs = append(locs, &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: funcs[i]}}})
+	}
+	a, b, c := locs[0], locs[1], locs[2]
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{b, a}, Value: []int64{1}},
+			{Location: []*profile.Location{c, a}, Value: []int64{2}},
+			// Samples without value do not contribute to nodes.
+			{Location: []*profile.Location{a}, Value: []int64{0}},
+			// Recursive calls count the sample once per node.
+			{Location: []*profile.Location{b, b, a}, Value: []int64{3}},
+		},
+		Location: locs,
+		Function: funcs,
+	}
+
+	for _, tc := range []struct {
+		callTree bool
+		want     map[string][][]int
+	}{
+		{
+			want: map[string][][]int{"a": {{0, 1, 3}}, "b": {{0, 3}}, "c": {{1}}},
+		},
+		{
+			// Tree nodes only get the samples of their call path.
+			callTree: true,
+			want:     map[string][][]int{"a": {{0, 1, 3}}, "b": {{0, 3}, {3}}, "c": {{1}}},
+		},
+	} {
+		g := New(prof, &Options{
+			SampleValue:   func(v []int64) int64 { return v[0] },
+			CallTree:      tc.callTree,
+			SampleIndices: true,
+		})
+		got := make(map[string][][]int)
+		for _, n := range g.Nodes {
+			got[n.Info.Name] = append(got[n.Info.Name], n.SampleIndices)
+		}
+		for _, indices := range got {
+			sort.Slice(indices, func(i, j int) bool { return len(indices[i]) > len(indices[j]) })
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("CallTree=%v: got sample indices %v, want %v", tc.callTree, got, tc.want)
+		}
+	}
+
+	g := New(prof, &Options{SampleValue: func(v []int64) int64 { return v[0] }})
+	for _, n := range g.Nodes {
+		if n.SampleIndices != nil {
+			t.Errorf("node %s has sample indices %v without Options.SampleIndices", n.Info.Name, n.SampleIndices)
+		}
+	}
+}
+
+func TestLabelMetrics(t *testing.T) {
+	var funcs []*profile.Function
+	var locs []*profile.Location
+	for i, name := range []string{"a", "b", "c"} {
+		funcs = append(funcs, &profile.Function{ID: uint64(i + 1), Name: name})
+		locs = append(locs, &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: funcs[i]}}})
+	}
+	a, b, c := locs[0], locs[1], locs[2]
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{b, a}, Value: []int64{1}, NumLabel: map[string][]int64{"misses": {10}}},
+			{Location: []*profile.Location{c, a}, Value: []int64{2}, NumLabel: map[string][]int64{"misses": {20}, "stalls": {5}}},
+			// Recursive calls count the metrics once per node.
+			{Location: []*profile.Location{b, b, a}, Value: []int64{3}, NumLabel: map[string][]int64{"misses": {1, 2}}},
+			{Location: []*profile.Location{a}, Value: []int64{4}},
+		},
+		Location: locs,
+		Function: funcs,
+	}
+	metrics := func(s *profile.Sample) map[string]int64 {
+		values := make(map[string]int64)
+		for k, vs := range s.NumLabel {
+			for _, v := range vs {
+				values[k] += v
+			}
+		}
+		return values
+	}
+
+	for _, tc := range []struct {
+		callTree bool
+		want     map[string]map[string]LabelMetric
+	}{
+		{
+			want: map[string]map[string]LabelMetric{
+				"a": {"misses": {Cum: 33}, "stalls": {Cum: 5}},
+				"b": {"misses": {Flat: 13, Cum: 13}},
+				"c": {"misses": {Flat: 20, Cum: 20}, "stalls": {Flat: 5, Cum: 5}},
+			},
+		},
+		{
+			// The flat metrics of the inner b tree node are the ones of
+			// the recursive sample.
+			callTree: true,
+			want: map[string]map[string]LabelMetric{
+				"a":   {"misses": {Cum: 33}, "stalls": {Cum: 5}},
+				"a/b": {"misses": {Flat: 10, Cum: 13}},
+				"b/b": {"misses": {Flat: 3, Cum: 3}},
+				"a/c": {"misses": {Flat: 20, Cum: 20}, "stalls": {Flat: 5, Cum: 5}},
+			},
+		},
+	} {
+		g := New(prof, &Options{
+			SampleValue:  func(v []int64) int64 { return v[0] },
+			CallTree:     tc.callTree,
+			LabelMetrics: metrics,
+		})
+		got := make(map[string]map[string]LabelMetric)
+		for _, n := range g.Nodes {
+			name := n.Info.Name
+			if tc.callTree && len(n.In) > 0 {
+				for _, e := range n.In {
+					name = e.Src.Info.Name + "/" + name
+				}
+			}
+			if len(n.LabelMetrics) == 0 {
+				continue
+			}
+			m := make(map[string]LabelMetric)
+			for k, v := range n.LabelMetrics {
+				m[k] = *v
+			}
+			got[name] = m
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("CallTree=%v: got label metrics %v, want %v", tc.callTree, got, tc.want)
+		}
+	}
+}
+
+func TestMergeFunctionNames(t *testing.T) {
+	m1 := &profile.Mapping{ID: 1, File: "bin1"}
+	m2 := &profile.Mapping{ID: 2, File: "bin2"}
+	funcs := []*profile.Function{
+		{ID: 1, Name: "main", Filename: "main.cc"},
+		{ID: 2, Name: "Vector<int>::size", SystemName: "_ZN6VectorIiE4sizeEv", Filename: "a.cc", StartLine: 10},
+		{ID: 3, Name: "Vector<int>::size", SystemName: "_ZN6VectorIiE4sizeEv", Filename: "b.cc", StartLine: 20},
+		{ID: 4, Name: "Vector<int>::size", SystemName: "_ZN6VectorIiE4sizeEv", Filename: "a.cc", StartLine: 10},
+	}
+	locs := []*profile.Location{
+		{ID: 1, Mapping: m1, Address: 0x10, Line: []profile.Line{{Function: funcs[0], Line: 1}}},
+		{ID: 2, Mapping: m1, Address: 0x20, Line: []profile.Line{{Function: funcs[1], Line: 11}}},
+		{ID: 3, Mapping: m1, Address: 0x30, Line: []profile.Line{{Function: funcs[2], Line: 21}}},
+		{ID: 4, Mapping: m2, Address: 0x40, Line: []profile.Line{{Function: funcs[3], Line: 12}}},
+		// Locations without function are not merged.
+		{ID: 5, Mapping: m2, Address: 0x50},
+		{ID: 6, Mapping: m2, Address: 0x60},
+	}
+	var samples []*profile.Sample
+	for i, l := range locs[1:] {
+		samples = append(samples, &profile.Sample{Location: []*profile.Location{l, locs[0]}, Value: []int64{int64(i + 1)}})
+	}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     samples,
+		Location:   locs,
+		Function:   funcs,
+		Mapping:    []*profile.Mapping{m1, m2},
+	}
+
+	for _, tc := range []struct {
+		desc string
+		o    Options
+		want map[string]int64
+	}{
+		{
+			desc: "by location",
+			o:    Options{ObjNames: true, OrigFnNames: true},
+			want: map[string]int64{
+				"main main.cc:1":            15,
+				"Vector<int>::size a.cc:11": 1,
+				"Vector<int>::size b.cc:21": 2,
+				"Vector<int>::size a.cc:12": 3,
+				"<unknown> 0x50":            4,
+				"<unknown> 0x60":            5,
+			},
+		},
+		{
+			desc: "merged",
+			o:    Options{ObjNames: true, OrigFnNames: true, MergeFunctionNames: true},
+			want: map[string]int64{
+				"main":              15,
+				"Vector<int>::size": 6,
+				"<unknown> 0x50":    4,
+				"<unknown> 0x60":    5,
+			},
+		},
+	} {
+		tc.o.SampleValue = func(v []int64) int64 { return v[0] }
+		g := New(prof, &tc.o)
+		got := make(map[string]int64)
+		for _, n := range g.Nodes {
+			key := n.Info.Name
+			switch {
+			case n.Info.Name == "":
+				key = fmt.Sprintf("<unknown> %#x", n.Info.Address)
+			case n.Info.File != "":
+				key = fmt.Sprintf("%s %s:%d", n.Info.Name, n.Info.File, n.Info.Lineno)
+			}
+			got[key] += n.Cum
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got nodes %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	var funcs []*profile.Function
+	var locs []*profile.Location
+	for i, name := range []string{"main", "foo", "bar"} {
+		funcs = append(funcs, &profile.Function{ID: uint64(i + 1), Name: name})
+		locs = append(locs, &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: funcs[i]}}})
+	}
+	main, foo, bar := locs[0], locs[1], locs[2]
+	tenant := func(name string) map[string][]string { return map[string][]string{"tenant": {name}} }
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{foo, main}, Value: []int64{1}, Label: tenant("x")},
+			{Location: []*profile.Location{foo, main}, Value: []int64{2}, Label: tenant("y")},
+			{Location: []*profile.Location{bar, foo, main}, Value: []int64{4}, Label: tenant("x")},
+		},
+		Location: locs,
+		Function: funcs,
+	}
+	// bar is keyed as foo, so in a graph it is merged into the foo node of
+	// its sample, and in a call tree it is a foo node called by foo.
+	key := func(info NodeInfo, s *profile.Sample) string {
+		name := info.Name
+		if name == "bar" {
+			name = "foo"
+		}
+		return name + "@" + s.Label["tenant"][0]
+	}
+
+	for _, tc := range []struct {
+		callTree bool
+		want     []string
+	}{
+		{
+			want: []string{
+				"foo@x flat=5 cum=5", "foo@y flat=2 cum=2", "main@x flat=0 cum=5", "main@y flat=0 cum=2",
+				"main@x->foo@x 5", "main@y->foo@y 2",
+			},
+		},
+		{
+			callTree: true,
+			want: []string{
+				"foo@x flat=1 cum=5", "foo@x flat=4 cum=4", "foo@y flat=2 cum=2", "main@x flat=0 cum=5", "main@y flat=0 cum=2",
+				"foo@x->foo@x 4", "main@x->foo@x 5", "main@y->foo@y 2",
+			},
+		},
+	} {
+		g := New(prof, &Options{
+			SampleValue: func(v []int64) int64 { return v[0] },
+			CallTree:    tc.callTree,
+			KeyFunc:     key,
+		})
+		var got, edges []string
+		for _, n := range g.Nodes {
+			if n.Info != (NodeInfo{Name: n.Info.Name}) {
+				t.Errorf("callTree=%v: node %s has info %+v, want only the key as name", tc.callTree, n.Info.Name, n.Info)
+			}
+			got = append(got, fmt.Sprintf("%s flat=%d cum=%d", n.Info.Name, n.Flat, n.Cum))
+			for _, e := range n.Out {
+				edges = append(edges, fmt.Sprintf("%s->%s %d", e.Src.Info.Name, e.Dest.Info.Name, e.Weight))
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(edges)
+		if got = append(got, edges...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("callTree=%v: got %v, want %v", tc.callTree, got, tc.want)
+		}
+	}
+}
+
+func TestNewCanceled(t *testing.T) {
+	prof := &profile.Profile{SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}}}
+	for i, name := range []string{"a", "b", "c", "d"} {
+		fn := &profile.Function{ID: uint64(i + 1), Name: name}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn}}}
+		prof.Function = append(prof.Function, fn)
+		prof.Location = append(prof.Location, loc)
+		prof.Sample = append(prof.Sample, &profile.Sample{Location: []*profile.Location{loc}, Value: []int64{1}})
+	}
+	for _, tc := range []struct {
+		desc     string
+		newGraph func(context.Context, *profile.Profile, *Options) (*Graph, error)
+		callTree bool
+	}{
+		{"graph", NewContext, false},
+		{"tree", NewContext, true},
+		{"nodes", NewNodes, false},
+	} {
+		// The context is canceled while the second sample is read.
+		ctx, cancel := context.WithCancel(context.Background())
+		var read int
+		o := &Options{
+			SampleValue: func(v []int64) int64 {
+				if read++; read == 2 {
+					cancel()
+				}
+				return v[0]
+			},
+			CallTree: tc.callTree,
+		}
+		g, err := tc.newGraph(ctx, prof, o)
+		if err != context.Canceled {
+			t.Errorf("%s: got error %v, want %v", tc.desc, err, context.Canceled)
+		}
+		if len(g.Nodes) != 2 || read != 2 {
+			t.Errorf("%s: got %d nodes after reading %d samples, want 2 of each", tc.desc, len(g.Nodes), read)
+		}
+
+		read = 0
+		g, err = tc.newGraph(context.Background(), prof, o)
+		if err != nil || len(g.Nodes) != 4 {
+			t.Errorf("%s: got %d nodes and error %v, want 4 nodes", tc.desc, len(g.Nodes), err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// GraphMLConfig contains attributes about how a graph should be
+// written in GraphML format.
+type GraphMLConfig struct {
+	Title  string   // The title of the graph
+	Labels []string // Descriptive labels for the graph, stored as graph data
+	Unit   string   // The unit of the node and edge values
+}
+
+// ComposeGraphML writes the graph to the writer in GraphML format, so
+// that it can be imported into tools such as Gephi or yEd. Nodes carry
+// their name, flat and cum values; edges carry their weight.
+func ComposeGraphML(w io.Writer, g *Graph, c *GraphMLConfig) {
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintln(w, `<graphml xmlns="http://graphml.graphdrawing.org/xmlns">`)
+	fmt.Fprintln(w, `  <key id="title" for="graph" attr.name="title" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="labels" for="graph" attr.name="labels" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="unit" for="graph" attr.name="unit" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="name" for="node" attr.name="name" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="flat" for="node" attr.name="flat" attr.type="long"/>`)
+	fmt.Fprintln(w, `  <key id="cum" for="node" attr.name="cum" attr.type="long"/>`)
+	fmt.Fprintln(w, `  <key id="weight" for="edge" attr.name="weight" attr.type="long"/>`)
+	fmt.Fprintln(w, `  <key id="inline" for="edge" attr.name="inline" attr.type="boolean"/>`)
+	fmt.Fprintln(w, `  <key id="residual" for="edge" attr.name="residual" attr.type="boolean"/>`)
+	fmt.Fprintln(w, `  <graph id="G" edgedefault="directed">`)
+	if c.Title != "" {
+		fmt.Fprintf(w, "    <data key=\"title\">%s</data>\n", escapeForXML(c.Title))
+	}
+	if len(c.Labels) > 0 {
+		fmt.Fprintf(w, "    <data key=\"labels\">%s</data>\n", escapeForXML(strings.Join(c.Labels, "\n")))
+	}
+	if c.Unit != "" {
+		fmt.Fprintf(w, "    <data key=\"unit\">%s</data>\n", escapeForXML(c.Unit))
+	}
+
+	nodeIDMap := make(map[*Node]int)
+	for i, n := range g.Nodes {
+		nodeIDMap[n] = i + 1
+	}
+
+	edges := EdgeMap{}
+	for _, n := range g.Nodes {
+		fmt.Fprintf(w, "    <node id=\"N%d\">\n", nodeIDMap[n])
+		fmt.Fprintf(w, "      <data key=\"name\">%s</data>\n", escapeForXML(n.Info.PrintableName()))
+		fmt.Fprintf(w, "      <data key=\"flat\">%d</data>\n", n.FlatValue())
+		fmt.Fprintf(w, "      <data key=\"cum\">%d</data>\n", n.CumValue())
+		fmt.Fprintln(w, "    </node>")
+
+		// Collect all edges. Use a fake node to support multiple incoming edges.
+		for _, e := range n.Out {
+			edges[&Node{}] = e
+		}
+	}
+
+	for i, e := range edges.Sort() {
+		fmt.Fprintf(w, "    <edge id=\"E%d\" source=\"N%d\" target=\"N%d\">\n", i+1, nodeIDMap[e.Src], nodeIDMap[e.Dest])
+		fmt.Fprintf(w, "      <data key=\"weight\">%d</data>\n", e.WeightValue())
+		if e.Inline {
+			fmt.Fprintln(w, `      <data key="inline">true</data>`)
+		}
+		if e.Residual {
+			fmt.Fprintln(w, `      <data key="residual">true</data>`)
+		}
+		fmt.Fprintln(w, "    </edge>")
+	}
+	fmt.Fprintln(w, "  </graph>")
+	fmt.Fprintln(w, "</graphml>")
+}
+
+// escapeForXML escapes the characters that are not allowed to appear
+// verbatim in XML character data or attribute values.
+func escapeForXML(str string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(str))
+	return b.String()
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+)
+
+func TestComposeGraphML(t *testing.T) {
+	g := baseGraph()
+	c := &GraphMLConfig{
+		Title:  "testtitle",
+		Labels: []string{"label1", `label2: "foo"`},
+		Unit:   "ms",
+	}
+
+	var buf bytes.Buffer
+	ComposeGraphML(&buf, g, c)
+
+	compareGraphs(t, buf.Bytes(), "compose1.graphml")
+}
+
+func TestComposeGraphMLWithNamesThatNeedEscaping(t *testing.T) {
+	g := baseGraph()
+	g.Nodes[0].Info = NodeInfo{Name: `operator<<(std::ostream&, "src")`}
+	g.Nodes[1].Info = NodeInfo{Name: `Map<K, V>::dest`}
+	g.Nodes[0].Out[g.Nodes[1]].Inline = true
+
+	var buf bytes.Buffer
+	ComposeGraphML(&buf, g, &GraphMLConfig{Title: `a & b`})
+
+	compareGraphs(t, buf.Bytes(), "compose2.graphml")
+
+	// The output must be well formed XML.
+	d := xml.NewDecoder(&buf)
+	for {
+		if _, err := d.Token(); err != nil {
+			if err != io.EOF {
+				t.Errorf("malformed GraphML: %v", err)
+			}
+			break
+		}
+	}
+}
@@ -16,6 +16,7 @@
 package plugin
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"regexp"
@@ -43,6 +44,12 @@ type Options struct {
 	// authentication checks.
 	HTTPServer    func(args *HTTPServerArgs) error
 	HTTPTransport http.RoundTripper
+
+	// NodeKey, if not nil, overrides the identity of the nodes of graph
+	// based reports: each frame of a sample goes to the node named by the
+	// key NodeKey returns for it, instead of the node of its function,
+	// file or address.
+	NodeKey func(f Frame, s *profile.Sample) string
 }
 
 // Writer provides a mechanism to write data under a certain name,
@@ -98,6 +105,15 @@ type Symbolizer interface {
 	Symbolize(mode string, srcs MappingSources, prof *profile.Profile) error
 }
 
+// A ContextSymbolizer is a Symbolizer that can be stopped by a context.
+type ContextSymbolizer interface {
+	Symbolizer
+
+	// SymbolizeContext is like Symbolize, but stops and returns the
+	// error of ctx once ctx is done.
+	SymbolizeContext(ctx context.Context, mode string, srcs MappingSources, prof *profile.Profile) error
+}
+
 // MappingSources map each profile.Mapping to the source of the profile.
 // The key is either Mapping.File or Mapping.BuildId.
 type MappingSources map[string][]struct {
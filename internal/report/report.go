@@ -17,11 +17,15 @@
 package report
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/url"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -38,11 +42,22 @@ import (
 const (
 	Callgrind = iota
 	Comments
+	Coverage
+	D3JSON
 	Dis
 	Dot
+	Edges
+	FlameGraph
+	GraphML
 	List
+	NDJSON
+	OneLine
+	Prometheus
 	Proto
 	Raw
+	Sample
+	SQLite
+	Sizes
 	Tags
 	Text
 	TopProto
@@ -57,21 +72,30 @@ type Options struct {
 	OutputFormat int
 
 	CumSort       bool
+	NameSort      bool
 	CallTree      bool
 	DropNegative  bool
 	CompactLabels bool
+	CommentsFirst bool // Show profile comments first in report headers.
+	FlatOnly      bool // Omit the cum columns of text reports, sorted by flat.
 	Ratio         float64
 	Title         string
 	ProfileLabels []string
+	ExtraLabels   []string // Labels added to the report headers by the user.
 	ActiveFilters []string
 	NumLabelUnits map[string]string
 
+	// NoInlineLabels omits the (inline) and (partial-inline) suffixes of
+	// names in text, traces and tree reports.
+	NoInlineLabels bool
+
 	NodeCount    int
 	NodeFraction float64
 	EdgeFraction float64
 
 	SampleValue       func(s []int64) int64
 	SampleMeanDivisor func(s []int64) int64
+	ContentionCount   func(s []int64) int64 // If set, text reports show the mean value per contention.
 	SampleType        string
 	SampleUnit        string // Unit for the sample data from the profile.
 
@@ -82,62 +106,211 @@ type Options struct {
 	TrimPath   string         // Paths to trim from source file paths.
 
 	IntelSyntax bool // Whether or not to print assembly in Intel syntax.
+	SourceAsm   bool // Show the assembly of each line in source listings.
+
+	// SourceURLTemplate links source lines in weblist to a code host. Its
+	// {file} and {line} placeholders are replaced by the file and line.
+	SourceURLTemplate string
+
+	// MergeFunctionNames merges the functions with the same name into a
+	// single node in graph-based reports, whatever the granularity.
+	MergeFunctionNames bool
+
+	DropAddressOnly bool // Drop locations with only an address from graph-based reports.
+	FoldMappingCase bool // Treat mapping file names differing only in case as the same file, as on Windows.
+	TraceTimestamps bool // Show the wall-clock time of samples in traces.
+	TraceMaxDepth   int  // Frames of each stack shown in traces; all if not positive.
+
+	LabelKeys []string // Label keys shown by the traces and tags reports; all if empty.
+	TagsCum   bool     // Add a cum column to the tags report.
+
+	// Thread, if not empty, restricts the traces report to the samples
+	// whose ThreadLabel label has this value. If ThreadLabel is empty,
+	// the first of threadLabelKeys present in a sample is used.
+	Thread      string
+	ThreadLabel string
+
+	// SampleNumber is the index in the profile of the sample printed by
+	// Sample reports.
+	SampleNumber int
+
+	StableDotIDs bool // Use content-derived node IDs in DOT output.
+	HotPath      bool // Highlight the heaviest path in DOT output.
+	OtherNode    bool // Aggregate the flat value of trimmed nodes into an "(other)" node.
+
+	// Concentration, if positive, adds the share of the total held by the
+	// Concentration heaviest nodes and a concentration index to the labels.
+	Concentration int
+
+	// EstimatedTotal adds to text reports the value of each entry times the
+	// period of the profile: the estimated total, in the unit of the period
+	// type, of a profile counting samples, such as a sampled CPU profile.
+	EstimatedTotal bool
+
+	// SampleCountDiff adds to text reports the number of samples of each
+	// entry minus its number of samples in the base profiles of a diff
+	// comparison, whatever their values. The numbers of samples are read
+	// from the samples/count values of the profile, which survive merges.
+	SampleCountDiff bool
+
+	// SampleIndices makes the nodes of the d3json output list the indices
+	// in the profile of the samples that contributed to them.
+	SampleIndices bool
+
+	// LabelMetrics are numeric label keys, such as hardware counters, whose
+	// values are summed per node and shown next to the node values in
+	// text and DOT reports.
+	LabelMetrics []string
+
+	RankDir string // Direction of the layout of DOT graphs, such as LR.
+
+	NodeSize  graph.NodeMetric // Node value scaling the size of DOT nodes.
+	NodeColor graph.NodeMetric // Node value setting the color of DOT nodes.
+
+	// NodeTagShow and NodeTagHide select the node tags shown in
+	// graph-based reports by their name or value. Samples and node values
+	// are kept.
+	NodeTagShow, NodeTagHide *regexp.Regexp
+
+	// KeyFunc, if not nil, overrides the identity of the graph nodes, as
+	// in graph.Options.
+	KeyFunc func(info graph.NodeInfo, s *profile.Sample) string
+
+	// Compression, if not nil, is the gzip compression level of the proto
+	// and topproto outputs instead of the default one.
+	Compression *int
+
+	// PercentBase selects the functions whose cumulative value is used as
+	// the total for percentages, instead of the value of all samples.
+	PercentBase *regexp.Regexp
+
+	// PathsTo, if not nil, prunes graphs down to the paths to the nodes
+	// whose name matches it.
+	PathsTo *regexp.Regexp
+}
+
+// Generate generates a report as directed by the Report. It stops
+// building the graphs of the report once ctx is done, and then returns
+// the error of ctx, as what was written to w is incomplete.
+func Generate(ctx context.Context, w io.Writer, rpt *Report, obj plugin.ObjTool) error {
+	if err := generate(ctx, w, rpt, obj); err != nil {
+		return err
+	}
+	return ctx.Err()
 }
 
-// Generate generates a report as directed by the Report.
-func Generate(w io.Writer, rpt *Report, obj plugin.ObjTool) error {
+func generate(ctx context.Context, w io.Writer, rpt *Report, obj plugin.ObjTool) error {
 	o := rpt.options
 
 	switch o.OutputFormat {
 	case Comments:
 		return printComments(w, rpt)
 	case Dot:
-		return printDOT(w, rpt)
+		return printDOT(ctx, w, rpt)
+	case GraphML:
+		return printGraphML(ctx, w, rpt)
+	case D3JSON:
+		return printD3JSON(ctx, w, rpt)
+	case NDJSON:
+		return printNDJSON(w, rpt)
+	case Prometheus:
+		return printPrometheus(ctx, w, rpt)
 	case Tree:
-		return printTree(w, rpt)
+		return printTree(ctx, w, rpt)
 	case Text:
-		return printText(w, rpt)
+		return printText(ctx, w, rpt)
+	case OneLine:
+		return printOneLine(ctx, w, rpt)
+	case Edges:
+		return printEdges(ctx, w, rpt)
 	case Traces:
 		return printTraces(w, rpt)
+	case Sample:
+		return printSample(w, rpt)
 	case Raw:
 		fmt.Fprint(w, rpt.prof.String())
 		return nil
 	case Tags:
 		return printTags(w, rpt)
+	case Sizes:
+		return printSizes(w, rpt)
 	case Proto:
 		return printProto(w, rpt)
 	case TopProto:
-		return printTopProto(w, rpt)
+		return printTopProto(ctx, w, rpt)
 	case Dis:
-		return printAssembly(w, rpt, obj)
+		return printAssembly(ctx, w, rpt, obj)
 	case List:
-		return printSource(w, rpt)
+		if o.SourceAsm {
+			return printSourceAsm(w, rpt, obj)
+		}
+		return printSource(ctx, w, rpt)
+	case Coverage:
+		return printCoverage(ctx, w, rpt, obj)
 	case Callgrind:
-		return printCallgrind(w, rpt)
+		return printCallgrind(ctx, w, rpt)
 	}
-	// Note: WebList handling is in driver package.
+	// Note: WebList and FlameGraph handling is in driver package.
 	return fmt.Errorf("unexpected output format %v", o.OutputFormat)
 }
 
 // newTrimmedGraph creates a graph for this report, trimmed according
 // to the report options.
-func (rpt *Report) newTrimmedGraph() (g *graph.Graph, origCount, droppedNodes, droppedEdges int) {
+func (rpt *Report) newTrimmedGraph(ctx context.Context) (g *graph.Graph, origCount, droppedNodes, droppedEdges int) {
+	// Text reports only show the edges of the nodes they select to tell
+	// whether they are inlined, so their nodes are selected from their
+	// values only, which are much faster to compute.
+	return rpt.trimmedGraph(ctx, rpt.options.OutputFormat == Text)
+}
+
+// trimmedGraph implements newTrimmedGraph. If nodesOnly is set, the nodes
+// are selected without building the graph of the profile, and only the
+// graph of the selected nodes is built.
+func (rpt *Report) trimmedGraph(ctx context.Context, nodesOnly bool) (g *graph.Graph, origCount, droppedNodes, droppedEdges int) {
 	o := rpt.options
 
 	// Build a graph and refine it. On each refinement step we must rebuild the graph from the samples,
 	// as the graph itself doesn't contain enough information to preserve full precision.
 	visualMode := o.OutputFormat == Dot
-	cumSort := o.CumSort
+	cumSort := o.CumSort && !(o.FlatOnly && o.OutputFormat == Text)
 
 	// The call_tree option is only honored when generating visual representations of the callgraph.
-	callTree := o.CallTree && (o.OutputFormat == Dot || o.OutputFormat == Callgrind)
+	callTree := o.CallTree && (o.OutputFormat == Dot || o.OutputFormat == Callgrind) || o.OutputFormat == D3JSON
+
+	// Trees are built from the paths of the nodes, not their values, and
+	// so are the paths to nodes. Without node trimming, the graph of all
+	// the nodes is built once.
+	trimsNodes := o.NodeFraction > 0 || o.NodeCount > 0
+	nodesOnly = nodesOnly && trimsNodes && !callTree && o.PathsTo == nil
+	newGraph := rpt.newGraph
+	if nodesOnly {
+		newGraph = rpt.newNodes
+	}
+	var kept graph.NodeSet
 
 	// First step: Build complete graph to identify low frequency nodes, based on their cum weight.
-	g = rpt.newGraph(nil)
+	g = newGraph(ctx, nil)
 	totalValue, _ := g.Nodes.Sum()
+	var totalDiv int64
+	for _, n := range g.Nodes {
+		totalDiv += n.FlatDiv
+	}
 	nodeCutoff := abs64(int64(float64(totalValue) * o.NodeFraction))
 	edgeCutoff := abs64(int64(float64(totalValue) * o.EdgeFraction))
 
+	// Keep only the paths to the selected nodes.
+	if o.PathsTo != nil {
+		if !g.KeepPathsTo(o.PathsTo) {
+			rpt.warnings = append(rpt.warnings, fmt.Sprintf("paths_to: no node matches %q; the graph is not pruned", o.PathsTo))
+		} else if !callTree {
+			kept = make(graph.NodeSet, len(g.Nodes))
+			for _, n := range g.Nodes {
+				kept[n.Info] = true
+			}
+			g = newGraph(ctx, kept)
+		}
+	}
+
 	// Filter out nodes with cum value below nodeCutoff.
 	if nodeCutoff > 0 {
 		if callTree {
@@ -148,7 +321,7 @@ func (rpt *Report) newTrimmedGraph() (g *graph.Graph, origCount, droppedNodes, d
 		} else {
 			if nodesKept := g.DiscardLowFrequencyNodes(nodeCutoff); len(g.Nodes) != len(nodesKept) {
 				droppedNodes = len(g.Nodes) - len(nodesKept)
-				g = rpt.newGraph(nodesKept)
+				g, kept = newGraph(ctx, nodesKept), nodesKept
 			}
 		}
 	}
@@ -160,6 +333,7 @@ func (rpt *Report) newTrimmedGraph() (g *graph.Graph, origCount, droppedNodes, d
 	if nodeCount := o.NodeCount; nodeCount > 0 {
 		// Remove low frequency tags and edges as they affect selection.
 		g.TrimLowFrequencyTags(nodeCutoff)
+		g.FilterTags(o.NodeTagShow, o.NodeTagHide)
 		g.TrimLowFrequencyEdges(edgeCutoff)
 		if callTree {
 			if nodesKept := g.SelectTopNodePtrs(nodeCount, visualMode); len(g.Nodes) != len(nodesKept) {
@@ -168,15 +342,25 @@ func (rpt *Report) newTrimmedGraph() (g *graph.Graph, origCount, droppedNodes, d
 			}
 		} else {
 			if nodesKept := g.SelectTopNodes(nodeCount, visualMode); len(g.Nodes) != len(nodesKept) {
-				g = rpt.newGraph(nodesKept)
+				g, kept = newGraph(ctx, nodesKept), nodesKept
 				g.SortNodes(cumSort, visualMode)
 			}
 		}
 	}
 
+	if nodesOnly {
+		g = rpt.newGraph(ctx, kept)
+		g.SortNodes(cumSort, visualMode)
+	}
+
+	if o.OtherNode {
+		addOtherNode(g, totalValue, totalDiv)
+	}
+
 	// Final step: Filter out low frequency tags and edges, and remove redundant edges that clutter
 	// the graph.
 	g.TrimLowFrequencyTags(nodeCutoff)
+	g.FilterTags(o.NodeTagShow, o.NodeTagHide)
 	droppedEdges = g.TrimLowFrequencyEdges(edgeCutoff)
 	if visualMode {
 		g.RemoveRedundantEdges()
@@ -184,6 +368,36 @@ func (rpt *Report) newTrimmedGraph() (g *graph.Graph, origCount, droppedNodes, d
 	return
 }
 
+// otherNodeName is the name of the node holding the value of trimmed nodes.
+const otherNodeName = "(other)"
+
+// addOtherNode appends to g a node holding the flat value of the nodes
+// trimmed from a graph whose nodes had the given total flat value and
+// divisor. Its cum value is its flat value, as the trimmed nodes' cum
+// values overlap with each other and with the remaining nodes.
+func addOtherNode(g *graph.Graph, totalFlat, totalDiv int64) {
+	flat, _ := g.Nodes.Sum()
+	var div int64
+	for _, n := range g.Nodes {
+		div += n.FlatDiv
+	}
+	flat, div = totalFlat-flat, totalDiv-div
+	if flat == 0 && div == 0 {
+		return
+	}
+	g.Nodes = append(g.Nodes, &graph.Node{
+		Info:        graph.NodeInfo{Name: otherNodeName},
+		Flat:        flat,
+		FlatDiv:     div,
+		Cum:         flat,
+		CumDiv:      div,
+		In:          make(graph.EdgeMap),
+		Out:         make(graph.EdgeMap),
+		LabelTags:   make(graph.TagMap),
+		NumericTags: make(map[string]graph.TagMap),
+	})
+}
+
 func (rpt *Report) selectOutputUnit(g *graph.Graph) {
 	o := rpt.options
 
@@ -235,14 +449,33 @@ func (rpt *Report) selectOutputUnit(g *graph.Graph) {
 // newGraph creates a new graph for this report. If nodes is non-nil,
 // only nodes whose info matches are included. Otherwise, all nodes
 // are included, without trimming.
-func (rpt *Report) newGraph(nodes graph.NodeSet) *graph.Graph {
+func (rpt *Report) newGraph(ctx context.Context, nodes graph.NodeSet) *graph.Graph {
+	// The graph is incomplete if ctx is done, which Generate reports.
+	g, _ := graph.NewContext(ctx, rpt.prof, rpt.graphOptions(nodes))
+	return g
+}
+
+// newNodes is like newGraph, but only computes the values of the nodes,
+// without their edges and tags.
+func (rpt *Report) newNodes(ctx context.Context, nodes graph.NodeSet) *graph.Graph {
+	g, _ := graph.NewNodes(ctx, rpt.prof, rpt.graphOptions(nodes))
+	return g
+}
+
+// graphOptions prepares the profile of the report for building a graph
+// with the given nodes and returns the options to build it.
+func (rpt *Report) graphOptions(nodes graph.NodeSet) *graph.Options {
 	o := rpt.options
+	rpt.splitRatioBase()
 
 	// Clean up file paths using heuristics.
 	prof := rpt.prof
 	for _, f := range prof.Function {
 		f.Filename = trimPath(f.Filename, o.TrimPath, o.SourcePath)
 	}
+	if len(o.LabelMetrics) > 0 && rpt.labelMetrics == nil {
+		rpt.labelMetrics = sampleLabelMetrics(prof, o.LabelMetrics)
+	}
 	// Removes all numeric tags except for the bytes tag prior
 	// to making graph.
 	// TODO: modify to select first numeric tag if no bytes tag
@@ -266,9 +499,24 @@ func (rpt *Report) newGraph(nodes graph.NodeSet) *graph.Graph {
 		s.NumUnit = numUnits
 	}
 
+	if o.SampleCountDiff && rpt.baseSamples == nil {
+		rpt.baseSamples = make(map[*profile.Sample]bool)
+		for _, s := range prof.Sample {
+			if s.HasLabel(baseLabel, "true") {
+				rpt.baseSamples[s] = true
+			}
+		}
+	}
 	// Remove label marking samples from the base profiles, so it does not appear
 	// as a nodelet in the graph view.
-	prof.RemoveLabel("pprof::base")
+	prof.RemoveLabel(baseLabel)
+
+	if o.DropAddressOnly {
+		dropAddressOnlyLocations(prof)
+	}
+	if o.FoldMappingCase {
+		foldMappingFileCase(prof)
+	}
 
 	formatTag := func(v int64, key string) string {
 		return measurement.ScaledLabel(v, key, o.OutputUnit)
@@ -278,19 +526,111 @@ func (rpt *Report) newGraph(nodes graph.NodeSet) *graph.Graph {
 		SampleValue:       o.SampleValue,
 		SampleMeanDivisor: o.SampleMeanDivisor,
 		FormatTag:         formatTag,
-		CallTree:          o.CallTree && (o.OutputFormat == Dot || o.OutputFormat == Callgrind),
+		CallTree:          o.CallTree && (o.OutputFormat == Dot || o.OutputFormat == Callgrind) || o.OutputFormat == D3JSON,
 		DropNegative:      o.DropNegative,
 		KeptNodes:         nodes,
+		SampleIndices:     o.SampleIndices,
+		KeyFunc:           o.KeyFunc,
+	}
+	if rpt.labelMetrics != nil {
+		gopt.LabelMetrics = func(s *profile.Sample) map[string]int64 {
+			return rpt.labelMetrics[s]
+		}
 	}
 
 	// Only keep binary names for disassembly-based reports, otherwise
 	// remove it to allow merging of functions across binaries.
 	switch o.OutputFormat {
-	case Raw, List, WebList, Dis, Callgrind:
+	case Raw, List, Coverage, WebList, Dis, Callgrind:
 		gopt.ObjNames = true
 	}
+	// Reports needing the binary of each location keep them apart.
+	gopt.MergeFunctionNames = o.MergeFunctionNames && !gopt.ObjNames
+
+	return gopt
+}
+
+// sampleLabelMetrics returns the sums of the values of the numeric labels
+// keys of each sample of prof that has any of them.
+func sampleLabelMetrics(prof *profile.Profile, keys []string) map[*profile.Sample]map[string]int64 {
+	metrics := make(map[*profile.Sample]map[string]int64)
+	for _, s := range prof.Sample {
+		var values map[string]int64
+		for _, k := range keys {
+			vs, ok := s.NumLabel[k]
+			if !ok {
+				continue
+			}
+			if values == nil {
+				values = make(map[string]int64, len(keys))
+			}
+			for _, v := range vs {
+				values[k] += v
+			}
+		}
+		if values != nil {
+			metrics[s] = values
+		}
+	}
+	return metrics
+}
+
+// formatLabelMetric formats the value of the label metric key in the unit
+// of the label.
+func (rpt *Report) formatLabelMetric(key string, v int64) string {
+	unit := rpt.options.NumLabelUnits[key]
+	if unit == "" {
+		unit = key
+	}
+	return measurement.ScaledLabel(v, unit, "auto")
+}
+
+// foldMappingFileCase renames each mapping whose file name only differs in
+// case from the file name of an earlier mapping to that name, so that both
+// are reported as the same binary, as file names are case insensitive on
+// Windows, where the same DLL can be loaded as KERNEL32.DLL and
+// kernel32.dll.
+func foldMappingFileCase(prof *profile.Profile) {
+	names := make(map[string]string)
+	for _, m := range prof.Mapping {
+		if m.File == "" {
+			continue
+		}
+		key := strings.ToLower(m.File)
+		if name, ok := names[key]; ok {
+			m.File = name
+		} else {
+			names[key] = m.File
+		}
+	}
+}
 
-	return graph.New(rpt.prof, gopt)
+// dropAddressOnlyLocations removes the locations that have no function or
+// file information from the sample stacks, so that their weight is
+// attributed to their callers. Samples whose stacks consist entirely of
+// such locations are left with an empty stack; they still count towards
+// the report total but do not contribute to any node.
+func dropAddressOnlyLocations(prof *profile.Profile) {
+	for _, s := range prof.Sample {
+		locs := s.Location[:0]
+		for _, l := range s.Location {
+			if !isAddressOnly(l) {
+				locs = append(locs, l)
+			}
+		}
+		s.Location = locs
+	}
+}
+
+// isAddressOnly reports whether a location carries no symbolic
+// information beyond its address.
+func isAddressOnly(l *profile.Location) bool {
+	for _, ln := range l.Line {
+		if fn := ln.Function; fn != nil && (fn.Name != "" || fn.Filename != "") {
+			return false
+		}
+	}
+	return true
 }
 
 // printProto writes the incoming proto via the writer w.
@@ -306,14 +646,46 @@ func printProto(w io.Writer, rpt *Report) error {
 			}
 		}
 	}
-	return p.Write(w)
+	return writeProto(w, p, o)
+}
+
+// writeProto writes p compressed at the level of the Compression option.
+func writeProto(w io.Writer, p *profile.Profile, o *Options) error {
+	if o.Compression == nil {
+		return p.Write(w)
+	}
+	return p.WriteLevel(w, *o.Compression)
+}
+
+// printSizes prints the number of bytes each table of the profile takes
+// up in its uncompressed serialized form.
+func printSizes(w io.Writer, rpt *Report) error {
+	s := rpt.prof.EncodedSizes()
+	total := s.Total()
+	tabw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tabw, "table\t bytes\t percent\t")
+	for _, t := range []struct {
+		name string
+		size int
+	}{
+		{"samples", s.Samples},
+		{"locations", s.Locations},
+		{"functions", s.Functions},
+		{"mappings", s.Mappings},
+		{"strings", s.Strings},
+		{"other", s.Other},
+		{"total", total},
+	} {
+		fmt.Fprintf(tabw, "%s\t %d\t %s\t\n", t.name, t.size, measurement.Percentage(int64(t.size), int64(total)))
+	}
+	return tabw.Flush()
 }
 
 // printTopProto writes a list of the hottest routines in a profile as a profile.proto.
-func printTopProto(w io.Writer, rpt *Report) error {
+func printTopProto(ctx context.Context, w io.Writer, rpt *Report) error {
 	p := rpt.prof
 	o := rpt.options
-	g, _, _, _ := rpt.newTrimmedGraph()
+	g, _, _, _ := rpt.newTrimmedGraph(ctx)
 	rpt.selectOutputUnit(g)
 
 	out := profile.Profile{
@@ -355,7 +727,7 @@ func printTopProto(w io.Writer, rpt *Report) error {
 		out.Sample = append(out.Sample, s)
 	}
 
-	return out.Write(w)
+	return writeProto(w, &out, o)
 }
 
 type functionMap map[string]*profile.Function
@@ -383,26 +755,37 @@ func (fm functionMap) findOrAdd(ni graph.NodeInfo) (*profile.Function, bool) {
 }
 
 // printAssembly prints an annotated assembly listing.
-func printAssembly(w io.Writer, rpt *Report, obj plugin.ObjTool) error {
-	return PrintAssembly(w, rpt, obj, -1)
+func printAssembly(ctx context.Context, w io.Writer, rpt *Report, obj plugin.ObjTool) error {
+	return PrintAssembly(ctx, w, rpt, obj, -1)
 }
 
-// PrintAssembly prints annotated disassembly of rpt to w.
-func PrintAssembly(w io.Writer, rpt *Report, obj plugin.ObjTool, maxFuncs int) error {
+// PrintAssembly prints annotated disassembly of rpt to w. Like Generate,
+// it returns the error of ctx once it is done.
+func PrintAssembly(ctx context.Context, w io.Writer, rpt *Report, obj plugin.ObjTool, maxFuncs int) error {
 	o := rpt.options
 	prof := rpt.prof
 
-	g := rpt.newGraph(nil)
+	g := rpt.newGraph(ctx, nil)
 
 	// If the regexp source can be parsed as an address, also match
-	// functions that land on that address.
+	// functions that land on that address. If it can be parsed as an
+	// address range, match the parts of functions within that range.
 	var address *uint64
+	var addrRange *addrInterval
 	if hex, err := strconv.ParseUint(o.Symbol.String(), 0, 64); err == nil {
 		address = &hex
+	} else {
+		addrRange = parseAddrInterval(o.Symbol.String())
 	}
 
 	fmt.Fprintln(w, "Total:", rpt.formatValue(rpt.total))
-	symbols := symbolsFromBinaries(prof, g, o.Symbol, address, obj)
+	var symbols []*objSymbol
+	if addrRange != nil {
+		symbols = symbolsInAddressRange(prof, *addrRange, obj)
+	} else {
+		symbols = symbolsFromBinaries(prof, g, o.Symbol, address, obj)
+	}
+	defer closeSymbolFiles(symbols)
 	symNodes := nodesPerSymbol(g.Nodes, symbols)
 
 	// Sort for printing.
@@ -434,6 +817,14 @@ func PrintAssembly(w io.Writer, rpt *Report, obj plugin.ObjTool, maxFuncs int) e
 	}
 
 	if len(syms) == 0 {
+		// The address range case
+		if addrRange != nil {
+			if len(symbols) == 0 {
+				return fmt.Errorf("no matches found for address range %s", addrRange)
+			}
+			return fmt.Errorf("address range %s found in binary, but the corresponding symbols do not have samples in the profile", addrRange)
+		}
+
 		// The symbol regexp case
 		if address == nil {
 			return fmt.Errorf("no matches found for regexp %s", o.Symbol)
@@ -446,6 +837,12 @@ func PrintAssembly(w io.Writer, rpt *Report, obj plugin.ObjTool, maxFuncs int) e
 		return fmt.Errorf("address 0x%x found in binary, but the corresponding symbols do not have samples in the profile", *address)
 	}
 
+	// Frames from the binary carry system names; show them as the profile does.
+	names := make(map[string]string, len(rpt.prof.Function))
+	for _, fn := range rpt.prof.Function {
+		names[fn.SystemName] = fn.Name
+	}
+
 	// Correlate the symbols from the binary with the profile samples.
 	for _, s := range syms {
 		sns := symNodes[s]
@@ -459,14 +856,18 @@ func PrintAssembly(w io.Writer, rpt *Report, obj plugin.ObjTool, maxFuncs int) e
 			return err
 		}
 
-		ns := annotateAssembly(insts, sns, s.file)
+		ns := annotateAssembly(insts, sns, s.file, names)
 
 		fmt.Fprintf(w, "ROUTINE ======================== %s\n", s.sym.Name[0])
 		for _, name := range s.sym.Name[1:] {
 			fmt.Fprintf(w, "    AKA ======================== %s\n", name)
 		}
-		fmt.Fprintf(w, "%10s %10s (flat, cum) %s of Total\n",
-			rpt.formatValue(flatSum), rpt.formatValue(cumSum),
+		sumPct := "."
+		if flatSum != 0 {
+			sumPct = measurement.Percentage(flatSum, flatSum)
+		}
+		fmt.Fprintf(w, "%10s %6s %10s (flat, flat%%, cum) %s of Total\n",
+			rpt.formatValue(flatSum), sumPct, rpt.formatValue(cumSum),
 			measurement.Percentage(cumSum, rpt.total))
 
 		function, file, line := "", "", 0
@@ -485,38 +886,46 @@ func PrintAssembly(w io.Writer, rpt *Report, obj plugin.ObjTool, maxFuncs int) e
 					}
 				}
 			}
+			flat := n.flatValue()
+			// The share of the flat value of the function, hence the dot
+			// for all instructions of functions without a flat value.
+			flatPct := "."
+			if flat != 0 && flatSum != 0 {
+				flatPct = measurement.Percentage(flat, flatSum)
+			}
 			switch {
 			case locStr == "":
 				// No location info, just print the instruction.
-				fmt.Fprintf(w, "%10s %10s %10x: %s\n",
-					valueOrDot(n.flatValue(), rpt),
+				fmt.Fprintf(w, "%10s %6s %10s %10x: %s\n",
+					valueOrDot(flat, rpt), flatPct,
 					valueOrDot(n.cumValue(), rpt),
 					n.address, n.instruction,
 				)
 			case len(n.instruction) < 40:
 				// Short instruction, print loc on the same line.
-				fmt.Fprintf(w, "%10s %10s %10x: %-40s;%s\n",
-					valueOrDot(n.flatValue(), rpt),
+				fmt.Fprintf(w, "%10s %6s %10s %10x: %-40s;%s\n",
+					valueOrDot(flat, rpt), flatPct,
 					valueOrDot(n.cumValue(), rpt),
 					n.address, n.instruction,
 					locStr,
 				)
 			default:
 				// Long instruction, print loc on a separate line.
-				fmt.Fprintf(w, "%74s;%s\n", "", locStr)
-				fmt.Fprintf(w, "%10s %10s %10x: %s\n",
-					valueOrDot(n.flatValue(), rpt),
+				fmt.Fprintf(w, "%81s;%s\n", "", locStr)
+				fmt.Fprintf(w, "%10s %6s %10s %10x: %s\n",
+					valueOrDot(flat, rpt), flatPct,
 					valueOrDot(n.cumValue(), rpt),
 					n.address, n.instruction,
 				)
 			}
 		}
 	}
-	return nil
+	return ctx.Err()
 }
 
 // symbolsFromBinaries examines the binaries listed on the profile that have
 // associated samples, and returns the identified symbols matching rx.
+// The files of the symbols are left open for the caller to close.
 func symbolsFromBinaries(prof *profile.Profile, g *graph.Graph, rx *regexp.Regexp, address *uint64, obj plugin.ObjTool) []*objSymbol {
 	// fileHasSamplesAndMatched is for optimization to speed up pprof: when later
 	// walking through the profile mappings, it will only examine the ones that have
@@ -552,8 +961,8 @@ func symbolsFromBinaries(prof *profile.Profile, g *graph.Graph, rx *regexp.Regex
 			addr = *address
 		}
 		msyms, err := f.Symbols(rx, addr)
-		f.Close()
-		if err != nil {
+		if err != nil || len(msyms) == 0 {
+			f.Close()
 			continue
 		}
 		for _, ms := range msyms {
@@ -569,6 +978,85 @@ func symbolsFromBinaries(prof *profile.Profile, g *graph.Graph, rx *regexp.Regex
 	return objSyms
 }
 
+// addrInterval is a half-open range of addresses [start, end).
+type addrInterval struct {
+	start, end uint64
+}
+
+// parseAddrInterval parses a range of addresses of the form start-end,
+// such as 0x1000-0x2000. It returns nil if s is not a non-empty range.
+func parseAddrInterval(s string) *addrInterval {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil
+	}
+	var r addrInterval
+	var err error
+	if r.start, err = strconv.ParseUint(start, 0, 64); err != nil {
+		return nil
+	}
+	if r.end, err = strconv.ParseUint(end, 0, 64); err != nil || r.end <= r.start {
+		return nil
+	}
+	return &r
+}
+
+func (r *addrInterval) String() string {
+	return fmt.Sprintf("%#x-%#x", r.start, r.end)
+}
+
+// symbolsInAddressRange returns the symbols of the binaries listed on the
+// profile that overlap with r, trimmed to the part within r. The files
+// of the symbols are left open for the caller to close.
+func symbolsInAddressRange(prof *profile.Profile, r addrInterval, obj plugin.ObjTool) []*objSymbol {
+	matchAll := regexp.MustCompile("")
+
+	var objSyms []*objSymbol
+	for _, m := range prof.Mapping {
+		if m.Limit <= r.start || m.Start >= r.end {
+			continue
+		}
+
+		f, err := obj.Open(m.File, m.Start, m.Limit, m.Offset, m.KernelRelocationSymbol)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			continue
+		}
+		msyms, err := f.Symbols(matchAll, 0)
+		if err != nil {
+			f.Close()
+			continue
+		}
+		n := len(objSyms)
+		for _, ms := range msyms {
+			// Symbol end addresses are inclusive.
+			if ms.End < r.start || ms.Start >= r.end {
+				continue
+			}
+			s := *ms
+			s.Start = max(s.Start, r.start)
+			s.End = min(s.End, r.end-1)
+			objSyms = append(objSyms, &objSymbol{sym: &s, file: f})
+		}
+		if len(objSyms) == n {
+			f.Close()
+		}
+	}
+	return objSyms
+}
+
+// closeSymbolFiles closes the binaries of symbols, which are kept open
+// to look up the source lines of their instructions.
+func closeSymbolFiles(symbols []*objSymbol) {
+	closed := make(map[plugin.ObjFile]bool)
+	for _, s := range symbols {
+		if !closed[s.file] {
+			closed[s.file] = true
+			s.file.Close()
+		}
+	}
+}
+
 // objSym represents a symbol identified from a binary. It includes
 // the SymbolInfo from the disasm package and the base that must be
 // added to correspond to sample addresses
@@ -634,8 +1122,9 @@ func (a *assemblyInstruction) cumValue() int64 {
 
 // annotateAssembly annotates a set of assembly instructions with a
 // set of samples. It returns a set of nodes to display. base is an
-// offset to adjust the sample addresses.
-func annotateAssembly(insts []plugin.Inst, samples graph.Nodes, file plugin.ObjFile) []assemblyInstruction {
+// offset to adjust the sample addresses. names maps the system names
+// of functions in the profile to their display names.
+func annotateAssembly(insts []plugin.Inst, samples graph.Nodes, file plugin.ObjFile, names map[string]string) []assemblyInstruction {
 	// Add end marker to simplify printing loop.
 	insts = append(insts, plugin.Inst{
 		Addr: ^uint64(0),
@@ -644,9 +1133,21 @@ func annotateAssembly(insts []plugin.Inst, samples graph.Nodes, file plugin.ObjF
 	// Ensure samples are sorted by address.
 	samples.Sort(graph.AddressOrder)
 
+	// The innermost inlined frame of the instructions is resolved once per
+	// address range the disassembler attributes to the same source line,
+	// from its first sampled instruction. Without line information from
+	// the disassembler, it is resolved for each sampled instruction.
+	var rangeFile string
+	var rangeLine int
+	var rangeFrame *plugin.Frame
+	rangeResolved := false
+
 	s := 0
 	asm := make([]assemblyInstruction, 0, len(insts))
 	for ix, in := range insts[:len(insts)-1] {
+		if ix == 0 || in.Line == 0 || in.File != rangeFile || in.Line != rangeLine {
+			rangeFile, rangeLine, rangeFrame, rangeResolved = in.File, in.Line, nil, false
+		}
 		n := assemblyInstruction{
 			address:     in.Addr,
 			instruction: in.Text,
@@ -659,11 +1160,16 @@ func annotateAssembly(insts []plugin.Inst, samples graph.Nodes, file plugin.ObjF
 
 		// Sum all the samples until the next instruction (to account
 		// for samples attributed to the middle of an instruction).
+		var sampleAddr uint64
+		sampled := false
 		for next := insts[ix+1].Addr; s < len(samples); s++ {
 			if addr, err := file.ObjAddr(samples[s].Info.Address); err != nil || addr >= next {
 				break
 			}
 			sample := samples[s]
+			if !sampled {
+				sampleAddr, sampled = sample.Info.Address, true
+			}
 			n.flatDiv += sample.FlatDiv
 			n.flat += sample.Flat
 			n.cumDiv += sample.CumDiv
@@ -678,6 +1184,26 @@ func annotateAssembly(insts []plugin.Inst, samples graph.Nodes, file plugin.ObjF
 				n.function = f
 			}
 		}
+		if sampled && !rangeResolved {
+			rangeResolved = true
+			if frames, err := file.SourceLine(sampleAddr); err == nil && len(frames) > 1 && frames[0].Line != 0 {
+				rangeFrame = &frames[0]
+			}
+		}
+		if sampled && rangeFrame != nil {
+			// With inlining, the innermost inlined function is the one the
+			// instruction was generated for, so prefer its frame over the
+			// one reported by the disassembler or the samples. The
+			// function, file and line all come from that frame.
+			if fn := rangeFrame.Func; fn != "" {
+				if name, ok := names[fn]; ok {
+					fn = name
+				}
+				n.function = fn
+			}
+			n.file = filepath.Base(rangeFrame.File)
+			n.line = rangeFrame.Line
+		}
 		asm = append(asm, n)
 	}
 
@@ -703,29 +1229,57 @@ func printTags(w io.Writer, rpt *Report) error {
 		return measurement.ScaledLabel(v, key, o.OutputUnit)
 	}
 
+	// The cum value of a tag is the sum of its cum values on the nodes of
+	// the call graph, where a sample counts once for each distinct node on
+	// its stack.
+	var locNodes map[uint64]graph.Nodes
+	if o.TagsCum {
+		_, locNodes = graph.CreateNodes(p, &graph.Options{SampleValue: o.SampleValue})
+	}
+	stackNodes := func(s *profile.Sample) int64 {
+		seen := make(map[*graph.Node]bool)
+		for _, l := range s.Location {
+			for _, n := range locNodes[l.ID] {
+				seen[n] = true
+			}
+		}
+		return int64(len(seen))
+	}
+
 	// Hashtable to keep accumulate tags as key,value,count.
 	tagMap := make(map[string]map[string]int64)
+	cumMap := make(map[string]map[string]int64)
+	add := func(key, val string, v, cum int64) {
+		valueMap, ok := tagMap[key]
+		if !ok {
+			valueMap = make(map[string]int64)
+			tagMap[key] = valueMap
+			cumMap[key] = make(map[string]int64)
+		}
+		valueMap[val] += v
+		cumMap[key][val] += cum
+	}
 	for _, s := range p.Sample {
+		v := o.SampleValue(s.Value)
+		var cum int64
+		if o.TagsCum {
+			cum = v * stackNodes(s)
+		}
 		for key, vals := range s.Label {
+			if !showLabel(o, key) {
+				continue
+			}
 			for _, val := range vals {
-				valueMap, ok := tagMap[key]
-				if !ok {
-					valueMap = make(map[string]int64)
-					tagMap[key] = valueMap
-				}
-				valueMap[val] += o.SampleValue(s.Value)
+				add(key, val, v, cum)
 			}
 		}
 		for key, vals := range s.NumLabel {
+			if !showLabel(o, key) {
+				continue
+			}
 			unit := o.NumLabelUnits[key]
 			for _, nval := range vals {
-				val := formatTag(nval, unit)
-				valueMap, ok := tagMap[key]
-				if !ok {
-					valueMap = make(map[string]int64)
-					tagMap[key] = valueMap
-				}
-				valueMap[val] += o.SampleValue(s.Value)
+				add(key, formatTag(nval, unit), v, cum)
 			}
 		}
 	}
@@ -736,22 +1290,37 @@ func printTags(w io.Writer, rpt *Report) error {
 	}
 	tabw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
 	for _, tagKey := range graph.SortTags(tagKeys, true) {
-		var total int64
+		var total, cumTotal int64
 		key := tagKey.Name
 		tags := make([]*graph.Tag, 0, len(tagMap[key]))
 		for t, c := range tagMap[key] {
 			total += c
-			tags = append(tags, &graph.Tag{Name: t, Flat: c})
+			cumTotal += cumMap[key][t]
+			tags = append(tags, &graph.Tag{Name: t, Flat: c, Cum: cumMap[key][t]})
 		}
 
 		f, u := measurement.Scale(total, o.SampleUnit, o.OutputUnit)
-		fmt.Fprintf(tabw, "%s:\t Total %.1f%s\n", key, f, u)
+		if o.TagsCum {
+			cf, cu := measurement.Scale(cumTotal, o.SampleUnit, o.OutputUnit)
+			fmt.Fprintf(tabw, "%s:\t Total %.1f%s\t Cum %.1f%s\n", key, f, u, cf, cu)
+		} else {
+			fmt.Fprintf(tabw, "%s:\t Total %.1f%s\n", key, f, u)
+		}
 		for _, t := range graph.SortTags(tags, true) {
 			f, u := measurement.Scale(t.FlatValue(), o.SampleUnit, o.OutputUnit)
+			flat := fmt.Sprintf("%.1f%s", f, u)
 			if total > 0 {
-				fmt.Fprintf(tabw, " \t%.1f%s (%s):\t %s\n", f, u, measurement.Percentage(t.FlatValue(), total), t.Name)
+				flat += fmt.Sprintf(" (%s)", measurement.Percentage(t.FlatValue(), total))
+			}
+			if o.TagsCum {
+				cf, cu := measurement.Scale(t.CumValue(), o.SampleUnit, o.OutputUnit)
+				cum := fmt.Sprintf("%.1f%s", cf, cu)
+				if cumTotal > 0 {
+					cum += fmt.Sprintf(" (%s)", measurement.Percentage(t.CumValue(), cumTotal))
+				}
+				fmt.Fprintf(tabw, " \t%s:\t %s:\t %s\n", flat, cum, t.Name)
 			} else {
-				fmt.Fprintf(tabw, " \t%.1f%s:\t %s\n", f, u, t.Name)
+				fmt.Fprintf(tabw, " \t%s:\t %s\n", flat, t.Name)
 			}
 		}
 		fmt.Fprintln(tabw)
@@ -759,6 +1328,12 @@ func printTags(w io.Writer, rpt *Report) error {
 	return tabw.Flush()
 }
 
+// showLabel reports whether the label with the given key should be
+// shown by the traces and tags reports.
+func showLabel(o *Options, key string) bool {
+	return len(o.LabelKeys) == 0 || slices.Contains(o.LabelKeys, key)
+}
+
 // printComments prints all freeform comments in the profile.
 func printComments(w io.Writer, rpt *Report) error {
 	p := rpt.prof
@@ -775,20 +1350,128 @@ type TextItem struct {
 	InlineLabel           string // Not empty if inlined
 	Flat, Cum             int64  // Raw values
 	FlatFormat, CumFormat string // Formatted values
+
+	// MeanFormat is the formatted cum value per contention. It is only
+	// set if Options.ContentionCount is set.
+	MeanFormat string `json:",omitempty"`
+
+	// RatioFormat is the ratio of the cum value to the cum value in the
+	// base profiles of a ratio comparison, if any.
+	RatioFormat string `json:",omitempty"`
+
+	// LabelMetricFormats are the formatted cum values of the label metrics
+	// of Options.LabelMetrics, in the same order, or their flat values if
+	// Options.FlatOnly is set.
+	LabelMetricFormats []string `json:",omitempty"`
+
+	// SourceMeanFormat and SourceStdErrFormat are the mean and standard
+	// error of the cum value, or flat value if Options.FlatOnly is set,
+	// across the source profiles of a merged profile, if known.
+	SourceMeanFormat   string `json:",omitempty"`
+	SourceStdErrFormat string `json:",omitempty"`
+
+	// EstimatedFormat is the cum value, or flat value if Options.FlatOnly
+	// is set, times the period of the profile. It is only set if
+	// Options.EstimatedTotal is set and the profile has a period.
+	EstimatedFormat string `json:",omitempty"`
+
+	// CountDiffFormat is the signed difference between the number of
+	// samples of the entry and its number of samples in the base profiles,
+	// through it, or at it if Options.FlatOnly is set. It is only set if
+	// Options.SampleCountDiff is set and there are base profiles.
+	CountDiffFormat string `json:",omitempty"`
 }
 
 // TextItems returns a list of text items from the report and a list
-// of labels that describe the report.
-func TextItems(rpt *Report) ([]TextItem, []string) {
-	g, origCount, droppedNodes, _ := rpt.newTrimmedGraph()
+// of labels that describe the report. The list is incomplete if ctx is
+// done.
+func TextItems(ctx context.Context, rpt *Report) ([]TextItem, []string) {
+	g, origCount, droppedNodes, _ := rpt.newTrimmedGraph(ctx)
 	rpt.selectOutputUnit(g)
-	labels := reportLabels(rpt, graphTotal(g), len(g.Nodes), origCount, droppedNodes, 0, false)
+	labels := reportLabels(rpt, graphTotal(g), g.Nodes, len(g.Nodes), origCount, droppedNodes, 0, false)
+	if rpt.options.NameSort {
+		// Nodes are selected by value above; only their presentation order
+		// changes here.
+		g.Nodes.Sort(graph.NameOrder)
+	}
+
+	var counts map[graph.NodeInfo]int64
+	if rpt.options.ContentionCount != nil {
+		counts = rpt.contentionCounts(ctx, g)
+	}
+	var baseValues map[graph.NodeInfo]int64
+	if rpt.ratioBase != nil {
+		baseValues = rpt.baseCumValues(ctx, g)
+	}
+	var stats map[graph.NodeInfo]sourceStat
+	if rpt.sourceCount > 1 {
+		stats = rpt.sourceStats(ctx, g)
+		labels = append(labels, fmt.Sprintf("Source stats: mean and standard error across %d source profiles", rpt.sourceCount))
+	}
+	period, periodUnit, noPeriod := rpt.period()
+	hasPeriod := noPeriod == ""
+	if rpt.options.EstimatedTotal {
+		if hasPeriod {
+			labels = append(labels, fmt.Sprintf("Estimated total: value times the period of %s", measurement.Label(period, periodUnit)))
+		} else {
+			labels = append(labels, "Estimated total: unavailable, "+noPeriod)
+		}
+	}
+
+	var countDiffs map[graph.NodeInfo]int64
+	if rpt.options.SampleCountDiff {
+		switch {
+		case len(rpt.baseSamples) == 0:
+			labels = append(labels, "Sample count diff: unavailable, there are no base profiles")
+		case rpt.sampleCountIndex() < 0:
+			labels = append(labels, "Sample count diff: unavailable, the profile has no samples/count values")
+		default:
+			countDiffs = rpt.sampleCountDiffs(ctx, g)
+			labels = append(labels, "Sample count diff: samples minus samples in the base profiles")
+		}
+	}
 
 	var items []TextItem
 	var flatSum int64
 	for _, n := range g.Nodes {
 		name, flat, cum := n.Info.PrintableName(), n.FlatValue(), n.CumValue()
 
+		var mean string
+		if counts != nil {
+			if c := counts[n.Info]; c != 0 {
+				mean = rpt.formatValue(cum / c)
+			}
+		}
+		var ratio string
+		if baseValues != nil {
+			ratio = formatRatio(cum, baseValues[n.Info])
+		}
+
+		var srcMean, srcStdErr string
+		if stats != nil {
+			st := stats[n.Info]
+			srcMean = rpt.formatValue(int64(math.Round(st.mean)))
+			srcStdErr = rpt.formatValue(int64(math.Round(st.stdErr)))
+		}
+
+		var estimated string
+		if rpt.options.EstimatedTotal && hasPeriod {
+			v := cum
+			if rpt.options.FlatOnly {
+				v = flat
+			}
+			if est := v * period; v != 0 && est/v != period {
+				estimated = "overflow"
+			} else {
+				estimated = measurement.Label(est, periodUnit)
+			}
+		}
+
+		var countDiff string
+		if countDiffs != nil {
+			countDiff = fmt.Sprintf("%+d", countDiffs[n.Info])
+		}
+
 		var inline, noinline bool
 		for _, e := range n.In {
 			if e.Inline {
@@ -799,7 +1482,7 @@ func TextItems(rpt *Report) ([]TextItem, []string) {
 		}
 
 		var inl string
-		if inline {
+		if inline && !rpt.options.NoInlineLabels {
 			if noinline {
 				inl = "(partial-inline)"
 			} else {
@@ -807,25 +1490,346 @@ func TextItems(rpt *Report) ([]TextItem, []string) {
 			}
 		}
 
+		var metrics []string
+		for _, key := range rpt.options.LabelMetrics {
+			var v int64
+			if m := n.LabelMetrics[key]; m != nil {
+				if rpt.options.FlatOnly {
+					v = m.Flat
+				} else {
+					v = m.Cum
+				}
+			}
+			metrics = append(metrics, rpt.formatLabelMetric(key, v))
+		}
+
 		flatSum += flat
 		items = append(items, TextItem{
-			Name:        name,
-			InlineLabel: inl,
-			Flat:        flat,
-			Cum:         cum,
-			FlatFormat:  rpt.formatValue(flat),
-			CumFormat:   rpt.formatValue(cum),
+			Name:               name,
+			InlineLabel:        inl,
+			Flat:               flat,
+			Cum:                cum,
+			FlatFormat:         rpt.formatValue(flat),
+			CumFormat:          rpt.formatValue(cum),
+			MeanFormat:         mean,
+			RatioFormat:        ratio,
+			LabelMetricFormats: metrics,
+			SourceMeanFormat:   srcMean,
+			SourceStdErrFormat: srcStdErr,
+			EstimatedFormat:    estimated,
+			CountDiffFormat:    countDiff,
 		})
 	}
 	return items, labels
 }
 
+// period returns the sampling period of the profile of the report and its
+// unit, or why the values of the report cannot be multiplied by it: only
+// counts of samples can.
+func (rpt *Report) period() (int64, string, string) {
+	p := rpt.prof
+	if p.Period <= 0 {
+		return 0, "", "the profile has no period"
+	}
+	switch rpt.options.SampleUnit {
+	case "count", "samples":
+	default:
+		return 0, "", fmt.Sprintf("the values are in %s, not sample counts", rpt.options.SampleUnit)
+	}
+	var unit string
+	if p.PeriodType != nil {
+		unit = p.PeriodType.Unit
+	}
+	return p.Period, unit, ""
+}
+
+// contentionCounts returns the cum number of contentions of each node in g,
+// keyed by node info.
+func (rpt *Report) contentionCounts(ctx context.Context, g *graph.Graph) map[graph.NodeInfo]int64 {
+	o := *rpt.options
+	o.SampleValue, o.SampleMeanDivisor = o.ContentionCount, nil
+	crpt := &Report{prof: rpt.prof, total: rpt.total, options: &o, formatValue: rpt.formatValue}
+
+	kept := make(graph.NodeSet, len(g.Nodes))
+	for _, n := range g.Nodes {
+		kept[n.Info] = true
+	}
+	counts := make(map[graph.NodeInfo]int64, len(g.Nodes))
+	for _, n := range crpt.newGraph(ctx, kept).Nodes {
+		counts[n.Info] += n.Cum
+	}
+	return counts
+}
+
+// ratioBaseLabel marks the samples of the base profiles of ratio
+// comparisons, whose nodes show the ratio of their values to the
+// values of the same nodes in the base profiles.
+const ratioBaseLabel = "pprof::ratio_base"
+
+// splitRatioBase moves the samples of the base profiles of a ratio
+// comparison out of the profile of the report, so that they are not
+// part of its graphs.
+func (rpt *Report) splitRatioBase() {
+	if rpt.ratioBase != nil {
+		return
+	}
+	var samples, base []*profile.Sample
+	for _, s := range rpt.prof.Sample {
+		if s.HasLabel(ratioBaseLabel, "true") {
+			base = append(base, s)
+		} else {
+			samples = append(samples, s)
+		}
+	}
+	if len(base) == 0 {
+		return
+	}
+	p := rpt.prof
+	p.Sample = samples
+	rpt.ratioBase = &profile.Profile{
+		SampleType: p.SampleType,
+		Sample:     base,
+		Mapping:    p.Mapping,
+		Location:   p.Location,
+		Function:   p.Function,
+	}
+	rpt.ratioBase.RemoveLabel(ratioBaseLabel)
+}
+
+// baseCumValues returns the cum value in the base profiles of a ratio
+// comparison of each node in g, keyed by node info.
+func (rpt *Report) baseCumValues(ctx context.Context, g *graph.Graph) map[graph.NodeInfo]int64 {
+	brpt := &Report{prof: rpt.ratioBase, total: rpt.total, options: rpt.options, formatValue: rpt.formatValue}
+
+	kept := make(graph.NodeSet, len(g.Nodes))
+	for _, n := range g.Nodes {
+		kept[n.Info] = true
+	}
+	values := make(map[graph.NodeInfo]int64, len(g.Nodes))
+	for _, n := range brpt.newGraph(ctx, kept).Nodes {
+		values[n.Info] += n.CumValue()
+	}
+	return values
+}
+
+// baseLabel marks the samples of the base profiles of a diff comparison.
+const baseLabel = "pprof::base"
+
+// sampleCountIndex returns the index of the samples/count values of the
+// profile of the report, or -1 if it has none.
+func (rpt *Report) sampleCountIndex() int {
+	for i, st := range rpt.prof.SampleType {
+		if st.Type == "samples" && st.Unit == "count" {
+			return i
+		}
+	}
+	return -1
+}
+
+// sampleCountDiffs returns the number of samples of each node in g minus
+// its number of samples in the base profiles of a diff comparison, keyed
+// by node info. The samples are counted through the node, or at the node
+// if Options.FlatOnly is set. The counts are read from the samples/count
+// values, as a profile.Sample can hold many merged samples.
+func (rpt *Report) sampleCountDiffs(ctx context.Context, g *graph.Graph) map[graph.NodeInfo]int64 {
+	kept := make(graph.NodeSet, len(g.Nodes))
+	for _, n := range g.Nodes {
+		kept[n.Info] = true
+	}
+	var samples, base []*profile.Sample
+	for _, s := range rpt.prof.Sample {
+		if rpt.baseSamples[s] {
+			base = append(base, s)
+		} else {
+			samples = append(samples, s)
+		}
+	}
+	o := *rpt.options
+	idx := rpt.sampleCountIndex()
+	// The values of the base samples are negated by the comparison.
+	o.SampleValue = func(v []int64) int64 {
+		if v[idx] < 0 {
+			return -v[idx]
+		}
+		return v[idx]
+	}
+	o.SampleMeanDivisor = nil
+	p := rpt.prof
+	diffs := make(map[graph.NodeInfo]int64, len(g.Nodes))
+	for _, part := range []struct {
+		samples []*profile.Sample
+		sign    int64
+	}{{samples, 1}, {base, -1}} {
+		sp := &profile.Profile{
+			SampleType: p.SampleType,
+			Sample:     part.samples,
+			Mapping:    p.Mapping,
+			Location:   p.Location,
+			Function:   p.Function,
+		}
+		crpt := &Report{prof: sp, total: rpt.total, options: &o, formatValue: rpt.formatValue}
+		for _, n := range crpt.newGraph(ctx, kept).Nodes {
+			if o.FlatOnly {
+				diffs[n.Info] += part.sign * n.Flat
+			} else {
+				diffs[n.Info] += part.sign * n.Cum
+			}
+		}
+	}
+	return diffs
+}
+
+// sourceLabel marks the samples of a merged profile with the index of the
+// source profile they come from, to compute the statistics of the values
+// of the nodes across the source profiles.
+const sourceLabel = "pprof::source"
+
+// countSources returns the number of source profiles whose samples in
+// prof are marked with sourceLabel.
+func countSources(prof *profile.Profile) int {
+	sources := make(map[string]bool)
+	for _, s := range prof.Sample {
+		for _, v := range s.Label[sourceLabel] {
+			sources[v] = true
+		}
+	}
+	return len(sources)
+}
+
+// splitSources saves the source profile of each sample and removes
+// sourceLabel, so that it does not appear in the reports.
+func (rpt *Report) splitSources() {
+	if rpt.sourceCount == 0 || rpt.sampleSources != nil {
+		return
+	}
+	rpt.sampleSources = make(map[*profile.Sample]string, len(rpt.prof.Sample))
+	for _, s := range rpt.prof.Sample {
+		if v := s.Label[sourceLabel]; len(v) > 0 {
+			rpt.sampleSources[s] = v[0]
+		}
+	}
+	rpt.prof.RemoveLabel(sourceLabel)
+}
+
+// sourceStat holds the mean and standard error of the mean of the value
+// of a node across source profiles.
+type sourceStat struct {
+	mean, stdErr float64
+}
+
+// sourceStats returns the mean and standard error of the cum value, or
+// flat value for flat-only reports, of each node in g across the source
+// profiles of the report, keyed by node info. Sources without samples
+// in a node count as a zero value.
+func (rpt *Report) sourceStats(ctx context.Context, g *graph.Graph) map[graph.NodeInfo]sourceStat {
+	kept := make(graph.NodeSet, len(g.Nodes))
+	for _, n := range g.Nodes {
+		kept[n.Info] = true
+	}
+	var sources []string
+	bySource := make(map[string][]*profile.Sample)
+	for _, s := range rpt.prof.Sample {
+		src, ok := rpt.sampleSources[s]
+		if !ok {
+			continue
+		}
+		if _, ok := bySource[src]; !ok {
+			sources = append(sources, src)
+		}
+		bySource[src] = append(bySource[src], s)
+	}
+
+	sum := make(map[graph.NodeInfo]float64, len(g.Nodes))
+	sumSq := make(map[graph.NodeInfo]float64, len(g.Nodes))
+	p := rpt.prof
+	for _, src := range sources {
+		sp := &profile.Profile{
+			SampleType: p.SampleType,
+			Sample:     bySource[src],
+			Mapping:    p.Mapping,
+			Location:   p.Location,
+			Function:   p.Function,
+		}
+		srpt := &Report{prof: sp, total: rpt.total, options: rpt.options, formatValue: rpt.formatValue}
+		values := make(map[graph.NodeInfo]int64)
+		for _, n := range srpt.newGraph(ctx, kept).Nodes {
+			if rpt.options.FlatOnly {
+				values[n.Info] += n.FlatValue()
+			} else {
+				values[n.Info] += n.CumValue()
+			}
+		}
+		for info, v := range values {
+			sum[info] += float64(v)
+			sumSq[info] += float64(v) * float64(v)
+		}
+	}
+
+	n := float64(rpt.sourceCount)
+	stats := make(map[graph.NodeInfo]sourceStat, len(g.Nodes))
+	for info := range kept {
+		mean := sum[info] / n
+		// Unbiased sample variance of the values of the sources.
+		variance := math.Max((sumSq[info]-sum[info]*mean)/(n-1), 0)
+		stats[info] = sourceStat{mean: mean, stdErr: math.Sqrt(variance / n)}
+	}
+	return stats
+}
+
+// formatRatio formats the ratio of value to base, as "new" if only value
+// is not zero.
+func formatRatio(value, base int64) string {
+	switch {
+	case base != 0:
+		return fmt.Sprintf("%.2fx", float64(value)/float64(base))
+	case value != 0:
+		return "new"
+	}
+	return "-"
+}
+
 // printText prints a flat text report for a profile.
-func printText(w io.Writer, rpt *Report) error {
-	items, labels := TextItems(rpt)
+func printText(ctx context.Context, w io.Writer, rpt *Report) error {
+	items, labels := TextItems(ctx, rpt)
 	fmt.Fprintln(w, strings.Join(labels, "\n"))
-	fmt.Fprintf(w, "%10s %5s%% %5s%% %10s %5s%%\n",
-		"flat", "flat", "sum", "cum", "cum")
+	// The mean is derived from the cum value, so it goes with it.
+	flatOnly := rpt.options.FlatOnly
+	showMean := rpt.options.ContentionCount != nil && !flatOnly
+	// So does the ratio to the base profiles of a ratio comparison.
+	showRatio := rpt.ratioBase != nil && !flatOnly
+	var extra string
+	if showMean {
+		extra += fmt.Sprintf(" %10s", "mean")
+	}
+	if showRatio {
+		extra += fmt.Sprintf(" %10s", "ratio")
+	}
+	// Statistics across source profiles and label metrics are cum values,
+	// or flat values in flat-only reports.
+	showSources := rpt.sourceCount > 1
+	if showSources {
+		extra += fmt.Sprintf(" %10s %10s", "src mean", "src stderr")
+	}
+	// So are the estimated totals.
+	_, _, noPeriod := rpt.period()
+	showEstimated := rpt.options.EstimatedTotal && noPeriod == ""
+	if showEstimated {
+		extra += fmt.Sprintf(" %10s", "est total")
+	}
+	// And the sample count differences.
+	showCountDiff := rpt.options.SampleCountDiff && len(rpt.baseSamples) > 0 && rpt.sampleCountIndex() >= 0
+	if showCountDiff {
+		extra += fmt.Sprintf(" %10s", "count diff")
+	}
+	for _, key := range rpt.options.LabelMetrics {
+		extra += fmt.Sprintf(" %10s", key)
+	}
+	if flatOnly {
+		fmt.Fprintf(w, "%10s %5s%% %5s%%%s\n", "flat", "flat", "sum", extra)
+	} else {
+		fmt.Fprintf(w, "%10s %5s%% %5s%% %10s %5s%%%s\n",
+			"flat", "flat", "sum", "cum", "cum", extra)
+	}
 	var flatSum int64
 	for _, item := range items {
 		inl := item.InlineLabel
@@ -833,11 +1837,150 @@ func printText(w io.Writer, rpt *Report) error {
 			inl = " " + inl
 		}
 		flatSum += item.Flat
-		fmt.Fprintf(w, "%10s %s %s %10s %s  %s%s\n",
-			item.FlatFormat, measurement.Percentage(item.Flat, rpt.total),
+		var metrics string
+		if showSources {
+			metrics += fmt.Sprintf(" %10s %10s", item.SourceMeanFormat, item.SourceStdErrFormat)
+		}
+		if showEstimated {
+			metrics += fmt.Sprintf(" %10s", item.EstimatedFormat)
+		}
+		if showCountDiff {
+			metrics += fmt.Sprintf(" %10s", item.CountDiffFormat)
+		}
+		for _, m := range item.LabelMetricFormats {
+			metrics += fmt.Sprintf(" %10s", m)
+		}
+		if flatOnly {
+			fmt.Fprintf(w, "%10s %s %s%s  %s%s\n",
+				item.FlatFormat, measurement.Percentage(item.Flat, rpt.percentTotal()),
+				measurement.Percentage(flatSum, rpt.total),
+				metrics, item.Name, inl)
+			continue
+		}
+		var extra string
+		if showMean {
+			extra += fmt.Sprintf(" %10s", item.MeanFormat)
+		}
+		if showRatio {
+			extra += fmt.Sprintf(" %10s", item.RatioFormat)
+		}
+		extra += metrics
+		fmt.Fprintf(w, "%10s %s %s %10s %s%s  %s%s\n",
+			item.FlatFormat, measurement.Percentage(item.Flat, rpt.percentTotal()),
 			measurement.Percentage(flatSum, rpt.total),
-			item.CumFormat, measurement.Percentage(item.Cum, rpt.total),
-			item.Name, inl)
+			item.CumFormat, measurement.Percentage(item.Cum, rpt.percentTotal()),
+			extra, item.Name, inl)
+	}
+	return nil
+}
+
+// printOneLine prints a single-line summary of a profile, with its total
+// value, the node with the highest flat value and the number of samples,
+// for easy consumption by scripts. The top node is omitted if there is none.
+func printOneLine(ctx context.Context, w io.Writer, rpt *Report) error {
+	g, _, _, _ := rpt.newTrimmedGraph(ctx)
+	rpt.selectOutputUnit(g)
+
+	fields := []string{"total=" + rpt.formatValue(rpt.total)}
+	if len(g.Nodes) > 0 {
+		g.Nodes.Sort(graph.FlatNameOrder)
+		top := g.Nodes[0]
+		fields = append(fields, fmt.Sprintf("top=%s:%s", top.Info.PrintableName(), rpt.formatValue(top.FlatValue())))
+	}
+	fields = append(fields, fmt.Sprintf("samples=%d", len(rpt.prof.Sample)))
+	_, err := fmt.Fprintln(w, strings.Join(fields, " "))
+	return err
+}
+
+// printSample prints the sample of the profile at rpt.options.SampleNumber:
+// all its values and labels and its full stack, with the address of each
+// location and every frame inlined at it, from the leaf to the root.
+func printSample(w io.Writer, rpt *Report) error {
+	prof := rpt.prof
+	n := rpt.options.SampleNumber
+	if n < 0 || n >= len(prof.Sample) {
+		return fmt.Errorf("sample index %d out of range, the profile has %d samples", n, len(prof.Sample))
+	}
+	sample := prof.Sample[n]
+
+	fmt.Fprintln(w, strings.Join(ProfileLabels(rpt), "\n"))
+	fmt.Fprintf(w, "Sample %d of %d\n", n, len(prof.Sample))
+	for i, st := range prof.SampleType {
+		if i < len(sample.Value) {
+			fmt.Fprintf(w, "%10s:  %s\n", st.Type, measurement.ScaledLabel(sample.Value[i], st.Unit, "auto"))
+		}
+	}
+	var labels []string
+	for key, vs := range sample.Label {
+		labels = append(labels, fmt.Sprintf("%10s:  %s\n", key, strings.Join(vs, " ")))
+	}
+	for key, vals := range sample.NumLabel {
+		var units []string
+		if sample.NumUnit != nil {
+			units = sample.NumUnit[key]
+		}
+		numValues := make([]string, len(vals))
+		for i, v := range vals {
+			unit := rpt.options.NumLabelUnits[key]
+			if i < len(units) && units[i] != "" {
+				unit = units[i]
+			}
+			numValues[i] = measurement.Label(v, unit)
+		}
+		labels = append(labels, fmt.Sprintf("%10s:  %s\n", key, strings.Join(numValues, " ")))
+	}
+	sort.Strings(labels)
+	fmt.Fprint(w, strings.Join(labels, ""))
+
+	fmt.Fprintf(w, "%10s:\n", "stack")
+	for _, loc := range sample.Location {
+		addr := fmt.Sprintf("%#x", loc.Address)
+		if len(loc.Line) == 0 {
+			name := "??"
+			if loc.Mapping != nil && loc.Mapping.File != "" {
+				name = loc.Mapping.File
+			}
+			fmt.Fprintf(w, "%18s  %s\n", addr, name)
+			continue
+		}
+		for i, ln := range loc.Line {
+			name, file := "??", "??"
+			if fn := ln.Function; fn != nil {
+				name, file = fn.Name, fn.Filename
+			}
+			var inline string
+			if i != len(loc.Line)-1 {
+				inline = " (inline)"
+			}
+			fmt.Fprintf(w, "%18s  %s %s:%d%s\n", addr, name, file, ln.Line, inline)
+			addr = ""
+		}
+	}
+	return nil
+}
+
+// printEdges prints the heaviest caller->callee edges of the whole graph,
+// by decreasing weight, up to Options.NodeCount of them if positive.
+func printEdges(ctx context.Context, w io.Writer, rpt *Report) error {
+	g := rpt.newGraph(ctx, nil)
+	rpt.selectOutputUnit(g)
+	edges := g.SortedEdges()
+	total := len(edges)
+	if n := rpt.options.NodeCount; n > 0 && n < len(edges) {
+		edges = edges[:n]
+	}
+
+	fmt.Fprintln(w, strings.Join(ProfileLabels(rpt), "\n"))
+	fmt.Fprintf(w, "Showing top %d edges out of %d\n", len(edges), total)
+	fmt.Fprintf(w, "%10s %6s  %s\n", "weight", "total%", "caller -> callee")
+	for _, e := range edges {
+		var inline string
+		if e.Inline && !rpt.options.NoInlineLabels {
+			inline = " (inline)"
+		}
+		fmt.Fprintf(w, "%10s %s  %s -> %s%s\n",
+			rpt.formatValue(e.WeightValue()), measurement.Percentage(e.WeightValue(), rpt.total),
+			e.Src.Info.PrintableName(), e.Dest.Info.PrintableName(), inline)
 	}
 	return nil
 }
@@ -852,7 +1995,12 @@ func printTraces(w io.Writer, rpt *Report) error {
 	const separator = "-----------+-------------------------------------------------------"
 
 	_, locations := graph.CreateNodes(prof, &graph.Options{})
+	var shown int
 	for _, sample := range prof.Sample {
+		if o.Thread != "" && !isThread(sample, o.ThreadLabel, o.Thread) {
+			continue
+		}
+		shown++
 		type stk struct {
 			*graph.NodeInfo
 			inline bool
@@ -873,9 +2021,19 @@ func printTraces(w io.Writer, rpt *Report) error {
 		}
 
 		fmt.Fprintln(w, separator)
+		var timePrinted bool
+		if o.TraceTimestamps {
+			if ts, ok := sampleTimestamp(sample, o.NumLabelUnits[timestampLabel]); ok {
+				fmt.Fprintf(w, "%10s:  %s\n", "time", ts.UTC().Format(time.RFC3339Nano))
+				timePrinted = true
+			}
+		}
 		// Print any text labels for the sample.
 		var labels []string
 		for s, vs := range sample.Label {
+			if !showLabel(o, s) {
+				continue
+			}
 			labels = append(labels, fmt.Sprintf("%10s:  %s\n", s, strings.Join(vs, " ")))
 		}
 		sort.Strings(labels)
@@ -884,6 +2042,13 @@ func printTraces(w io.Writer, rpt *Report) error {
 		// Print any numeric labels for the sample
 		var numLabels []string
 		for key, vals := range sample.NumLabel {
+			if timePrinted && key == timestampLabel {
+				// Already printed as the sample time.
+				continue
+			}
+			if !showLabel(o, key) {
+				continue
+			}
 			unit := o.NumLabelUnits[key]
 			numValues := make([]string, len(vals))
 			for i, vv := range vals {
@@ -903,29 +2068,86 @@ func printTraces(w io.Writer, rpt *Report) error {
 		if d != 0 {
 			v = v / d
 		}
+		var omitted int
+		if max := o.TraceMaxDepth; max > 0 && len(stack) > max {
+			stack, omitted = stack[:max], len(stack)-max
+		}
 		for i, s := range stack {
 			var vs, inline string
 			if i == 0 {
 				vs = rpt.formatValue(v)
 			}
-			if s.inline {
+			if s.inline && !o.NoInlineLabels {
 				inline = " (inline)"
 			}
 			fmt.Fprintf(w, "%10s   %s%s\n", vs, s.PrintableName(), inline)
 		}
+		if omitted > 0 {
+			fmt.Fprintf(w, "%10s   ... (%d more frames)\n", "", omitted)
+		}
 	}
 	fmt.Fprintln(w, separator)
+	if o.Thread != "" && shown == 0 {
+		return fmt.Errorf("no samples found for thread %s", o.Thread)
+	}
 	return nil
 }
 
+// threadLabelKeys are the label keys holding the thread or goroutine id
+// of a sample, in order of preference.
+var threadLabelKeys = []string{"thread", "tid", "goroutine"}
+
+// isThread reports whether the thread or goroutine id of s, held by its
+// string or numeric label key, is id. If key is empty, the first of
+// threadLabelKeys that s has is used.
+func isThread(s *profile.Sample, key, id string) bool {
+	if key == "" {
+		for _, k := range threadLabelKeys {
+			if len(s.Label[k]) > 0 || len(s.NumLabel[k]) > 0 {
+				key = k
+				break
+			}
+		}
+	}
+	if slices.Contains(s.Label[key], id) {
+		return true
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	return err == nil && slices.Contains(s.NumLabel[key], n)
+}
+
+// timestampLabel is the numeric label holding the time at which a sample
+// was taken, as an offset from the Unix epoch.
+const timestampLabel = "timestamp"
+
+// sampleTimestamp returns the wall-clock time recorded in the timestamp
+// label of the sample. Timestamps without a unit, or with the unit
+// "timestamp" that Profile.NumLabelUnits gives them by default, are taken to
+// be in nanoseconds.
+func sampleTimestamp(s *profile.Sample, unit string) (time.Time, bool) {
+	vals := s.NumLabel[timestampLabel]
+	if len(vals) == 0 {
+		return time.Time{}, false
+	}
+	switch unit {
+	case "", timestampLabel, "ns", "nanosecond", "nanoseconds":
+		return time.Unix(0, vals[0]), true
+	}
+	ns, u := measurement.Scale(vals[0], unit, "nanoseconds")
+	if u != "ns" {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(ns)), true
+}
+
 // printCallgrind prints a graph for a profile on callgrind format.
-func printCallgrind(w io.Writer, rpt *Report) error {
+func printCallgrind(ctx context.Context, w io.Writer, rpt *Report) error {
 	o := rpt.options
 	rpt.options.NodeFraction = 0
 	rpt.options.EdgeFraction = 0
 	rpt.options.NodeCount = 0
 
-	g, _, _, _ := rpt.newTrimmedGraph()
+	g, _, _, _ := rpt.newTrimmedGraph(ctx)
 	rpt.selectOutputUnit(g)
 
 	nodeNames := getDisambiguatedNames(g)
@@ -937,6 +2159,10 @@ func printCallgrind(w io.Writer, rpt *Report) error {
 	files := make(map[string]int)
 	names := make(map[string]int)
 
+	// Callgrind costs are integers, so count the values that lose a
+	// fractional part when scaled to the output unit.
+	var truncated int
+
 	// prevInfo points to the previous NodeInfo.
 	// It is used to group cost lines together as much as possible.
 	var prevInfo *graph.NodeInfo
@@ -950,11 +2176,17 @@ func printCallgrind(w io.Writer, rpt *Report) error {
 
 		addr := callgrindAddress(prevInfo, n.Info.Address)
 		sv, _ := measurement.Scale(n.FlatValue(), o.SampleUnit, o.OutputUnit)
+		if sv != math.Trunc(sv) {
+			truncated++
+		}
 		fmt.Fprintf(w, "%s %d %d\n", addr, n.Info.Lineno, int64(sv))
 
 		// Print outgoing edges.
 		for _, out := range n.Out.Sort() {
 			c, _ := measurement.Scale(out.Weight, o.SampleUnit, o.OutputUnit)
+			if c != math.Trunc(c) {
+				truncated++
+			}
 			callee := out.Dest
 			fmt.Fprintln(w, "cfl="+callgrindName(files, callee.Info.File))
 			fmt.Fprintln(w, "cfn="+callgrindName(names, nodeNames[callee]))
@@ -970,6 +2202,9 @@ func printCallgrind(w io.Writer, rpt *Report) error {
 		prevInfo = &n.Info
 	}
 
+	if truncated > 0 {
+		rpt.warnings = append(rpt.warnings, fmt.Sprintf("callgrind: %d values were truncated to whole %s; use -unit to select a finer unit", truncated, o.OutputUnit))
+	}
 	return nil
 }
 
@@ -1058,14 +2293,14 @@ func callgrindAddress(prevInfo *graph.NodeInfo, curr uint64) string {
 }
 
 // printTree prints a tree-based report in text form.
-func printTree(w io.Writer, rpt *Report) error {
+func printTree(ctx context.Context, w io.Writer, rpt *Report) error {
 	const separator = "----------------------------------------------------------+-------------"
 	const legend = "      flat  flat%   sum%        cum   cum%   calls calls% + context 	 	 "
 
-	g, origCount, droppedNodes, _ := rpt.newTrimmedGraph()
+	g, origCount, droppedNodes, _ := rpt.newTrimmedGraph(ctx)
 	rpt.selectOutputUnit(g)
 
-	fmt.Fprintln(w, strings.Join(reportLabels(rpt, graphTotal(g), len(g.Nodes), origCount, droppedNodes, 0, false), "\n"))
+	fmt.Fprintln(w, strings.Join(reportLabels(rpt, graphTotal(g), g.Nodes, len(g.Nodes), origCount, droppedNodes, 0, false), "\n"))
 
 	fmt.Fprintln(w, separator)
 	fmt.Fprintln(w, legend)
@@ -1087,7 +2322,7 @@ func printTree(w io.Writer, rpt *Report) error {
 		inEdges := n.In.Sort()
 		for _, in := range inEdges {
 			var inline string
-			if in.Inline {
+			if in.Inline && !rpt.options.NoInlineLabels {
 				inline = " (inline)"
 			}
 			fmt.Fprintf(w, "%50s %s |   %s%s\n", rpt.formatValue(in.Weight),
@@ -1098,17 +2333,17 @@ func printTree(w io.Writer, rpt *Report) error {
 		flatSum += flat
 		fmt.Fprintf(w, "%10s %s %s %10s %s                | %s\n",
 			rpt.formatValue(flat),
-			measurement.Percentage(flat, rpt.total),
+			measurement.Percentage(flat, rpt.percentTotal()),
 			measurement.Percentage(flatSum, rpt.total),
 			rpt.formatValue(cum),
-			measurement.Percentage(cum, rpt.total),
+			measurement.Percentage(cum, rpt.percentTotal()),
 			name)
 
 		// Print outgoing edges.
 		outEdges := n.Out.Sort()
 		for _, out := range outEdges {
 			var inline string
-			if out.Inline {
+			if out.Inline && !rpt.options.NoInlineLabels {
 				inline = " (inline)"
 			}
 			fmt.Fprintf(w, "%50s %s |   %s%s\n", rpt.formatValue(out.Weight),
@@ -1125,33 +2360,254 @@ func printTree(w io.Writer, rpt *Report) error {
 }
 
 // GetDOT returns a graph suitable for dot processing along with some
-// configuration information.
-func GetDOT(rpt *Report) (*graph.Graph, *graph.DotConfig) {
-	g, origCount, droppedNodes, droppedEdges := rpt.newTrimmedGraph()
+// configuration information. The graph is incomplete if ctx is done.
+func GetDOT(ctx context.Context, rpt *Report) (*graph.Graph, *graph.DotConfig) {
+	g, origCount, droppedNodes, droppedEdges := rpt.newTrimmedGraph(ctx)
 	rpt.selectOutputUnit(g)
-	labels := reportLabels(rpt, graphTotal(g), len(g.Nodes), origCount, droppedNodes, droppedEdges, true)
+	labels := reportLabels(rpt, graphTotal(g), g.Nodes, len(g.Nodes), origCount, droppedNodes, droppedEdges, true)
 
 	c := &graph.DotConfig{
 		Title:       rpt.options.Title,
 		Labels:      labels,
 		FormatValue: rpt.formatValue,
 		Total:       rpt.total,
+		HotPath:     rpt.options.HotPath,
+
+		PercentTotal: rpt.percentBase,
+		Diff:         hasNegativeValues(g),
+		RankDir:      rpt.options.RankDir,
+		SizeBy:       rpt.options.NodeSize,
+		ColorBy:      rpt.options.NodeColor,
+
+		LabelMetrics:      rpt.options.LabelMetrics,
+		FormatLabelMetric: rpt.formatLabelMetric,
 	}
 	return g, c
 }
 
+// hasNegativeValues reports whether a node of g has a negative value,
+// as only happens in comparisons of profiles.
+func hasNegativeValues(g *graph.Graph) bool {
+	for _, n := range g.Nodes {
+		if n.Flat < 0 || n.Cum < 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // printDOT prints an annotated callgraph in DOT format.
-func printDOT(w io.Writer, rpt *Report) error {
-	g, c := GetDOT(rpt)
+func printDOT(ctx context.Context, w io.Writer, rpt *Report) error {
+	g, c := GetDOT(ctx, rpt)
+	c.StableIDs = rpt.options.StableDotIDs
 	graph.ComposeDot(w, g, &graph.DotAttributes{}, c)
 	return nil
 }
 
+// printGraphML prints an annotated callgraph in GraphML format.
+func printGraphML(ctx context.Context, w io.Writer, rpt *Report) error {
+	g, origCount, droppedNodes, droppedEdges := rpt.newTrimmedGraph(ctx)
+	rpt.selectOutputUnit(g)
+	labels := reportLabels(rpt, graphTotal(g), g.Nodes, len(g.Nodes), origCount, droppedNodes, droppedEdges, true)
+
+	c := &graph.GraphMLConfig{
+		Title:  rpt.options.Title,
+		Labels: labels,
+		Unit:   rpt.options.SampleUnit,
+	}
+	graph.ComposeGraphML(w, g, c)
+	return nil
+}
+
+// d3Node is a node of the hierarchy printed by the D3JSON format, in the
+// shape expected by d3.hierarchy. Value is the flat value of the node, so
+// that summing the values of a subtree gives its cumulative value.
+type d3Node struct {
+	Name     string    `json:"name"`
+	Value    int64     `json:"value"`
+	Samples  []int     `json:"samples,omitempty"`
+	Children []*d3Node `json:"children,omitempty"`
+}
+
+// printD3JSON prints the call tree as hierarchical JSON for D3 sunburst and
+// treemap layouts. The roots of the call tree become the children of a
+// single root node named after the report title. The call tree is built
+// with the call_tree mode, so nodes are specific to their calling context.
+// A node reachable through several paths is repeated under each of them,
+// and edges closing a cycle are dropped.
+func printD3JSON(ctx context.Context, w io.Writer, rpt *Report) error {
+	g, _, _, _ := rpt.newTrimmedGraph(ctx)
+
+	value := func(v int64) int64 {
+		if r := rpt.options.Ratio; r > 0 && r != 1 {
+			return int64(float64(v) * r)
+		}
+		return v
+	}
+
+	onPath := make(map[*graph.Node]bool)
+	var expand func(n *graph.Node) *d3Node
+	expand = func(n *graph.Node) *d3Node {
+		d := &d3Node{Name: n.Info.PrintableName(), Value: value(n.FlatValue()), Samples: n.SampleIndices}
+		onPath[n] = true
+		for _, e := range n.Out.Sort() {
+			if !onPath[e.Dest] {
+				d.Children = append(d.Children, expand(e.Dest))
+			}
+		}
+		delete(onPath, n)
+		return d
+	}
+
+	root := &d3Node{Name: rpt.options.Title}
+	if root.Name == "" {
+		root.Name = "root"
+	}
+	for _, n := range g.Nodes {
+		if len(n.In) == 0 {
+			root.Children = append(root.Children, expand(n))
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(root)
+}
+
+// ndjsonSample is a sample printed by the NDJSON format, one per line.
+// Value is the value of the sample selected for the report and Values has
+// all of its values by sample type. Frames is the stack from the leaf to the
+// root, with the frames inlined at a location before the frame they are
+// inlined into.
+type ndjsonSample struct {
+	Value     int64               `json:"value"`
+	Values    map[string]int64    `json:"values"`
+	Frames    []ndjsonFrame       `json:"frames"`
+	Labels    map[string][]string `json:"labels,omitempty"`
+	NumLabels map[string][]int64  `json:"num_labels,omitempty"`
+	NumUnits  map[string][]string `json:"num_units,omitempty"`
+}
+
+// ndjsonFrame is a frame of the stack of an ndjsonSample. Address is the
+// hexadecimal address of its location, and Mapping the file of the mapping
+// of the location. Inline is set for frames inlined into the next one.
+type ndjsonFrame struct {
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int64  `json:"line,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Mapping  string `json:"mapping,omitempty"`
+	Inline   bool   `json:"inline,omitempty"`
+}
+
+// printNDJSON prints the samples of the profile as newline-delimited JSON,
+// an ndjsonSample per line, for streaming into log and analytics pipelines.
+func printNDJSON(w io.Writer, rpt *Report) error {
+	prof := rpt.prof
+	o := rpt.options
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, sample := range prof.Sample {
+		v := o.SampleValue(sample.Value)
+		if o.SampleMeanDivisor != nil {
+			if d := o.SampleMeanDivisor(sample.Value); d != 0 {
+				v = v / d
+			}
+		}
+		s := ndjsonSample{
+			Value:     v,
+			Values:    make(map[string]int64, len(prof.SampleType)),
+			Frames:    []ndjsonFrame{},
+			Labels:    sample.Label,
+			NumLabels: sample.NumLabel,
+			NumUnits:  sample.NumUnit,
+		}
+		for i, st := range prof.SampleType {
+			if i < len(sample.Value) {
+				s.Values[st.Type] = sample.Value[i]
+			}
+		}
+		for _, loc := range sample.Location {
+			var f ndjsonFrame
+			if loc.Address != 0 {
+				f.Address = fmt.Sprintf("%#x", loc.Address)
+			}
+			if loc.Mapping != nil {
+				f.Mapping = loc.Mapping.File
+			}
+			if len(loc.Line) == 0 {
+				s.Frames = append(s.Frames, f)
+				continue
+			}
+			for i, ln := range loc.Line {
+				f.Line, f.Inline = ln.Line, i != len(loc.Line)-1
+				f.Function, f.File = "", ""
+				if fn := ln.Function; fn != nil {
+					f.Function, f.File = fn.Name, fn.Filename
+				}
+				s.Frames = append(s.Frames, f)
+			}
+		}
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prometheusEscaper escapes the label values of the Prometheus text format.
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusLabelValue returns s sanitized as a label value of the
+// Prometheus text format: valid UTF-8, with its backslashes, double quotes
+// and newlines escaped.
+func prometheusLabelValue(s string) string {
+	return prometheusEscaper.Replace(strings.ToValidUTF8(s, "\uFFFD"))
+}
+
+// printPrometheus prints the flat and cum values of the functions of the
+// report as gauges in the Prometheus text format, in the unit of the
+// samples, for pushing profile summaries into monitoring systems.
+func printPrometheus(ctx context.Context, w io.Writer, rpt *Report) error {
+	g, _, _, _ := rpt.trimmedGraph(ctx, true)
+	unit := prometheusLabelValue(rpt.options.SampleUnit)
+
+	// Nodes with the same name are merged, as a series can only be
+	// printed once.
+	var names []string
+	flat, cum := make(map[string]int64), make(map[string]int64)
+	for _, n := range g.Nodes {
+		name := prometheusLabelValue(n.Info.PrintableName())
+		if _, ok := flat[name]; !ok {
+			names = append(names, name)
+		}
+		flat[name] += n.FlatValue()
+		cum[name] += n.CumValue()
+	}
+
+	for _, m := range []struct {
+		name, help string
+		values     map[string]int64
+	}{
+		{"pprof_function_flat", "Value of the samples in the function itself.", flat},
+		{"pprof_function_cum", "Value of the samples in the function and its callees.", cum},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{func=\"%s\",unit=\"%s\"} %d\n", m.name, name, unit, m.values[name])
+		}
+	}
+	return nil
+}
+
 // ProfileLabels returns printable labels for a profile.
 func ProfileLabels(rpt *Report) []string {
 	label := []string{}
 	prof := rpt.prof
 	o := rpt.options
+	if o.CommentsFirst {
+		label = append(label, visibleComments(prof)...)
+	}
 	if len(prof.Mapping) > 0 {
 		if prof.Mapping[0].File != "" {
 			label = append(label, "File: "+filepath.Base(prof.Mapping[0].File))
@@ -1160,11 +2616,8 @@ func ProfileLabels(rpt *Report) []string {
 			label = append(label, "Build ID: "+prof.Mapping[0].BuildID)
 		}
 	}
-	// Only include comments that do not start with '#'.
-	for _, c := range prof.Comments {
-		if !strings.HasPrefix(c, "#") {
-			label = append(label, c)
-		}
+	if !o.CommentsFirst {
+		label = append(label, visibleComments(prof)...)
 	}
 	if o.SampleType != "" {
 		label = append(label, "Type: "+o.SampleType)
@@ -1185,9 +2638,22 @@ func ProfileLabels(rpt *Report) []string {
 		}
 		label = append(label, fmt.Sprintf("Duration: %s, Total samples = %s %s", duration, rpt.formatValue(rpt.total), ratio))
 	}
+	label = append(label, o.ExtraLabels...)
 	return label
 }
 
+// visibleComments returns the comments of the profile that are shown in
+// report headers, which are those that do not start with '#'.
+func visibleComments(prof *profile.Profile) []string {
+	var comments []string
+	for _, c := range prof.Comments {
+		if !strings.HasPrefix(c, "#") {
+			comments = append(comments, c)
+		}
+	}
+	return comments
+}
+
 func graphTotal(g *graph.Graph) int64 {
 	var total int64
 	for _, n := range g.Nodes {
@@ -1197,16 +2663,25 @@ func graphTotal(g *graph.Graph) int64 {
 }
 
 // reportLabels returns printable labels for a report. Includes
-// profileLabels.
-func reportLabels(rpt *Report, shownTotal int64, nodeCount, origCount, droppedNodes, droppedEdges int, fullHeaders bool) []string {
+// profileLabels. The shown nodes are only used for the concentration
+// labels and may be nil.
+func reportLabels(rpt *Report, shownTotal int64, nodes graph.Nodes, nodeCount, origCount, droppedNodes, droppedEdges int, fullHeaders bool) []string {
 	nodeFraction := rpt.options.NodeFraction
 	edgeFraction := rpt.options.EdgeFraction
 
 	var label []string
 	if len(rpt.options.ProfileLabels) > 0 {
 		label = append(label, rpt.options.ProfileLabels...)
+		label = append(label, rpt.options.ExtraLabels...)
 	} else if fullHeaders || !rpt.options.CompactLabels {
 		label = ProfileLabels(rpt)
+	} else {
+		// Comments and labels added by the user are shown even with
+		// compact labels.
+		if rpt.options.CommentsFirst {
+			label = append(label, visibleComments(rpt.prof)...)
+		}
+		label = append(label, rpt.options.ExtraLabels...)
 	}
 
 	if len(rpt.options.ActiveFilters) > 0 {
@@ -1215,6 +2690,9 @@ func reportLabels(rpt *Report, shownTotal int64, nodeCount, origCount, droppedNo
 	}
 
 	label = append(label, fmt.Sprintf("Showing nodes accounting for %s, %s of %s total", rpt.formatValue(shownTotal), strings.TrimSpace(measurement.Percentage(shownTotal, rpt.total)), rpt.formatValue(rpt.total)))
+	if rpt.percentBase != 0 {
+		label = append(label, fmt.Sprintf("Node percentages relative to %s, the cum of functions matching %s", rpt.formatValue(rpt.percentBase), rpt.options.PercentBase))
+	}
 
 	if rpt.total != 0 {
 		if droppedNodes > 0 {
@@ -1229,6 +2707,9 @@ func reportLabels(rpt *Report, shownTotal int64, nodeCount, origCount, droppedNo
 			label = append(label, fmt.Sprintf("Showing top %d nodes out of %d",
 				nodeCount, origCount))
 		}
+		if n := rpt.options.Concentration; n > 0 {
+			label = append(label, concentrationLabels(rpt, nodes, n)...)
+		}
 	}
 
 	// Help new users understand the graph.
@@ -1240,6 +2721,44 @@ func reportLabels(rpt *Report, shownTotal int64, nodeCount, origCount, droppedNo
 	return label
 }
 
+// concentrationLabels returns labels describing how concentrated the flat
+// values of nodes are: the share of the total held by the n nodes with
+// the largest flat values, and the Gini coefficient of the flat values,
+// which ranges from 0 when all nodes are equal to nearly 1 when a single
+// node holds everything. Negative values are counted by magnitude.
+func concentrationLabels(rpt *Report, nodes graph.Nodes, n int) []string {
+	flats := make([]int64, len(nodes))
+	var sum int64
+	for i, node := range nodes {
+		flats[i] = abs64(node.FlatValue())
+		sum += flats[i]
+	}
+	if sum == 0 {
+		return nil
+	}
+	sort.Slice(flats, func(i, j int) bool { return flats[i] > flats[j] })
+
+	n = min(n, len(flats))
+	var top int64
+	for _, v := range flats[:n] {
+		top += v
+	}
+
+	// With the values in ascending order x_1..x_k, the Gini coefficient is
+	// 2*sum(i*x_i)/(k*sum(x_i)) - (k+1)/k.
+	k := float64(len(flats))
+	var weighted float64
+	for i, v := range flats {
+		weighted += (k - float64(i)) * float64(v)
+	}
+	gini := 2*weighted/(k*float64(sum)) - (k+1)/k
+
+	return []string{
+		fmt.Sprintf("Top %d nodes account for %s, %s of %s total", n, rpt.formatValue(top), strings.TrimSpace(measurement.Percentage(top, rpt.total)), rpt.formatValue(rpt.total)),
+		fmt.Sprintf("Concentration (Gini) index of flat values: %.2f", gini),
+	}
+}
+
 func legendActiveFilters(activeFilters []string) []string {
 	legendActiveFilters := make([]string, len(activeFilters)+1)
 	legendActiveFilters[0] = "Active filters:"
@@ -1269,8 +2788,50 @@ func New(prof *profile.Profile, o *Options) *Report {
 		}
 		return measurement.ScaledLabel(v, o.SampleUnit, o.OutputUnit)
 	}
-	return &Report{prof, computeTotal(prof, o.SampleValue, o.SampleMeanDivisor),
-		o, format}
+	rpt := &Report{
+		prof:        prof,
+		total:       computeTotal(prof, o.SampleValue, o.SampleMeanDivisor),
+		options:     o,
+		formatValue: format,
+		sourceCount: countSources(prof),
+	}
+	// The source of each sample is kept aside, so that it does not show up
+	// in any output.
+	rpt.splitSources()
+	// Only text reports use the base profiles of ratio comparisons, once
+	// the samples are filtered. Other reports drop them right away, so that
+	// they do not show up in outputs built from the samples, such as traces
+	// or protos.
+	if o.OutputFormat != Text {
+		rpt.splitRatioBase()
+	}
+	if o.PercentBase != nil {
+		base := &profile.Profile{Sample: samplesMatching(prof, o.PercentBase)}
+		if total := computeTotal(base, o.SampleValue, o.SampleMeanDivisor); total != 0 {
+			rpt.percentBase = total
+		} else {
+			rpt.warnings = append(rpt.warnings, fmt.Sprintf("percent_base: no samples match %q; percentages are relative to the profile total", o.PercentBase))
+		}
+	}
+	return rpt
+}
+
+// samplesMatching returns the samples of prof with a function matching rx
+// anywhere in their stack.
+func samplesMatching(prof *profile.Profile, rx *regexp.Regexp) []*profile.Sample {
+	var samples []*profile.Sample
+	for _, s := range prof.Sample {
+	stack:
+		for _, loc := range s.Location {
+			for _, ln := range loc.Line {
+				if ln.Function != nil && rx.MatchString(ln.Function.Name) {
+					samples = append(samples, s)
+					break stack
+				}
+			}
+		}
+	}
+	return samples
 }
 
 // NewDefault builds a new report indexing the last sample value
@@ -1291,10 +2852,14 @@ func NewDefault(prof *profile.Profile, options Options) *Report {
 
 // computeTotal computes the sum of the absolute value of all sample values.
 // If any samples have label indicating they belong to the diff base, then the
-// total will only include samples with that label.
+// total will only include samples with that label. Samples of the base
+// profiles of ratio comparisons are not included.
 func computeTotal(prof *profile.Profile, value, meanDiv func(v []int64) int64) int64 {
 	var div, total, diffDiv, diffTotal int64
 	for _, sample := range prof.Sample {
+		if sample.HasLabel(ratioBaseLabel, "true") {
+			continue
+		}
 		var d, v int64
 		v = value(sample.Value)
 		if meanDiv != nil {
@@ -1327,11 +2892,56 @@ type Report struct {
 	total       int64
 	options     *Options
 	formatValue func(int64) string
+	warnings    []string
+
+	// ratioBase holds the samples of the base profiles of a ratio
+	// comparison, moved out of prof by New, or when building the first
+	// graph of a text report.
+	ratioBase *profile.Profile
+
+	// labelMetrics holds the values of the Options.LabelMetrics labels of
+	// each sample, saved before building the first graph drops them.
+	labelMetrics map[*profile.Sample]map[string]int64
+
+	// sourceCount is the number of source profiles the samples were
+	// merged from, if they are marked with sourceLabel, counted before
+	// any filtering. sampleSources holds the source of each sample, saved
+	// by New, which drops the label.
+	sourceCount   int
+	sampleSources map[*profile.Sample]string
+
+	// baseSamples holds the samples of the base profiles of a diff
+	// comparison, marked with baseLabel, saved before building the first
+	// graph drops the label. It is only set if Options.SampleCountDiff is.
+	baseSamples map[*profile.Sample]bool
+
+	// percentBase is the cum value of the Options.PercentBase functions,
+	// which the flat and cum percentages of nodes are relative to instead
+	// of total, or 0 if there is none.
+	percentBase int64
 }
 
 // Total returns the total number of samples in a report.
 func (rpt *Report) Total() int64 { return rpt.total }
 
+// percentTotal returns the value the flat and cum percentages of nodes
+// are relative to.
+func (rpt *Report) percentTotal() int64 {
+	if rpt.percentBase != 0 {
+		return rpt.percentBase
+	}
+	return rpt.total
+}
+
+// Warnings returns the warnings raised while generating the report, such
+// as loss of precision in the output.
+func (rpt *Report) Warnings() []string { return rpt.warnings }
+
+// SampleType returns the type and unit of the sample values of the report.
+func (rpt *Report) SampleType() (typ, unit string) {
+	return rpt.options.SampleType, rpt.options.SampleUnit
+}
+
 // OutputFormat returns the output format for the report.
 func (rpt *Report) OutputFormat() int { return rpt.options.OutputFormat }
 
@@ -16,18 +16,24 @@ package report
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/pprof/internal/binutils"
 	"github.com/google/pprof/internal/graph"
+	"github.com/google/pprof/internal/plugin"
 	"github.com/google/pprof/internal/proftest"
 	"github.com/google/pprof/profile"
 )
@@ -76,7 +82,7 @@ func TestSource(t *testing.T) {
 		},
 	} {
 		var b bytes.Buffer
-		if err := Generate(&b, tc.rpt, &binutils.Binutils{}); err != nil {
+		if err := Generate(context.Background(), &b, tc.rpt, &binutils.Binutils{}); err != nil {
 			t.Fatalf("%s: %v", tc.want, err)
 		}
 
@@ -135,7 +141,7 @@ func TestFilter(t *testing.T) {
 			})
 
 			var buf bytes.Buffer
-			err := Generate(&buf, rpt, &binutils.Binutils{})
+			err := Generate(context.Background(), &buf, rpt, &binutils.Binutils{})
 			if err == nil {
 				t.Fatalf("Generate got nil, want error; buf = %s", buf.String())
 			}
@@ -545,12 +551,157 @@ func TestPrintAssemblyErrorMessage(t *testing.T) {
 			},
 		)
 
-		if err := PrintAssembly(os.Stdout, rpt, &binutils.Binutils{}, -1); err == nil || err.Error() != tc.want {
+		if err := PrintAssembly(context.Background(), os.Stdout, rpt, &binutils.Binutils{}, -1); err == nil || err.Error() != tc.want {
 			t.Errorf(`Got "%v", want %q`, err, tc.want)
 		}
 	}
 }
 
+func TestPrintAssemblyAddressRange(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("disassembly only tested on x86-64 linux")
+	}
+	profile := readProfile(filepath.Join("testdata", "sample.cpu"), t)
+	disasm := func(symbol string) (string, error) {
+		rpt := New(profile.Copy(), &Options{
+			OutputFormat: Dis,
+			Symbol:       regexp.MustCompile(symbol),
+			SampleValue:  func(v []int64) int64 { return v[1] },
+			SampleUnit:   profile.SampleType[1].Unit,
+		})
+		var buf bytes.Buffer
+		err := PrintAssembly(context.Background(), &buf, rpt, &binutils.Binutils{}, -1)
+		return buf.String(), err
+	}
+
+	// main.busyLoop spans 0x4b4310-0x4b45bf.
+	out, err := disasm("0x4b4400-0x4b4440")
+	if err != nil {
+		t.Fatalf("PrintAssembly: %v", err)
+	}
+	if got := strings.Count(out, "ROUTINE"); got != 1 || !strings.Contains(out, "ROUTINE ======================== main.busyLoop\n") {
+		t.Errorf("got %d routines, want only main.busyLoop:\n%s", got, out)
+	}
+	addrRx := regexp.MustCompile(`(?m)^\s+\S+\s+\S+\s+\S+\s+([0-9a-f]+): `)
+	var addrs []uint64
+	for _, m := range addrRx.FindAllStringSubmatch(out, -1) {
+		a, err := strconv.ParseUint(m[1], 16, 64)
+		if err != nil {
+			t.Fatalf("bad address %q: %v", m[1], err)
+		}
+		addrs = append(addrs, a)
+	}
+	if len(addrs) == 0 {
+		t.Fatalf("no instructions in output:\n%s", out)
+	}
+	for _, a := range addrs {
+		if a < 0x4b4400 || a >= 0x4b4440 {
+			t.Errorf("got instruction at %#x, want only instructions in [0x4b4400, 0x4b4440)", a)
+		}
+	}
+	if !strings.Contains(out, "1.37s     4b4421: callq") {
+		t.Errorf("output does not contain the sampled call at 0x4b4421:\n%s", out)
+	}
+
+	if _, err := disasm("0xffff0000-0xffff1000"); err == nil || err.Error() != "no matches found for address range 0xffff0000-0xffff1000" {
+		t.Errorf("got error %v for a range outside the binary", err)
+	}
+}
+
+// fakeDisasmObj is an object tool for a binary holding the functions hot,
+// at [0x1000, 0x1005), and cold, at [0x1100, 0x1103).
+type fakeDisasmObj struct{}
+
+func (fakeDisasmObj) Open(file string, start, limit, offset uint64, relocationSymbol string) (plugin.ObjFile, error) {
+	return fakeDisasmFile{file}, nil
+}
+
+func (fakeDisasmObj) Disasm(file string, start, end uint64, intelSyntax bool) ([]plugin.Inst, error) {
+	var insts []plugin.Inst
+	for _, fn := range []struct {
+		name  string
+		start uint64
+		n     int
+	}{{"hot", 0x1000, 5}, {"cold", 0x1100, 3}} {
+		for i := 0; i < fn.n; i++ {
+			addr := fn.start + uint64(i)
+			if addr >= start && addr <= end {
+				insts = append(insts, plugin.Inst{Addr: addr, Text: fmt.Sprintf("op%d", i), Function: fn.name, File: "prog.c", Line: i + 1})
+			}
+		}
+	}
+	return insts, nil
+}
+
+type fakeDisasmFile struct{ name string }
+
+func (f fakeDisasmFile) Name() string                                 { return f.name }
+func (fakeDisasmFile) ObjAddr(addr uint64) (uint64, error)            { return addr, nil }
+func (fakeDisasmFile) BuildID() string                                { return "" }
+func (fakeDisasmFile) SourceLine(addr uint64) ([]plugin.Frame, error) { return nil, nil }
+func (fakeDisasmFile) Close() error                                   { return nil }
+
+func (f fakeDisasmFile) Symbols(r *regexp.Regexp, addr uint64) ([]*plugin.Sym, error) {
+	var syms []*plugin.Sym
+	for _, s := range []*plugin.Sym{
+		{Name: []string{"hot"}, File: f.name, Start: 0x1000, End: 0x1005},
+		{Name: []string{"cold"}, File: f.name, Start: 0x1100, End: 0x1103},
+	} {
+		if (r == nil || r.MatchString(s.Name[0])) && (addr == 0 || s.Start <= addr && addr <= s.End) {
+			syms = append(syms, s)
+		}
+	}
+	return syms, nil
+}
+
+func TestPrintAssemblyPercentages(t *testing.T) {
+	m := &profile.Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "prog", HasFunctions: true}
+	hot := &profile.Function{ID: 1, Name: "hot", Filename: "prog.c"}
+	cold := &profile.Function{ID: 2, Name: "cold", Filename: "prog.c"}
+	var locs []*profile.Location
+	loc := func(addr uint64, fn *profile.Function) *profile.Location {
+		l := &profile.Location{ID: uint64(len(locs) + 1), Mapping: m, Address: addr, Line: []profile.Line{{Function: fn}}}
+		locs = append(locs, l)
+		return l
+	}
+	hot0, hot2, hot4, cold1 := loc(0x1000, hot), loc(0x1002, hot), loc(0x1004, hot), loc(0x1101, cold)
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			// hot has flat values only, and cold only cum values.
+			{Location: []*profile.Location{hot0, cold1}, Value: []int64{60}},
+			{Location: []*profile.Location{hot2, cold1}, Value: []int64{30}},
+			{Location: []*profile.Location{hot4}, Value: []int64{10}},
+		},
+		Mapping:  []*profile.Mapping{m},
+		Location: locs,
+		Function: []*profile.Function{hot, cold},
+	}
+	rpt := New(prof, &Options{
+		OutputFormat: Dis,
+		Symbol:       regexp.MustCompile("hot|cold"),
+		SampleValue:  func(v []int64) int64 { return v[0] },
+		SampleUnit:   "count",
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, fakeDisasmObj{}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	const golden = "testdata/disasm.rpt"
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%s: %v", golden, err)
+	}
+	if got := buf.String(); got != string(want) {
+		d, err := proftest.Diff(want, []byte(got))
+		if err != nil {
+			t.Fatalf("diff: %v", err)
+		}
+		t.Errorf("disasm output differs from %s:\n%s", golden, d)
+	}
+}
+
 func TestDocURL(t *testing.T) {
 	type testCase struct {
 		input string
@@ -615,3 +766,1652 @@ func TestProfileLabels(t *testing.T) {
 		t.Errorf("wanted to find a label containing %q, but found none in %v", want, labels)
 	}
 }
+
+func TestTextItemsNameSort(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		nameSort bool
+		want     []string
+	}{
+		{
+			name: "default value order",
+			want: []string{"tee", "bar", "main", "foo"},
+		},
+		{
+			name:     "name order",
+			nameSort: true,
+			want:     []string{"bar", "foo", "main", "tee"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prof := testProfile.Copy()
+			if err := prof.Aggregate(true, true, false, false, false, false); err != nil {
+				t.Fatalf("Aggregate: %v", err)
+			}
+			rpt := New(prof, &Options{
+				OutputFormat: Text,
+				NameSort:     tc.nameSort,
+				SampleValue:  func(v []int64) int64 { return v[1] },
+				SampleUnit:   testProfile.SampleType[1].Unit,
+			})
+			items, _ := TextItems(context.Background(), rpt)
+			var got []string
+			for _, item := range items {
+				got = append(got, item.Name)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("TextItems() names = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOneLine(t *testing.T) {
+	prof := testProfile.Copy()
+	if err := prof.Aggregate(true, true, false, false, false, false); err != nil {
+		t.Fatalf("Aggregate: %v", err)
+	}
+	rpt := New(prof, &Options{
+		OutputFormat: OneLine,
+		OutputUnit:   "minimum",
+		SampleValue:  func(v []int64) int64 { return v[1] },
+		SampleUnit:   testProfile.SampleType[1].Unit,
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if got, want := buf.String(), "total=11111cycles top=tee:11100cycles samples=5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOtherNode(t *testing.T) {
+	textItems := func(nodeCount int, other bool) []TextItem {
+		prof := testProfile.Copy()
+		if err := prof.Aggregate(true, true, false, false, false, false); err != nil {
+			t.Fatalf("Aggregate: %v", err)
+		}
+		rpt := New(prof, &Options{
+			OutputFormat: Text,
+			NodeCount:    nodeCount,
+			OtherNode:    other,
+			SampleValue:  func(v []int64) int64 { return v[1] },
+			SampleUnit:   testProfile.SampleType[1].Unit,
+		})
+		items, _ := TextItems(context.Background(), rpt)
+		return items
+	}
+
+	all := textItems(0, true)
+	for _, item := range all {
+		if item.Name == otherNodeName {
+			t.Errorf("got %s node with no trimmed nodes", otherNodeName)
+		}
+	}
+
+	const nodeCount = 2
+	trimmed := textItems(nodeCount, true)
+	if got, want := len(trimmed), nodeCount+1; got != want {
+		t.Fatalf("got %d nodes, want %d", got, want)
+	}
+	kept := make(map[string]bool)
+	var other *TextItem
+	for i, item := range trimmed {
+		if item.Name == otherNodeName {
+			other = &trimmed[i]
+			continue
+		}
+		kept[item.Name] = true
+	}
+	if other == nil {
+		t.Fatalf("got no %s node", otherNodeName)
+	}
+	var dropped int64
+	for _, item := range all {
+		if !kept[item.Name] {
+			dropped += item.Flat
+		}
+	}
+	if dropped == 0 {
+		t.Fatal("test profile has no flat value in dropped nodes")
+	}
+	if other.Flat != dropped || other.Cum != dropped {
+		t.Errorf("got %s node with flat %d, cum %d, want %d for both", otherNodeName, other.Flat, other.Cum, dropped)
+	}
+
+	if items := textItems(nodeCount, false); len(items) != nodeCount {
+		t.Errorf("got %d nodes without OtherNode, want %d", len(items), nodeCount)
+	}
+}
+
+func TestDropAddressOnly(t *testing.T) {
+	addrOnly := &profile.Location{ID: 7, Mapping: testM[0], Address: 0x1000}
+	newProfile := func() *profile.Profile {
+		p := makeTestProfile(
+			// Address-only leaf called from a symbolized stack.
+			testSample(100, addrOnly, testL[2], testL[0]),
+			// Stack made up only of an address-only location.
+			testSample(10, addrOnly),
+			testSample(1, testL[0]),
+		)
+		p.Location = append(append([]*profile.Location{}, testL...), addrOnly)
+		return p
+	}
+
+	for _, tc := range []struct {
+		name     string
+		drop     bool
+		wantFlat map[string]int64
+		wantLen  int
+	}{
+		{
+			name:     "kept",
+			wantFlat: map[string]int64{"bar": 0, "main": 1},
+			wantLen:  3,
+		},
+		{
+			name:     "dropped",
+			drop:     true,
+			wantFlat: map[string]int64{"bar": 100, "main": 1},
+			wantLen:  2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rpt := New(newProfile(), &Options{
+				OutputFormat:    Text,
+				DropAddressOnly: tc.drop,
+				SampleValue:     func(v []int64) int64 { return v[0] },
+				SampleUnit:      "count",
+			})
+			items, _ := TextItems(context.Background(), rpt)
+			if len(items) != tc.wantLen {
+				t.Errorf("got %d items %v, want %d", len(items), items, tc.wantLen)
+			}
+			for _, item := range items {
+				fn, _, _ := strings.Cut(item.Name, " ")
+				if want, ok := tc.wantFlat[fn]; ok && item.Flat != want {
+					t.Errorf("flat of %s = %d, want %d", item.Name, item.Flat, want)
+				}
+			}
+			// Address-only samples remain in the total either way.
+			if got, want := rpt.Total(), int64(111); got != want {
+				t.Errorf("total = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFoldMappingCase(t *testing.T) {
+	newProfile := func() *profile.Profile {
+		// The same DLL, loaded by two processes with a different case.
+		m1 := &profile.Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: `C:\Windows\System32\KERNEL32.DLL`}
+		m2 := &profile.Mapping{ID: 2, Start: 0x1000, Limit: 0x2000, File: `c:\windows\system32\kernel32.dll`}
+		l1 := &profile.Location{ID: 1, Mapping: m1, Address: 0x1100}
+		l2 := &profile.Location{ID: 2, Mapping: m2, Address: 0x1100}
+		p := makeTestProfile(testSample(10, l1), testSample(20, l2))
+		p.Mapping = []*profile.Mapping{m1, m2}
+		p.Location = []*profile.Location{l1, l2}
+		return p
+	}
+
+	for _, tc := range []struct {
+		fold bool
+		want []int64
+	}{
+		{false, []int64{20, 10}},
+		{true, []int64{30}},
+	} {
+		rpt := New(newProfile(), &Options{
+			OutputFormat:    Text,
+			FoldMappingCase: tc.fold,
+			SampleValue:     func(v []int64) int64 { return v[0] },
+			SampleUnit:      "count",
+		})
+		items, _ := TextItems(context.Background(), rpt)
+		var got []int64
+		for _, item := range items {
+			got = append(got, item.Flat)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("FoldMappingCase=%v: got flat values %v, want %v", tc.fold, got, tc.want)
+		}
+		if tc.fold && !strings.Contains(items[0].Name, "KERNEL32.DLL") {
+			t.Errorf("FoldMappingCase=%v: got item %s, want the name of the first mapping", tc.fold, items[0].Name)
+		}
+	}
+}
+
+func TestTracesTimestamps(t *testing.T) {
+	newProfile := func() *profile.Profile {
+		p := makeTestProfile(
+			testSample(10, testL[1], testL[0]),
+			testSample(20, testL[0]),
+		)
+		p.Sample[0].NumLabel = map[string][]int64{"timestamp": {1700000000123456789}}
+		p.Sample[1].NumLabel = map[string][]int64{"timestamp": {1700000001000000000}}
+		return p
+	}
+	for _, tc := range []struct {
+		desc       string
+		timestamps bool
+		units      map[string]string // Overrides the units of the profile.
+		want       []string
+		notWant    []string
+	}{
+		{
+			desc:       "with timestamps",
+			timestamps: true,
+			want: []string{
+				"      time:  2023-11-14T22:13:20.123456789Z\n",
+				"      time:  2023-11-14T22:13:21Z\n",
+			},
+			notWant: []string{"timestamp:"},
+		},
+		{
+			desc:       "with timestamps in an unknown unit",
+			timestamps: true,
+			units:      map[string]string{"timestamp": "furlongs"},
+			want:       []string{" timestamp:  "},
+			notWant:    []string{"time:  "},
+		},
+		{
+			desc:    "without timestamps",
+			want:    []string{" timestamp:  "},
+			notWant: []string{"time:  "},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := newProfile()
+			// Units as identified by the driver.
+			units, _ := p.NumLabelUnits()
+			if tc.units != nil {
+				units = tc.units
+			}
+			rpt := New(p, &Options{
+				OutputFormat:    Traces,
+				TraceTimestamps: tc.timestamps,
+				NumLabelUnits:   units,
+				SampleValue:     func(v []int64) int64 { return v[0] },
+				SampleUnit:      "count",
+			})
+			var buf bytes.Buffer
+			if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			got := buf.String()
+			for _, w := range tc.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("traces output does not contain %q:\n%s", w, got)
+				}
+			}
+			for _, w := range tc.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("traces output unexpectedly contains %q:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceMaxDepth(t *testing.T) {
+	for _, tc := range []struct {
+		depth   int
+		want    []string
+		notWant []string
+	}{
+		{
+			depth: 0,
+			want:  []string{"   foo ", "   bar ", "   tee ", "   main "},
+		},
+		{
+			depth:   2,
+			want:    []string{"   foo ", "   bar ", "      ... (2 more frames)\n"},
+			notWant: []string{"   tee ", "   main "},
+		},
+		{
+			depth:   4,
+			want:    []string{"   main "},
+			notWant: []string{"more frames"},
+		},
+	} {
+		t.Run(fmt.Sprint(tc.depth), func(t *testing.T) {
+			p := makeTestProfile(testSample(10, testL[1], testL[2], testL[3], testL[0]))
+			rpt := New(p, &Options{
+				OutputFormat:  Traces,
+				TraceMaxDepth: tc.depth,
+				SampleValue:   func(v []int64) int64 { return v[0] },
+				SampleUnit:    "count",
+			})
+			var buf bytes.Buffer
+			if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			got := buf.String()
+			for _, w := range tc.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("traces output does not contain %q:\n%s", w, got)
+				}
+			}
+			for _, w := range tc.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("traces output unexpectedly contains %q:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLabelKeys(t *testing.T) {
+	newProfile := func() *profile.Profile {
+		p := makeTestProfile(
+			testSample(10, testL[1], testL[0]),
+			testSample(20, testL[0]),
+		)
+		for _, s := range p.Sample {
+			s.Label = map[string][]string{"key1": {"value1"}, "key2": {"value2"}, "key3": {"value3"}}
+			s.NumLabel = map[string][]int64{"bytes": {1024}}
+		}
+		return p
+	}
+	for name, format := range map[string]int{"traces": Traces, "tags": Tags} {
+		for _, tc := range []struct {
+			desc    string
+			keys    []string
+			want    []string
+			notWant []string
+		}{
+			{
+				desc: "all labels by default",
+				want: []string{"key1", "key2", "key3", "bytes"},
+			},
+			{
+				desc:    "subset",
+				keys:    []string{"key2", "bytes"},
+				want:    []string{"key2", "value2", "bytes"},
+				notWant: []string{"key1", "value1", "key3", "value3"},
+			},
+		} {
+			t.Run(name+"/"+tc.desc, func(t *testing.T) {
+				rpt := New(newProfile(), &Options{
+					OutputFormat:  format,
+					LabelKeys:     tc.keys,
+					NumLabelUnits: map[string]string{"bytes": "bytes"},
+					SampleValue:   func(v []int64) int64 { return v[0] },
+					SampleUnit:    "count",
+				})
+				var buf bytes.Buffer
+				if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+					t.Fatalf("Generate: %v", err)
+				}
+				got := buf.String()
+				for _, w := range tc.want {
+					if !strings.Contains(got, w) {
+						t.Errorf("output does not contain %q:\n%s", w, got)
+					}
+				}
+				for _, w := range tc.notWant {
+					if strings.Contains(got, w) {
+						t.Errorf("output unexpectedly contains %q:\n%s", w, got)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTracesThread(t *testing.T) {
+	newProfile := func() *profile.Profile {
+		p := makeTestProfile(
+			testSample(10, testL[1], testL[0]),
+			testSample(20, testL[0]),
+			testSample(30, testL[2]),
+			testSample(40, testL[1]),
+		)
+		p.Sample[0].Label = map[string][]string{"name": {"s0"}, "thread": {"7"}}
+		p.Sample[1].Label = map[string][]string{"name": {"s1"}, "thread": {"8"}}
+		p.Sample[2].Label = map[string][]string{"name": {"s2"}}
+		p.Sample[2].NumLabel = map[string][]int64{"tid": {7}}
+		p.Sample[3].Label = map[string][]string{"name": {"s3"}, "worker": {"7"}}
+		return p
+	}
+	for _, tc := range []struct {
+		desc    string
+		thread  string
+		label   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			desc: "all samples by default",
+			want: []string{"s0", "s1", "s2", "s3"},
+		},
+		{
+			desc:   "string and numeric default labels",
+			thread: "7",
+			want:   []string{"s0", "s2"},
+		},
+		{
+			desc:   "custom label",
+			thread: "7",
+			label:  "worker",
+			want:   []string{"s3"},
+		},
+		{
+			desc:    "unknown thread",
+			thread:  "9",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rpt := New(newProfile(), &Options{
+				OutputFormat:  Traces,
+				Thread:        tc.thread,
+				ThreadLabel:   tc.label,
+				NumLabelUnits: map[string]string{"tid": ""},
+				SampleValue:   func(v []int64) int64 { return v[0] },
+				SampleUnit:    "count",
+			})
+			var buf bytes.Buffer
+			err := Generate(context.Background(), &buf, rpt, nil)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Generate succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			got := buf.String()
+			for _, name := range []string{"s0", "s1", "s2", "s3"} {
+				if want := slices.Contains(tc.want, name); strings.Contains(got, name) != want {
+					t.Errorf("sample %s shown = %v, want %v:\n%s", name, !want, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRatioBase(t *testing.T) {
+	base := func(s *profile.Sample) *profile.Sample {
+		s.Label = map[string][]string{ratioBaseLabel: {"true"}}
+		return s
+	}
+	newProfile := func() *profile.Profile {
+		return makeTestProfile(
+			testSample(20, testL[1], testL[0]),
+			testSample(10, testL[2], testL[0]),
+			base(testSample(10, testL[1], testL[0])),
+			base(testSample(5, testL[3], testL[0])),
+		)
+	}
+	o := &Options{
+		OutputFormat: Text,
+		SampleValue:  func(v []int64) int64 { return v[0] },
+		SampleUnit:   "count",
+	}
+	rpt := New(newProfile(), o)
+	if got, want := rpt.Total(), int64(30); got != want {
+		t.Errorf("got total %d, want %d", got, want)
+	}
+	items, _ := TextItems(context.Background(), rpt)
+	got := map[string]string{}
+	for _, item := range items {
+		got[strings.Fields(item.Name)[0]] = item.RatioFormat
+	}
+	want := map[string]string{"main": "2.00x", "foo": "2.00x", "bar": "new"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got ratios %v, want %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, New(newProfile(), o), nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !regexp.MustCompile(`(?m)^\s+flat\s+flat%\s+sum%\s+cum\s+cum%\s+ratio$`).MatchString(buf.String()) {
+		t.Errorf("text report has no ratio column:\n%s", buf.String())
+	}
+
+	// Reports built from the samples leave out the base samples.
+	for _, format := range []int{Traces, Tags, Proto} {
+		o := *o
+		o.OutputFormat = format
+		buf.Reset()
+		if err := Generate(context.Background(), &buf, New(newProfile(), &o), nil); err != nil {
+			t.Fatalf("Generate(%d): %v", format, err)
+		}
+		if format == Proto {
+			p, err := profile.Parse(&buf)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if len(p.Sample) != 2 {
+				t.Errorf("proto report: got %d samples, want 2", len(p.Sample))
+			}
+			continue
+		}
+		if got := buf.String(); strings.Contains(got, ratioBaseLabel) || strings.Contains(got, "tee") {
+			t.Errorf("report format %d: got base samples:\n%s", format, got)
+		}
+	}
+}
+
+func TestCallgrindUnit(t *testing.T) {
+	for _, tc := range []struct {
+		unit        string
+		wantEvents  string
+		wantCost    string
+		wantWarning bool
+	}{
+		{"nanoseconds", "events: cpu(nanoseconds)", " 2 1500000\n", false},
+		{"us", "events: cpu(us)", " 2 1500\n", false},
+		{"ms", "events: cpu(ms)", " 2 1\n", true},
+	} {
+		t.Run(tc.unit, func(t *testing.T) {
+			p := makeTestProfile(testSample(1500000, testL[0]))
+			rpt := New(p, &Options{
+				OutputFormat: Callgrind,
+				OutputUnit:   tc.unit,
+				SampleType:   "cpu",
+				SampleValue:  func(v []int64) int64 { return v[0] },
+				SampleUnit:   "nanoseconds",
+			})
+			var buf bytes.Buffer
+			if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			got := buf.String()
+			if !strings.Contains(got, tc.wantEvents+"\n") {
+				t.Errorf("callgrind output does not contain %q:\n%s", tc.wantEvents, got)
+			}
+			if !strings.Contains(got, tc.wantCost) {
+				t.Errorf("callgrind output does not contain cost line %q:\n%s", tc.wantCost, got)
+			}
+			if gotWarning := len(rpt.Warnings()) > 0; gotWarning != tc.wantWarning {
+				t.Errorf("got warnings %q, want warning: %v", rpt.Warnings(), tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestCommentsFirst(t *testing.T) {
+	prof := testProfile.Copy()
+	prof.Comments = []string{"built at rev 1234", "#hidden comment", "host: example"}
+	for _, tc := range []struct {
+		desc          string
+		format        int
+		commentsFirst bool
+		compactLabels bool
+		wantPrefix    string
+		wantAbsent    []string
+	}{
+		{
+			desc:       "comments command",
+			format:     Comments,
+			wantPrefix: "built at rev 1234\n#hidden comment\nhost: example\n",
+		},
+		{
+			desc:          "text",
+			format:        Text,
+			commentsFirst: true,
+			wantPrefix:    "built at rev 1234\nhost: example\nDuration: 10s",
+			wantAbsent:    []string{"#hidden"},
+		},
+		{
+			desc:          "text with compact labels",
+			format:        Text,
+			commentsFirst: true,
+			compactLabels: true,
+			wantPrefix:    "built at rev 1234\nhost: example\nShowing nodes",
+			wantAbsent:    []string{"#hidden", "Duration:"},
+		},
+		{
+			desc:          "text with compact labels and no comments first",
+			format:        Text,
+			compactLabels: true,
+			wantPrefix:    "Showing nodes",
+			wantAbsent:    []string{"built at rev 1234"},
+		},
+		{
+			desc:          "dot",
+			format:        Dot,
+			commentsFirst: true,
+			wantPrefix:    `digraph "testbinary" {` + "\n" + `node [style=filled fillcolor="#f8f8f8"]` + "\n" + `subgraph cluster_L { "built at rev 1234" [`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rpt := New(prof, &Options{
+				OutputFormat:  tc.format,
+				CommentsFirst: tc.commentsFirst,
+				CompactLabels: tc.compactLabels,
+				Title:         "testbinary",
+				SampleValue:   func(v []int64) int64 { return v[1] },
+				SampleUnit:    testProfile.SampleType[1].Unit,
+			})
+			var buf bytes.Buffer
+			if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			got := buf.String()
+			if !strings.HasPrefix(got, tc.wantPrefix) {
+				t.Errorf("got output starting with\n%s\nwant prefix\n%s", got[:min(len(got), 200)], tc.wantPrefix)
+			}
+			for _, s := range tc.wantAbsent {
+				if strings.Contains(got, s) {
+					t.Errorf("output contains %q:\n%s", s, got)
+				}
+			}
+		})
+	}
+}
+
+// fakeObjFile is an object file loaded at base, with the source lines of
+// its addresses (in the object file's address space) given by lines, and
+// the symbols syms.
+type fakeObjFile struct {
+	base  uint64
+	lines map[uint64][]plugin.Frame
+	syms  []*plugin.Sym
+
+	// sourceLines counts the calls to SourceLine.
+	sourceLines int
+}
+
+func (f *fakeObjFile) Name() string    { return "fake.bin" }
+func (f *fakeObjFile) BuildID() string { return "" }
+func (f *fakeObjFile) Close() error    { return nil }
+
+func (f *fakeObjFile) ObjAddr(addr uint64) (uint64, error) {
+	return addr - f.base, nil
+}
+
+func (f *fakeObjFile) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	f.sourceLines++
+	return f.lines[addr-f.base], nil
+}
+
+func (f *fakeObjFile) Symbols(*regexp.Regexp, uint64) ([]*plugin.Sym, error) {
+	return f.syms, nil
+}
+
+func TestAnnotateAssemblyInlined(t *testing.T) {
+	obj := &fakeObjFile{
+		base: 0x1000,
+		lines: map[uint64][]plugin.Frame{
+			0x14: {
+				{Func: "_Z5innerv", File: "/src/inner.go", Line: 42},
+				{Func: "_Z5outerv", File: "/src/outer.go", Line: 6},
+			},
+			0x18: {
+				{Func: "_Z5outerv", File: "/src/outer.go", Line: 7},
+			},
+		},
+	}
+	insts := []plugin.Inst{
+		{Addr: 0x10, Text: "nop", Function: "outer", File: "/src/outer.go", Line: 5},
+		{Addr: 0x14, Text: "add", Function: "outer", File: "/src/outer.go", Line: 6},
+		{Addr: 0x16, Text: "mov", Function: "outer", File: "/src/outer.go", Line: 6},
+		{Addr: 0x18, Text: "ret", Function: "outer", File: "/src/outer.go", Line: 7},
+	}
+	samples := graph.Nodes{
+		{Info: graph.NodeInfo{Address: 0x1014, Name: "outer", File: "/src/outer.go", Lineno: 6}, Flat: 10, Cum: 10},
+		{Info: graph.NodeInfo{Address: 0x1016, Name: "outer", File: "/src/outer.go", Lineno: 6}, Flat: 2, Cum: 2},
+		{Info: graph.NodeInfo{Address: 0x1018, Name: "outer", File: "/src/outer.go", Lineno: 7}, Flat: 1, Cum: 1},
+	}
+	type loc struct {
+		function, file string
+		line           int
+		flat           int64
+	}
+	want := []loc{
+		{"outer", "outer.go", 5, 0},
+		// The innermost inlined frame is preferred, for the whole range of
+		// the line.
+		{"inner", "inner.go", 42, 10},
+		{"inner", "inner.go", 42, 2},
+		// Outside of inlined code, the disassembler's line is kept.
+		{"outer", "outer.go", 7, 1},
+	}
+	names := map[string]string{"_Z5innerv": "inner", "_Z5outerv": "outer"}
+	asm := annotateAssembly(insts, samples, obj, names)
+	if len(asm) != len(want) {
+		t.Fatalf("got %d instructions, want %d", len(asm), len(want))
+	}
+	for i, a := range asm {
+		if got := (loc{a.function, a.file, a.line, a.flat}); got != want[i] {
+			t.Errorf("instruction %#x: got %+v, want %+v", a.address, got, want[i])
+		}
+	}
+	// Once for each of the sampled lines.
+	if obj.sourceLines != 2 {
+		t.Errorf("got %d SourceLine calls, want 2", obj.sourceLines)
+	}
+}
+
+// closableObj is an object tool for a binary holding the function outer,
+// at [0x1010, 0x1018], into which inner is inlined at 0x1014. Its files
+// refuse to look up source lines once closed, like binutils.
+type closableObj struct {
+	files []*closableObjFile
+}
+
+type closableObjFile struct {
+	*fakeObjFile
+	closed bool
+}
+
+func (f *closableObjFile) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	if f.closed {
+		return nil, fmt.Errorf("%s: file is closed", f.Name())
+	}
+	return f.fakeObjFile.SourceLine(addr)
+}
+
+func (f *closableObjFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (o *closableObj) Open(file string, start, limit, offset uint64, relocationSymbol string) (plugin.ObjFile, error) {
+	f := &closableObjFile{fakeObjFile: &fakeObjFile{
+		lines: map[uint64][]plugin.Frame{
+			0x1014: {
+				{Func: "inner", File: "/src/inner.go", Line: 42},
+				{Func: "outer", File: "/src/outer.go", Line: 6},
+			},
+		},
+		syms: []*plugin.Sym{{Name: []string{"outer"}, File: file, Start: 0x1010, End: 0x1018}},
+	}}
+	o.files = append(o.files, f)
+	return f, nil
+}
+
+func (*closableObj) Disasm(file string, start, end uint64, intelSyntax bool) ([]plugin.Inst, error) {
+	return []plugin.Inst{
+		{Addr: 0x1010, Text: "nop", Function: "outer", File: "/src/outer.go", Line: 5},
+		{Addr: 0x1014, Text: "add", Function: "outer", File: "/src/outer.go", Line: 6},
+		{Addr: 0x1018, Text: "ret", Function: "outer", File: "/src/outer.go", Line: 7},
+	}, nil
+}
+
+func TestPrintAssemblyInlined(t *testing.T) {
+	m := &profile.Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "prog", HasFunctions: true}
+	outer := &profile.Function{ID: 1, Name: "outer", Filename: "/src/outer.go"}
+	inner := &profile.Function{ID: 2, Name: "inner", Filename: "/src/inner.go"}
+	l := &profile.Location{ID: 1, Mapping: m, Address: 0x1014, Line: []profile.Line{
+		{Function: inner, Line: 42},
+		{Function: outer, Line: 6},
+	}}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{l}, Value: []int64{10}}},
+		Mapping:    []*profile.Mapping{m},
+		Location:   []*profile.Location{l},
+		Function:   []*profile.Function{outer, inner},
+	}
+	rpt := New(prof, &Options{
+		OutputFormat: Dis,
+		Symbol:       regexp.MustCompile("outer"),
+		SampleValue:  func(v []int64) int64 { return v[0] },
+		SampleUnit:   "count",
+	})
+	obj := &closableObj{}
+	var buf bytes.Buffer
+	if err := PrintAssembly(context.Background(), &buf, rpt, obj, -1); err != nil {
+		t.Fatalf("PrintAssembly: %v", err)
+	}
+	// The source lines are looked up before the binary is closed.
+	if got := buf.String(); !strings.Contains(got, ";inner inner.go:42") {
+		t.Errorf("output does not attribute 0x1014 to inner:\n%s", got)
+	}
+	for _, f := range obj.files {
+		if !f.closed {
+			t.Errorf("file %s left open", f.Name())
+		}
+	}
+}
+
+func TestPercentBase(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		base        *regexp.Regexp
+		wantLines   []string
+		wantWarning bool
+	}{
+		{
+			desc: "profile total",
+			wantLines: []string{
+				"Showing nodes accounting for 11111, 100% of 11111 total",
+				"10  0.09%   100%        110  0.99%  bar testdata/source1:10",
+				"0     0%   100%         10  0.09%  foo testdata/source1:4:4",
+			},
+		},
+		{
+			desc: "base node",
+			base: regexp.MustCompile("^bar$"),
+			wantLines: []string{
+				"Showing nodes accounting for 11111, 100% of 11111 total",
+				"Node percentages relative to 110, the cum of functions matching ^bar$",
+				"10  9.09%   100%        110   100%  bar testdata/source1:10",
+				"0     0%   100%         10  9.09%  foo testdata/source1:4:4",
+			},
+		},
+		{
+			desc: "no matching node",
+			base: regexp.MustCompile("nomatch"),
+			wantLines: []string{
+				"Showing nodes accounting for 11111, 100% of 11111 total",
+			},
+			wantWarning: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rpt := New(testProfile.Copy(), &Options{
+				OutputFormat: Text,
+				PercentBase:  tc.base,
+				SampleValue:  func(v []int64) int64 { return v[1] },
+				SampleUnit:   testProfile.SampleType[1].Unit,
+			})
+			var buf bytes.Buffer
+			if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			for _, want := range tc.wantLines {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("output does not contain %q:\n%s", want, buf.String())
+				}
+			}
+			if got := len(rpt.Warnings()) > 0; got != tc.wantWarning {
+				t.Errorf("got warnings %q, want warning: %v", rpt.Warnings(), tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestD3JSON(t *testing.T) {
+	prof := testProfile.Copy()
+	if err := prof.Aggregate(true, true, false, false, false, false); err != nil {
+		t.Fatalf("Aggregate: %v", err)
+	}
+	rpt := New(prof, &Options{
+		OutputFormat: D3JSON,
+		Title:        "testbinary",
+		SampleValue:  func(v []int64) int64 { return v[1] },
+		SampleUnit:   testProfile.SampleType[1].Unit,
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	var got d3Node
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+
+	// Functions reached through several call paths, such as tee and bar,
+	// have a node under each of them.
+	want := d3Node{Name: "testbinary", Children: []*d3Node{
+		{Name: "main", Value: 1, Children: []*d3Node{
+			{Name: "tee", Value: 1000, Children: []*d3Node{
+				{Name: "tee", Value: 10000},
+			}},
+			{Name: "bar", Children: []*d3Node{
+				{Name: "tee", Value: 100},
+			}},
+			{Name: "foo", Children: []*d3Node{
+				{Name: "bar", Value: 10},
+			}},
+		}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got hierarchy\n%s\nwant the same as\n%+v", buf.String(), want)
+	}
+}
+
+func TestD3JSONSampleIndices(t *testing.T) {
+	rpt := New(testProfile.Copy(), &Options{
+		OutputFormat:  D3JSON,
+		SampleIndices: true,
+		SampleValue:   func(v []int64) int64 { return v[1] },
+		SampleUnit:    testProfile.SampleType[1].Unit,
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	var got d3Node
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if len(got.Children) != 1 {
+		t.Fatalf("got %d roots, want 1:\n%s", len(got.Children), buf.String())
+	}
+	// main is on the stack of every sample, foo only on the second one.
+	main := got.Children[0]
+	if want := []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(main.Samples, want) {
+		t.Errorf("samples of %s: got %v, want %v", main.Name, main.Samples, want)
+	}
+	for _, c := range main.Children {
+		if c.Name == "foo" {
+			if want := []int{1}; !reflect.DeepEqual(c.Samples, want) {
+				t.Errorf("samples of %s: got %v, want %v", c.Name, c.Samples, want)
+			}
+		}
+	}
+}
+
+func TestTagsCum(t *testing.T) {
+	prof := makeTestProfile(
+		// Three nodes on the stack: main, foo and bar.
+		&profile.Sample{
+			Location: []*profile.Location{testL[2], testL[1], testL[0]},
+			Value:    []int64{10},
+			Label:    map[string][]string{"key": {"deep"}},
+		},
+		&profile.Sample{
+			Location: []*profile.Location{testL[0]},
+			Value:    []int64{15},
+			Label:    map[string][]string{"key": {"shallow"}},
+		},
+	)
+	for _, tc := range []struct {
+		cum  bool
+		want string
+	}{
+		{
+			cum: false,
+			want: " key: Total 25.0\n" +
+				"      15.0 (60.00%): shallow\n" +
+				"      10.0 (40.00%): deep\n\n",
+		},
+		{
+			cum: true,
+			want: " key:     Total 25.0 Cum 45.0\n" +
+				"      15.0 (60.00%):  15.0 (33.33%): shallow\n" +
+				"      10.0 (40.00%):  30.0 (66.67%): deep\n\n",
+		},
+	} {
+		rpt := New(prof.Copy(), &Options{
+			OutputFormat: Tags,
+			TagsCum:      tc.cum,
+			SampleValue:  func(v []int64) int64 { return v[0] },
+			SampleUnit:   "count",
+			OutputUnit:   "minimum",
+		})
+		var buf bytes.Buffer
+		if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("tags report with cum=%v:\ngot:\n%q\nwant:\n%q", tc.cum, got, tc.want)
+		}
+	}
+}
+
+func TestConcentration(t *testing.T) {
+	prof := makeTestProfile(
+		&profile.Sample{
+			Location: []*profile.Location{testL[0]},
+			Value:    []int64{60},
+		},
+		&profile.Sample{
+			Location: []*profile.Location{testL[1], testL[0]},
+			Value:    []int64{30},
+		},
+		&profile.Sample{
+			Location: []*profile.Location{testL[2], testL[1], testL[0]},
+			Value:    []int64{10},
+		},
+	)
+	for _, tc := range []struct {
+		n    int
+		want []string
+	}{
+		{0, nil},
+		{1, []string{"Top 1 nodes account for 60, 60.00% of 100 total", "Concentration (Gini) index of flat values: 0.33"}},
+		{2, []string{"Top 2 nodes account for 90, 90.00% of 100 total", "Concentration (Gini) index of flat values: 0.33"}},
+		{10, []string{"Top 3 nodes account for 100, 100% of 100 total", "Concentration (Gini) index of flat values: 0.33"}},
+	} {
+		rpt := New(prof.Copy(), &Options{
+			OutputFormat:  Text,
+			Concentration: tc.n,
+			SampleValue:   func(v []int64) int64 { return v[0] },
+			SampleUnit:    "count",
+			OutputUnit:    "minimum",
+		})
+		_, labels := TextItems(context.Background(), rpt)
+		var got []string
+		for _, l := range labels {
+			if strings.HasPrefix(l, "Top ") || strings.HasPrefix(l, "Concentration ") {
+				got = append(got, l)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("concentration %d: got labels %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestLabelMetrics(t *testing.T) {
+	prof := makeTestProfile(
+		&profile.Sample{
+			Location: []*profile.Location{testL[1], testL[0]},
+			Value:    []int64{10},
+			NumLabel: map[string][]int64{"cache_misses": {1000}, "bytes": {64}},
+		},
+		&profile.Sample{
+			Location: []*profile.Location{testL[2], testL[0]},
+			Value:    []int64{20},
+			NumLabel: map[string][]int64{"cache_misses": {3000}},
+		},
+		&profile.Sample{
+			Location: []*profile.Location{testL[0]},
+			Value:    []int64{5},
+		},
+	)
+	o := &Options{
+		OutputFormat: Text,
+		LabelMetrics: []string{"cache_misses"},
+		SampleValue:  func(v []int64) int64 { return v[0] },
+		SampleUnit:   "count",
+	}
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, New(prof.Copy(), o), nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	for _, want := range []string{
+		"flat  flat%   sum%        cum   cum% cache_misses",
+		"20 57.14% 57.14%         20 57.14%       3000  bar",
+		"10 28.57% 85.71%         10 28.57%       1000  foo",
+		"5 14.29%   100%         35   100%       4000  main",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("text report: want line with %q, got:\n%s", want, buf.String())
+		}
+	}
+
+	o.FlatOnly = true
+	buf.Reset()
+	if err := Generate(context.Background(), &buf, New(prof.Copy(), o), nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if want := "5 14.29%   100%          0  main"; !strings.Contains(buf.String(), want) {
+		t.Errorf("flat-only text report: want line with %q, got:\n%s", want, buf.String())
+	}
+
+	o.FlatOnly = false
+	o.OutputFormat = Dot
+	buf.Reset()
+	if err := Generate(context.Background(), &buf, New(prof.Copy(), o), nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if want := `of 35 (100%)\ncache_misses: 4000"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("DOT report: want label with %q, got:\n%s", want, buf.String())
+	}
+	// The bytes label is still shown as a tag.
+	if !strings.Contains(buf.String(), `label = "64"`) {
+		t.Errorf("DOT report: want bytes tag, got:\n%s", buf.String())
+	}
+}
+
+func TestSourceStats(t *testing.T) {
+	sample := func(src string, v int64, locs ...*profile.Location) *profile.Sample {
+		return &profile.Sample{
+			Location: locs,
+			Value:    []int64{v},
+			Label:    map[string][]string{sourceLabel: {src}},
+		}
+	}
+	prof := makeTestProfile(
+		sample("0", 10, testL[1], testL[0]),
+		sample("1", 20, testL[1], testL[0]),
+		sample("2", 30, testL[1], testL[0]),
+		sample("0", 4, testL[2], testL[0]),
+		sample("1", 4, testL[2], testL[0]),
+		sample("2", 4, testL[2], testL[0]),
+		sample("0", 9, testL[0]),
+	)
+	o := &Options{
+		OutputFormat: Text,
+		SampleValue:  func(v []int64) int64 { return v[0] },
+		SampleUnit:   "count",
+	}
+	items, labels := TextItems(context.Background(), New(prof.Copy(), o))
+	got := make(map[string][2]string)
+	for _, item := range items {
+		name := strings.Fields(item.Name)[0]
+		got[name] = [2]string{item.SourceMeanFormat, item.SourceStdErrFormat}
+	}
+	// The cum values of main are 23, 24 and 34 in the sources.
+	want := map[string][2]string{
+		"foo":  {"20", "6"},
+		"bar":  {"4", "0"},
+		"main": {"27", "4"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got mean and standard error %v, want %v", got, want)
+	}
+	if want := "Source stats: mean and standard error across 3 source profiles"; !slices.Contains(labels, want) {
+		t.Errorf("got labels %q, want %q", labels, want)
+	}
+
+	// Flat values of main are 9, 0 and 0.
+	o.FlatOnly = true
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, New(prof.Copy(), o), nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	for _, want := range []string{
+		"flat  flat%   sum%   src mean src stderr",
+		"9 11.11%   100%          3          3  main",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("flat-only text report: want line with %q, got:\n%s", want, buf.String())
+		}
+	}
+
+	// The label is not shown by any report.
+	o.FlatOnly = false
+	for _, format := range []int{Dot, Traces, Tags, Raw, Proto} {
+		o.OutputFormat = format
+		buf.Reset()
+		if err := Generate(context.Background(), &buf, New(prof.Copy(), o), nil); err != nil {
+			t.Fatalf("Generate(%d): %v", format, err)
+		}
+		got := buf.String()
+		if format == Proto {
+			p, err := profile.Parse(&buf)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			got = p.String()
+		}
+		if strings.Contains(got, sourceLabel) {
+			t.Errorf("report format %d: got source labels:\n%s", format, got)
+		}
+	}
+}
+
+func TestNoInlineLabels(t *testing.T) {
+	// foo is inlined into main at one address and called at another.
+	inlined := &profile.Location{
+		ID:      10,
+		Mapping: testM[0],
+		Line:    []profile.Line{{Function: testF[1], Line: 4}, {Function: testF[0], Line: 2}},
+	}
+	called := &profile.Location{ID: 11, Mapping: testM[0], Line: []profile.Line{{Function: testF[1], Line: 4}}}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{inlined}, Value: []int64{10}},
+			{Location: []*profile.Location{called, testL[0]}, Value: []int64{5}},
+		},
+		Location: []*profile.Location{inlined, called, testL[0]},
+		Function: testF,
+		Mapping:  testM,
+	}
+	for _, tc := range []struct {
+		format         int
+		noInlineLabels bool
+		want           string
+	}{
+		{Text, false, "(partial-inline)"},
+		{Text, true, ""},
+		{Traces, false, "(inline)"},
+		{Traces, true, ""},
+		{Tree, false, "(inline)"},
+		{Tree, true, ""},
+	} {
+		o := &Options{
+			OutputFormat:   tc.format,
+			NoInlineLabels: tc.noInlineLabels,
+			SampleValue:    func(v []int64) int64 { return v[0] },
+			SampleUnit:     "count",
+		}
+		var buf bytes.Buffer
+		if err := Generate(context.Background(), &buf, New(prof.Copy(), o), nil); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		got := buf.String()
+		if tc.want != "" && !strings.Contains(got, tc.want) {
+			t.Errorf("format %d: want %s suffix, got:\n%s", tc.format, tc.want, got)
+		}
+		if tc.noInlineLabels && strings.Contains(got, "inline)") {
+			t.Errorf("format %d with NoInlineLabels: got inline suffixes:\n%s", tc.format, got)
+		}
+	}
+}
+
+// trimmedGraphSummary describes the nodes of a graph shown by text reports.
+// Text reports do not show the number of dropped edges.
+func trimmedGraphSummary(g *graph.Graph, origCount, droppedNodes, _ int) []string {
+	summary := []string{fmt.Sprintf("orig=%d dropped=%d", origCount, droppedNodes)}
+	for _, n := range g.Nodes {
+		var inline, noinline bool
+		for _, e := range n.In {
+			if e.Inline {
+				inline = true
+			} else {
+				noinline = true
+			}
+		}
+		summary = append(summary, fmt.Sprintf("%s flat=%d/%d cum=%d/%d inline=%v noinline=%v",
+			n.Info.PrintableName(), n.Flat, n.FlatDiv, n.Cum, n.CumDiv, inline, noinline))
+	}
+	return summary
+}
+
+func TestTextNodesOnly(t *testing.T) {
+	base := testProfile.Copy()
+	base.Scale(-2)
+	diff, err := profile.Merge([]*profile.Profile{testProfile.Copy(), base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc string
+		prof *profile.Profile
+	}{
+		{"cpu", readProfile(filepath.Join("..", "driver", "testdata", "cppbench.cpu"), t)},
+		{"contention", readProfile(filepath.Join("..", "driver", "testdata", "cppbench.contention"), t)},
+		{"go", readProfile(filepath.Join("..", "driver", "testdata", "go.crc32.cpu"), t)},
+		{"sample", readProfile(filepath.Join("testdata", "sample.cpu"), t)},
+		{"inlined", testProfile},
+		{"diff", diff},
+	} {
+		for _, o := range []Options{
+			{},
+			{NodeCount: 10},
+			{NodeCount: 10, NodeFraction: 0.005, EdgeFraction: 0.001, CumSort: true},
+			{NodeFraction: 0.01, DropNegative: true},
+			{NodeCount: 5, OtherNode: true, MergeFunctionNames: true},
+		} {
+			o := o
+			o.OutputFormat = Text
+			last := len(tc.prof.SampleType) - 1
+			o.SampleValue = func(v []int64) int64 { return v[last] }
+			o.SampleMeanDivisor = func(v []int64) int64 { return v[0] }
+			o.SampleUnit = tc.prof.SampleType[last].Unit
+
+			want := trimmedGraphSummary(New(tc.prof.Copy(), &o).trimmedGraph(context.Background(), false))
+			got := trimmedGraphSummary(New(tc.prof.Copy(), &o).trimmedGraph(context.Background(), true))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %+v: got\n%s\nwant\n%s", tc.desc, o, strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		}
+	}
+}
+
+func BenchmarkTextReport(b *testing.B) {
+	f, err := os.Open(filepath.Join("..", "driver", "testdata", "cppbench.cpu"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	o := &Options{
+		OutputFormat: Text,
+		NodeCount:    10,
+		NodeFraction: 0.005,
+		SampleValue:  func(v []int64) int64 { return v[1] },
+		SampleUnit:   prof.SampleType[1].Unit,
+	}
+	for _, nodesOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("nodesOnly=%v", nodesOnly), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				New(prof.Copy(), o).trimmedGraph(context.Background(), nodesOnly)
+			}
+		})
+	}
+}
+
+func TestPrintSample(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main", Filename: "main.go"}
+	foo := &profile.Function{ID: 2, Name: "foo", Filename: "foo.go"}
+	bar := &profile.Function{ID: 3, Name: "bar", Filename: "bar.go"}
+	m := &profile.Mapping{ID: 1, File: "/bin/app"}
+	locs := []*profile.Location{
+		// bar inlined into foo.
+		{ID: 1, Mapping: m, Address: 0x1010, Line: []profile.Line{{Function: bar, Line: 30}, {Function: foo, Line: 20}}},
+		{ID: 2, Mapping: m, Address: 0x2000, Line: []profile.Line{{Function: main, Line: 10}}},
+		{ID: 3, Mapping: m, Address: 0x3000},
+	}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{locs[1]}, Value: []int64{1, 10000000}},
+			{
+				Location: []*profile.Location{locs[2], locs[0], locs[1]},
+				Value:    []int64{2, 20000000},
+				Label:    map[string][]string{"thread": {"worker"}},
+				NumLabel: map[string][]int64{"bytes": {4096}},
+				NumUnit:  map[string][]string{"bytes": {"bytes"}},
+			},
+		},
+		Location: locs,
+		Function: []*profile.Function{main, foo, bar},
+		Mapping:  []*profile.Mapping{m},
+	}
+	newReport := func(n int) *Report {
+		return New(p, &Options{
+			OutputFormat: Sample,
+			SampleNumber: n,
+			SampleValue:  func(v []int64) int64 { return v[1] },
+			SampleUnit:   "nanoseconds",
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, newReport(1), nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	got := buf.String()
+	want := `Sample 1 of 2
+   samples:  2
+       cpu:  20ms
+     bytes:  4kB
+    thread:  worker
+     stack:
+            0x3000  /bin/app
+            0x1010  bar bar.go:30 (inline)
+                    foo foo.go:20
+            0x2000  main main.go:10
+`
+	if i := strings.Index(got, "Sample 1"); i < 0 || got[i:] != want {
+		t.Errorf("got:\n%s\nwant it to end with:\n%s", got, want)
+	}
+
+	for _, n := range []int{-1, 2} {
+		if err := Generate(context.Background(), &bytes.Buffer{}, newReport(n), nil); err == nil {
+			t.Errorf("Generate(sample %d) of a profile with 2 samples: got no error", n)
+		}
+	}
+}
+
+func TestEstimatedTotal(t *testing.T) {
+	newProfile := func(period int64) *profile.Profile {
+		p := makeTestProfile(
+			testSample(3, testL[1], testL[0]),
+			testSample(2, testL[0]),
+		)
+		p.SampleType = []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		}
+		for _, s := range p.Sample {
+			s.Value = append(s.Value, s.Value[0]*10000000)
+		}
+		p.PeriodType = &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+		p.Period = period
+		return p
+	}
+	for _, tc := range []struct {
+		desc     string
+		period   int64
+		flatOnly bool
+		cpu      bool
+		want     []string
+		notWant  []string
+	}{
+		{
+			desc:   "cum",
+			period: 10000000,
+			want: []string{
+				"Estimated total: value times the period of 10ms",
+				"   cum%  est total\n",
+				"      50ms  main ",
+				"      30ms  foo ",
+			},
+		},
+		{
+			desc:     "flat only",
+			period:   10000000,
+			flatOnly: true,
+			want: []string{
+				"      20ms  main ",
+				"      30ms  foo ",
+			},
+		},
+		{
+			desc:    "no period",
+			want:    []string{"Estimated total: unavailable, the profile has no period"},
+			notWant: []string{"est total", "ms  "},
+		},
+		{
+			desc:    "not counts",
+			period:  10000000,
+			cpu:     true,
+			want:    []string{"Estimated total: unavailable, the values are in nanoseconds, not sample counts"},
+			notWant: []string{"est total"},
+		},
+		{
+			desc:   "overflow",
+			period: math.MaxInt64 / 4,
+			want:   []string{"overflow  main "},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			idx, unit := 0, "count"
+			if tc.cpu {
+				idx, unit = 1, "nanoseconds"
+			}
+			rpt := New(newProfile(tc.period), &Options{
+				OutputFormat:   Text,
+				EstimatedTotal: true,
+				FlatOnly:       tc.flatOnly,
+				SampleValue:    func(v []int64) int64 { return v[idx] },
+				SampleUnit:     unit,
+			})
+			var buf bytes.Buffer
+			if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			got := buf.String()
+			for _, w := range tc.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("text output does not contain %q:\n%s", w, got)
+				}
+			}
+			for _, w := range tc.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("text output unexpectedly contains %q:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main", Filename: "main.go"}
+	foo := &profile.Function{ID: 2, Name: "foo", Filename: "foo.go"}
+	bar := &profile.Function{ID: 3, Name: "bar", Filename: "bar.go"}
+	m := &profile.Mapping{ID: 1, File: "/bin/app"}
+	locs := []*profile.Location{
+		// bar inlined into foo.
+		{ID: 1, Mapping: m, Address: 0x1010, Line: []profile.Line{{Function: bar, Line: 30}, {Function: foo, Line: 20}}},
+		{ID: 2, Mapping: m, Address: 0x2000, Line: []profile.Line{{Function: main, Line: 10}}},
+		{ID: 3, Address: 0x3000},
+	}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{locs[1]}, Value: []int64{1, 10}},
+			{
+				Location: []*profile.Location{locs[2], locs[0], locs[1]},
+				Value:    []int64{2, 20},
+				Label:    map[string][]string{"thread": {"<worker>"}},
+				NumLabel: map[string][]int64{"bytes": {4096}},
+				NumUnit:  map[string][]string{"bytes": {"bytes"}},
+			},
+		},
+		Location: locs,
+		Function: []*profile.Function{main, foo, bar},
+		Mapping:  []*profile.Mapping{m},
+	}
+	rpt := New(p, &Options{
+		OutputFormat: NDJSON,
+		SampleValue:  func(v []int64) int64 { return v[1] },
+		SampleUnit:   "nanoseconds",
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := `{"value":10,"values":{"cpu":10,"samples":1},"frames":[{"function":"main","file":"main.go","line":10,"address":"0x2000","mapping":"/bin/app"}]}
+{"value":20,"values":{"cpu":20,"samples":2},"frames":[{"address":"0x3000"},{"function":"bar","file":"bar.go","line":30,"address":"0x1010","mapping":"/bin/app","inline":true},{"function":"foo","file":"foo.go","line":20,"address":"0x1010","mapping":"/bin/app"},{"function":"main","file":"main.go","line":10,"address":"0x2000","mapping":"/bin/app"}],"labels":{"thread":["<worker>"]},"num_labels":{"bytes":[4096]},"num_units":{"bytes":["bytes"]}}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var s ndjsonSample
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			t.Errorf("line %q is not a JSON sample: %v", line, err)
+		}
+	}
+}
+
+func TestPrometheusLabelValue(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"main", "main"},
+		{`operator"" _kb`, `operator\"\" _kb`},
+		{`C:\src\main.c`, `C:\\src\\main.c`},
+		{"two\nlines", `two\nlines`},
+		{"bad\xffutf8", "bad\uFFFDutf8"},
+	} {
+		if got := prometheusLabelValue(tc.in); got != tc.want {
+			t.Errorf("prometheusLabelValue(%q): got %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEdges(t *testing.T) {
+	// testL[0] is main, testL[1] foo and testL[2] bar.
+	p := makeTestProfile(
+		testSample(5, testL[2], testL[1], testL[0]),
+		testSample(3, testL[2], testL[0]),
+		testSample(2, testL[1], testL[0]),
+	)
+	for _, tc := range []struct {
+		nodeCount int
+		want      string
+	}{
+		{
+			want: `Showing top 3 edges out of 3
+    weight total%  caller -> callee
+         7 70.00%  main testdata/source1:2:2 -> foo testdata/source1:4:4
+         5 50.00%  foo testdata/source1:4:4 -> bar testdata/source1:10
+         3 30.00%  main testdata/source1:2:2 -> bar testdata/source1:10
+`,
+		},
+		{
+			nodeCount: 2,
+			want: `Showing top 2 edges out of 3
+    weight total%  caller -> callee
+         7 70.00%  main testdata/source1:2:2 -> foo testdata/source1:4:4
+         5 50.00%  foo testdata/source1:4:4 -> bar testdata/source1:10
+`,
+		},
+	} {
+		rpt := New(p.Copy(), &Options{
+			OutputFormat: Edges,
+			NodeCount:    tc.nodeCount,
+			SampleValue:  func(v []int64) int64 { return v[0] },
+			SampleUnit:   "count",
+		})
+		var buf bytes.Buffer
+		if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		got := buf.String()
+		if i := strings.Index(got, "Showing top"); i < 0 || got[i:] != tc.want {
+			t.Errorf("nodeCount=%d: got:\n%s\nwant it to end with:\n%s", tc.nodeCount, got, tc.want)
+		}
+	}
+}
+
+func TestSampleCountDiff(t *testing.T) {
+	base := func(s *profile.Sample) *profile.Sample {
+		s.Label = map[string][]string{"pprof::base": {"true"}}
+		return s
+	}
+	// testL[0] is main, testL[1] foo and testL[2] bar. The base profile
+	// has fewer but heavier samples of foo, and a sample of bar only. The
+	// samples of foo are merged into one with a count of 3.
+	sample := func(count, cpu int64, locs ...*profile.Location) *profile.Sample {
+		s := testSample(count, locs...)
+		s.Value = append(s.Value, cpu)
+		return s
+	}
+	newProfile := func() *profile.Profile {
+		p := makeTestProfile(
+			sample(3, 30, testL[1], testL[0]),
+			base(sample(-1, -100, testL[1], testL[0])),
+			base(sample(-1, -5, testL[2], testL[0])),
+		)
+		p.SampleType = append(p.SampleType, &profile.ValueType{Type: "cpu", Unit: "nanoseconds"})
+		return p
+	}
+	for _, tc := range []struct {
+		flatOnly bool
+		want     map[string]string
+	}{
+		{want: map[string]string{"main": "+1", "foo": "+2", "bar": "-1"}},
+		{flatOnly: true, want: map[string]string{"main": "+0", "foo": "+2", "bar": "-1"}},
+	} {
+		rpt := New(newProfile(), &Options{
+			OutputFormat:    Text,
+			SampleCountDiff: true,
+			FlatOnly:        tc.flatOnly,
+			SampleValue:     func(v []int64) int64 { return v[1] },
+			SampleUnit:      "nanoseconds",
+		})
+		items, labels := TextItems(context.Background(), rpt)
+		got := make(map[string]string)
+		for _, item := range items {
+			got[strings.Fields(item.Name)[0]] = item.CountDiffFormat
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("flatOnly=%v: got count diffs %v, want %v", tc.flatOnly, got, tc.want)
+		}
+		if !slices.Contains(labels, "Sample count diff: samples minus samples in the base profiles") {
+			t.Errorf("flatOnly=%v: labels %q do not describe the count diff", tc.flatOnly, labels)
+		}
+	}
+
+	rpt := New(makeTestProfile(testSample(10, testL[1], testL[0])), &Options{
+		OutputFormat:    Text,
+		SampleCountDiff: true,
+		SampleValue:     func(v []int64) int64 { return v[0] },
+		SampleUnit:      "count",
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if got := buf.String(); !strings.Contains(got, "Sample count diff: unavailable, there are no base profiles") || strings.Contains(got, "count diff\n") {
+		t.Errorf("text report without base profiles:\n%s\nwant a note and no count diff column", got)
+	}
+
+	p := newProfile()
+	p.SampleType[0] = &profile.ValueType{Type: "events", Unit: "count"}
+	rpt = New(p, &Options{
+		OutputFormat:    Text,
+		SampleCountDiff: true,
+		SampleValue:     func(v []int64) int64 { return v[1] },
+		SampleUnit:      "nanoseconds",
+	})
+	buf.Reset()
+	if err := Generate(context.Background(), &buf, rpt, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if got := buf.String(); !strings.Contains(got, "Sample count diff: unavailable, the profile has no samples/count values") || strings.Contains(got, "count diff\n") {
+		t.Errorf("text report without sample counts:\n%s\nwant a note and no count diff column", got)
+	}
+}
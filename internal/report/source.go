@@ -19,7 +19,9 @@ package report
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"html"
 	"html/template"
 	"io"
 	"os"
@@ -39,64 +41,33 @@ import (
 // functions with samples that match the regexp rpt.options.symbol.
 // The sources are sorted by function name and then by filename to
 // eliminate potential nondeterminism.
-func printSource(w io.Writer, rpt *Report) error {
-	o := rpt.options
-	g := rpt.newGraph(nil)
-
-	// Identify all the functions that match the regexp provided.
-	// Group nodes for each matching function.
-	var functions graph.Nodes
-	functionNodes := make(map[string]graph.Nodes)
-	for _, n := range g.Nodes {
-		if !o.Symbol.MatchString(n.Info.Name) {
-			continue
-		}
-		if functionNodes[n.Info.Name] == nil {
-			functions = append(functions, n)
-		}
-		functionNodes[n.Info.Name] = append(functionNodes[n.Info.Name], n)
-	}
-	functions.Sort(graph.NameOrder)
-
-	if len(functionNodes) == 0 {
-		return fmt.Errorf("no matches found for regexp: %s", o.Symbol)
+//
+// If the report compares the profile to diff base profiles, each line
+// shows its cum value in the base profiles, in the profile and their
+// difference, marked with "+" or "-" as in a patch.
+func printSource(ctx context.Context, w io.Writer, rpt *Report) error {
+	// The base lines must be computed first, as the graph of the report
+	// no longer marks the samples of the base profiles.
+	base := rpt.diffBaseLines(ctx)
+	functions, functionNodes, reader, err := sourceFunctions(ctx, rpt)
+	if err != nil {
+		return err
 	}
 
-	sourcePath := o.SourcePath
-	if sourcePath == "" {
-		wd, err := os.Getwd()
-		if err != nil {
-			return fmt.Errorf("could not stat current dir: %v", err)
-		}
-		sourcePath = wd
+	if base != nil {
+		fmt.Fprintf(w, "Total: %s -> %s (%s)\n", rpt.formatValue(base.total), rpt.formatValue(base.current), formatDelta(base.current-base.total, rpt))
+	} else {
+		fmt.Fprintf(w, "Total: %s\n", rpt.formatValue(rpt.total))
 	}
-	reader := newSourceReader(sourcePath, o.TrimPath)
-
-	fmt.Fprintf(w, "Total: %s\n", rpt.formatValue(rpt.total))
 	for _, fn := range functions {
 		name := fn.Info.Name
 
-		// Identify all the source files associated to this function.
-		// Group nodes for each source file.
-		var sourceFiles graph.Nodes
-		fileNodes := make(map[string]graph.Nodes)
-		for _, n := range functionNodes[name] {
-			if n.Info.File == "" {
-				continue
-			}
-			if fileNodes[n.Info.File] == nil {
-				sourceFiles = append(sourceFiles, n)
-			}
-			fileNodes[n.Info.File] = append(fileNodes[n.Info.File], n)
-		}
-
+		sourceFiles, fileNodes := groupByFile(functionNodes[name])
 		if len(sourceFiles) == 0 {
 			fmt.Fprintf(w, "No source information for %s\n", name)
 			continue
 		}
 
-		sourceFiles.Sort(graph.FileOrder)
-
 		// Print each file associated with this function.
 		for _, fl := range sourceFiles {
 			filename := fl.Info.File
@@ -105,6 +76,10 @@ func printSource(w io.Writer, rpt *Report) error {
 
 			fnodes, _, err := getSourceFromFile(filename, reader, fns, 0, 0)
 			fmt.Fprintf(w, "ROUTINE ======================== %s in %s\n", name, filename)
+			if base != nil {
+				printSourceDiff(w, rpt, base, name, filename, fnodes, err)
+				continue
+			}
 			fmt.Fprintf(w, "%10s %10s (flat, cum) %s of Total\n",
 				rpt.formatValue(flatSum), rpt.formatValue(cumSum),
 				measurement.Percentage(cumSum, rpt.total))
@@ -122,6 +97,352 @@ func printSource(w io.Writer, rpt *Report) error {
 	return nil
 }
 
+// sourceDiffBase holds the values of the base profiles of a diff
+// comparison for annotated source listings.
+type sourceDiffBase struct {
+	total, current int64 // Totals of the base profiles and of the profile.
+	lines          map[sourceLineKey]int64
+}
+
+// sourceLineKey identifies a source line of a function.
+type sourceLineKey struct {
+	name, file string
+	line       int
+}
+
+// diffBaseLines returns the cum value of each source line in the base
+// profiles of a diff comparison, or nil if the report is not one.
+func (rpt *Report) diffBaseLines(ctx context.Context) *sourceDiffBase {
+	p := rpt.prof
+	var samples []*profile.Sample
+	var current int64
+	for _, s := range p.Sample {
+		if s.DiffBaseSample() {
+			samples = append(samples, s)
+		} else {
+			current += rpt.options.SampleValue(s.Value)
+		}
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	bp := &profile.Profile{
+		SampleType: p.SampleType,
+		Sample:     samples,
+		Mapping:    p.Mapping,
+		Location:   p.Location,
+		Function:   p.Function,
+	}
+	brpt := &Report{prof: bp, total: rpt.total, options: rpt.options, formatValue: rpt.formatValue}
+	base := &sourceDiffBase{total: rpt.total, current: current, lines: make(map[sourceLineKey]int64)}
+	for _, n := range brpt.newGraph(ctx, nil).Nodes {
+		// The values of base samples are negated in diff comparisons.
+		base.lines[sourceLineKey{n.Info.Name, n.Info.File, n.Info.Lineno}] -= n.Cum
+	}
+	return base
+}
+
+// printSourceDiff prints the source lines of function name in filename
+// with their cum values in the base profiles and in the profile, given by
+// the values of the lines in fnodes, which are their differences.
+func printSourceDiff(w io.Writer, rpt *Report, base *sourceDiffBase, name, filename string, fnodes graph.Nodes, err error) {
+	var baseSum, deltaSum int64
+	for k, v := range base.lines {
+		if k.name == name && k.file == filename {
+			baseSum += v
+		}
+	}
+	for _, fn := range fnodes {
+		deltaSum += fn.Cum
+	}
+	fmt.Fprintf(w, "  %10s %10s %10s (base, current, delta cum)\n",
+		rpt.formatValue(baseSum), rpt.formatValue(baseSum+deltaSum), formatDelta(deltaSum, rpt))
+
+	if err != nil {
+		fmt.Fprintf(w, " Error: %v\n", err)
+		return
+	}
+
+	for _, fn := range fnodes {
+		b := base.lines[sourceLineKey{name, filename, fn.Info.Lineno}]
+		marker := " "
+		switch {
+		case fn.Cum > 0:
+			marker = "+"
+		case fn.Cum < 0:
+			marker = "-"
+		}
+		fmt.Fprintf(w, "%s %10s %10s %10s %6d:%s\n", marker, valueOrDot(b, rpt), valueOrDot(b+fn.Cum, rpt), formatDelta(fn.Cum, rpt), fn.Info.Lineno, fn.Info.Name)
+	}
+}
+
+// formatDelta formats a difference of values with its sign, or as "." if
+// it is zero.
+func formatDelta(delta int64, rpt *Report) string {
+	if delta > 0 {
+		return "+" + rpt.formatValue(delta)
+	}
+	return valueOrDot(delta, rpt)
+}
+
+// printSourceAsm prints an annotated source listing of the functions
+// matching rpt.options.Symbol in which each source line is followed by
+// the instructions generated for it, as in the weblist view. Lines
+// whose source is not available are shown as "???", and only the source
+// is shown if the instructions cannot be disassembled.
+func printSourceAsm(w io.Writer, rpt *Report, obj plugin.ObjTool) error {
+	listing, err := MakeWebList(rpt, obj, -1)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Total: %s\n", listing.Total)
+	for _, f := range listing.Files {
+		for _, fn := range f.Funcs {
+			fmt.Fprintf(w, "ROUTINE ======================== %s in %s\n", fn.Name, fn.File)
+			fmt.Fprintf(w, "%10s %10s (flat, cum) %s of Total\n", fn.Flat, fn.Cumulative, fn.Percent)
+			for _, l := range fn.Lines {
+				fmt.Fprintf(w, "%10s %10s %6d:%s\n", l.Flat, l.Cumulative, l.Line, l.SrcLine)
+				for _, inst := range l.Instructions {
+					if inst.NewBlock {
+						fmt.Fprintf(w, "%10s %10s %8s\n", "", "", "⋮")
+					}
+					for _, c := range inst.InlinedCalls {
+						fmt.Fprintf(w, "%10s %10s %8s  %s %s:%d\n", "", "", "", strings.TrimRight(c.SrcLine, " "), c.FileBase, c.Line)
+					}
+					if inst.Synthetic {
+						continue
+					}
+					fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("%10s %10s %8x: %s %s", inst.Flat, inst.Cumulative, inst.Address, inst.Disasm, html.UnescapeString(inst.FileLine)), " "))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// printCoverage prints, for each function matching rpt.options.Symbol,
+// the source lines that have samples and those that do not. A function
+// spans from its start line, or its first line with samples if unknown,
+// to the last line of its code in the binary, or its last line with
+// samples if the binary is not available. Blank lines are not counted.
+func printCoverage(ctx context.Context, w io.Writer, rpt *Report, obj plugin.ObjTool) error {
+	functions, functionNodes, reader, err := sourceFunctions(ctx, rpt)
+	if err != nil {
+		return err
+	}
+
+	var totalCovered, totalLines int
+	for _, fn := range functions {
+		name := fn.Info.Name
+
+		sourceFiles, fileNodes := groupByFile(functionNodes[name])
+		if len(sourceFiles) == 0 {
+			fmt.Fprintf(w, "No source information for %s\n", name)
+			continue
+		}
+
+		for _, fl := range sourceFiles {
+			filename := fl.Info.File
+			fns := fileNodes[filename]
+
+			start, end := fns[0].Info.StartLine, 0
+			sampled := make(map[int]bool)
+			for _, n := range fns {
+				if n.Flat == 0 && n.Cum == 0 {
+					continue
+				}
+				lineno := n.Info.Lineno
+				sampled[lineno] = true
+				if start == 0 || lineno < start {
+					start = lineno
+				}
+				if lineno > end {
+					end = lineno
+				}
+			}
+			if last := functionEnd(rpt.prof, obj, fns, filename); last > end {
+				end = last
+			}
+
+			fmt.Fprintf(w, "ROUTINE ======================== %s in %s\n", name, filename)
+			var covered, lines []int
+			for lineno := start; lineno <= end; lineno++ {
+				line, ok := reader.line(filename, lineno)
+				if !ok {
+					break
+				}
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				lines = append(lines, lineno)
+				if sampled[lineno] {
+					covered = append(covered, lineno)
+				}
+			}
+			if err := reader.fileError(filename); err != nil {
+				fmt.Fprintf(w, " Error: %v\n", err)
+				continue
+			}
+
+			var uncovered []int
+			for _, lineno := range lines {
+				if !sampled[lineno] {
+					uncovered = append(uncovered, lineno)
+				}
+			}
+			fmt.Fprintf(w, "%10d of %d lines covered (%s)\n", len(covered), len(lines), measurement.Percentage(int64(len(covered)), int64(len(lines))))
+			fmt.Fprintf(w, "%10s %s\n", "covered:", lineRanges(covered))
+			fmt.Fprintf(w, "%10s %s\n", "uncovered:", lineRanges(uncovered))
+			totalCovered += len(covered)
+			totalLines += len(lines)
+		}
+	}
+	fmt.Fprintf(w, "Total: %d of %d lines covered (%s)\n", totalCovered, totalLines, measurement.Percentage(int64(totalCovered), int64(totalLines)))
+	return nil
+}
+
+// functionEnd returns the last line of filename that code of the function
+// of nodes is attributed to, in the symbol of the binary holding the
+// address of one of nodes. It returns 0 if it cannot be found.
+func functionEnd(prof *profile.Profile, obj plugin.ObjTool, nodes graph.Nodes, filename string) int {
+	if obj == nil {
+		return 0
+	}
+	for _, n := range nodes {
+		if n.Info.Address == 0 || n.Info.Objfile == "" {
+			continue
+		}
+		for _, m := range prof.Mapping {
+			if m.File != n.Info.Objfile || n.Info.Address < m.Start || n.Info.Address >= m.Limit {
+				continue
+			}
+			if end := symbolEnd(obj, m, n.Info, filename); end != 0 {
+				return end
+			}
+		}
+	}
+	return 0
+}
+
+// symbolEnd implements functionEnd for the address of a node in mapping m.
+func symbolEnd(obj plugin.ObjTool, m *profile.Mapping, info graph.NodeInfo, filename string) int {
+	f, err := obj.Open(m.File, m.Start, m.Limit, m.Offset, m.KernelRelocationSymbol)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	objAddr, err := f.ObjAddr(info.Address)
+	if err != nil {
+		return 0
+	}
+	syms, err := f.Symbols(nil, objAddr)
+	if err != nil {
+		return 0
+	}
+	for _, sym := range syms {
+		if objAddr < sym.Start || objAddr > sym.End {
+			continue
+		}
+		insts, err := obj.Disasm(sym.File, sym.Start, sym.End, false)
+		if err != nil {
+			return 0
+		}
+		base := info.Address - objAddr
+		end := 0
+		for _, inst := range insts {
+			frames, err := f.SourceLine(inst.Addr + base)
+			if err != nil {
+				continue
+			}
+			// The function may also be inlined in the symbol, or have
+			// other functions inlined in it.
+			for _, fr := range frames {
+				if fr.File == filename && fr.Line > end && (fr.Func == info.Name || fr.Func == info.OrigName) {
+					end = fr.Line
+				}
+			}
+		}
+		return end
+	}
+	return 0
+}
+
+// lineRanges formats a sorted list of line numbers as a comma-separated
+// list of ranges, eg "3-5,8", or "-" if the list is empty.
+func lineRanges(lines []int) string {
+	if len(lines) == 0 {
+		return "-"
+	}
+	var ranges []string
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(lines[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// sourceFunctions identifies all the functions that match the regexp
+// in rpt.options.Symbol, sorted by name, and groups the graph nodes of
+// each of them. It also returns a reader for their source files.
+func sourceFunctions(ctx context.Context, rpt *Report) (graph.Nodes, map[string]graph.Nodes, *sourceReader, error) {
+	o := rpt.options
+	g := rpt.newGraph(ctx, nil)
+
+	var functions graph.Nodes
+	functionNodes := make(map[string]graph.Nodes)
+	for _, n := range g.Nodes {
+		if !o.Symbol.MatchString(n.Info.Name) {
+			continue
+		}
+		if functionNodes[n.Info.Name] == nil {
+			functions = append(functions, n)
+		}
+		functionNodes[n.Info.Name] = append(functionNodes[n.Info.Name], n)
+	}
+	functions.Sort(graph.NameOrder)
+
+	if len(functionNodes) == 0 {
+		return nil, nil, nil, fmt.Errorf("no matches found for regexp: %s", o.Symbol)
+	}
+
+	sourcePath := o.SourcePath
+	if sourcePath == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not stat current dir: %v", err)
+		}
+		sourcePath = wd
+	}
+	return functions, functionNodes, newSourceReader(sourcePath, o.TrimPath), nil
+}
+
+// groupByFile identifies all the source files associated to the nodes
+// of a function, sorted by name, and groups the nodes of each of them.
+func groupByFile(nodes graph.Nodes) (graph.Nodes, map[string]graph.Nodes) {
+	var sourceFiles graph.Nodes
+	fileNodes := make(map[string]graph.Nodes)
+	for _, n := range nodes {
+		if n.Info.File == "" {
+			continue
+		}
+		if fileNodes[n.Info.File] == nil {
+			sourceFiles = append(sourceFiles, n)
+		}
+		fileNodes[n.Info.File] = append(fileNodes[n.Info.File], n)
+	}
+	sourceFiles.Sort(graph.FileOrder)
+	return sourceFiles, fileNodes
+}
+
 // sourcePrinter holds state needed for generating source+asm HTML listing.
 type sourcePrinter struct {
 	reader     *sourceReader
@@ -213,6 +534,7 @@ type WebListLine struct {
 	SrcLine      string
 	HTMLClass    string
 	Line         int
+	URL          string // Link to the line on a code host, if any.
 	Flat         string
 	Cumulative   string
 	Instructions []WebListInstruction
@@ -704,7 +1026,9 @@ func (sp *sourcePrinter) generateFile(f *sourceFile, rpt *Report) WebListFile {
 				})
 			}
 
-			listfn.Lines = append(listfn.Lines, makeWebListLine(l, flatSum, cumSum, lineContents, asm, sp.reader, rpt))
+			line := makeWebListLine(l, flatSum, cumSum, lineContents, asm, sp.reader, rpt)
+			line.URL = sourceURL(rpt.options.SourceURLTemplate, f.fname, l)
+			listfn.Lines = append(listfn.Lines, line)
 		}
 
 		result.Funcs = append(result.Funcs, listfn)
@@ -712,6 +1036,20 @@ func (sp *sourcePrinter) generateFile(f *sourceFile, rpt *Report) WebListFile {
 	return result
 }
 
+// sourceURL returns the link for a line of a source file according to the
+// template tmpl, replacing its {file} and {line} placeholders. Only
+// relative file names are expected to map to the template, so there is
+// no link for absolute or unknown file names, or unknown lines.
+func sourceURL(tmpl, file string, line int) string {
+	if tmpl == "" || file == "" || file == "." || line <= 0 || filepath.IsAbs(file) || strings.HasPrefix(file, "/") {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{file}", filepath.ToSlash(file),
+		"{line}", strconv.Itoa(line),
+	).Replace(tmpl)
+}
+
 // functions splits apart the lines to show in a file into a list of per-function ranges.
 func (sp *sourcePrinter) functions(f *sourceFile) []sourceFunction {
 	var funcs []sourceFunction
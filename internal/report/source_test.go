@@ -15,6 +15,8 @@
 package report
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -24,6 +26,8 @@ import (
 	"testing"
 
 	"github.com/google/pprof/internal/binutils"
+	"github.com/google/pprof/internal/plugin"
+	"github.com/google/pprof/internal/proftest"
 	"github.com/google/pprof/profile"
 )
 
@@ -52,6 +56,163 @@ func TestWebList(t *testing.T) {
 	}
 }
 
+func TestSourceAsm(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("source_asm only tested on x86-64 linux")
+	}
+
+	cpu := readProfile(filepath.Join("testdata", "sample.cpu"), t)
+	rpt := New(cpu, &Options{
+		OutputFormat: List,
+		SourceAsm:    true,
+		Symbol:       regexp.MustCompile("busyLoop"),
+		SampleValue:  func(v []int64) int64 { return v[1] },
+		SampleUnit:   cpu.SampleType[1].Unit,
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, &binutils.Binutils{}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	// The instructions themselves depend on the disassembler, so only
+	// their addresses, values and locations are compared.
+	insts := regexp.MustCompile(`(?m)^(.{22}\s+[0-9a-f]+:) .*?(?:\s+(\S+:\d+))?$`)
+	got := insts.ReplaceAllString(buf.String(), "$1 ... $2")
+
+	const golden = "testdata/source_asm.rpt"
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%s: %v", golden, err)
+	}
+	if got != string(want) {
+		d, err := proftest.Diff(want, []byte(got))
+		if err != nil {
+			t.Fatalf("diff: %v", err)
+		}
+		t.Errorf("source_asm output differs from %s:\n%s", golden, d)
+	}
+}
+
+func TestSourceAsmWithoutObject(t *testing.T) {
+	rpt := New(testProfile.Copy(), &Options{
+		OutputFormat: List,
+		SourceAsm:    true,
+		Symbol:       regexp.MustCompile(`^tee$`),
+		TrimPath:     "/some/path",
+		SampleValue:  func(v []int64) int64 { return v[1] },
+		SampleUnit:   testProfile.SampleType[1].Unit,
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, &binutils.Binutils{}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	got := filepath.ToSlash(buf.String())
+	for _, want := range []string{
+		"ROUTINE ======================== tee in /some/path/testdata/source2\n",
+		"      2:source2 line 2;\n",
+		"      8:source2 line 8;\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output does not contain %q:\n%s", want, got)
+		}
+	}
+	if regexp.MustCompile(`(?m)^.{22}\s+[0-9a-f]+: `).MatchString(got) {
+		t.Errorf("output has instructions without an object file:\n%s", got)
+	}
+}
+
+func TestSourceDiff(t *testing.T) {
+	main4 := &profile.Location{ID: 10, Mapping: testM[0], Line: []profile.Line{{Function: testF[0], Line: 4}}}
+	main6 := &profile.Location{ID: 11, Mapping: testM[0], Line: []profile.Line{{Function: testF[0], Line: 6}}}
+	base := map[string][]string{"pprof::base": {"true"}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{testL[2], testL[0]}, Value: []int64{30}},
+			{Location: []*profile.Location{main6}, Value: []int64{20}},
+			// Samples of the base profile, subtracted from the profile.
+			{Location: []*profile.Location{testL[2], testL[0]}, Value: []int64{-10}, Label: base},
+			{Location: []*profile.Location{main4}, Value: []int64{-5}, Label: base},
+		},
+		Location: append([]*profile.Location{main4, main6}, testL...),
+		Function: testF,
+		Mapping:  testM,
+	}
+	rpt := New(p.Copy(), &Options{
+		OutputFormat: List,
+		Symbol:       regexp.MustCompile(`^main$`),
+		SampleValue:  func(v []int64) int64 { return v[0] },
+		SampleUnit:   "count",
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, &binutils.Binutils{}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	const golden = "testdata/source_diff.rpt"
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%s: %v", golden, err)
+	}
+	if got := filepath.ToSlash(buf.String()); got != string(want) {
+		d, err := proftest.Diff(want, []byte(got))
+		if err != nil {
+			t.Fatalf("diff: %v", err)
+		}
+		t.Errorf("list output differs from %s:\n%s", golden, d)
+	}
+}
+
+func TestWebListSourceURL(t *testing.T) {
+	makeLoc := func(id uint64, fname string, line int64) *profile.Location {
+		return &profile.Location{
+			ID: id,
+			Line: []profile.Line{
+				{Function: &profile.Function{ID: id, Name: "f" + fname, Filename: fname}, Line: line},
+			},
+		}
+	}
+	rel, abs := makeLoc(1, "pkg/foo.go", 10), makeLoc(2, "/usr/lib/bar.go", 20)
+	prof := &profile.Profile{
+		Sample: []*profile.Sample{
+			{Value: []int64{1}, Location: []*profile.Location{rel}},
+			{Value: []int64{1}, Location: []*profile.Location{abs}},
+		},
+	}
+	rpt := &Report{
+		prof: prof,
+		options: &Options{
+			Symbol:            regexp.MustCompile("foo|bar"),
+			SampleValue:       func(s []int64) int64 { return s[0] },
+			SourceURLTemplate: "https://example.com/repo/+/v1/{file}#{line}",
+		},
+		formatValue: func(v int64) string { return fmt.Sprint(v) },
+	}
+	result, err := MakeWebList(rpt, nil, -1)
+	if err != nil {
+		t.Fatalf("MakeWebList: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, f := range result.Files {
+		for _, fn := range f.Funcs {
+			for _, l := range fn.Lines {
+				got[fmt.Sprintf("%s:%d", fn.File, l.Line)] = l.URL
+			}
+		}
+	}
+	for key, want := range map[string]string{
+		"pkg/foo.go:10":      "https://example.com/repo/+/v1/pkg/foo.go#10",
+		"/usr/lib/bar.go:20": "",
+	} {
+		if url, ok := got[key]; !ok {
+			t.Errorf("no line %s in weblist", key)
+		} else if url != want {
+			t.Errorf("got URL %q for %s, want %q", url, key, want)
+		}
+	}
+}
+
 func TestSourceSyntheticAddress(t *testing.T) {
 	testSourceMapping(t, true)
 }
@@ -286,3 +447,102 @@ func readProfile(fname string, t *testing.T) *profile.Profile {
 
 	return p
 }
+
+func TestCoverage(t *testing.T) {
+	rpt := New(testProfile.Copy(), &Options{
+		OutputFormat: Coverage,
+		Symbol:       regexp.MustCompile(`^(main|tee)$`),
+		TrimPath:     "/some/path",
+		SampleValue:  func(v []int64) int64 { return v[1] },
+		SampleUnit:   testProfile.SampleType[1].Unit,
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, &binutils.Binutils{}); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"ROUTINE ======================== main in testdata/source1",
+		"         1 of 1 lines covered (  100%)",
+		"  covered: 2",
+		"uncovered: -",
+		"ROUTINE ======================== tee in testdata/source2",
+		"         2 of 7 lines covered (28.57%)",
+		"  covered: 2,8",
+		"uncovered: 3-7",
+		"Total: 3 of 8 lines covered (37.50%)",
+		"",
+	}, "\n")
+	if got := filepath.ToSlash(buf.String()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// fakeCoverageObj is an object tool for a binary holding the function tee,
+// at [0x1000, 0x1004], with code for lines 2 to 6 of testdata/source2, and
+// the function next, at [0x1005, 0x1007].
+type fakeCoverageObj struct{}
+
+func (fakeCoverageObj) Open(file string, start, limit, offset uint64, relocationSymbol string) (plugin.ObjFile, error) {
+	return &fakeObjFile{
+		lines: map[uint64][]plugin.Frame{
+			0x1000: {{Func: "tee", File: "testdata/source2", Line: 2}},
+			0x1001: {{Func: "tee", File: "testdata/source2", Line: 2}},
+			0x1002: {{Func: "tee", File: "testdata/source2", Line: 3}},
+			0x1003: {{Func: "tee", File: "testdata/source2", Line: 4}},
+			0x1004: {{Func: "tee", File: "testdata/source2", Line: 6}},
+			0x1005: {{Func: "next", File: "testdata/source2", Line: 9}},
+		},
+		syms: []*plugin.Sym{
+			{Name: []string{"tee"}, File: file, Start: 0x1000, End: 0x1004},
+			{Name: []string{"next"}, File: file, Start: 0x1005, End: 0x1007},
+		},
+	}, nil
+}
+
+func (fakeCoverageObj) Disasm(file string, start, end uint64, intelSyntax bool) ([]plugin.Inst, error) {
+	var insts []plugin.Inst
+	for addr := start; addr <= end; addr++ {
+		insts = append(insts, plugin.Inst{Addr: addr, Text: "op"})
+	}
+	return insts, nil
+}
+
+func TestCoverageFunctionEnd(t *testing.T) {
+	m := &profile.Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "prog", HasFunctions: true}
+	tee := &profile.Function{ID: 1, Name: "tee", Filename: "testdata/source2"}
+	l1 := &profile.Location{ID: 1, Mapping: m, Address: 0x1001, Line: []profile.Line{{Function: tee, Line: 2}}}
+	l2 := &profile.Location{ID: 2, Mapping: m, Address: 0x1003, Line: []profile.Line{{Function: tee, Line: 4}}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{l1}, Value: []int64{1}},
+			{Location: []*profile.Location{l2}, Value: []int64{2}},
+		},
+		Mapping:  []*profile.Mapping{m},
+		Location: []*profile.Location{l1, l2},
+		Function: []*profile.Function{tee},
+	}
+	rpt := New(p, &Options{
+		OutputFormat: Coverage,
+		Symbol:       regexp.MustCompile(`^tee$`),
+		SampleValue:  func(v []int64) int64 { return v[0] },
+		SampleUnit:   "count",
+	})
+	var buf bytes.Buffer
+	if err := Generate(context.Background(), &buf, rpt, fakeCoverageObj{}); err != nil {
+		t.Fatal(err)
+	}
+	// Lines 5 and 6 come after the last sampled line, but are part of the
+	// code of tee.
+	want := strings.Join([]string{
+		"ROUTINE ======================== tee in testdata/source2",
+		"         2 of 5 lines covered (40.00%)",
+		"  covered: 2,4",
+		"uncovered: 3,5-6",
+		"Total: 2 of 5 lines covered (40.00%)",
+		"",
+	}, "\n")
+	if got := filepath.ToSlash(buf.String()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
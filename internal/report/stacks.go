@@ -19,6 +19,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/google/pprof/internal/measurement"
 	"github.com/google/pprof/profile"
@@ -196,6 +198,30 @@ func (s *StackSet) fillPlaces() {
 	}
 }
 
+// Folded returns the stacks in the folded format used by flame graph
+// tools: one line per distinct stack, holding the names of its frames
+// from the root to the leaf separated by semicolons, a space and the
+// total value of the stack. Lines are sorted and stacks with a zero
+// value are omitted.
+func (s *StackSet) Folded() []string {
+	values := make(map[string]int64)
+	for _, stack := range s.Stacks {
+		var names []string
+		for _, src := range stack.Sources[1:] { // Skip the synthesized root.
+			names = append(names, s.Sources[src].FullName)
+		}
+		values[strings.Join(names, ";")] += stack.Value
+	}
+	lines := make([]string, 0, len(values))
+	for stack, value := range values {
+		if value != 0 && stack != "" {
+			lines = append(lines, fmt.Sprintf("%s %d", stack, value))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
 // pickColor picks a color for key.
 func pickColor(key string) int {
 	const numColors = 1048576
@@ -206,7 +232,7 @@ func pickColor(key string) int {
 
 // Legend returns the list of lines to display as the legend.
 func (s *StackSet) Legend() []string {
-	return reportLabels(s.report, s.report.total, len(s.Sources), len(s.Sources), 0, 0, false)
+	return reportLabels(s.report, s.report.total, nil, len(s.Sources), len(s.Sources), 0, 0, false)
 }
 
 func addLineInfo(str string, line profile.Line) string {
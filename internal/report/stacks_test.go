@@ -238,3 +238,23 @@ func makeFileLocation(loc *profile.Location) *profile.Location {
 	}
 	return &result
 }
+
+func TestFolded(t *testing.T) {
+	// See report_test.go for the functions available to use in tests.
+	locs := clearLineAndColumn(testL)
+	main, foo, bar, tee := locs[0], locs[1], locs[2], locs[3]
+
+	stacks := makeTestStacks(
+		testSample(100, bar, foo, main),
+		testSample(200, tee, foo, main),
+		testSample(50, bar, foo, main),
+		testSample(0, foo, main),
+	)
+	want := []string{
+		"main;foo;bar 150",
+		"main;foo;tee 200",
+	}
+	if got := stacks.Folded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
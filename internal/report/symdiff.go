@@ -0,0 +1,70 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// SymbolDiff holds the function names an address resolves to in two
+// binaries, with the innermost frame first.
+type SymbolDiff struct {
+	Address uint64
+	A, B    []string
+}
+
+// DiffSymbols returns the addresses that resolve to different function
+// names in a and b, which hold the names of each address in addrs.
+func DiffSymbols(addrs []uint64, a, b [][]string) []SymbolDiff {
+	var diffs []SymbolDiff
+	for i, addr := range addrs {
+		if !slices.Equal(a[i], b[i]) {
+			diffs = append(diffs, SymbolDiff{Address: addr, A: a[i], B: b[i]})
+		}
+	}
+	return diffs
+}
+
+// PrintSymbolDiff prints the addresses of diffs with the function names
+// they resolve to in the binaries nameA and nameB. The frames of an
+// address are listed from the innermost one, each followed by "<-" and
+// the frame it is inlined into.
+func PrintSymbolDiff(w io.Writer, diffs []SymbolDiff, total int, nameA, nameB string) {
+	fmt.Fprintf(w, "Symbols differing between %s and %s: %d of %d addresses\n", nameA, nameB, len(diffs), total)
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%#x\n", d.Address)
+		fmt.Fprintf(w, "  %s: %s\n", nameA, frameNames(d.A))
+		fmt.Fprintf(w, "  %s: %s\n", nameB, frameNames(d.B))
+	}
+}
+
+// frameNames formats the function names of the frames of an address,
+// using "??" for addresses or frames without a name.
+func frameNames(names []string) string {
+	if len(names) == 0 {
+		return "??"
+	}
+	s := make([]string, len(names))
+	for i, n := range names {
+		if n == "" {
+			n = "??"
+		}
+		s[i] = n
+	}
+	return strings.Join(s, " <- ")
+}
@@ -18,10 +18,13 @@
 package symbolizer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -48,7 +51,13 @@ var demangleFunction = Demangle
 // local binaries; if the source is a URL it attempts to get any
 // missed entries using symbolz.
 func (s *Symbolizer) Symbolize(mode string, sources plugin.MappingSources, p *profile.Profile) error {
-	remote, local, fast, force, demanglerMode := true, true, false, false, ""
+	return s.SymbolizeContext(context.Background(), mode, sources, p)
+}
+
+// SymbolizeContext is like Symbolize, but stops and returns the error of
+// ctx once ctx is done.
+func (s *Symbolizer) SymbolizeContext(ctx context.Context, mode string, sources plugin.MappingSources, p *profile.Profile) error {
+	remote, local, fast, gosym, force, discard, demanglerMode := true, true, false, false, false, false, ""
 	for _, o := range strings.Split(strings.ToLower(mode), ":") {
 		switch o {
 		case "":
@@ -59,10 +68,14 @@ func (s *Symbolizer) Symbolize(mode string, sources plugin.MappingSources, p *pr
 			remote, local = false, true
 		case "fastlocal":
 			remote, local, fast = false, true, true
+		case "gosym":
+			remote, local, gosym = false, true, true
 		case "remote":
 			remote, local = true, false
 		case "force":
 			force = true
+		case "clear":
+			force, discard = true, true
 		default:
 			switch d := strings.TrimPrefix(o, "demangle="); d {
 			case "full", "none", "templates":
@@ -73,36 +86,52 @@ func (s *Symbolizer) Symbolize(mode string, sources plugin.MappingSources, p *pr
 				continue
 			}
 			s.UI.PrintErr("ignoring unrecognized symbolization option: " + mode)
-			s.UI.PrintErr("expecting -symbolize=[local|fastlocal|remote|none][:force][:demangle=[none|full|templates|default]")
+			s.UI.PrintErr("expecting -symbolize=[local|fastlocal|gosym|remote|none][:force|:clear][:demangle=[none|full|templates|default]")
 		}
 	}
 
 	var err error
 	if local {
+		if gosym {
+			if bu, ok := s.Obj.(*binutils.Binutils); ok {
+				bu.SetGoSymbolization(true)
+			}
+		}
 		// Symbolize locally using binutils.
-		if err = localSymbolize(p, fast, force, s.Obj, s.UI); err != nil {
+		if err = localSymbolize(ctx, p, fast, force, discard, s.Obj, s.UI); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
 			s.UI.PrintErr("local symbolization: " + err.Error())
 		}
 	}
 	if remote {
 		post := func(source, post string) ([]byte, error) {
-			return postURL(source, post, s.Transport)
+			return postURL(ctx, source, post, s.Transport)
 		}
 		if err = symbolzSymbolize(p, force, sources, post, s.UI); err != nil {
 			return err // Ran out of options.
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	demangleFunction(p, force, demanglerMode)
 	return nil
 }
 
 // postURL issues a POST to a URL over HTTP.
-func postURL(source, post string, tr http.RoundTripper) ([]byte, error) {
+func postURL(ctx context.Context, source, post string, tr http.RoundTripper) ([]byte, error) {
 	client := &http.Client{
 		Transport: tr,
 	}
-	resp, err := client.Post(source, "application/octet-stream", strings.NewReader(post))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, source, strings.NewReader(post))
+	if err != nil {
+		return nil, fmt.Errorf("http post %s: %v", source, err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("http post %s: %v", source, err)
 	}
@@ -126,7 +155,14 @@ func statusCodeError(resp *http.Response) error {
 // doLocalSymbolize adds symbol and line number information to all locations
 // in a profile. mode enables some options to control
 // symbolization.
-func doLocalSymbolize(prof *profile.Profile, fast, force bool, obj plugin.ObjTool, ui plugin.UI) error {
+//
+// If discard is set, the existing symbol information of each mapping whose
+// binary is found is discarded before symbolizing it, so that locations
+// the binary cannot resolve are left with only their address instead of
+// keeping stale symbols. Mappings without a usable binary are unchanged.
+//
+// It stops and returns the error of ctx once ctx is done.
+func doLocalSymbolize(ctx context.Context, prof *profile.Profile, fast, force, discard bool, obj plugin.ObjTool, ui plugin.UI) error {
 	if fast {
 		if bu, ok := obj.(*binutils.Binutils); ok {
 			bu.SetFastSymbolization(true)
@@ -150,6 +186,9 @@ func doLocalSymbolize(prof *profile.Profile, fast, force bool, obj plugin.ObjToo
 		mappingLocs[l.Mapping] = append(mappingLocs[l.Mapping], l)
 	}
 	for midx, m := range prof.Mapping {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		locs := mappingLocs[m]
 		if len(locs) == 0 {
 			// The mapping is dangling and has no locations pointing to it.
@@ -193,20 +232,70 @@ func doLocalSymbolize(prof *profile.Profile, fast, force bool, obj plugin.ObjToo
 			f.Close()
 			continue
 		}
-		symbolizeOneMapping(m, locs, f, addFunction)
+		if discard {
+			clearSymbols(m, locs)
+		}
+		n := symbolizeOneMapping(ctx, m, locs, f, addFunction)
 		f.Close()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if n > 0 {
+			ui.PrintErr("Local symbolization timed out for ", name, ": ", n, " locations left unsymbolized")
+		}
 	}
 
 	if missingBinaries {
 		ui.PrintErr("Some binary filenames not available. Symbolization may be incomplete.\n" +
 			"Try setting PPROF_BINARY_PATH to the search path for local binaries.")
 	}
+	if discard {
+		dropUnusedFunctions(prof)
+	}
 	return nil
 }
 
-func symbolizeOneMapping(m *profile.Mapping, locs []*profile.Location, obj plugin.ObjFile, addFunction func(*profile.Function) *profile.Function) {
+// clearSymbols removes the symbol information of a mapping and its
+// locations.
+func clearSymbols(m *profile.Mapping, locs []*profile.Location) {
+	m.HasFunctions, m.HasFilenames, m.HasLineNumbers, m.HasInlineFrames = false, false, false, false
 	for _, l := range locs {
+		l.Line = nil
+	}
+}
+
+// dropUnusedFunctions removes the functions no location refers to, such
+// as those whose symbols were cleared, and renumbers the others.
+func dropUnusedFunctions(prof *profile.Profile) {
+	used := make(map[*profile.Function]bool)
+	for _, l := range prof.Location {
+		for _, ln := range l.Line {
+			used[ln.Function] = true
+		}
+	}
+	var functions []*profile.Function
+	for _, f := range prof.Function {
+		if used[f] {
+			f.ID = uint64(len(functions)) + 1
+			functions = append(functions, f)
+		}
+	}
+	prof.Function = functions
+}
+
+// symbolizeOneMapping symbolizes the locations of a mapping with obj. It
+// returns the number of locations left unsymbolized because the symbolizer
+// timed out. It stops early once ctx is done.
+func symbolizeOneMapping(ctx context.Context, m *profile.Mapping, locs []*profile.Location, obj plugin.ObjFile, addFunction func(*profile.Function) *profile.Function) (timedOut int) {
+	for _, l := range locs {
+		if ctx.Err() != nil {
+			break
+		}
 		stack, err := obj.SourceLine(l.Address)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			timedOut++
+			continue
+		}
 		if err != nil || len(stack) == 0 {
 			// No answers from addr2line.
 			continue
@@ -241,6 +330,24 @@ func symbolizeOneMapping(m *profile.Mapping, locs []*profile.Location, obj plugi
 			m.HasInlineFrames = true
 		}
 	}
+	return timedOut
+}
+
+// FunctionNames returns the names of the functions the addresses resolve
+// to in obj, one slice per address with the innermost frame first. It is
+// empty for the addresses obj cannot resolve.
+func FunctionNames(obj plugin.ObjFile, addrs []uint64) [][]string {
+	names := make([][]string, len(addrs))
+	for i, addr := range addrs {
+		stack, err := obj.SourceLine(addr)
+		if err != nil {
+			continue
+		}
+		for _, frame := range stack {
+			names[i] = append(names[i], frame.Func)
+		}
+	}
+	return names
 }
 
 // Demangle updates the function names in a profile with demangled C++
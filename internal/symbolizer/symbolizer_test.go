@@ -15,8 +15,12 @@
 package symbolizer
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
@@ -154,6 +158,10 @@ func TestSymbolization(t *testing.T) {
 			"force:remote",
 			"force:symbolz=[force]",
 		},
+		{
+			"local:clear",
+			"force:local=[force,clear]",
+		},
 	} {
 		prof := testProfile.Copy()
 		if err := s.Symbolize(tc.mode, nil, prof); err != nil {
@@ -177,7 +185,7 @@ func symbolzMock(p *profile.Profile, force bool, sources plugin.MappingSources,
 	return nil
 }
 
-func localMock(p *profile.Profile, fast, force bool, obj plugin.ObjTool, ui plugin.UI) error {
+func localMock(_ context.Context, p *profile.Profile, fast, force, discard bool, obj plugin.ObjTool, ui plugin.UI) error {
 	var args []string
 	if fast {
 		args = append(args, "fast")
@@ -185,6 +193,9 @@ func localMock(p *profile.Profile, fast, force bool, obj plugin.ObjTool, ui plug
 	if force {
 		args = append(args, "force")
 	}
+	if discard {
+		args = append(args, "clear")
+	}
 	p.Comments = append(p.Comments, "local=["+strings.Join(args, ",")+"]")
 	return nil
 }
@@ -209,7 +220,7 @@ func TestLocalSymbolization(t *testing.T) {
 	}
 
 	b := mockObjTool{}
-	if err := localSymbolize(prof, false, false, b, &proftest.TestUI{T: t}); err != nil {
+	if err := localSymbolize(context.Background(), prof, false, false, false, b, &proftest.TestUI{T: t}); err != nil {
 		t.Fatalf("localSymbolize(): %v", err)
 	}
 
@@ -226,6 +237,86 @@ func TestLocalSymbolization(t *testing.T) {
 	}
 }
 
+func TestLocalSymbolizationTimeout(t *testing.T) {
+	prof := testProfile.Copy()
+	ui := &proftest.TestUI{T: t, AllowRx: "Local symbolization timed out for " + filePath}
+	if err := localSymbolize(context.Background(), prof, false, false, false, timeoutObjTool{}, ui); err != nil {
+		t.Fatalf("localSymbolize(): %v", err)
+	}
+	if ui.NumAllowRxMatches != 1 {
+		t.Errorf("got %d timeout warnings, want 1", ui.NumAllowRxMatches)
+	}
+	if prof.HasFunctions() || prof.HasFileLines() {
+		t.Error("got symbolized locations, want none")
+	}
+}
+
+func TestLocalSymbolizationCanceled(t *testing.T) {
+	prof := testProfile.Copy()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := localSymbolize(ctx, prof, false, false, false, mockObjTool{}, &proftest.TestUI{T: t}); !errors.Is(err, context.Canceled) {
+		t.Errorf("localSymbolize(): got error %v, want %v", err, context.Canceled)
+	}
+	if prof.HasFunctions() || prof.HasFileLines() {
+		t.Error("got symbolized locations, want none")
+	}
+
+	s := &Symbolizer{Obj: mockObjTool{}, UI: &proftest.TestUI{T: t}}
+	if err := s.SymbolizeContext(ctx, "local", nil, prof); !errors.Is(err, context.Canceled) {
+		t.Errorf("SymbolizeContext(): got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLocalSymbolizationClear(t *testing.T) {
+	// staleProfile returns a profile symbolized against an older binary,
+	// where the last location no longer resolves.
+	staleProfile := func() *profile.Profile {
+		prof := testProfile.Copy()
+		stale := &profile.Function{ID: 1, Name: "stale", SystemName: "stale", Filename: "stale.src"}
+		prof.Function = []*profile.Function{stale}
+		for _, l := range prof.Location {
+			l.Line = []profile.Line{{Function: stale, Line: 1}}
+		}
+		prof.Location[4].Address = 4500
+		m := prof.Mapping[0]
+		m.HasFunctions, m.HasFilenames, m.HasLineNumbers, m.HasInlineFrames = true, true, true, true
+		return prof
+	}
+
+	for _, discard := range []bool{false, true} {
+		prof := staleProfile()
+		if err := localSymbolize(context.Background(), prof, false, true, discard, mockObjTool{}, &proftest.TestUI{T: t}); err != nil {
+			t.Fatalf("localSymbolize(): %v", err)
+		}
+		for _, loc := range prof.Location[:4] {
+			if err := checkSymbolizedLocation(loc.Address, loc.Line); err != nil {
+				t.Errorf("discard=%v: location %d: %v", discard, loc.Address, err)
+			}
+		}
+		var names []string
+		for _, f := range prof.Function {
+			names = append(names, f.Name)
+		}
+		unresolved := prof.Location[4]
+		if discard {
+			if len(unresolved.Line) != 0 {
+				t.Errorf("discard=%v: got lines %v for unresolved location, want none", discard, unresolved.Line)
+			}
+			if slices.Contains(names, "stale") {
+				t.Errorf("discard=%v: got functions %q, want no stale function", discard, names)
+			}
+		} else {
+			if len(unresolved.Line) != 1 || unresolved.Line[0].Function.Name != "stale" {
+				t.Errorf("discard=%v: got lines %v for unresolved location, want the stale line", discard, unresolved.Line)
+			}
+		}
+		if err := prof.CheckValid(); err != nil {
+			t.Errorf("discard=%v: invalid profile: %v", discard, err)
+		}
+	}
+}
+
 func TestLocalSymbolizationHandlesSpecialCases(t *testing.T) {
 	for _, tc := range []struct {
 		desc, file, buildID, allowOutputRx string
@@ -273,7 +364,7 @@ func TestLocalSymbolizationHandlesSpecialCases(t *testing.T) {
 
 			b := mockObjTool{}
 			ui := &proftest.TestUI{T: t, AllowRx: tc.allowOutputRx}
-			if err := localSymbolize(prof, false, false, b, ui); err != nil {
+			if err := localSymbolize(context.Background(), prof, false, false, false, b, ui); err != nil {
 				t.Fatalf("localSymbolize(): %v", err)
 			}
 			if ui.NumAllowRxMatches != tc.wantNumOutputRegexMatches {
@@ -492,3 +583,20 @@ func (mockObjFile) Symbols(r *regexp.Regexp, addr uint64) ([]*plugin.Sym, error)
 func (mockObjFile) Close() error {
 	return nil
 }
+
+// timeoutObjTool opens files whose symbolizer always times out.
+type timeoutObjTool struct {
+	mockObjTool
+}
+
+func (timeoutObjTool) Open(file string, start, limit, offset uint64, relocationSymbol string) (plugin.ObjFile, error) {
+	return timeoutObjFile{}, nil
+}
+
+type timeoutObjFile struct {
+	mockObjFile
+}
+
+func (timeoutObjFile) SourceLine(addr uint64) ([]plugin.Frame, error) {
+	return nil, fmt.Errorf("symbolizer timed out: %w", os.ErrDeadlineExceeded)
+}
@@ -160,6 +160,64 @@ func (p *Profile) encode(b *buffer) {
 	encodeInt64Opt(b, 15, p.docURLX)
 }
 
+// TableSizes holds the number of bytes taken by each table of a profile
+// in its uncompressed serialized form.
+type TableSizes struct {
+	Samples   int
+	Locations int
+	Functions int
+	Mappings  int
+	Strings   int
+	Other     int // Sample types, comments and other header fields.
+}
+
+// Total returns the size of the serialized profile.
+func (s TableSizes) Total() int {
+	return s.Samples + s.Locations + s.Functions + s.Mappings + s.Strings + s.Other
+}
+
+// EncodedSizes returns the number of bytes each table of the profile
+// takes up when serialized, before compression. The sizes add up to the
+// size of the output of WriteUncompressed.
+func (p *Profile) EncodedSizes() TableSizes {
+	p.encodeMu.Lock()
+	defer p.encodeMu.Unlock()
+	p.preEncode()
+
+	var b buffer
+	measure := func(encode func()) int {
+		n := len(b.data)
+		encode()
+		return len(b.data) - n
+	}
+	var s TableSizes
+	s.Samples = measure(func() {
+		for _, x := range p.Sample {
+			encodeMessage(&b, 2, x)
+		}
+	})
+	s.Mappings = measure(func() {
+		for _, x := range p.Mapping {
+			encodeMessage(&b, 3, x)
+		}
+	})
+	s.Locations = measure(func() {
+		for _, x := range p.Location {
+			encodeMessage(&b, 4, x)
+		}
+	})
+	s.Functions = measure(func() {
+		for _, x := range p.Function {
+			encodeMessage(&b, 5, x)
+		}
+	})
+	s.Strings = measure(func() {
+		encodeStrings(&b, 6, p.stringTable)
+	})
+	s.Other = len(marshal(p)) - s.Total()
+	return s
+}
+
 var profileDecoder = []decoder{
 	nil, // 0
 	// repeated ValueType sample_type = 1
@@ -16,12 +16,26 @@ package profile
 
 // Implements methods to filter samples from profiles.
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+)
 
 // FilterSamplesByName filters the samples in a profile and only keeps
 // samples where at least one frame matches focus but none match ignore.
 // Returns true is the corresponding regexp matched at least one sample.
 func (p *Profile) FilterSamplesByName(focus, ignore, hide, show *regexp.Regexp) (fm, im, hm, hnm bool) {
+	return p.filterSamplesByName(focus, ignore, hide, show, false)
+}
+
+// FilterSamplesByAnyName is like FilterSamplesByName, but the regular
+// expressions are also matched against the system names of functions,
+// such as the mangled names of C++ functions.
+func (p *Profile) FilterSamplesByAnyName(focus, ignore, hide, show *regexp.Regexp) (fm, im, hm, hnm bool) {
+	return p.filterSamplesByName(focus, ignore, hide, show, true)
+}
+
+func (p *Profile) filterSamplesByName(focus, ignore, hide, show *regexp.Regexp, systemName bool) (fm, im, hm, hnm bool) {
 	if focus == nil && ignore == nil && hide == nil && show == nil {
 		fm = true // Missing focus implies a match
 		return
@@ -29,23 +43,23 @@ func (p *Profile) FilterSamplesByName(focus, ignore, hide, show *regexp.Regexp)
 	focusOrIgnore := make(map[uint64]bool)
 	hidden := make(map[uint64]bool)
 	for _, l := range p.Location {
-		if ignore != nil && l.matchesName(ignore) {
+		if ignore != nil && l.matchesName(ignore, systemName) {
 			im = true
 			focusOrIgnore[l.ID] = false
-		} else if focus == nil || l.matchesName(focus) {
+		} else if focus == nil || l.matchesName(focus, systemName) {
 			fm = true
 			focusOrIgnore[l.ID] = true
 		}
 
-		if hide != nil && l.matchesName(hide) {
+		if hide != nil && l.matchesName(hide, systemName) {
 			hm = true
-			l.Line = l.unmatchedLines(hide)
+			l.Line = l.unmatchedLines(hide, systemName)
 			if len(l.Line) == 0 {
 				hidden[l.ID] = true
 			}
 		}
 		if show != nil {
-			l.Line = l.matchedLines(show)
+			l.Line = l.matchedLines(show, systemName)
 			if len(l.Line) == 0 {
 				hidden[l.ID] = true
 			} else {
@@ -116,6 +130,26 @@ func (p *Profile) ShowFrom(showFrom *regexp.Regexp) (matched bool) {
 	return matched
 }
 
+// FilterSamplesByLeaf keeps only the samples whose leaf location, the first
+// location of the sample, matches focus, and returns whether any did. The
+// location matches if any of its frames, including those of functions
+// inlined at it, or its mapping does, as for FilterSamplesByName; system
+// names are also matched if systemName is set. If focus is nil it returns
+// false and does not modify the profile.
+func (p *Profile) FilterSamplesByLeaf(focus *regexp.Regexp, systemName bool) (matched bool) {
+	if focus == nil {
+		return false
+	}
+	s := make([]*Sample, 0, len(p.Sample))
+	for _, sample := range p.Sample {
+		if len(sample.Location) > 0 && sample.Location[0].matchesName(focus, systemName) {
+			s = append(s, sample)
+		}
+	}
+	p.Sample = s
+	return len(s) > 0
+}
+
 // filterShowFromLocation tests a showFrom regex against a location, removes
 // lines after the last match and returns whether a match was found. If the
 // mapping is matched, then all lines are kept.
@@ -173,13 +207,20 @@ func (p *Profile) FilterTagsByName(show, hide *regexp.Regexp) (sm, hm bool) {
 	return
 }
 
+// matchesFunction returns whether the function name or file name of fn
+// matches the regular expression, or its system name if systemName is set.
+func matchesFunction(fn *Function, re *regexp.Regexp, systemName bool) bool {
+	return re.MatchString(fn.Name) || re.MatchString(fn.Filename) ||
+		(systemName && re.MatchString(fn.SystemName))
+}
+
 // matchesName returns whether the location matches the regular
 // expression. It checks any available function names, file names, and
-// mapping object filename.
-func (loc *Location) matchesName(re *regexp.Regexp) bool {
+// mapping object filename, as well as system names if systemName is set.
+func (loc *Location) matchesName(re *regexp.Regexp, systemName bool) bool {
 	for _, ln := range loc.Line {
 		if fn := ln.Function; fn != nil {
-			if re.MatchString(fn.Name) || re.MatchString(fn.Filename) {
+			if matchesFunction(fn, re, systemName) {
 				return true
 			}
 		}
@@ -192,14 +233,14 @@ func (loc *Location) matchesName(re *regexp.Regexp) bool {
 
 // unmatchedLines returns the lines in the location that do not match
 // the regular expression.
-func (loc *Location) unmatchedLines(re *regexp.Regexp) []Line {
+func (loc *Location) unmatchedLines(re *regexp.Regexp, systemName bool) []Line {
 	if m := loc.Mapping; m != nil && re.MatchString(m.File) {
 		return nil
 	}
 	var lines []Line
 	for _, ln := range loc.Line {
 		if fn := ln.Function; fn != nil {
-			if re.MatchString(fn.Name) || re.MatchString(fn.Filename) {
+			if matchesFunction(fn, re, systemName) {
 				continue
 			}
 		}
@@ -210,14 +251,14 @@ func (loc *Location) unmatchedLines(re *regexp.Regexp) []Line {
 
 // matchedLines returns the lines in the location that match
 // the regular expression.
-func (loc *Location) matchedLines(re *regexp.Regexp) []Line {
+func (loc *Location) matchedLines(re *regexp.Regexp, systemName bool) []Line {
 	if m := loc.Mapping; m != nil && re.MatchString(m.File) {
 		return loc.Line
 	}
 	var lines []Line
 	for _, ln := range loc.Line {
 		if fn := ln.Function; fn != nil {
-			if !re.MatchString(fn.Name) && !re.MatchString(fn.Filename) {
+			if !matchesFunction(fn, re, systemName) {
 				continue
 			}
 		}
@@ -247,6 +288,54 @@ func focusedAndNotIgnored(locs []*Location, m map[uint64]bool) bool {
 	return f
 }
 
+// FilterSamplesByBuildID removes all samples from the profile, except
+// those with a location in a mapping whose build ID starts with buildID,
+// ignoring case. It reports whether any sample was kept.
+func (p *Profile) FilterSamplesByBuildID(buildID string) (fm bool) {
+	buildID = strings.ToLower(buildID)
+	matched := make(map[*Mapping]bool)
+	for _, m := range p.Mapping {
+		matched[m] = strings.HasPrefix(strings.ToLower(m.BuildID), buildID)
+	}
+	samples := make([]*Sample, 0, len(p.Sample))
+	for _, s := range p.Sample {
+		for _, loc := range s.Location {
+			if matched[loc.Mapping] {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	p.Sample = samples
+	return len(samples) > 0
+}
+
+// FilterSamplesByMappingOffset removes all samples from the profile, except
+// those with a location in a mapping of the given file whose file offset,
+// its address minus the start of the mapping plus the mapping offset, is in
+// the range [start, end). It reports whether any sample was kept.
+func (p *Profile) FilterSamplesByMappingOffset(file string, start, end uint64) (fm bool) {
+	inRange := func(loc *Location) bool {
+		m := loc.Mapping
+		if m == nil || m.File != file || loc.Address < m.Start {
+			return false
+		}
+		offset := loc.Address - m.Start + m.Offset
+		return offset >= start && offset < end
+	}
+	samples := make([]*Sample, 0, len(p.Sample))
+	for _, s := range p.Sample {
+		for _, loc := range s.Location {
+			if inRange(loc) {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	p.Sample = samples
+	return len(samples) > 0
+}
+
 // TagMatch selects tags for filtering
 type TagMatch func(s *Sample) bool
 
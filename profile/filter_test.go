@@ -16,6 +16,7 @@ package profile
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -414,6 +415,79 @@ func TestFilterSamplesByName(t *testing.T) {
 	}
 }
 
+func TestFilterSamplesByAnyName(t *testing.T) {
+	fns := []*Function{
+		{ID: 1, Name: "ns::Foo()", SystemName: "_ZN2ns3FooEv", Filename: "foo.cc"},
+		{ID: 2, Name: "ns::Bar()", SystemName: "_ZN2ns3BarEv", Filename: "bar.cc"},
+	}
+	locs := []*Location{
+		{ID: 1, Mapping: mappings[0], Address: 0x1000, Line: []Line{{Function: fns[0], Line: 1}}},
+		{ID: 2, Mapping: mappings[0], Address: 0x2000, Line: []Line{{Function: fns[1], Line: 1}}},
+	}
+	mangledProfile := &Profile{
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Mapping:    mappings,
+		Function:   fns,
+		Location:   locs,
+		Sample: []*Sample{
+			{Value: []int64{1}, Location: []*Location{locs[0]}},
+			{Value: []int64{2}, Location: []*Location{locs[1], locs[0]}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name                      string
+		focus, ignore, hide, show *regexp.Regexp
+		// Expected samples when also matching system names, and when
+		// matching only names.
+		wantAny, wantName []string
+	}{
+		{
+			name:     "focus on mangled name",
+			focus:    regexp.MustCompile("_ZN2ns3Bar"),
+			wantAny:  []string{"ns::Bar() ns::Foo(): 2"},
+			wantName: nil,
+		},
+		{
+			name:     "ignore mangled name",
+			ignore:   regexp.MustCompile("3BarEv$"),
+			wantAny:  []string{"ns::Foo(): 1"},
+			wantName: []string{"ns::Foo(): 1", "ns::Bar() ns::Foo(): 2"},
+		},
+		{
+			name:     "hide mangled name",
+			hide:     regexp.MustCompile("3Bar"),
+			wantAny:  []string{"ns::Foo(): 1", "ns::Foo(): 2"},
+			wantName: []string{"ns::Foo(): 1", "ns::Bar() ns::Foo(): 2"},
+		},
+		{
+			name:     "show mangled name",
+			show:     regexp.MustCompile("3Bar"),
+			wantAny:  []string{"ns::Bar(): 2"},
+			wantName: nil,
+		},
+		{
+			name:     "demangled names still match",
+			focus:    regexp.MustCompile(`ns::Bar\(\)`),
+			wantAny:  []string{"ns::Bar() ns::Foo(): 2"},
+			wantName: []string{"ns::Bar() ns::Foo(): 2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mangledProfile.Copy()
+			p.FilterSamplesByAnyName(tc.focus, tc.ignore, tc.hide, tc.show)
+			if got := sampleFuncs(p); !reflect.DeepEqual(got, tc.wantAny) {
+				t.Errorf("FilterSamplesByAnyName: got %q, want %q", got, tc.wantAny)
+			}
+			p = mangledProfile.Copy()
+			p.FilterSamplesByName(tc.focus, tc.ignore, tc.hide, tc.show)
+			if got := sampleFuncs(p); !reflect.DeepEqual(got, tc.wantName) {
+				t.Errorf("FilterSamplesByName: got %q, want %q", got, tc.wantName)
+			}
+		})
+	}
+}
+
 func TestShowFrom(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
@@ -538,6 +612,74 @@ func TestShowFrom(t *testing.T) {
 	}
 }
 
+func TestFilterSamplesByLeaf(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		profile   *Profile
+		focus     *regexp.Regexp
+		wantMatch bool
+		// wantSampleFuncs is in the format returned by sampleFuncs.
+		wantSampleFuncs []string
+	}{
+		{
+			name:            "nil focus keeps all samples",
+			profile:         noInlinesProfile,
+			wantSampleFuncs: allNoInlinesSampleFuncs,
+		},
+		{
+			name:      "leaf and non-leaf occurrences",
+			profile:   noInlinesProfile,
+			focus:     regexp.MustCompile("fun4"),
+			wantMatch: true,
+			// fun4 is also in the last sample, but not as its leaf.
+			wantSampleFuncs: []string{"fun4 fun5 fun1 fun6: 2"},
+		},
+		{
+			name:      "only non-leaf occurrences",
+			profile:   noInlinesProfile,
+			focus:     regexp.MustCompile("fun1$"),
+			wantMatch: false,
+		},
+		{
+			name:      "mapping of the leaf",
+			profile:   noInlinesProfile,
+			focus:     regexp.MustCompile("map0"),
+			wantMatch: true,
+			wantSampleFuncs: []string{
+				"fun0 fun1 fun2 fun3: 1",
+				"fun4 fun5 fun1 fun6: 2",
+				"fun7 fun8: 3",
+				"fun9 fun4 fun10 fun7: 4",
+			},
+		},
+		{
+			name:      "function inlined at the leaf location",
+			profile:   inlinesProfile,
+			focus:     regexp.MustCompile("fun1$"),
+			wantMatch: true,
+			wantSampleFuncs: []string{
+				"fun0 fun1 fun2 fun3: 1",
+			},
+		},
+		{
+			name:      "function of a non-leaf location",
+			profile:   inlinesProfile,
+			focus:     regexp.MustCompile("fun2"),
+			wantMatch: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.profile.Copy()
+			if gotMatch := p.FilterSamplesByLeaf(tc.focus, false); gotMatch != tc.wantMatch {
+				t.Errorf("match got %v, want %v", gotMatch, tc.wantMatch)
+			}
+			if got := sampleFuncs(p); !reflect.DeepEqual(got, tc.wantSampleFuncs) {
+				t.Errorf("got samples %q, want %q", got, tc.wantSampleFuncs)
+			}
+		})
+	}
+}
+
 // sampleFuncs returns a slice of strings where each string represents one
 // profile sample in the format "<fun1> <fun2> <fun3>: <value>". This allows
 // the expected values for test cases to be specified in human-readable
@@ -598,3 +740,95 @@ func TestTagFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterSamplesByBuildID(t *testing.T) {
+	// Two versions of the same library, mapped at different addresses.
+	libs := []*Mapping{
+		{ID: 1, Start: 0x10000, Limit: 0x20000, File: "main", BuildID: "aaaa1111"},
+		{ID: 2, Start: 0x30000, Limit: 0x40000, File: "libfoo.so", BuildID: "BBBB2222"},
+		{ID: 3, Start: 0x50000, Limit: 0x60000, File: "libfoo.so", BuildID: "cccc3333"},
+	}
+	locs := []*Location{
+		{ID: 1, Mapping: libs[0], Address: 0x11000, Line: []Line{{Function: functions[0]}}},
+		{ID: 2, Mapping: libs[1], Address: 0x31000, Line: []Line{{Function: functions[1]}}},
+		{ID: 3, Mapping: libs[2], Address: 0x51000, Line: []Line{{Function: functions[1]}}},
+	}
+	p := &Profile{
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Mapping:    libs,
+		Function:   functions,
+		Location:   locs,
+		Sample: []*Sample{
+			{Value: []int64{1}, Location: []*Location{locs[1], locs[0]}},
+			{Value: []int64{2}, Location: []*Location{locs[2], locs[0]}},
+			{Value: []int64{3}, Location: []*Location{locs[0]}},
+		},
+	}
+
+	for _, tc := range []struct {
+		buildID string
+		want    []string
+	}{
+		{"bbbb2222", []string{"fun1 fun0: 1"}},
+		{"cccc", []string{"fun1 fun0: 2"}},
+		{"AAAA", []string{"fun1 fun0: 1", "fun1 fun0: 2", "fun0: 3"}},
+		{"dddd", nil},
+	} {
+		prof := p.Copy()
+		fm := prof.FilterSamplesByBuildID(tc.buildID)
+		if want := tc.want != nil; fm != want {
+			t.Errorf("FilterSamplesByBuildID(%s): got match %v, want %v", tc.buildID, fm, want)
+		}
+		if got := sampleFuncs(prof); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("FilterSamplesByBuildID(%s): got samples %v, want %v", tc.buildID, got, tc.want)
+		}
+	}
+}
+
+func TestFilterSamplesByMappingOffset(t *testing.T) {
+	// The JIT region is mapped twice, the second time from file offset 0x1000.
+	maps := []*Mapping{
+		{ID: 1, Start: 0x10000, Limit: 0x20000, File: "main"},
+		{ID: 2, Start: 0x30000, Limit: 0x40000, File: "jit"},
+		{ID: 3, Start: 0x50000, Limit: 0x60000, Offset: 0x1000, File: "jit"},
+	}
+	locs := []*Location{
+		{ID: 1, Mapping: maps[0], Address: 0x10200, Line: []Line{{Function: functions[0]}}},
+		{ID: 2, Mapping: maps[1], Address: 0x30200, Line: []Line{{Function: functions[1]}}},
+		{ID: 3, Mapping: maps[2], Address: 0x50200, Line: []Line{{Function: functions[1]}}},
+	}
+	p := &Profile{
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Mapping:    maps,
+		Function:   functions,
+		Location:   locs,
+		Sample: []*Sample{
+			{Value: []int64{1}, Location: []*Location{locs[1], locs[0]}},
+			{Value: []int64{2}, Location: []*Location{locs[2], locs[0]}},
+			{Value: []int64{3}, Location: []*Location{locs[0]}},
+		},
+	}
+
+	for _, tc := range []struct {
+		file       string
+		start, end uint64
+		want       []string
+	}{
+		// Offset 0x200 in jit is at 0x30200, offset 0x1200 at 0x50200.
+		{"jit", 0x100, 0x300, []string{"fun1 fun0: 1"}},
+		{"jit", 0x1200, 0x1201, []string{"fun1 fun0: 2"}},
+		{"jit", 0, 0x2000, []string{"fun1 fun0: 1", "fun1 fun0: 2"}},
+		{"jit", 0x300, 0x1200, nil},
+		{"main", 0x200, 0x201, []string{"fun1 fun0: 1", "fun1 fun0: 2", "fun0: 3"}},
+		{"other", 0, 0x100000, nil},
+	} {
+		prof := p.Copy()
+		fm := prof.FilterSamplesByMappingOffset(tc.file, tc.start, tc.end)
+		if want := tc.want != nil; fm != want {
+			t.Errorf("FilterSamplesByMappingOffset(%s, %#x, %#x): got match %v, want %v", tc.file, tc.start, tc.end, fm, want)
+		}
+		if got := sampleFuncs(prof); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("FilterSamplesByMappingOffset(%s, %#x, %#x): got samples %v, want %v", tc.file, tc.start, tc.end, got, tc.want)
+		}
+	}
+}
@@ -677,6 +677,30 @@ func scaleHeapSample(count, size, rate int64) (int64, int64) {
 	return int64(float64(count) * scale), int64(float64(size) * scale)
 }
 
+// UnsampleHeap estimates the unsampled values of a heap profile whose
+// values are the sampled allocations, collected on average every Period
+// bytes, such as older heap profiles. An allocation of S bytes is sampled
+// with the probability 1-exp(-S/Period), so the object count and size of
+// each sample are divided by that probability, S being the average size of
+// the objects of the sample. It reports whether the profile is a heap
+// profile with a sampling period; it is left unchanged otherwise.
+//
+// Profiles whose values were already unsampled, as those of the Go
+// runtime and the legacy heapz profiles parsed by this package, must not
+// be unsampled again.
+func (p *Profile) UnsampleHeap() bool {
+	if !isProfileType(p, heapzSampleTypes) || p.PeriodType == nil || p.PeriodType.Unit != "bytes" || p.Period <= 1 {
+		return false
+	}
+	for _, s := range p.Sample {
+		// Heap profiles have object count and size value pairs.
+		for i := 0; i+1 < len(s.Value); i += 2 {
+			s.Value[i], s.Value[i+1] = scaleHeapSample(s.Value[i], s.Value[i+1], p.Period)
+		}
+	}
+	return true
+}
+
 // parseContention parses a mutex or contention profile. There are 2 cases:
 // "--- contentionz " for legacy C++ profiles (and backwards compatibility)
 // "--- mutex:" or "--- contention:" for profiles generated by the Go runtime.
@@ -319,3 +319,65 @@ sub/dir-ect_o.ry profile: total 999
 		})
 	}
 }
+
+func TestUnsampleHeap(t *testing.T) {
+	heap := func(period int64, values ...[]int64) *Profile {
+		p := &Profile{
+			SampleType: []*ValueType{
+				{Type: "alloc_objects", Unit: "count"},
+				{Type: "alloc_space", Unit: "bytes"},
+				{Type: "inuse_objects", Unit: "count"},
+				{Type: "inuse_space", Unit: "bytes"},
+			},
+			PeriodType: &ValueType{Type: "space", Unit: "bytes"},
+			Period:     period,
+		}
+		for _, v := range values {
+			p.Sample = append(p.Sample, &Sample{Value: v})
+		}
+		return p
+	}
+
+	p := heap(524288,
+		// An allocation of the size of the sampling period is sampled
+		// with the probability 1-1/e.
+		[]int64{1, 524288, 0, 0},
+		// Small allocations are rarely sampled.
+		[]int64{10, 1000, 2, 200},
+		// Large allocations are almost always sampled.
+		[]int64{2, 4194304, 2, 4194304},
+	)
+	if !p.UnsampleHeap() {
+		t.Fatal("UnsampleHeap: got false, want true")
+	}
+	want := [][]int64{
+		{1, 829411, 0, 0},
+		{52433, 5243380, 10486, 1048676},
+		{2, 4272558, 2, 4272558},
+	}
+	for i, s := range p.Sample {
+		if !reflect.DeepEqual(s.Value, want[i]) {
+			t.Errorf("sample %d: got %v, want %v", i, s.Value, want[i])
+		}
+	}
+
+	// Profiles collecting every allocation and other profiles are left
+	// unchanged.
+	for _, p := range []*Profile{
+		heap(1, []int64{10, 1000, 2, 200}),
+		{
+			SampleType: []*ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+			PeriodType: &ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Period:     10000000,
+			Sample:     []*Sample{{Value: []int64{10, 1000}}},
+		},
+	} {
+		before := p.Copy()
+		if p.UnsampleHeap() {
+			t.Errorf("UnsampleHeap of %v: got true, want false", p.SampleType)
+		}
+		if !reflect.DeepEqual(p.Sample[0].Value, before.Sample[0].Value) {
+			t.Errorf("UnsampleHeap of %v: changed values to %v", p.SampleType, p.Sample[0].Value)
+		}
+	}
+}
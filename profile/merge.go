@@ -30,6 +30,28 @@ func (p *Profile) Compact() *Profile {
 	return p
 }
 
+// RemoveZeroSamples removes the samples of p whose values are all zero,
+// as can result from scaling or subtracting profiles; a sample with any
+// non-zero value is kept. The profile is then compacted in place,
+// dropping the locations, functions and mappings no longer referenced.
+func (p *Profile) RemoveZeroSamples() {
+	fillIdx := 0
+	for _, s := range p.Sample {
+		if !isZeroSample(s) {
+			p.Sample[fillIdx] = s
+			fillIdx++
+		}
+	}
+	p.Sample = p.Sample[:fillIdx]
+
+	c := p.Compact()
+	if c == nil {
+		// The profile could not be merged with itself; keep its tables.
+		return
+	}
+	p.Sample, p.Location, p.Function, p.Mapping = c.Sample, c.Location, c.Function, c.Mapping
+}
+
 // Merge merges all the profiles in profs into a single Profile.
 // Returns a new profile independent of the input profiles. The merged
 // profile is compacted to eliminate unused samples, locations,
@@ -41,6 +63,42 @@ func (p *Profile) Compact() *Profile {
 // specialization in how headers are combined. There may be other
 // subtleties now or in the future regarding associativity.
 func Merge(srcs []*Profile) (*Profile, error) {
+	return MergeReducer(srcs, nil)
+}
+
+// MergeCompatible merges profiles like Merge, after making their sample
+// types compatible with CompatibilizeSampleTypes, which modifies the
+// profiles in place. It also returns the sample types dropped because they
+// do not appear in all the profiles, in the order in which they first
+// appear, so that callers can report what the merged profile lost.
+func MergeCompatible(srcs []*Profile) (*Profile, []string, error) {
+	if len(srcs) == 0 {
+		return nil, nil, fmt.Errorf("no profiles to merge")
+	}
+	dropped := uncommonSampleTypes(srcs, commonSampleTypes(srcs))
+	if err := CompatibilizeSampleTypes(srcs); err != nil {
+		return nil, nil, err
+	}
+	p, err := Merge(srcs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, dropped, nil
+}
+
+// MergeReducer merges profiles like Merge, but combines the values of
+// matching samples using reduce instead of adding them up. reduce is
+// called with the value accumulated so far and the value of the next
+// matching sample, for each sample value index, and must be associative
+// for the result not to depend on the order of the samples. Passing
+// a nil reduce sums the values, as Merge does. For example, to track
+// peak usage across a series of snapshots:
+//
+//	p, err := MergeReducer(snapshots, func(a, b int64) int64 { return max(a, b) })
+//
+// Note that reduce also applies to matching samples within a single
+// profile.
+func MergeReducer(srcs []*Profile, reduce func(a, b int64) int64) (*Profile, error) {
 	if len(srcs) == 0 {
 		return nil, fmt.Errorf("no profiles to merge")
 	}
@@ -51,6 +109,7 @@ func Merge(srcs []*Profile) (*Profile, error) {
 
 	pm := &profileMerger{
 		p:         p,
+		reduce:    reduce,
 		samples:   make(map[sampleKey]*Sample, len(srcs[0].Sample)),
 		locations: make(map[locationKey]*Location, len(srcs[0].Location)),
 		functions: make(map[functionKey]*Function, len(srcs[0].Function)),
@@ -82,7 +141,7 @@ func Merge(srcs []*Profile) (*Profile, error) {
 		if isZeroSample(s) {
 			// If there are any zero samples, re-merge the profile to GC
 			// them.
-			return Merge([]*Profile{p})
+			return MergeReducer([]*Profile{p}, reduce)
 		}
 	}
 
@@ -124,6 +183,37 @@ func (p *Profile) Normalize(pb *Profile) error {
 	return nil
 }
 
+// RebaseAddresses rewrites the addresses of locations in mappings that
+// have a build ID so that they are relative to the start of the mapped
+// file: each such mapping is moved to start at its file offset, and its
+// locations are shifted by the same amount. Profiles collected from runs
+// with different load addresses then agree on location addresses, and
+// merge into the same locations. Mappings without a build ID, including
+// anonymous and kernel mappings, are left unchanged since their addresses
+// cannot be attributed to a specific module image. Rebasing should be
+// done after symbolization, as symbolizers expect the original runtime
+// addresses.
+func (p *Profile) RebaseAddresses() {
+	delta := make(map[*Mapping]uint64)
+	for _, m := range p.Mapping {
+		if m.BuildID == "" || m.KernelRelocationSymbol != "" || m.Start == m.Offset {
+			continue
+		}
+		d := m.Start - m.Offset
+		m.Start -= d
+		m.Limit -= d
+		delta[m] = d
+	}
+	if len(delta) == 0 {
+		return
+	}
+	for _, l := range p.Location {
+		if d, ok := delta[l.Mapping]; ok {
+			l.Address -= d
+		}
+	}
+}
+
 func isZeroSample(s *Sample) bool {
 	for _, v := range s.Value {
 		if v != 0 {
@@ -136,6 +226,9 @@ func isZeroSample(s *Sample) bool {
 type profileMerger struct {
 	p *Profile
 
+	// reduce combines the values of matching samples; nil means sum.
+	reduce func(a, b int64) int64
+
 	// Memoization tables within a profile.
 	locationsByID locationIDMap
 	functionsByID map[uint64]*Function
@@ -157,6 +250,12 @@ func (pm *profileMerger) mapSample(src *Sample) *Sample {
 	// Check memoization table
 	k := pm.sampleKey(src)
 	if ss, ok := pm.samples[k]; ok {
+		if pm.reduce != nil {
+			for i, v := range src.Value {
+				ss.Value[i] = pm.reduce(ss.Value[i], v)
+			}
+			return ss
+		}
 		for i, v := range src.Value {
 			ss.Value[i] += v
 		}
@@ -618,6 +717,25 @@ func commonSampleTypes(ps []*Profile) []string {
 	return res
 }
 
+// uncommonSampleTypes returns the sample types of the profiles that are not
+// in the common list, in the order in which they first appear.
+func uncommonSampleTypes(ps []*Profile, common []string) []string {
+	seen := make(map[string]bool, len(common))
+	for _, st := range common {
+		seen[st] = true
+	}
+	var res []string
+	for _, p := range ps {
+		for _, st := range p.SampleType {
+			if !seen[st.Type] {
+				seen[st.Type] = true
+				res = append(res, st.Type)
+			}
+		}
+	}
+	return res
+}
+
 // compatibilizeSampleTypes drops sample types that are not present in sTypes
 // list and reorder them if needed.
 //
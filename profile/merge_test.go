@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/google/pprof/internal/proftest"
@@ -445,6 +446,87 @@ func TestCompatibilizeSampleTypes(t *testing.T) {
 	}
 }
 
+func TestMergeCompatible(t *testing.T) {
+	fn := &Function{ID: 1, Name: "main"}
+	loc := &Location{ID: 1, Line: []Line{{Function: fn}}}
+	makeProfile := func(types ...string) *Profile {
+		p := &Profile{
+			PeriodType: &ValueType{Type: "cpu", Unit: "count"},
+			Function:   []*Function{fn},
+			Location:   []*Location{loc},
+		}
+		var values []int64
+		for i, st := range types {
+			p.SampleType = append(p.SampleType, &ValueType{Type: st, Unit: "count"})
+			values = append(values, int64(i+1))
+		}
+		p.Sample = []*Sample{{Location: []*Location{loc}, Value: values}}
+		return p
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		ps          []*Profile
+		wantTypes   []string
+		wantValues  []int64
+		wantDropped []string
+		wantErr     bool
+	}{
+		{
+			desc:       "identical sample types",
+			ps:         []*Profile{makeProfile("a", "b"), makeProfile("a", "b")},
+			wantTypes:  []string{"a", "b"},
+			wantValues: []int64{2, 4},
+		},
+		{
+			desc:        "overlapping sample types",
+			ps:          []*Profile{makeProfile("a", "b", "c"), makeProfile("d", "c", "a")},
+			wantTypes:   []string{"a", "c"},
+			wantValues:  []int64{1 + 3, 3 + 2},
+			wantDropped: []string{"b", "d"},
+		},
+		{
+			desc:        "type dropped from several profiles is listed once",
+			ps:          []*Profile{makeProfile("a", "b"), makeProfile("a"), makeProfile("b", "a")},
+			wantTypes:   []string{"a"},
+			wantValues:  []int64{1 + 1 + 2},
+			wantDropped: []string{"b"},
+		},
+		{
+			desc:    "disjoint sample types",
+			ps:      []*Profile{makeProfile("a"), makeProfile("b")},
+			wantErr: true,
+		},
+		{
+			desc:    "no profiles",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, dropped, err := MergeCompatible(tc.ps)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("MergeCompatible() returned error: %v, want any error=%t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(dropped, tc.wantDropped) {
+				t.Errorf("got dropped sample types %q, want %q", dropped, tc.wantDropped)
+			}
+			var types []string
+			for _, st := range p.SampleType {
+				types = append(types, st.Type)
+			}
+			if !reflect.DeepEqual(types, tc.wantTypes) {
+				t.Errorf("got sample types %q, want %q", types, tc.wantTypes)
+			}
+			if len(p.Sample) != 1 || !reflect.DeepEqual(p.Sample[0].Value, tc.wantValues) {
+				t.Errorf("got samples %v, want a single sample with values %v", p.Sample, tc.wantValues)
+			}
+		})
+	}
+}
+
 func TestDocURLMerge(t *testing.T) {
 	const url1 = "http://example.com/url1"
 	const url2 = "http://example.com/url2"
@@ -504,3 +586,175 @@ func TestDocURLMerge(t *testing.T) {
 		})
 	}
 }
+
+func TestRebaseAddresses(t *testing.T) {
+	// aslrProfile returns a profile with the main binary loaded at start,
+	// and a mapping without a build ID at anonStart.
+	aslrProfile := func(start, anonStart uint64) *Profile {
+		mapping := &Mapping{ID: 1, Start: start, Limit: start + 0x3000, Offset: 0x1000, File: "/bin/main", BuildID: "abcdef"}
+		anon := &Mapping{ID: 2, Start: anonStart, Limit: anonStart + 0x1000}
+		fn := &Function{ID: 1, Name: "main"}
+		locs := []*Location{
+			{ID: 1, Mapping: mapping, Address: start + 0x10, Line: []Line{{Function: fn, Line: 1}}},
+			{ID: 2, Mapping: mapping, Address: start + 0x20, Line: []Line{{Function: fn, Line: 2}}},
+			{ID: 3, Mapping: anon, Address: anonStart + 0x30},
+		}
+		return &Profile{
+			PeriodType: &ValueType{Type: "cpu", Unit: "milliseconds"},
+			SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+			Sample: []*Sample{
+				{Location: []*Location{locs[0], locs[2]}, Value: []int64{1}},
+				{Location: []*Location{locs[1]}, Value: []int64{2}},
+			},
+			Location: locs,
+			Mapping:  []*Mapping{mapping, anon},
+			Function: []*Function{fn},
+		}
+	}
+
+	p1 := aslrProfile(0x400000, 0x7f0000)
+	p2 := aslrProfile(0x555000, 0x7f0000)
+	p1.RebaseAddresses()
+	p2.RebaseAddresses()
+
+	for _, p := range []*Profile{p1, p2} {
+		if m := p.Mapping[0]; m.Start != 0x1000 || m.Limit != 0x4000 {
+			t.Errorf("rebased mapping is [%#x, %#x), want [0x1000, 0x4000)", m.Start, m.Limit)
+		}
+		if got, want := p.Location[0].Address, uint64(0x1010); got != want {
+			t.Errorf("rebased address = %#x, want %#x", got, want)
+		}
+		// Mappings without a build ID are not rebased.
+		if m := p.Mapping[1]; m.Start != 0x7f0000 {
+			t.Errorf("mapping without build ID moved to %#x, want 0x7f0000", m.Start)
+		}
+		if got, want := p.Location[2].Address, uint64(0x7f0030); got != want {
+			t.Errorf("address in mapping without build ID = %#x, want %#x", got, want)
+		}
+		if err := p.CheckValid(); err != nil {
+			t.Errorf("invalid rebased profile: %v", err)
+		}
+	}
+
+	// Without rebasing, the merged profile would keep the addresses of
+	// whichever profile comes first.
+	for _, profs := range [][]*Profile{{p1, p2}, {p2, p1}} {
+		merged, err := Merge(profs)
+		if err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+		if got, want := len(merged.Mapping), 2; got != want {
+			t.Errorf("merged profile has %d mappings, want %d", got, want)
+		}
+		if m := merged.Mapping[0]; m.Start != 0x1000 || m.Limit != 0x4000 {
+			t.Errorf("merged mapping is [%#x, %#x), want [0x1000, 0x4000)", m.Start, m.Limit)
+		}
+		var addrs []uint64
+		for _, l := range merged.Location {
+			addrs = append(addrs, l.Address)
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+		if want := []uint64{0x1010, 0x1020, 0x7f0030}; !reflect.DeepEqual(addrs, want) {
+			t.Errorf("merged location addresses = %#x, want %#x", addrs, want)
+		}
+		if got, want := len(merged.Sample), 2; got != want {
+			t.Errorf("merged profile has %d samples, want %d", got, want)
+		}
+		for _, s := range merged.Sample {
+			// Each sample of the source profiles appears twice.
+			want := map[int]int64{2: 2, 1: 4}[len(s.Location)]
+			if s.Value[0] != want {
+				t.Errorf("merged sample with %d locations has value %d, want %d", len(s.Location), s.Value[0], want)
+			}
+		}
+	}
+}
+
+func TestMergeReducer(t *testing.T) {
+	fn := &Function{ID: 1, Name: "f"}
+	gn := &Function{ID: 2, Name: "g"}
+	snapshot := func(fv, gv int64) *Profile {
+		locs := []*Location{
+			{ID: 1, Address: 0x10, Line: []Line{{Function: fn, Line: 1}}},
+			{ID: 2, Address: 0x20, Line: []Line{{Function: gn, Line: 2}}},
+		}
+		return &Profile{
+			PeriodType: &ValueType{Type: "space", Unit: "bytes"},
+			SampleType: []*ValueType{{Type: "inuse_space", Unit: "bytes"}},
+			Sample: []*Sample{
+				{Location: []*Location{locs[0]}, Value: []int64{fv}},
+				{Location: []*Location{locs[1]}, Value: []int64{gv}},
+			},
+			Location: locs,
+			Function: []*Function{fn, gn},
+		}
+	}
+	srcs := []*Profile{snapshot(100, 5), snapshot(30, 50), snapshot(70, 20)}
+	maxReducer := func(a, b int64) int64 { return max(a, b) }
+
+	for _, tc := range []struct {
+		desc   string
+		reduce func(a, b int64) int64
+		want   map[string]int64
+	}{
+		{"max", maxReducer, map[string]int64{"f": 100, "g": 50}},
+		{"nil sums", nil, map[string]int64{"f": 200, "g": 75}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := MergeReducer(srcs, tc.reduce)
+			if err != nil {
+				t.Fatalf("MergeReducer: %v", err)
+			}
+			got := make(map[string]int64)
+			for _, s := range p.Sample {
+				got[s.Location[0].Line[0].Function.Name] += s.Value[0]
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("merged values %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRemoveZeroSamples(t *testing.T) {
+	fns := []*Function{{ID: 1, Name: "f"}, {ID: 2, Name: "g"}, {ID: 3, Name: "h"}}
+	var locs []*Location
+	for i, fn := range fns {
+		locs = append(locs, &Location{ID: uint64(i + 1), Address: uint64(0x10 * (i + 1)), Line: []Line{{Function: fn, Line: 1}}})
+	}
+	// A profile subtracted from an equal one leaves only zero-valued samples
+	// where nothing changed.
+	p := &Profile{
+		PeriodType: &ValueType{Type: "cpu", Unit: "nanoseconds"},
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*Sample{
+			{Location: []*Location{locs[0]}, Value: []int64{3, 300}},
+			{Location: []*Location{locs[1], locs[0]}, Value: []int64{0, 0}},
+			{Location: []*Location{locs[2], locs[0]}, Value: []int64{0, -100}},
+		},
+		Location: locs,
+		Function: fns,
+	}
+	p.RemoveZeroSamples()
+
+	var got [][]int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value)
+	}
+	if want := [][]int64{{3, 300}, {0, -100}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sample values %v, want %v", got, want)
+	}
+	var gotFns []string
+	for _, fn := range p.Function {
+		gotFns = append(gotFns, fn.Name)
+	}
+	if want := []string{"f", "h"}; !reflect.DeepEqual(gotFns, want) {
+		t.Errorf("got functions %v, want %v", gotFns, want)
+	}
+	if len(p.Location) != 2 {
+		t.Errorf("got %d locations, want 2", len(p.Location))
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Errorf("CheckValid: %v", err)
+	}
+}
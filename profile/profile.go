@@ -19,11 +19,14 @@ package profile
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -348,6 +351,22 @@ func (p *Profile) Write(w io.Writer) error {
 	return err
 }
 
+// WriteLevel writes the profile as a gzip-compressed marshaled protobuf,
+// using the given gzip compression level: gzip.HuffmanOnly,
+// gzip.DefaultCompression, or from gzip.NoCompression to
+// gzip.BestCompression.
+func (p *Profile) WriteLevel(w io.Writer, level int) error {
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return fmt.Errorf("invalid compression level: %d", level)
+	}
+	if _, err := zw.Write(serialize(p)); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
 // WriteUncompressed writes the profile as a marshaled protobuf.
 func (p *Profile) WriteUncompressed(w io.Writer) error {
 	_, err := w.Write(serialize(p))
@@ -486,6 +505,118 @@ func (p *Profile) Aggregate(inlineFrame, function, filename, linenumber, columnn
 	return p.CheckValid()
 }
 
+// NameInlinesByLeaf collapses the inlined frames of every location into
+// a single frame attributed to the outermost (out-of-line) caller, like
+// Aggregate does when inline frames are dropped, but names the frame
+// after the innermost inlined function so the inlining stays visible.
+// The collapsed frame is named "leaf (inlined into caller)" and keeps
+// the caller's file and line. Locations without inlined frames are left
+// untouched, so a function that is inlined only at some of its call
+// sites (a partial inline) keeps its own name at the remaining ones.
+func (p *Profile) NameInlinesByLeaf() error {
+	var maxID uint64
+	for _, f := range p.Function {
+		if f.ID > maxID {
+			maxID = f.ID
+		}
+	}
+	type funcKey struct {
+		leaf, caller *Function
+	}
+	collapsed := make(map[funcKey]*Function)
+	for _, l := range p.Location {
+		if len(l.Line) < 2 {
+			continue
+		}
+		leaf, caller := l.Line[0], l.Line[len(l.Line)-1]
+		k := funcKey{leaf.Function, caller.Function}
+		f := collapsed[k]
+		if f == nil {
+			maxID++
+			f = &Function{
+				ID:         maxID,
+				Name:       leaf.Function.Name + " (inlined into " + caller.Function.Name + ")",
+				SystemName: leaf.Function.SystemName + " (inlined into " + caller.Function.SystemName + ")",
+				Filename:   caller.Function.Filename,
+				StartLine:  caller.Function.StartLine,
+			}
+			collapsed[k] = f
+			p.Function = append(p.Function, f)
+		}
+		caller.Function = f
+		l.Line = []Line{caller}
+	}
+	for _, m := range p.Mapping {
+		m.HasInlineFrames = false
+	}
+	return p.CheckValid()
+}
+
+var (
+	// Go function literals are named after their enclosing function with
+	// a funcN suffix per level of nesting, followed by the number of the
+	// copy for inlined ones, as in "pkg.Outer.func1.2", and the wrappers
+	// of go and defer statements with gowrapN and deferwrapN suffixes.
+	// Method values are wrapped in functions with a -fm suffix.
+	goAnonymousRegExp = regexp.MustCompile(`((\.(func|gowrap|deferwrap)\d+(\.\d+)*)+|-fm)$`)
+	// Java lambdas are synthetic methods of the enclosing class, named
+	// after the enclosing method, as in "pkg.Class.lambda$method$0".
+	javaLambdaRegExp = regexp.MustCompile(`\blambda\$([^$]+)\$\d+`)
+	// Rust closures are {{closure}} members of their enclosing function,
+	// as in "crate::outer::{{closure}}".
+	rustClosureRegExp = regexp.MustCompile(`(::\{\{closure\}\})+`)
+	// C++ lambdas are members of their enclosing function, named like
+	// "{lambda(int)#1}" by GCC, "$_0" or "'lambda'(int)" by Clang, as in
+	// "ns::Outer(int)::{lambda(int)#1}::operator()(int) const".
+	cppLambdaPrefixes = []string{"::{lambda(", "::$_", "::'lambda"}
+)
+
+// CollapseAnonymousFunctions renames the anonymous functions of the
+// profile, such as Go function literals and C++ lambdas, after their
+// enclosing named function, so that their samples are attributed to it
+// once the functions are aggregated by name. The system names are kept.
+func (p *Profile) CollapseAnonymousFunctions() {
+	for _, f := range p.Function {
+		f.Name = enclosingFunctionName(f.Name)
+	}
+}
+
+// enclosingFunctionName returns the name of the named function enclosing
+// the anonymous function with the given name, or the name unchanged if it
+// is not recognized as anonymous. The naming schemes of Go, C++, Java and
+// Rust are recognized.
+func enclosingFunctionName(name string) string {
+	name = javaLambdaRegExp.ReplaceAllString(name, "$1")
+	name = rustClosureRegExp.ReplaceAllString(name, "")
+	name = cppEnclosingFunctionName(name)
+	return goAnonymousRegExp.ReplaceAllString(name, "")
+}
+
+// cppEnclosingFunctionName returns the name of the C++ function enclosing
+// the lambda named name, by cutting the name at its first lambda outside
+// of template arguments and parameter lists.
+func cppEnclosingFunctionName(name string) string {
+	depth := 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '<', '(':
+			depth++
+		case '>', ')':
+			depth--
+		case ':':
+			if depth != 0 {
+				continue
+			}
+			for _, prefix := range cppLambdaPrefixes {
+				if strings.HasPrefix(name[i:], prefix) {
+					return name[:i]
+				}
+			}
+		}
+	}
+	return name
+}
+
 // NumLabelUnits returns a map of numeric label keys to the units
 // associated with those keys and a map of those keys to any units
 // that were encountered but not used.
@@ -771,6 +902,55 @@ func (p *Profile) RemoveNumLabel(key string) {
 	}
 }
 
+// BucketNumLabel replaces the numeric label key of all samples in the
+// profile with a string label of the same key holding the range of each
+// value, so that samples can be grouped by range instead of by value.
+// The buckets are the boundaries of the ranges, in any order. Ranges are
+// half-open: a value v with b[i] <= v < b[i+1], b being the sorted
+// boundaries, is labeled "[b[i], b[i+1])", while values below the first
+// boundary are labeled "<b[0]" and values at or above the last one
+// ">=b[n-1]". Values in the same range are labeled once, and the labels
+// are added to any string label values the sample already has for key.
+// The profile is not modified if buckets is empty.
+func (p *Profile) BucketNumLabel(key string, buckets []int64) {
+	if len(buckets) == 0 {
+		return
+	}
+	bounds := append([]int64(nil), buckets...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	bounds = slices.Compact(bounds)
+
+	bucket := func(v int64) string {
+		// The index of the first boundary above v.
+		i := sort.Search(len(bounds), func(i int) bool { return bounds[i] > v })
+		switch i {
+		case 0:
+			return fmt.Sprintf("<%d", bounds[0])
+		case len(bounds):
+			return fmt.Sprintf(">=%d", bounds[i-1])
+		}
+		return fmt.Sprintf("[%d, %d)", bounds[i-1], bounds[i])
+	}
+	for _, sample := range p.Sample {
+		values, ok := sample.NumLabel[key]
+		if !ok {
+			continue
+		}
+		delete(sample.NumLabel, key)
+		delete(sample.NumUnit, key)
+		if sample.Label == nil {
+			sample.Label = make(map[string][]string)
+		}
+		labels := sample.Label[key]
+		for _, v := range values {
+			if b := bucket(v); !slices.Contains(labels, b) {
+				labels = append(labels, b)
+			}
+		}
+		sample.Label[key] = labels
+	}
+}
+
 // DiffBaseSample returns true if a sample belongs to the diff base and false
 // otherwise.
 func (s *Sample) DiffBaseSample() bool {
@@ -790,6 +970,27 @@ func (p *Profile) Scale(ratio float64) {
 	p.ScaleN(ratios)
 }
 
+// ClampNonNegative sets all negative sample values in a profile to zero,
+// keeping for instance only the growth of a comparison of profiles, and
+// keeps only samples that have at least one non-zero value.
+func (p *Profile) ClampNonNegative() {
+	fillIdx := 0
+	for _, s := range p.Sample {
+		keepSample := false
+		for i, v := range s.Value {
+			if v < 0 {
+				s.Value[i] = 0
+			}
+			keepSample = keepSample || s.Value[i] != 0
+		}
+		if keepSample {
+			p.Sample[fillIdx] = s
+			fillIdx++
+		}
+	}
+	p.Sample = p.Sample[:fillIdx]
+}
+
 // ScaleN multiplies each sample values in a sample by a different amount
 // and keeps only samples that have at least one non-zero value.
 func (p *Profile) ScaleN(ratios []float64) error {
@@ -847,6 +1048,118 @@ func (p *Profile) HasFileLines() bool {
 	return true
 }
 
+// SourceFiles returns the sorted set of distinct, non-empty source file
+// names referenced by the functions in this profile.
+func (p *Profile) SourceFiles() []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, f := range p.Function {
+		if f.Filename == "" || seen[f.Filename] {
+			continue
+		}
+		seen[f.Filename] = true
+		files = append(files, f.Filename)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Frame is a resolved stack frame of a sample, as passed to ForEachSample.
+type Frame struct {
+	Func    string // Function name, empty if unknown.
+	File    string // Source file name, empty if unknown.
+	Line    int64  // Line number in File, zero if unknown.
+	Address uint64 // Address of the location the frame belongs to.
+}
+
+// ForEachSample calls fn for each sample of the profile with its values,
+// its stack resolved into frames and its string labels. The frames are
+// ordered from the leaf to the root; a location with inlined functions
+// yields one frame per function, and a location with only an address
+// yields a frame with only the address set. Iteration stops when fn
+// returns false. fn must not modify values or labels.
+func (p *Profile) ForEachSample(fn func(values []int64, frames []Frame, labels map[string][]string) bool) {
+	for _, s := range p.Sample {
+		var frames []Frame
+		for _, loc := range s.Location {
+			if len(loc.Line) == 0 {
+				frames = append(frames, Frame{Address: loc.Address})
+				continue
+			}
+			for _, ln := range loc.Line {
+				f := Frame{Line: ln.Line, Address: loc.Address}
+				if ln.Function != nil {
+					f.Func, f.File = ln.Function.Name, ln.Function.Filename
+				}
+				frames = append(frames, f)
+			}
+		}
+		if !fn(s.Value, frames, s.Label) {
+			return
+		}
+	}
+}
+
+// FillBuildIDsFrom sets the build ID of mappings of p that have none to the
+// build ID of the mapping of o with the same file path. Mappings with an
+// empty file path are not matched, and existing build IDs are never
+// overwritten. If the mappings of o for a given path have different build
+// IDs, the match is ambiguous and mappings of p for that path are left
+// unchanged.
+func (p *Profile) FillBuildIDsFrom(o *Profile) {
+	buildIDs := make(map[string]string)
+	for _, m := range o.Mapping {
+		if m.File == "" || m.BuildID == "" {
+			continue
+		}
+		if id, ok := buildIDs[m.File]; ok && id != m.BuildID {
+			// Mark the path as ambiguous.
+			buildIDs[m.File] = ""
+			continue
+		}
+		buildIDs[m.File] = m.BuildID
+	}
+	for _, m := range p.Mapping {
+		if m.BuildID == "" && m.File != "" {
+			m.BuildID = buildIDs[m.File]
+		}
+	}
+}
+
+// Anonymize replaces the names of functions, their source files and the
+// files of mappings with hashes of those names, so that a profile can be
+// shared without revealing them. Equal names are replaced by equal
+// hashes, so the structure of the profile and its values are preserved.
+// File name extensions and the names of unsymbolizable mappings such as
+// "[vdso]" are kept.
+func (p *Profile) Anonymize() {
+	for _, f := range p.Function {
+		f.Name = anonymizedName("func_", f.Name)
+		f.SystemName = anonymizedName("func_", f.SystemName)
+		f.Filename = anonymizedFile(f.Filename)
+	}
+	for _, m := range p.Mapping {
+		if !m.Unsymbolizable() {
+			m.File = anonymizedFile(m.File)
+		}
+	}
+}
+
+// anonymizedName returns prefix followed by a hash of name, or the empty
+// string for an empty name.
+func anonymizedName(prefix, name string) string {
+	if name == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(name))
+	return prefix + hex.EncodeToString(h[:8])
+}
+
+// anonymizedFile returns a hash of the file name that keeps its extension.
+func anonymizedFile(name string) string {
+	return anonymizedName("file_", name) + filepath.Ext(name)
+}
+
 // Unsymbolizable returns true if a mapping points to a binary for which
 // locations can't be symbolized in principle, at least now. Examples are
 // "[vdso]", "[vsyscall]" and some others, see the code.
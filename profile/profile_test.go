@@ -16,6 +16,7 @@ package profile
 
 import (
 	"bytes"
+	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
@@ -668,6 +669,102 @@ func TestAggregation(t *testing.T) {
 	}
 }
 
+func TestCollapseAnonymousFunctions(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		// Go.
+		{"main.main.func1", "main.main"},
+		{"net/http.(*Server).Serve.func3.2", "net/http.(*Server).Serve"},
+		{"pkg.Outer[...].func1.func2", "pkg.Outer[...]"},
+		{"pkg.worker.gowrap1", "pkg.worker"},
+		{"pkg.(*T).Close.deferwrap2", "pkg.(*T).Close"},
+		{"pkg.(*T).Handle-fm", "pkg.(*T).Handle"},
+		{"pkg.function1", "pkg.function1"},
+		// C++.
+		{"ns::Outer(int)::{lambda(int)#1}::operator()(int) const", "ns::Outer(int)"},
+		{"ns::Outer(int)::$_0::operator()() const", "ns::Outer(int)"},
+		{"Outer()::'lambda'(int)::operator()(int) const", "Outer()"},
+		{"std::_Function_handler<void (), Outer()::{lambda()#1}>::_M_invoke(std::_Any_data const&)", "std::_Function_handler<void (), Outer()::{lambda()#1}>::_M_invoke(std::_Any_data const&)"},
+		{"ns::Named::run()", "ns::Named::run()"},
+		// Java.
+		{"com.example.Service.lambda$handle$0", "com.example.Service.handle"},
+		{"com.example.Service.handle", "com.example.Service.handle"},
+		// Rust.
+		{"app::server::run::{{closure}}::{{closure}}", "app::server::run"},
+	} {
+		p := &Profile{Function: []*Function{{ID: 1, Name: tc.name, SystemName: tc.name}}}
+		p.CollapseAnonymousFunctions()
+		if got := p.Function[0].Name; got != tc.want {
+			t.Errorf("CollapseAnonymousFunctions(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+		if got := p.Function[0].SystemName; got != tc.name {
+			t.Errorf("CollapseAnonymousFunctions(%q) changed the system name to %q", tc.name, got)
+		}
+	}
+}
+
+func TestNameInlinesByLeaf(t *testing.T) {
+	// partialInlines adds an out-of-line call to fun0, which is otherwise
+	// only seen inlined into fun1.
+	partialInlines := inlinesProfile.Copy()
+	loc := &Location{ID: 4, Mapping: partialInlines.Mapping[0], Address: 0x4000, Line: []Line{{Function: partialInlines.Function[0], Line: 2}}}
+	partialInlines.Location = append(partialInlines.Location, loc)
+	partialInlines.Sample = append(partialInlines.Sample, &Sample{Value: []int64{3}, Location: []*Location{loc, partialInlines.Location[1]}})
+
+	for _, tc := range []struct {
+		desc            string
+		profile         *Profile
+		wantSampleFuncs []string
+		wantFirstFile   string
+	}{
+		{
+			desc:    "inlined frames are named after the leaf",
+			profile: inlinesProfile.Copy(),
+			wantSampleFuncs: []string{
+				"fun0 (inlined into fun1) fun2 (inlined into fun3): 1",
+				"fun4 (inlined into fun6): 2",
+			},
+			wantFirstFile: "file1",
+		},
+		{
+			desc:    "out-of-line calls keep their name",
+			profile: partialInlines,
+			wantSampleFuncs: []string{
+				"fun0 (inlined into fun1) fun2 (inlined into fun3): 1",
+				"fun4 (inlined into fun6): 2",
+				"fun0 fun2 (inlined into fun3): 3",
+			},
+			wantFirstFile: "file1",
+		},
+		{
+			desc:            "profiles without inlines are unchanged",
+			profile:         noInlinesProfile.Copy(),
+			wantSampleFuncs: allNoInlinesSampleFuncs,
+			wantFirstFile:   "file0",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := tc.profile
+			if err := p.NameInlinesByLeaf(); err != nil {
+				t.Fatalf("NameInlinesByLeaf: %v", err)
+			}
+			if got := sampleFuncs(p); !reflect.DeepEqual(got, tc.wantSampleFuncs) {
+				t.Errorf("got %v, want %v", got, tc.wantSampleFuncs)
+			}
+			for _, l := range p.Location {
+				if len(l.Line) > 1 {
+					t.Errorf("location %d has %d lines, want 1", l.ID, len(l.Line))
+				}
+			}
+			// Collapsed frames keep the caller's file.
+			if got := p.Location[0].Line[0].Function.Filename; got != tc.wantFirstFile {
+				t.Errorf("got file %s for first location, want %s", got, tc.wantFirstFile)
+			}
+		})
+	}
+}
+
 // checkAggregation verifies that the profile remained consistent
 // with its aggregation.
 func checkAggregation(prof *Profile, a *aggTest) error {
@@ -994,6 +1091,50 @@ func TestEmptyMappingMerge(t *testing.T) {
 	}
 }
 
+func TestClampNonNegative(t *testing.T) {
+	p := testProfile1.Copy()
+	for i, v := range [][]int64{{-1000, 1000}, {100, -100}, {-10, -10}, {0, -5}, {1, 1}} {
+		p.Sample[i].Value = v
+	}
+	p.ClampNonNegative()
+
+	var got [][]int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value)
+	}
+	want := [][]int64{{0, 1000}, {100, 0}, {1, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got sample values %v, want %v", got, want)
+	}
+}
+
+func TestWriteLevel(t *testing.T) {
+	var sizes []int
+	for _, level := range []int{gzip.NoCompression, gzip.BestCompression} {
+		var buf bytes.Buffer
+		if err := testProfile1.Copy().WriteLevel(&buf, level); err != nil {
+			t.Fatalf("WriteLevel(%d): %v", level, err)
+		}
+		sizes = append(sizes, buf.Len())
+		p, err := Parse(&buf)
+		if err != nil {
+			t.Fatalf("Parse of profile written at level %d: %v", level, err)
+		}
+		if got, want := p.String(), testProfile1.String(); got != want {
+			t.Errorf("profile written at level %d differs: got\n%s\nwant\n%s", level, got, want)
+		}
+	}
+	if sizes[0] <= sizes[1] {
+		t.Errorf("uncompressed profile has %d bytes, want more than the %d of the compressed one", sizes[0], sizes[1])
+	}
+
+	for _, level := range []int{gzip.HuffmanOnly - 1, gzip.BestCompression + 1} {
+		if err := testProfile1.Copy().WriteLevel(io.Discard, level); err == nil {
+			t.Errorf("WriteLevel(%d) got nil error", level)
+		}
+	}
+}
+
 func TestNormalizeBySameProfile(t *testing.T) {
 	pb := testProfile1.Copy()
 	p := testProfile1.Copy()
@@ -1940,3 +2081,285 @@ func BenchmarkWrite(b *testing.B) {
 		}
 	}
 }
+
+func TestSourceFiles(t *testing.T) {
+	withEmpty := testProfile1.Copy()
+	withEmpty.Function = append(withEmpty.Function,
+		&Function{ID: 4, Name: "unknown"},
+		&Function{ID: 5, Name: "bar", Filename: "bar.c"},
+	)
+	for _, tc := range []struct {
+		desc string
+		prof *Profile
+		want []string
+	}{
+		{
+			desc: "test profile",
+			prof: testProfile1,
+			want: []string{"foo.c", "main.c"},
+		},
+		{
+			desc: "empty file names are skipped",
+			prof: withEmpty,
+			want: []string{"bar.c", "foo.c", "main.c"},
+		},
+		{
+			desc: "no functions",
+			prof: &Profile{},
+			want: nil,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := tc.prof.SourceFiles(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("SourceFiles() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestForEachSample(t *testing.T) {
+	m := &Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "/bin/main"}
+	fMain := &Function{ID: 1, Name: "main", Filename: "main.c"}
+	fFoo := &Function{ID: 2, Name: "foo", Filename: "foo.c"}
+	fBar := &Function{ID: 3, Name: "bar", Filename: "foo.c"}
+	locMain := &Location{ID: 1, Mapping: m, Address: 0x1010, Line: []Line{{Function: fMain, Line: 10}}}
+	// bar is inlined into foo.
+	locInlined := &Location{ID: 2, Mapping: m, Address: 0x1020, Line: []Line{{Function: fBar, Line: 5}, {Function: fFoo, Line: 20}}}
+	locAddr := &Location{ID: 3, Mapping: m, Address: 0x1030}
+	p := &Profile{
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*Sample{
+			{Location: []*Location{locInlined, locMain}, Value: []int64{1}, Label: map[string][]string{"key": {"a"}}},
+			{Location: []*Location{locAddr, locMain}, Value: []int64{2}},
+			{Location: []*Location{locMain}, Value: []int64{3}},
+		},
+		Location: []*Location{locMain, locInlined, locAddr},
+		Function: []*Function{fMain, fFoo, fBar},
+		Mapping:  []*Mapping{m},
+	}
+
+	type sample struct {
+		values []int64
+		frames []Frame
+		labels map[string][]string
+	}
+	var got []sample
+	p.ForEachSample(func(values []int64, frames []Frame, labels map[string][]string) bool {
+		got = append(got, sample{values, frames, labels})
+		return true
+	})
+	want := []sample{
+		{
+			values: []int64{1},
+			frames: []Frame{
+				{Func: "bar", File: "foo.c", Line: 5, Address: 0x1020},
+				{Func: "foo", File: "foo.c", Line: 20, Address: 0x1020},
+				{Func: "main", File: "main.c", Line: 10, Address: 0x1010},
+			},
+			labels: map[string][]string{"key": {"a"}},
+		},
+		{
+			values: []int64{2},
+			frames: []Frame{
+				{Address: 0x1030},
+				{Func: "main", File: "main.c", Line: 10, Address: 0x1010},
+			},
+		},
+		{
+			values: []int64{3},
+			frames: []Frame{{Func: "main", File: "main.c", Line: 10, Address: 0x1010}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachSample got %+v, want %+v", got, want)
+	}
+
+	// Returning false stops the iteration.
+	n := 0
+	p.ForEachSample(func([]int64, []Frame, map[string][]string) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("ForEachSample called fn %d times after it returned false on call 2", n)
+	}
+}
+
+func TestFillBuildIDsFrom(t *testing.T) {
+	p := &Profile{Mapping: []*Mapping{
+		{ID: 1, File: "/bin/main"},
+		{ID: 2, File: "/lib/libc.so", BuildID: "keep"},
+		{ID: 3, File: "/lib/libm.so"},
+		{ID: 4, File: "/lib/libz.so"},
+		{ID: 5, File: ""},
+		{ID: 6, File: "/lib/libm.so"},
+	}}
+	o := &Profile{Mapping: []*Mapping{
+		{ID: 1, File: "/bin/main", BuildID: "main-id"},
+		{ID: 2, File: "/lib/libc.so", BuildID: "other"},
+		{ID: 3, File: "/lib/libm.so", BuildID: "m1"},
+		{ID: 4, File: "/lib/libm.so", BuildID: "m1"},
+		{ID: 5, File: "/lib/libz.so", BuildID: "z1"},
+		{ID: 6, File: "/lib/libz.so", BuildID: "z2"},
+		{ID: 7, File: "", BuildID: "anon"},
+	}}
+	p.FillBuildIDsFrom(o)
+	want := []string{
+		"main-id", // Filled in.
+		"keep",    // Existing build IDs are not overwritten.
+		"m1",      // Duplicate mappings with the same build ID match.
+		"",        // Conflicting build IDs are ambiguous.
+		"",        // Empty paths are never matched.
+		"m1",
+	}
+	for i, m := range p.Mapping {
+		if m.BuildID != want[i] {
+			t.Errorf("mapping %d (%q): got build ID %q, want %q", m.ID, m.File, m.BuildID, want[i])
+		}
+	}
+	if o.Mapping[0].BuildID != "main-id" || len(o.Mapping) != 7 {
+		t.Errorf("FillBuildIDsFrom modified its argument")
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	orig := testProfile1.Copy()
+	orig.Function = append(orig.Function, &Function{ID: 100, Name: orig.Function[0].Name, SystemName: "_Z3foov", Filename: "src/other.cc"})
+	orig.Mapping = append(orig.Mapping, &Mapping{ID: 100, File: "[vdso]"})
+
+	p := orig.Copy()
+	p.Anonymize()
+
+	// Names are replaced, consistently for equal names.
+	hashes := make(map[string]string)
+	checkName := func(kind, from, to string) {
+		t.Helper()
+		if from == "" {
+			if to != "" {
+				t.Errorf("empty %s name replaced by %q", kind, to)
+			}
+			return
+		}
+		if to == from || strings.Contains(to, strings.TrimSuffix(filepath.Base(from), filepath.Ext(from))) {
+			t.Errorf("%s name %q not anonymized: %q", kind, from, to)
+		}
+		if prev, ok := hashes[from]; ok && prev != to {
+			t.Errorf("%s name %q replaced by both %q and %q", kind, from, prev, to)
+		}
+		hashes[from] = to
+	}
+	for i, f := range p.Function {
+		o := orig.Function[i]
+		checkName("function", o.Name, f.Name)
+		checkName("function", o.SystemName, f.SystemName)
+		checkName("file", o.Filename, f.Filename)
+		if got, want := filepath.Ext(f.Filename), filepath.Ext(o.Filename); got != want {
+			t.Errorf("file %q has extension %q, want %q", f.Filename, got, want)
+		}
+	}
+	for i, m := range p.Mapping {
+		if o := orig.Mapping[i]; o.Unsymbolizable() {
+			if m.File != o.File {
+				t.Errorf("unsymbolizable mapping %q renamed to %q", o.File, m.File)
+			}
+		} else {
+			checkName("mapping", o.File, m.File)
+		}
+	}
+
+	// Anonymization is deterministic.
+	p2 := orig.Copy()
+	p2.Anonymize()
+	if got, want := p2.String(), p.String(); got != want {
+		t.Errorf("anonymizing twice gives different results:\n%s\nvs\n%s", got, want)
+	}
+
+	// Structure and values are preserved.
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("CheckValid: %v", err)
+	}
+	if len(p.Sample) != len(orig.Sample) || len(p.Location) != len(orig.Location) {
+		t.Fatalf("got %d samples and %d locations, want %d and %d", len(p.Sample), len(p.Location), len(orig.Sample), len(orig.Location))
+	}
+	for i, s := range p.Sample {
+		o := orig.Sample[i]
+		if !reflect.DeepEqual(s.Value, o.Value) {
+			t.Errorf("sample %d has values %v, want %v", i, s.Value, o.Value)
+		}
+		for j, l := range s.Location {
+			if l.ID != o.Location[j].ID || l.Address != o.Location[j].Address {
+				t.Errorf("sample %d location %d is %d@%#x, want %d@%#x", i, j, l.ID, l.Address, o.Location[j].ID, o.Location[j].Address)
+			}
+		}
+	}
+}
+
+func TestBucketNumLabel(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		buckets []int64
+		// The bytes label values of the samples, and the string label
+		// values they are replaced with.
+		values []int64
+		want   []string
+	}{
+		{
+			desc:    "half-open ranges",
+			buckets: []int64{1024, 4096},
+			values:  []int64{1023, 1024, 4095},
+			want:    []string{"<1024", "[1024, 4096)"},
+		},
+		{
+			desc:    "above the last boundary",
+			buckets: []int64{1024, 4096},
+			values:  []int64{4096, 1 << 20},
+			want:    []string{">=4096"},
+		},
+		{
+			desc:    "unsorted and repeated boundaries",
+			buckets: []int64{4096, 0, 1024, 1024},
+			values:  []int64{-1, 0, 2048},
+			want:    []string{"<0", "[0, 1024)", "[1024, 4096)"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := testProfile1.Copy()
+			p.Sample = []*Sample{
+				{
+					Location: []*Location{cpuL[0]},
+					Value:    []int64{1000},
+					NumLabel: map[string][]int64{"bytes": tc.values, "count": {2}},
+					NumUnit:  map[string][]string{"bytes": make([]string, len(tc.values)), "count": {""}},
+				},
+				{
+					Location: []*Location{cpuL[0]},
+					Value:    []int64{1000},
+				},
+			}
+			p.BucketNumLabel("bytes", tc.buckets)
+			s := p.Sample[0]
+			if got := s.Label["bytes"]; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got bytes labels %q, want %q", got, tc.want)
+			}
+			if _, ok := s.NumLabel["bytes"]; ok {
+				t.Errorf("got bytes numeric label %v, want none", s.NumLabel["bytes"])
+			}
+			if _, ok := s.NumUnit["bytes"]; ok {
+				t.Errorf("got bytes numeric label units %v, want none", s.NumUnit["bytes"])
+			}
+			if got, want := s.NumLabel["count"], []int64{2}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got count numeric label %v, want %v", got, want)
+			}
+			if s := p.Sample[1]; s.Label != nil || s.NumLabel != nil {
+				t.Errorf("sample without the label got labels %v and numeric labels %v", s.Label, s.NumLabel)
+			}
+		})
+	}
+
+	p := testProfile1.Copy()
+	p.Sample = []*Sample{{Location: []*Location{cpuL[0]}, Value: []int64{1000}, NumLabel: map[string][]int64{"bytes": {1}}}}
+	p.BucketNumLabel("bytes", nil)
+	if got, want := p.Sample[0].NumLabel["bytes"], []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without buckets: got bytes numeric label %v, want %v", got, want)
+	}
+}
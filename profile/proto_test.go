@@ -179,3 +179,46 @@ func TestMarshalUnmarshal(t *testing.T) {
 		t.Error("\n" + string(d))
 	}
 }
+
+func TestEncodedSizes(t *testing.T) {
+	m := &Mapping{ID: 1, Start: 0x1000, Limit: 0x2000}
+	fn := &Function{ID: 1, Name: "main"}
+	loc := &Location{ID: 1, Mapping: m, Address: 0x1010, Line: []Line{{Function: fn, Line: 3}}}
+	p := &Profile{
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*Sample{{Location: []*Location{loc}, Value: []int64{1}}},
+		Mapping:    []*Mapping{m},
+		Location:   []*Location{loc},
+		Function:   []*Function{fn},
+	}
+	want := TableSizes{
+		// Tag and length, location ID and value.
+		Samples: 2 + 2 + 2,
+		// Tag and length, ID, mapping ID, 2-byte address and a line
+		// with a function ID and a line number.
+		Locations: 2 + 2 + 2 + 3 + (2 + 2 + 2),
+		// Tag and length, ID and name.
+		Functions: 2 + 2 + 2,
+		// Tag and length, ID, 2-byte start and 2-byte limit.
+		Mappings: 2 + 2 + 3 + 3,
+		// Tag and length of "", "samples", "count" and "main".
+		Strings: 2 + (2 + 7) + (2 + 5) + (2 + 4),
+		// The sample type and the default sample type, which is always
+		// encoded.
+		Other: (2 + 2 + 2) + 2,
+	}
+	if got := p.EncodedSizes(); got != want {
+		t.Errorf("EncodedSizes() = %+v, want %+v", got, want)
+	}
+
+	for _, p := range []*Profile{p, testProfile1, testProfile2, &Profile{}} {
+		var buf bytes.Buffer
+		if err := p.WriteUncompressed(&buf); err != nil {
+			t.Fatalf("WriteUncompressed: %v", err)
+		}
+		s := p.EncodedSizes()
+		if got, want := s.Total(), buf.Len(); got != want {
+			t.Errorf("EncodedSizes() = %+v adds up to %d, want %d", s, got, want)
+		}
+	}
+}